@@ -111,7 +111,17 @@ func runClient(id uint) {
 		_, _ = <-startChan
 	}
 
-	msg := common.Message{Action: common.ActionChat}
+	msg, err := admit(ws)
+	if err != nil {
+		logFunc("error connecting: %v", err)
+		return
+	}
+	if msg.Action != common.ActionConnect {
+		logFunc("error connecting: %v", newUnexpectedMsgErr(common.ActionConnect, msg))
+		return
+	}
+
+	msg = common.Message{Action: common.ActionChat}
 	contentsBuf := &strings.Builder{}
 	for i := uint(0); i < msgsPerConn; i++ {
 		fmt.Fprintf(contentsBuf, "Worker #%d: Message %d", id, i+1)
@@ -153,10 +163,11 @@ func runClientTest(id uint) {
 		_, _ = <-startChan
 	}
 
-  // Get the UUID, this SHOULD be immediate/already here
-  var msg common.Message
+  // Get the UUID, this SHOULD be immediate/already here (unless there's a
+  // challenge to solve first)
 	ws.SetReadDeadline(time.Now().Add(testTimeout))
-	if err := webs.JSON.Receive(ws, &msg); err != nil {
+	msg, err := admit(ws)
+	if err != nil {
     tres.recvErr = fmt.Errorf("error receiving UUID: %v", err)
 		return
 	}
@@ -213,6 +224,28 @@ func runClientTest(id uint) {
 	tres.msgsSent, tres.sendDur, tres.sendErr = msgsSent, sendDur, err
 }
 
+// admit solves the server's challenge, if it sends one, and returns the first
+// message after it (which should be the connect).
+func admit(ws *webs.Conn) (common.Message, error) {
+	var msg common.Message
+	if err := webs.JSON.Receive(ws, &msg); err != nil {
+		return msg, err
+	}
+	if msg.Action != common.ActionChallenge || msg.Challenge == nil {
+		return msg, nil
+	}
+	reply := common.Message{
+		Action:   common.ActionChallenge,
+		Contents: msg.Challenge.Solve(),
+	}
+	if err := webs.JSON.Send(ws, reply); err != nil {
+		return msg, fmt.Errorf("error sending challenge solution: %v", err)
+	}
+	msg = common.Message{}
+	err := webs.JSON.Receive(ws, &msg)
+	return msg, err
+}
+
 func runRecvTest(ws *webs.Conn, tres *TestResults, doneChan chan struct{}) {
 	defer close(doneChan)
 
@@ -5,4 +5,5 @@ go 1.19
 require (
 	github.com/google/uuid v1.3.0
 	golang.org/x/net v0.10.0
+	golang.org/x/text v0.13.0
 )
@@ -0,0 +1,318 @@
+package main
+
+import (
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base32"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// Room access modes.
+const (
+  AccessPublic = "public"
+  AccessPassword = "password"
+  AccessInvite = "invite"
+)
+
+const (
+  defaultInviteTTL = 24 * time.Hour
+  maxInviteTTL = 30 * 24 * time.Hour
+)
+
+// Invite lets whoever has its code into an invite-only room until it expires
+// or is revoked.
+type Invite struct {
+  // The display name of who issued it.
+  By string `json:"by"`
+  Created int64 `json:"created"`
+  Expires int64 `json:"expires"`
+}
+
+var (
+  errPasswordRequired = &common.ErrorInfo{
+    Code: "password_required", Message: "room requires a password",
+  }
+  errWrongPassword = &common.ErrorInfo{
+    Code: "wrong_password", Message: "wrong room password",
+  }
+  errInviteRequired = &common.ErrorInfo{
+    Code: "invite_required", Message: "room is invite-only",
+  }
+  errInvalidInvite = &common.ErrorInfo{
+    Code: "invalid_invite", Message: "invite code is invalid, expired or revoked",
+  }
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "access",
+    Usage: "/access [public|password <password>|invite]",
+    Help: "Show or set who can join the room",
+    Run: cmdAccess,
+  })
+  RegisterCommand(&Command{
+    Name: "invite",
+    Usage: "/invite [duration]",
+    Help: "Issue an invite code for the room, valid for the duration (default 24h)",
+    Run: cmdInvite,
+  })
+  RegisterCommand(&Command{
+    Name: "invites",
+    Usage: "/invites",
+    Help: "List the room's invite codes",
+    Run: cmdInvites,
+  })
+  RegisterCommand(&Command{
+    Name: "revoke",
+    Usage: "/revoke <code>",
+    Help: "Revoke an invite code",
+    Run: cmdRevoke,
+  })
+}
+
+func hashRoomPassword(salt, password string) string {
+  sum := sha256.Sum256([]byte(salt + password))
+  return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) string {
+  b := make([]byte, n)
+  if _, err := rand.Read(b); err != nil {
+    panic(err)
+  }
+  return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+// roomAccess returns the room's access mode.
+func (state RoomState) roomAccess() string {
+  if state.Access == "" {
+    return AccessPublic
+  }
+  return state.Access
+}
+
+// isRoomMember reports whether the client can always access the room:
+// moderators, the creator and signed-in users who've joined it before.
+// roomsMtx must be held.
+func (state *RoomState) isRoomMember(client *Client) bool {
+  if client.role.AtLeast(RoleModerator) {
+    return true
+  }
+  key := userKey(client.id, client.identity)
+  return key == state.CreatorKey || (client.identity != "" && state.Members[key])
+}
+
+// checkRoomAccess returns why the client can't join the room with the
+// password or invite code, if it can't. Signed-in users let in become
+// members, so they don't need them again.
+func checkRoomAccess(client *Client, room, password, invite string) error {
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  state, ok := roomStates[room]
+  if !ok || state.roomAccess() == AccessPublic || state.isRoomMember(client) {
+    return nil
+  }
+  switch state.roomAccess() {
+  case AccessPassword:
+    if password == "" {
+      return errPasswordRequired
+    }
+    hash := hashRoomPassword(state.PasswordSalt, password)
+    if subtle.ConstantTimeCompare([]byte(hash), []byte(state.PasswordHash)) != 1 {
+      return errWrongPassword
+    }
+  case AccessInvite:
+    if invite == "" {
+      return errInviteRequired
+    }
+    inv, ok := state.Invites[invite]
+    if !ok || inv.Expires <= time.Now().UnixNano() {
+      return errInvalidInvite
+    }
+  }
+  if client.identity != "" {
+    if state.Members == nil {
+      state.Members = make(map[string]bool)
+    }
+    state.Members[userKey(client.id, client.identity)] = true
+    if err := saveRooms(); err != nil {
+      log.Printf("error saving rooms: %v", err)
+    }
+  }
+  return nil
+}
+
+// canAccessRoom reports whether the client may see the room's traffic
+// without joining it, i.e., it's public, the client is in it or a member.
+func canAccessRoom(client *Client, room string) bool {
+  if client.InRoom(room) {
+    return true
+  }
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  state, ok := roomStates[room]
+  return !ok || state.roomAccess() == AccessPublic || state.isRoomMember(client)
+}
+
+// httpRoomAccess reports whether the request may read the room's history.
+// Rooms that aren't public need the token (as a Bearer token or token query
+// parameter) of a member, or the room's password or an invite code as query
+// parameters.
+func httpRoomAccess(r *http.Request, room string) bool {
+  if roomState(room).roomAccess() == AccessPublic {
+    return true
+  }
+  client, ok := httpClient(r)
+  if !ok {
+    return false
+  }
+  params := r.URL.Query()
+  return checkRoomAccess(client, room, params.Get("password"), params.Get("invite")) == nil
+}
+
+// httpClient returns a stand-in client for who made the request, signed in
+// if it has a token (as ?token= or a Bearer token). It returns false if the
+// token is invalid.
+func httpClient(r *http.Request) (*Client, bool) {
+  token := r.URL.Query().Get("token")
+  if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+    token = strings.TrimPrefix(auth, "Bearer ")
+  }
+  client := NewClient("", r.RemoteAddr, 0)
+  if token != "" {
+    identity, role, ok := authenticate(token)
+    if !ok {
+      return nil, false
+    }
+    client.identity, client.role = identity, role
+  }
+  return client, true
+}
+
+func cmdAccess(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    ctx.Reply("Access: " + roomState(ctx.Room).roomAccess())
+    return nil
+  }
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  mode, password, _ := strings.Cut(ctx.Args, " ")
+  password = strings.TrimSpace(password)
+  switch mode {
+  case AccessPublic, AccessInvite:
+    if password != "" {
+      return errors.New("usage: /access [public|password <password>|invite]")
+    }
+  case AccessPassword:
+    if password == "" {
+      return errors.New("usage: /access password <password>")
+    }
+  default:
+    return errors.New("usage: /access [public|password <password>|invite]")
+  }
+  state := updateRoom(ctx.Room, func(state *RoomState) {
+    state.Access, state.PasswordHash, state.PasswordSalt = mode, "", ""
+    if mode == AccessPassword {
+      state.PasswordSalt = randomString(16)
+      state.PasswordHash = hashRoomPassword(state.PasswordSalt, password)
+    }
+    // Those let in before have to be again.
+    state.Members = nil
+  })
+  broadcastRoomChange(ctx, state)
+  return nil
+}
+
+func cmdInvite(ctx *CommandContext) error {
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  ttl := defaultInviteTTL
+  if ctx.Args != "" {
+    d, err := time.ParseDuration(ctx.Args)
+    if err != nil || d <= 0 || d > maxInviteTTL {
+      return fmt.Errorf("invalid duration (must be at most %s)", maxInviteTTL)
+    }
+    ttl = d
+  }
+  code := randomString(10)
+  now := time.Now()
+  updateRoom(ctx.Room, func(state *RoomState) {
+    if state.Invites == nil {
+      state.Invites = make(map[string]*Invite)
+    }
+    pruneInvites(state, now)
+    state.Invites[code] = &Invite{
+      By: ctx.Client.DisplayName(),
+      Created: now.UnixNano(),
+      Expires: now.Add(ttl).UnixNano(),
+    }
+  })
+  ctx.Reply(fmt.Sprintf(
+    "Invite code: %s (expires %s)", code, now.Add(ttl).UTC().Format(time.RFC3339),
+  ))
+  return nil
+}
+
+// pruneInvites removes expired invites.
+func pruneInvites(state *RoomState, now time.Time) {
+  for code, inv := range state.Invites {
+    if inv.Expires <= now.UnixNano() {
+      delete(state.Invites, code)
+    }
+  }
+}
+
+func cmdInvites(ctx *CommandContext) error {
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  var lines []string
+  updateRoom(ctx.Room, func(state *RoomState) {
+    pruneInvites(state, time.Now())
+    for code, inv := range state.Invites {
+      lines = append(lines, fmt.Sprintf(
+        "%s by %s, expires %s",
+        code, inv.By, time.Unix(0, inv.Expires).UTC().Format(time.RFC3339),
+      ))
+    }
+  })
+  if len(lines) == 0 {
+    ctx.Reply("No invite codes")
+    return nil
+  }
+  sort.Strings(lines)
+  ctx.Reply(fmt.Sprintf("%d invite code(s):\n%s", len(lines), strings.Join(lines, "\n")))
+  return nil
+}
+
+func cmdRevoke(ctx *CommandContext) error {
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  if ctx.Args == "" {
+    return errors.New("usage: /revoke <code>")
+  }
+  found := false
+  updateRoom(ctx.Room, func(state *RoomState) {
+    if _, found = state.Invites[ctx.Args]; found {
+      delete(state.Invites, ctx.Args)
+    }
+  })
+  if !found {
+    return fmt.Errorf("no such invite code: %s", ctx.Args)
+  }
+  ctx.Reply("Revoked " + ctx.Args)
+  return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+// setTestRoomAccess makes the room's access mode the mode, with the password
+// and a valid "good" and expired "old" invite code.
+func setTestRoomAccess(room, mode, password string) {
+  now := time.Now()
+  updateRoom(room, func(state *RoomState) {
+    state.Access, state.Members = mode, nil
+    state.PasswordSalt = "salt"
+    state.PasswordHash = hashRoomPassword("salt", password)
+    state.Invites = map[string]*Invite{
+      "good": {By: "alice", Created: now.UnixNano(), Expires: now.Add(time.Hour).UnixNano()},
+      "old": {By: "alice", Created: now.Add(-2 * time.Hour).UnixNano(), Expires: now.Add(-time.Hour).UnixNano()},
+    }
+  })
+}
+
+func TestCheckRoomAccess(t *testing.T) {
+  useTestRooms(t)
+  client := func(id, identity string, role Role) *Client {
+    c := NewClient(id, "", 0)
+    c.identity, c.role = identity, role
+    return c
+  }
+  creator := client("conn-1", "alice", RoleUser)
+  ensureRoom("locked", creator)
+  bob := client("conn-2", "bob", RoleUser)
+  anon := client("conn-3", "", RoleUser)
+
+  tests := []struct {
+    name string
+    mode string
+    client *Client
+    password, invite string
+    want error
+  }{
+    {name: "public", mode: AccessPublic, client: anon},
+    {name: "no password", mode: AccessPassword, client: bob, want: errPasswordRequired},
+    {name: "wrong password", mode: AccessPassword, client: bob, password: "guess", want: errWrongPassword},
+    {name: "invite instead of password", mode: AccessPassword, client: bob, invite: "good", want: errPasswordRequired},
+    {name: "password", mode: AccessPassword, client: bob, password: "secret"},
+    // Signed-in users let in don't need the password again.
+    {name: "member", mode: AccessPassword, client: bob},
+    {name: "member on another connection", mode: AccessPassword, client: client("conn-4", "Bob", RoleUser)},
+    {name: "anonymous with password", mode: AccessPassword, client: anon, password: "secret"},
+    {name: "anonymous again", mode: AccessPassword, client: anon, want: errPasswordRequired},
+    {name: "creator", mode: AccessPassword, client: creator},
+    {name: "moderator", mode: AccessPassword, client: client("conn-5", "mod", RoleModerator)},
+    {name: "no invite", mode: AccessInvite, client: bob, want: errInviteRequired},
+    {name: "unknown invite", mode: AccessInvite, client: bob, invite: "nope", want: errInvalidInvite},
+    {name: "expired invite", mode: AccessInvite, client: bob, invite: "old", want: errInvalidInvite},
+    {name: "password instead of invite", mode: AccessInvite, client: bob, password: "secret", want: errInviteRequired},
+    {name: "invite", mode: AccessInvite, client: bob, invite: "good"},
+    {name: "anonymous with invite", mode: AccessInvite, client: anon, invite: "good"},
+  }
+  mode := ""
+  for _, tt := range tests {
+    // Changing the mode forgets the members.
+    if tt.mode != mode {
+      setTestRoomAccess("locked", tt.mode, "secret")
+      mode = tt.mode
+    }
+    if err := checkRoomAccess(tt.client, "locked", tt.password, tt.invite); err != tt.want {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+    }
+  }
+  if err := checkRoomAccess(bob, "never-joined", "", ""); err != nil {
+    t.Errorf("room without state: err = %v", err)
+  }
+  state := roomState("locked")
+  if len(state.Members) != 1 || !state.Members[userKey("", "bob")] {
+    t.Errorf("members = %v, want only bob", state.Members)
+  }
+}
+
+func TestAccessCommands(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "alice": {Token: "a", Role: RoleUser},
+    "bob": {Token: "b", Role: RoleUser},
+  })
+  alice := newTestClient(t, "access-alice", "alice", "club")
+  bob := newTestClient(t, "access-bob", "bob", "club")
+  ensureRoom("club", alice)
+
+  tests := []struct {
+    client *Client
+    command string
+    wantInfo, wantErr string
+    wantAccess string
+  }{
+    {client: bob, command: "/access", wantInfo: "Access: public", wantAccess: AccessPublic},
+    {client: bob, command: "/access invite", wantErr: errNotRoomManager.Error(), wantAccess: AccessPublic},
+    {client: alice, command: "/access password", wantErr: "usage", wantAccess: AccessPublic},
+    {client: alice, command: "/access invite secret", wantErr: "usage", wantAccess: AccessPublic},
+    {client: alice, command: "/access private", wantErr: "usage", wantAccess: AccessPublic},
+    {client: alice, command: "/access password  open sesame ", wantAccess: AccessPassword},
+    {client: bob, command: "/access", wantInfo: "Access: password", wantAccess: AccessPassword},
+    {client: alice, command: "/access invite", wantAccess: AccessInvite},
+    {client: bob, command: "/invite", wantErr: errNotRoomManager.Error(), wantAccess: AccessInvite},
+    {client: alice, command: "/invite forever", wantErr: "invalid duration", wantAccess: AccessInvite},
+    {client: alice, command: "/invite 1000h", wantErr: "invalid duration", wantAccess: AccessInvite},
+    {client: alice, command: "/invite 1h", wantInfo: "Invite code: ", wantAccess: AccessInvite},
+    {client: bob, command: "/invites", wantErr: errNotRoomManager.Error(), wantAccess: AccessInvite},
+    {client: alice, command: "/invites", wantInfo: "1 invite code(s):", wantAccess: AccessInvite},
+    {client: alice, command: "/revoke", wantErr: "usage", wantAccess: AccessInvite},
+    {client: alice, command: "/revoke nope", wantErr: "no such invite code", wantAccess: AccessInvite},
+  }
+  for _, tt := range tests {
+    info, err := runTestCommand(t, tt.client, "club", tt.command)
+    if !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    if !strings.HasPrefix(info, tt.wantInfo) {
+      t.Errorf("%s: info %q, want %q", tt.command, info, tt.wantInfo)
+    }
+    if got := roomState("club").roomAccess(); got != tt.wantAccess {
+      t.Errorf("%s: access = %s, want %s", tt.command, got, tt.wantAccess)
+    }
+  }
+
+  // The password was trimmed, and is only stored hashed.
+  runTestCommand(t, alice, "club", "/access password  open sesame ")
+  state := roomState("club")
+  if strings.Contains(state.PasswordHash, "sesame") || state.PasswordHash != hashRoomPassword(state.PasswordSalt, "open sesame") {
+    t.Errorf("password hash = %q with salt %q", state.PasswordHash, state.PasswordSalt)
+  }
+  outsider := NewClient("access-outsider", "", 0)
+  if err := checkRoomAccess(outsider, "club", "open sesame", ""); err != nil {
+    t.Errorf("joining with the password: %v", err)
+  }
+
+  // Issued codes let users in until they're revoked.
+  runTestCommand(t, alice, "club", "/access invite")
+  info, _ := runTestCommand(t, alice, "club", "/invite")
+  code, _, _ := strings.Cut(strings.TrimPrefix(info, "Invite code: "), " ")
+  if err := checkRoomAccess(outsider, "club", "", code); err != nil {
+    t.Errorf("joining with the issued code %q: %v", code, err)
+  }
+  if info, err := runTestCommand(t, alice, "club", "/revoke "+code); err != "" || info != "Revoked "+code {
+    t.Errorf("revoking: %q, %q", info, err)
+  }
+  if err := checkRoomAccess(outsider, "club", "", code); err != errInvalidInvite {
+    t.Errorf("joining with a revoked code: err = %v, want %v", err, errInvalidInvite)
+  }
+}
+
+func TestHTTPRoomAccess(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "alice": {Token: "atok", Role: RoleUser},
+    "bob": {Token: "btok", Role: RoleUser},
+  })
+  alice := NewClient("http-alice", "", 0)
+  alice.identity = "alice"
+  ensureRoom("locked", alice)
+  setTestRoomAccess("locked", AccessPassword, "secret")
+
+  tests := []struct {
+    room, query, auth string
+    want bool
+  }{
+    {"open", "", "", true},
+    {"locked", "", "", false},
+    {"locked", "password=guess", "", false},
+    {"locked", "password=secret", "", true},
+    {"locked", "invite=good", "", false},
+    {"locked", "token=atok", "", true},
+    {"locked", "", "Bearer atok", true},
+    {"locked", "token=btok", "", false},
+    {"locked", "token=nope&password=secret", "", false},
+    // Bob's now a member.
+    {"locked", "token=btok&password=secret", "", true},
+    {"locked", "", "Bearer btok", true},
+  }
+  for _, tt := range tests {
+    r := httptest.NewRequest("GET", "/history?"+tt.query, nil)
+    if tt.auth != "" {
+      r.Header.Set("Authorization", tt.auth)
+    }
+    if got := httpRoomAccess(r, tt.room); got != tt.want {
+      t.Errorf("%s?%s (%s): httpRoomAccess = %v, want %v", tt.room, tt.query, tt.auth, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "fmt"
+  "os"
+  "strings"
+)
+
+type Role string
+
+const (
+  RoleUser Role = "user"
+  RoleModerator Role = "moderator"
+  RoleAdmin Role = "admin"
+)
+
+func (r Role) rank() int {
+  switch r {
+  case RoleModerator:
+    return 1
+  case RoleAdmin:
+    return 2
+  }
+  return 0
+}
+
+// AtLeast reports whether the role has the permissions of other.
+func (r Role) AtLeast(other Role) bool {
+  return r.rank() >= other.rank()
+}
+
+// Account is an identity users can sign in as by connecting with its token
+// (the "token" query parameter, or PASS over IRC).
+type Account struct {
+  Token string `json:"token"`
+  Role Role `json:"role,omitempty"`
+}
+
+var (
+  // map[identity]*Account, set once on startup
+  accounts map[string]*Account
+)
+
+// loadAccounts reads a JSON file containing an object of identities to
+// accounts.
+func loadAccounts(path string) (map[string]*Account, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var accts map[string]*Account
+  if err := json.NewDecoder(f).Decode(&accts); err != nil {
+    return nil, err
+  }
+  tokens := make(map[string]bool, len(accts))
+  for identity, acct := range accts {
+    if !isValidName(identity) {
+      return nil, fmt.Errorf("invalid identity: %q", identity)
+    }
+    if acct.Token == "" || tokens[acct.Token] {
+      return nil, fmt.Errorf("account %q: token must be non-empty and unique", identity)
+    }
+    tokens[acct.Token] = true
+    switch acct.Role {
+    case "":
+      acct.Role = RoleUser
+    case RoleUser, RoleModerator, RoleAdmin:
+    default:
+      return nil, fmt.Errorf("account %q: invalid role: %q", identity, acct.Role)
+    }
+  }
+  return accts, nil
+}
+
+// authenticate returns the identity and role the token belongs to.
+func authenticate(token string) (string, Role, bool) {
+  for identity, acct := range accounts {
+    if subtle.ConstantTimeCompare([]byte(token), []byte(acct.Token)) == 1 {
+      return identity, acct.Role, true
+    }
+  }
+  return "", RoleUser, false
+}
+
+// isReservedName reports whether the name belongs to an account, so only
+// those signed in as it may use it, or to a webhook's bot, so no one may.
+func isReservedName(name string) bool {
+  for identity := range accounts {
+    if strings.EqualFold(identity, name) {
+      return true
+    }
+  }
+  for _, hook := range incomingWebhooks {
+    if strings.EqualFold(hook.Bot, name) {
+      return true
+    }
+  }
+  return false
+}
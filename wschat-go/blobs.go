@@ -0,0 +1,353 @@
+package main
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/fs"
+  "log"
+  "math"
+  "net"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync/atomic"
+  "unicode/utf8"
+
+  "wschat/wschat-go/common"
+)
+
+const (
+  // The max number of attachments on a chat.
+  maxAttachments = 10
+  maxAttachmentNameLen = 255
+)
+
+var (
+  // Where uploads are stored, by hash. Uploads are disabled if empty.
+  blobDir string
+  // The max size of an upload, in bytes.
+  maxUploadSize int64 = 10 << 20
+  // The MIME types that can be uploaded. A type ending in "/*" allows all of
+  // its subtypes.
+  uploadTypes = []string{"image/*", "text/plain", "application/pdf"}
+  // The max total size of the blob dir, in bytes. 0 means no limit.
+  blobQuota int64 = 1 << 30
+  // The total size of the blobs stored, and of uploads being stored.
+  blobsSize atomic.Int64
+
+  // Uploads per second from each IP, and how many can be made at once.
+  uploadRate = 0.1
+  uploadBurst = 5
+  uploadLimiter *IPRateLimiter
+
+  errAttachmentNotFound = &common.ErrorInfo{
+    Code: "attachment_not_found", Message: "attachment not found (upload it first)",
+  }
+  errTooManyAttachments = &common.ErrorInfo{
+    Code: "too_many_attachments",
+    Message: fmt.Sprintf("chats can have at most %d attachments", maxAttachments),
+  }
+  errBlobQuota = &common.ErrorInfo{
+    Code: "quota_exceeded", Message: "the server is out of space for uploads",
+  }
+)
+
+// loadBlobsSize adds up the size of the blobs already stored.
+func loadBlobsSize() error {
+  var total int64
+  err := filepath.WalkDir(blobDir, func(path string, d fs.DirEntry, err error) error {
+    if err != nil || d.IsDir() || !isValidHash(d.Name()) {
+      return err
+    }
+    info, err := d.Info()
+    if err != nil {
+      return err
+    }
+    total += info.Size()
+    return nil
+  })
+  blobsSize.Store(total)
+  return err
+}
+
+func isValidHash(hash string) bool {
+  if len(hash) != sha256.Size*2 {
+    return false
+  }
+  _, err := hex.DecodeString(hash)
+  return err == nil && strings.ToLower(hash) == hash
+}
+
+func blobPath(hash string) string {
+  return filepath.Join(blobDir, hash[:2], hash)
+}
+
+// detectBlobType returns the MIME type of the blob, sniffed from its contents.
+func detectBlobType(f *os.File) (string, error) {
+  buf := make([]byte, 512)
+  n, err := f.ReadAt(buf, 0)
+  if err != nil && err != io.EOF {
+    return "", err
+  }
+  return http.DetectContentType(buf[:n]), nil
+}
+
+func isUploadTypeAllowed(mimeType string) bool {
+  mimeType, _, _ = strings.Cut(mimeType, ";")
+  for _, allowed := range uploadTypes {
+    if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed {
+      if strings.HasPrefix(mimeType, prefix) {
+        return true
+      }
+    } else if mimeType == allowed {
+      return true
+    }
+  }
+  return false
+}
+
+// storeBlob writes the file to the blob dir, returning its hash, size and
+// type. Nothing is stored if its type isn't allowed, or it would put the blob
+// dir over the quota.
+func storeBlob(r io.Reader) (hash string, size int64, mimeType string, err error) {
+  tmp, err := os.CreateTemp(blobDir, "upload-*")
+  if err != nil {
+    return "", 0, "", err
+  }
+  defer os.Remove(tmp.Name())
+  defer tmp.Close()
+  h := sha256.New()
+  if size, err = io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+    return "", 0, "", err
+  }
+  if mimeType, err = detectBlobType(tmp); err != nil {
+    return "", 0, "", err
+  }
+  if !isUploadTypeAllowed(mimeType) {
+    return "", 0, mimeType, &common.ErrorInfo{
+      Code: "type_not_allowed",
+      Message: fmt.Sprintf("files of type %s can't be uploaded", mimeType),
+    }
+  }
+  hash = hex.EncodeToString(h.Sum(nil))
+  path := blobPath(hash)
+  if _, err := os.Stat(path); err == nil {
+    // Already uploaded.
+    return hash, size, mimeType, nil
+  }
+  // Reserved until it's stored, so concurrent uploads can't overshoot.
+  if blobsSize.Add(size) > blobQuota && blobQuota > 0 {
+    blobsSize.Add(-size)
+    return "", 0, "", errBlobQuota
+  }
+  stored := false
+  defer func() {
+    if !stored {
+      blobsSize.Add(-size)
+    }
+  }()
+  if err := tmp.Sync(); err != nil {
+    return "", 0, "", err
+  }
+  if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+    return "", 0, "", err
+  }
+  if err := os.Rename(tmp.Name(), path); err != nil {
+    return "", 0, "", err
+  }
+  stored = true
+  return hash, size, mimeType, nil
+}
+
+// resolveAttachments fills in the metadata of the attachments sent with a
+// chat from the uploaded blobs. Only their hashes and names are used.
+func resolveAttachments(in []common.Attachment) ([]common.Attachment, error) {
+  if len(in) > maxAttachments {
+    return nil, errTooManyAttachments
+  }
+  if blobDir == "" {
+    return nil, &common.ErrorInfo{
+      Code: "attachments_disabled", Message: "attachments aren't enabled",
+    }
+  }
+  attachments := make([]common.Attachment, len(in))
+  for i, att := range in {
+    if !isValidHash(att.Hash) {
+      return nil, errAttachmentNotFound
+    }
+    f, err := os.Open(blobPath(att.Hash))
+    if err != nil {
+      return nil, errAttachmentNotFound
+    }
+    info, err := f.Stat()
+    var mimeType string
+    if err == nil {
+      mimeType, err = detectBlobType(f)
+    }
+    f.Close()
+    if err != nil {
+      return nil, err
+    }
+    attachments[i] = common.Attachment{
+      Name: cleanAttachmentName(att.Name, att.Hash),
+      Size: info.Size(),
+      Type: mimeType,
+      Hash: att.Hash,
+    }
+  }
+  return attachments, nil
+}
+
+// cleanAttachmentName strips any path from the name, defaulting to the hash.
+func cleanAttachmentName(name, hash string) string {
+  name = strings.ToValidUTF8(name, "\ufffd")
+  if i := strings.LastIndexAny(name, `/\`); i != -1 {
+    name = name[i+1:]
+  }
+  name = strings.Map(func(r rune) rune {
+    if r < ' ' || r == 0x7f {
+      return -1
+    }
+    return r
+  }, strings.TrimSpace(name))
+  if name == "" || name == "." || name == ".." {
+    return hash
+  }
+  for utf8.RuneCountInString(name) > maxAttachmentNameLen {
+    _, size := utf8.DecodeLastRuneInString(name)
+    name = name[:len(name)-size]
+  }
+  return name
+}
+
+// canUpload reports whether the request is from a signed-in user (by token)
+// or a connected one (by ?conn=<connection ID>, from the same IP), who isn't
+// banned.
+func canUpload(r *http.Request) bool {
+  client, ok := httpClient(r)
+  if !ok {
+    return false
+  }
+  if client.identity == "" {
+    id := r.URL.Query().Get("conn")
+    if id == "" {
+      return false
+    }
+    v, ok := clients.Load(id)
+    if !ok || !sameIP(v.(*Client).addr, r.RemoteAddr) {
+      return false
+    }
+    client = v.(*Client)
+  }
+  return findBan(client.identity, r.RemoteAddr) == nil
+}
+
+func sameIP(addr1, addr2 string) bool {
+  ip1, _, err1 := net.SplitHostPort(addr1)
+  ip2, _, err2 := net.SplitHostPort(addr2)
+  return err1 == nil && err2 == nil && ip1 == ip2
+}
+
+// uploadHandler serves POST /uploads: the file in the "file" field of a
+// multipart form is stored, and its common.Attachment returned. It can then
+// be sent with chats.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodPost {
+    w.Header().Set("Allow", http.MethodPost)
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  if !canUpload(r) {
+    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    return
+  }
+  if ok, wait := uploadLimiter.Allow(r.RemoteAddr); !ok {
+    w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+    http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+    return
+  }
+  // Room for the rest of the form.
+  r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+64<<10)
+  file, header, err := r.FormFile("file")
+  if err != nil {
+    maxBytesErr := &http.MaxBytesError{}
+    if errors.As(err, &maxBytesErr) {
+      http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+    } else {
+      http.Error(w, "Must provide a file", http.StatusBadRequest)
+    }
+    return
+  }
+  defer file.Close()
+  if header.Size > maxUploadSize {
+    http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+    return
+  }
+  hash, size, mimeType, err := storeBlob(file)
+  if err != nil {
+    info := &common.ErrorInfo{}
+    if err == errBlobQuota {
+      http.Error(w, errBlobQuota.Message, http.StatusInsufficientStorage)
+    } else if errors.As(err, &info) {
+      http.Error(w, info.Message, http.StatusUnsupportedMediaType)
+    } else {
+      log.Printf("error storing upload: %v", err)
+      http.Error(w, "Internal server error", http.StatusInternalServerError)
+    }
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(common.Attachment{
+    Name: cleanAttachmentName(header.Filename, hash),
+    Size: size,
+    Type: mimeType,
+    Hash: hash,
+  })
+}
+
+// blobHandler serves GET /blobs/<hash>, downloading an uploaded file. Only
+// images are shown inline.
+func blobHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet && r.Method != http.MethodHead {
+    w.Header().Set("Allow", "GET, HEAD")
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  hash := strings.TrimPrefix(r.URL.Path, "/blobs/")
+  if !isValidHash(hash) {
+    http.Error(w, "Blob not found", http.StatusNotFound)
+    return
+  }
+  f, err := os.Open(blobPath(hash))
+  if err != nil {
+    http.Error(w, "Blob not found", http.StatusNotFound)
+    return
+  }
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    return
+  }
+  mimeType, err := detectBlobType(f)
+  if err != nil {
+    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    return
+  }
+  name := cleanAttachmentName(r.URL.Query().Get("name"), hash)
+  disposition := "attachment"
+  if strings.HasPrefix(mimeType, "image/") {
+    disposition = "inline"
+  }
+  w.Header().Set("Content-Type", mimeType)
+  w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, name))
+  w.Header().Set("X-Content-Type-Options", "nosniff")
+  // Blobs never change.
+  w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+  http.ServeContent(w, r, "", info.ModTime(), f)
+}
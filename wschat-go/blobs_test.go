@@ -0,0 +1,269 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "mime/multipart"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+var (
+  testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+  testText = []byte("hello, world\n")
+)
+
+func testHash(data []byte) string {
+  sum := sha256.Sum256(data)
+  return hex.EncodeToString(sum[:])
+}
+
+// useTestBlobs stores uploads in a temp dir with the quota, limited to
+// burst uploads per IP, and restores the upload settings when the test ends.
+func useTestBlobs(t *testing.T, quota int64, burst int) {
+  oldDir, oldQuota, oldSize, oldLimiter := blobDir, blobQuota, blobsSize.Load(), uploadLimiter
+  blobDir, blobQuota = t.TempDir(), quota
+  blobsSize.Store(0)
+  uploadLimiter = NewIPRateLimiter(0.001, burst)
+  t.Cleanup(func() {
+    blobDir, blobQuota, uploadLimiter = oldDir, oldQuota, oldLimiter
+    blobsSize.Store(oldSize)
+  })
+}
+
+func TestIsValidHash(t *testing.T) {
+  tests := []struct {
+    hash string
+    want bool
+  }{
+    {testHash(testText), true},
+    {strings.ToUpper(testHash(testText)), false},
+    {testHash(testText)[1:], false},
+    {"../" + testHash(testText)[3:], false},
+    {strings.Repeat("g", 64), false},
+    {"", false},
+  }
+  for _, tt := range tests {
+    if got := isValidHash(tt.hash); got != tt.want {
+      t.Errorf("isValidHash(%q) = %v, want %v", tt.hash, got, tt.want)
+    }
+  }
+}
+
+func TestIsUploadTypeAllowed(t *testing.T) {
+  tests := []struct {
+    mimeType string
+    want bool
+  }{
+    {"image/png", true},
+    {"image/svg+xml", true},
+    {"text/plain; charset=utf-8", true},
+    {"application/pdf", true},
+    {"text/html; charset=utf-8", false},
+    {"application/pdfx", false},
+    {"imagex/png", false},
+    {"application/octet-stream", false},
+    {"", false},
+  }
+  for _, tt := range tests {
+    if got := isUploadTypeAllowed(tt.mimeType); got != tt.want {
+      t.Errorf("isUploadTypeAllowed(%q) = %v, want %v", tt.mimeType, got, tt.want)
+    }
+  }
+}
+
+func TestCleanAttachmentName(t *testing.T) {
+  long := strings.Repeat("é", maxAttachmentNameLen+1)
+  tests := []struct {
+    name, want string
+  }{
+    {"cat.png", "cat.png"},
+    {"  cat.png ", "cat.png"},
+    {"../../etc/passwd", "passwd"},
+    {`C:\Users\me\cat.png`, "cat.png"},
+    {"a\x00b\nc\x7f.txt", "abc.txt"},
+    {"bad\xffutf8", "bad\ufffdutf8"},
+    {"", "HASH"},
+    {"dir/", "HASH"},
+    {"..", "HASH"},
+    {long, long[:len(long)-len("é")]},
+  }
+  for _, tt := range tests {
+    if got := cleanAttachmentName(tt.name, "HASH"); got != tt.want {
+      t.Errorf("cleanAttachmentName(%q) = %q, want %q", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestStoreBlob(t *testing.T) {
+  useTestBlobs(t, int64(len(testPNG)+len(testText)), 5)
+  tests := []struct {
+    name string
+    data []byte
+    wantType string
+    wantErr string
+    // The total size stored after.
+    wantSize int
+  }{
+    {name: "image", data: testPNG, wantType: "image/png", wantSize: len(testPNG)},
+    {name: "again", data: testPNG, wantType: "image/png", wantSize: len(testPNG)},
+    {name: "not allowed", data: []byte("<html><body>hi"), wantErr: "type_not_allowed", wantSize: len(testPNG)},
+    {name: "text", data: testText, wantType: "text/plain; charset=utf-8", wantSize: len(testPNG) + len(testText)},
+    {name: "over quota", data: []byte("one more"), wantErr: "quota_exceeded", wantSize: len(testPNG) + len(testText)},
+    // Already stored, so it doesn't count against the quota.
+    {name: "again at quota", data: testText, wantType: "text/plain; charset=utf-8", wantSize: len(testPNG) + len(testText)},
+  }
+  for _, tt := range tests {
+    hash, size, mimeType, err := storeBlob(bytes.NewReader(tt.data))
+    if tt.wantErr != "" {
+      if info, ok := err.(*common.ErrorInfo); !ok || info.Code != tt.wantErr {
+        t.Errorf("%s: err = %v, want %s", tt.name, err, tt.wantErr)
+      }
+    } else if err != nil || hash != testHash(tt.data) || size != int64(len(tt.data)) || mimeType != tt.wantType {
+      t.Errorf("%s: got %s, %d, %q, %v, want %s, %d, %q",
+        tt.name, hash, size, mimeType, err, testHash(tt.data), len(tt.data), tt.wantType)
+    }
+    if got := blobsSize.Load(); got != int64(tt.wantSize) {
+      t.Errorf("%s: blobs size = %d, want %d", tt.name, got, tt.wantSize)
+    }
+  }
+  if _, err := os.Stat(blobPath(testHash(testText))); err != nil {
+    t.Errorf("blob not stored: %v", err)
+  }
+  // Only the blobs are left, and they're counted on startup.
+  blobsSize.Store(0)
+  if err := loadBlobsSize(); err != nil {
+    t.Fatal(err)
+  }
+  if got, want := blobsSize.Load(), int64(len(testPNG)+len(testText)); got != want {
+    t.Errorf("loaded blobs size = %d, want %d", got, want)
+  }
+}
+
+func TestResolveAttachments(t *testing.T) {
+  useTestBlobs(t, 0, 5)
+  if _, _, _, err := storeBlob(bytes.NewReader(testPNG)); err != nil {
+    t.Fatal(err)
+  }
+  stored := testHash(testPNG)
+  tests := []struct {
+    name string
+    in []common.Attachment
+    want []common.Attachment
+    wantErr error
+  }{
+    {
+      name: "stored",
+      // Only the hash and name are used.
+      in: []common.Attachment{{Hash: stored, Name: "../cat.png", Size: 1, Type: "text/html"}},
+      want: []common.Attachment{{Hash: stored, Name: "cat.png", Size: int64(len(testPNG)), Type: "image/png"}},
+    },
+    {name: "not uploaded", in: []common.Attachment{{Hash: testHash(testText)}}, wantErr: errAttachmentNotFound},
+    {name: "invalid hash", in: []common.Attachment{{Hash: "../../secret"}}, wantErr: errAttachmentNotFound},
+    {name: "too many", in: make([]common.Attachment, maxAttachments+1), wantErr: errTooManyAttachments},
+  }
+  for _, tt := range tests {
+    got, err := resolveAttachments(tt.in)
+    if err != tt.wantErr {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+      continue
+    }
+    if err == nil && (len(got) != len(tt.want) || got[0] != tt.want[0]) {
+      t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+    }
+  }
+  blobDir = ""
+  if _, err := resolveAttachments([]common.Attachment{{Hash: stored}}); err == nil {
+    t.Error("attachments resolved with uploads disabled")
+  }
+}
+
+func TestUploadHandler(t *testing.T) {
+  useTestBlobs(t, int64(len(testPNG)+len(testText)), 3)
+  resetModeration(t)
+  setTestAccounts(t, map[string]*Account{
+    "alice": {Token: "atok", Role: RoleUser},
+    "banned": {Token: "btok", Role: RoleUser},
+  })
+  addBan(&Ban{Identity: "banned", By: "mod", Created: time.Now().UnixNano()})
+  // Connected from the same IP as the requests.
+  newTestClient(t, "upload-conn", "")
+
+  upload := func(method, query, remoteAddr string, data []byte) *httptest.ResponseRecorder {
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    if data != nil {
+      fw, _ := mw.CreateFormFile("file", "../cat.png")
+      fw.Write(data)
+    }
+    mw.Close()
+    r := httptest.NewRequest(method, "/uploads?"+query, &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    if remoteAddr != "" {
+      r.RemoteAddr = remoteAddr
+    }
+    w := httptest.NewRecorder()
+    uploadHandler(w, r)
+    return w
+  }
+  tests := []struct {
+    name, method, query, remoteAddr string
+    data []byte
+    wantStatus int
+  }{
+    {name: "GET", method: "GET", query: "token=atok", data: testPNG, wantStatus: http.StatusMethodNotAllowed},
+    {name: "anonymous", method: "POST", data: testPNG, wantStatus: http.StatusUnauthorized},
+    {name: "invalid token", method: "POST", query: "token=nope", data: testPNG, wantStatus: http.StatusUnauthorized},
+    {name: "banned", method: "POST", query: "token=btok", data: testPNG, wantStatus: http.StatusUnauthorized},
+    {name: "unknown connection", method: "POST", query: "conn=nope", data: testPNG, wantStatus: http.StatusUnauthorized},
+    {
+      name: "connection from another IP", method: "POST", query: "conn=upload-conn", remoteAddr: "198.51.100.1:1234",
+      data: testPNG, wantStatus: http.StatusUnauthorized,
+    },
+    // Refusals don't use up the rate limit.
+    {name: "signed in", method: "POST", query: "token=atok", data: testPNG, wantStatus: http.StatusOK},
+    {name: "no file", method: "POST", query: "conn=upload-conn", wantStatus: http.StatusBadRequest},
+    {name: "type not allowed", method: "POST", query: "token=atok", data: []byte("\x00\x01\x02"), wantStatus: http.StatusUnsupportedMediaType},
+    {name: "rate limited", method: "POST", query: "token=atok", data: testText, wantStatus: http.StatusTooManyRequests},
+    {name: "from another IP", method: "POST", query: "token=atok", remoteAddr: "198.51.100.1:1234", data: testText, wantStatus: http.StatusOK},
+    {
+      name: "over quota", method: "POST", query: "token=atok", remoteAddr: "198.51.100.1:1234",
+      data: []byte("more text"), wantStatus: http.StatusInsufficientStorage,
+    },
+  }
+  for _, tt := range tests {
+    w := upload(tt.method, tt.query, tt.remoteAddr, tt.data)
+    if w.Code != tt.wantStatus {
+      t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body)
+      continue
+    }
+    switch w.Code {
+    case http.StatusTooManyRequests:
+      if w.Header().Get("Retry-After") == "" {
+        t.Errorf("%s: no Retry-After", tt.name)
+      }
+    case http.StatusOK:
+      var att common.Attachment
+      if err := json.NewDecoder(w.Body).Decode(&att); err != nil || att.Hash != testHash(tt.data) || att.Name != "cat.png" {
+        t.Errorf("%s: got %+v, %v", tt.name, att, err)
+      }
+    }
+  }
+
+  oldMax := maxUploadSize
+  maxUploadSize = 4
+  t.Cleanup(func() {
+    maxUploadSize = oldMax
+  })
+  if w := upload("POST", "token=atok", "198.51.100.2:1234", testText); w.Code != http.StatusRequestEntityTooLarge {
+    t.Errorf("too large: status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+  }
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+  "errors"
+  "math/bits"
+  "net"
+  "sync/atomic"
+  "time"
+
+  webs "golang.org/x/net/websocket"
+  "wschat/wschat-go/common"
+)
+
+// The most leading zero bits a challenge can require, however loaded the
+// server is.
+const maxChallengeDifficulty = 32
+
+var (
+  // The leading zero bits challenges require with no load. 0 disables them.
+  challengeDifficulty int
+  // Each time the load doubles past this many connections, challenges require
+  // another bit.
+  challengeLoadStep = 100
+  // How long clients have to solve challenges.
+  challengeTimeout = 30 * time.Second
+
+  // The number of websocket clients connected and the number still solving
+  // challenges, which together are the load.
+  wsConns, pendingChallenges atomic.Int64
+
+  errChallengeFailed = &common.ErrorInfo{
+    Code: "challenge_failed", Message: "wrong challenge solution",
+  }
+  errChallengeTimeout = &common.ErrorInfo{
+    Code: "challenge_timeout", Message: "challenge wasn't solved in time",
+  }
+)
+
+// currentDifficulty returns the leading zero bits a new challenge requires,
+// scaled up with the load.
+func currentDifficulty() int {
+  load := wsConns.Load() + pendingChallenges.Load()
+  step := int64(challengeLoadStep)
+  if step < 1 {
+    step = 1
+  }
+  difficulty := challengeDifficulty + bits.Len64(uint64(load/step))
+  if difficulty > maxChallengeDifficulty {
+    difficulty = maxChallengeDifficulty
+  }
+  return difficulty
+}
+
+// runChallenge sends the client a challenge and waits for its solution,
+// returning why it's rejected, if it is. It's a no-op if challenges are
+// disabled.
+func runChallenge(ws *webs.Conn) error {
+  if challengeDifficulty <= 0 {
+    return nil
+  }
+  pendingChallenges.Add(1)
+  defer pendingChallenges.Add(-1)
+  challenge := &common.Challenge{Nonce: randomString(16), Difficulty: currentDifficulty()}
+  msg := common.NewSystemMessage(common.ActionChallenge, "")
+  msg.Challenge = challenge
+  if err := webs.JSON.Send(ws, msg); err != nil {
+    return err
+  }
+  ws.SetReadDeadline(time.Now().Add(challengeTimeout))
+  defer ws.SetReadDeadline(time.Time{})
+  var reply common.Message
+  if err := webs.JSON.Receive(ws, &reply); err != nil {
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+      return errChallengeTimeout
+    }
+    return errChallengeFailed
+  }
+  if reply.Action != common.ActionChallenge || !challenge.Verify(reply.Contents) {
+    return errChallengeFailed
+  }
+  return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+
+  webs "golang.org/x/net/websocket"
+  "wschat/wschat-go/common"
+)
+
+// setTestChallenges sets the challenge difficulty and load, restoring them
+// when the test ends.
+func setTestChallenges(t *testing.T, difficulty, loadStep int) {
+  oldDifficulty, oldStep, oldTimeout := challengeDifficulty, challengeLoadStep, challengeTimeout
+  oldConns, oldPending := wsConns.Load(), pendingChallenges.Load()
+  challengeDifficulty, challengeLoadStep = difficulty, loadStep
+  wsConns.Store(0)
+  pendingChallenges.Store(0)
+  t.Cleanup(func() {
+    challengeDifficulty, challengeLoadStep, challengeTimeout = oldDifficulty, oldStep, oldTimeout
+    wsConns.Store(oldConns)
+    pendingChallenges.Store(oldPending)
+  })
+}
+
+func TestCurrentDifficulty(t *testing.T) {
+  setTestChallenges(t, 10, 100)
+  tests := []struct {
+    conns, pending int64
+    loadStep int
+    want int
+  }{
+    {0, 0, 100, 10},
+    {99, 0, 100, 10},
+    {100, 0, 100, 11},
+    {150, 49, 100, 11},
+    {150, 50, 100, 12},
+    {400, 0, 100, 13},
+    // Never past the max.
+    {1 << 40, 0, 100, maxChallengeDifficulty},
+    // A step under 1 is 1.
+    {3, 0, 0, 12},
+  }
+  for _, tt := range tests {
+    wsConns.Store(tt.conns)
+    pendingChallenges.Store(tt.pending)
+    challengeLoadStep = tt.loadStep
+    if got := currentDifficulty(); got != tt.want {
+      t.Errorf("%d connected and %d pending with step %d: difficulty %d, want %d",
+        tt.conns, tt.pending, tt.loadStep, got, tt.want)
+    }
+  }
+}
+
+func TestRunChallenge(t *testing.T) {
+  setTestChallenges(t, 4, 100)
+  challengeTimeout = 100 * time.Millisecond
+  results := make(chan error)
+  srv := httptest.NewServer(webs.Handler(func(ws *webs.Conn) {
+    results <- runChallenge(ws)
+  }))
+  t.Cleanup(srv.Close)
+  url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+  solved := func(c *common.Challenge) string { return c.Solve() }
+  tests := []struct {
+    name string
+    // The reply to the challenge, if any.
+    action common.Action
+    solution func(c *common.Challenge) string
+    raw string
+    want error
+  }{
+    {name: "solved", action: common.ActionChallenge, solution: solved},
+    {name: "wrong solution", action: common.ActionChallenge, solution: func(c *common.Challenge) string {
+      // The nonce is random, so any given solution might be right.
+      for i := 0; ; i++ {
+        if s := strings.Repeat("x", i); !c.Verify(s) {
+          return s
+        }
+      }
+    }, want: errChallengeFailed},
+    {name: "wrong action", action: common.ActionChat, solution: solved, want: errChallengeFailed},
+    {name: "not JSON", raw: "solved!", want: errChallengeFailed},
+    {name: "no reply", want: errChallengeTimeout},
+  }
+  for _, tt := range tests {
+    ws, err := webs.Dial(url, "", srv.URL)
+    if err != nil {
+      t.Fatal(err)
+    }
+    var msg common.Message
+    if err := webs.JSON.Receive(ws, &msg); err != nil {
+      t.Fatal(err)
+    }
+    c := msg.Challenge
+    if msg.Action != common.ActionChallenge || c == nil || len(c.Nonce) < 16 || c.Difficulty != 4 {
+      t.Fatalf("%s: challenge = %+v", tt.name, msg)
+    }
+    if tt.solution != nil {
+      reply := common.NewSystemMessage(tt.action, tt.solution(c))
+      webs.JSON.Send(ws, reply)
+    } else if tt.raw != "" {
+      webs.Message.Send(ws, tt.raw)
+    }
+    if err := <-results; err != tt.want {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+    }
+    ws.Close()
+  }
+
+  // Nothing is sent with challenges disabled.
+  challengeDifficulty = 0
+  ws, err := webs.Dial(url, "", srv.URL)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer ws.Close()
+  if err := <-results; err != nil {
+    t.Errorf("disabled: err = %v", err)
+  }
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "sort"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  uuidpkg "github.com/google/uuid"
+  "wschat/wschat-go/common"
+)
+
+const maxNameLen = 32
+
+// Command is a slash command, run when a chat's contents start with
+// "/<name>".
+type Command struct {
+  Name string
+  // Shown by /help, e.g., "/nick <name>".
+  Usage string
+  Help string
+  // Returning an error sends it to the client as an error message.
+  Run func(ctx *CommandContext) error
+}
+
+// CommandContext is what a command was run with.
+type CommandContext struct {
+  Client *Client
+  Room string
+  // Everything after the command name, trimmed.
+  Args string
+}
+
+// Reply sends info to only the client that ran the command.
+func (ctx *CommandContext) Reply(contents string) {
+  msg := common.NewSystemMessage(common.ActionInfo, contents)
+  msg.Room = ctx.Room
+  ctx.Client.SendMsg(msg)
+}
+
+// Broadcast sends the message to the room the command was run in.
+func (ctx *CommandContext) Broadcast(msg common.Message) {
+  msg.Room = ctx.Room
+  broadcastMsg(msg)
+}
+
+var (
+  // map[name]*Command
+  commands = make(map[string]*Command)
+)
+
+// RegisterCommand adds a command, replacing any with the same name.
+func RegisterCommand(cmd *Command) {
+  commands[cmd.Name] = cmd
+}
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "help",
+    Usage: "/help [command]",
+    Help: "List commands or show a command's help",
+    Run: cmdHelp,
+  })
+  RegisterCommand(&Command{
+    Name: "nick",
+    Usage: "/nick <name>",
+    Help: "Set your display name",
+    Run: cmdNick,
+  })
+  RegisterCommand(&Command{
+    Name: "me",
+    Usage: "/me <action>",
+    Help: "Describe what you're doing",
+    Run: cmdMe,
+  })
+  RegisterCommand(&Command{
+    Name: "who",
+    Usage: "/who",
+    Help: "List the users in the room",
+    Run: cmdWho,
+  })
+  RegisterCommand(&Command{
+    Name: "topic",
+    Usage: "/topic [topic|-]",
+    Help: "Show or set (or with -, clear) the room's topic",
+    Run: cmdTopic,
+  })
+}
+
+// runCommand runs the contents as a command, returning false if it isn't
+// one.
+func runCommand(client *Client, room, contents string) bool {
+  if !strings.HasPrefix(contents, "/") {
+    return false
+  }
+  name, args, _ := strings.Cut(contents[1:], " ")
+  if name == "" {
+    return false
+  }
+  ctx := &CommandContext{
+    Client: client,
+    Room: room,
+    Args: strings.TrimSpace(args),
+  }
+  var err error
+  if cmd, ok := commands[strings.ToLower(name)]; ok {
+    err = cmd.Run(ctx)
+  } else {
+    err = fmt.Errorf("unknown command: /%s (see /help)", name)
+  }
+  if err != nil {
+    msg := common.NewErrorMessage(err)
+    msg.Room = room
+    if err := client.SendMsg(msg); err != nil {
+      log.Printf("error sending command error: %v", err)
+    }
+  }
+  return true
+}
+
+func cmdHelp(ctx *CommandContext) error {
+  if ctx.Args != "" {
+    cmd, ok := commands[strings.ToLower(strings.TrimPrefix(ctx.Args, "/"))]
+    if !ok {
+      return fmt.Errorf("unknown command: %s", ctx.Args)
+    }
+    ctx.Reply(fmt.Sprintf("%s - %s", cmd.Usage, cmd.Help))
+    return nil
+  }
+  lines := make([]string, 0, len(commands))
+  for _, cmd := range commands {
+    lines = append(lines, fmt.Sprintf("%s - %s", cmd.Usage, cmd.Help))
+  }
+  sort.Strings(lines)
+  ctx.Reply("Commands:\n" + strings.Join(lines, "\n"))
+  return nil
+}
+
+func isValidName(name string) bool {
+  if name == "" || utf8.RuneCountInString(name) > maxNameLen {
+    return false
+  }
+  if strings.EqualFold(name, "system") {
+    return false
+  }
+  // Can't look like someone else's ID.
+  if _, err := uuidpkg.Parse(name); err == nil {
+    return false
+  }
+  for _, r := range name {
+    if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+      return false
+    }
+  }
+  return true
+}
+
+func cmdNick(ctx *CommandContext) error {
+  name, client := ctx.Args, ctx.Client
+  if client.identity != "" {
+    return errors.New("signed-in users are named by their identity")
+  }
+  if client.irc {
+    return errors.New("IRC users are named by their nick")
+  }
+  if !isValidName(name) {
+    return fmt.Errorf(
+      "invalid name (must be 1-%d characters without spaces)", maxNameLen,
+    )
+  }
+  oldName := client.Name()
+  if name == oldName {
+    return nil
+  }
+  if isReservedName(name) {
+    return errors.New("name already in use")
+  }
+  if id, loaded := names.LoadOrStore(strings.ToLower(name), client.id); loaded {
+    if id != client.id {
+      return errors.New("name already in use")
+    }
+  }
+  if oldName != "" && !strings.EqualFold(oldName, name) {
+    names.Delete(strings.ToLower(oldName))
+  }
+  client.SetName(name)
+  client.rooms.Range(func(iRoom, _ any) bool {
+    msg := common.NewSystemMessage(common.ActionNick, client.id)
+    msg.Room, msg.Name = iRoom.(string), name
+    broadcastMsg(msg)
+    return true
+  })
+  return nil
+}
+
+func cmdMe(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    return errors.New("usage: /me <action>")
+  }
+  msg := common.NewChatMessage(ctx.Client.id, ctx.Args)
+  msg.Action, msg.Name, msg.Room = common.ActionEmote, ctx.Client.Name(), ctx.Room
+  broadcastFrom(ctx.Client, msg)
+  return nil
+}
+
+func cmdWho(ctx *CommandContext) error {
+  var users []string
+  clients.Range(func(_, iClient any) bool {
+    client := iClient.(*Client)
+    if client.InRoom(ctx.Room) {
+      if name := client.Name(); name != "" {
+        users = append(users, fmt.Sprintf("%s (%s)", name, client.id))
+      } else {
+        users = append(users, client.id)
+      }
+    }
+    return true
+  })
+  sort.Strings(users)
+  ctx.Reply(fmt.Sprintf("%d user(s) here:\n%s", len(users), strings.Join(users, "\n")))
+  return nil
+}
+
+func cmdTopic(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    if topic := roomState(ctx.Room).Topic; topic != "" {
+      ctx.Reply("Topic: " + topic)
+    } else {
+      ctx.Reply("No topic is set")
+    }
+    return nil
+  }
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  topic := ctx.Args
+  if topic == "-" {
+    topic = ""
+  }
+  updateRoom(ctx.Room, func(state *RoomState) {
+    state.Topic = topic
+  })
+  msg := common.NewChatMessage(ctx.Client.id, topic)
+  msg.Action, msg.Name = common.ActionTopic, ctx.Client.Name()
+  ctx.Broadcast(msg)
+  return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+  "encoding/json"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// newTestClient adds a connected client in the rooms, removed when the test
+// ends.
+func newTestClient(t *testing.T, id, identity string, rooms ...string) *Client {
+  client := NewClient(id, "192.0.2.1:1234", 100)
+  client.identity = identity
+  if identity != "" {
+    client.SetName(identity)
+    if acct, ok := accounts[identity]; ok {
+      client.role = acct.Role
+    }
+  }
+  for _, room := range rooms {
+    client.JoinRoom(room)
+  }
+  clients.Store(id, client)
+  t.Cleanup(func() {
+    clients.Delete(id)
+    if name := client.Name(); name != "" && identity == "" {
+      names.Delete(strings.ToLower(name))
+    }
+  })
+  return client
+}
+
+// received returns the messages sent to the client since it was last called.
+func received(t *testing.T, client *Client) []common.Message {
+  t.Helper()
+  var msgs []common.Message
+  for {
+    select {
+    case b := <-client.channel.c:
+      var msg common.Message
+      if err := json.Unmarshal(b, &msg); err != nil {
+        t.Fatalf("invalid message %s: %v", b, err)
+      }
+      msgs = append(msgs, msg)
+    default:
+      return msgs
+    }
+  }
+}
+
+// lastReceived returns the last message sent to the client, failing if there
+// wasn't one.
+func lastReceived(t *testing.T, client *Client) common.Message {
+  t.Helper()
+  msgs := received(t, client)
+  if len(msgs) == 0 {
+    t.Fatal("no message received")
+  }
+  return msgs[len(msgs)-1]
+}
+
+// setTestAccounts replaces the accounts until the test ends.
+func setTestAccounts(t *testing.T, accts map[string]*Account) {
+  oldAccounts := accounts
+  accounts = accts
+  t.Cleanup(func() {
+    accounts = oldAccounts
+  })
+}
+
+func TestRunCommand(t *testing.T) {
+  var ran *CommandContext
+  RegisterCommand(&Command{
+    Name: "testecho",
+    Run: func(ctx *CommandContext) error {
+      ran = ctx
+      return nil
+    },
+  })
+  t.Cleanup(func() {
+    delete(commands, "testecho")
+  })
+  client := newTestClient(t, "cmd-client", "", "cmd")
+
+  tests := []struct {
+    contents string
+    isCommand bool
+    args string
+    wantErr string
+  }{
+    {contents: "hello", isCommand: false},
+    {contents: "/", isCommand: false},
+    {contents: "/ testecho", isCommand: false},
+    {contents: "/testecho", isCommand: true},
+    {contents: "/testecho  some  args ", isCommand: true, args: "some  args"},
+    {contents: "/TestEcho x", isCommand: true, args: "x"},
+    {contents: "/testechox", isCommand: true, wantErr: "unknown command: /testechox (see /help)"},
+    {contents: "/help nope", isCommand: true, wantErr: "unknown command: nope"},
+  }
+  for _, tt := range tests {
+    ran = nil
+    if got := runCommand(client, "cmd", tt.contents); got != tt.isCommand {
+      t.Errorf("runCommand(%q) = %v, want %v", tt.contents, got, tt.isCommand)
+      continue
+    }
+    msgs := received(t, client)
+    if tt.wantErr != "" {
+      if len(msgs) != 1 || msgs[0].Action != common.ActionError || msgs[0].Contents != tt.wantErr ||
+        msgs[0].Room != "cmd" {
+        t.Errorf("runCommand(%q) sent %+v, want the error %q", tt.contents, msgs, tt.wantErr)
+      }
+      continue
+    }
+    if len(msgs) != 0 {
+      t.Errorf("runCommand(%q) sent %+v", tt.contents, msgs)
+    }
+    if !tt.isCommand {
+      continue
+    }
+    if ran == nil || ran.Args != tt.args || ran.Room != "cmd" || ran.Client != client {
+      t.Errorf("runCommand(%q) ran with %+v, want args %q", tt.contents, ran, tt.args)
+    }
+  }
+}
+
+func TestIsValidName(t *testing.T) {
+  tests := []struct {
+    name string
+    want bool
+  }{
+    {"alice", true},
+    {"Ünïcödé", true},
+    {"a-b_c.d", true},
+    {"", false},
+    {"system", false},
+    {"SYSTEM", false},
+    {"al ice", false},
+    {"tab\there", false},
+    {"bell\a", false},
+    {"0b1f2d6d-98dd-4163-a921-502777e62163", false},
+    {strings.Repeat("é", maxNameLen), true},
+    {strings.Repeat("é", maxNameLen+1), false},
+  }
+  for _, tt := range tests {
+    if got := isValidName(tt.name); got != tt.want {
+      t.Errorf("isValidName(%q) = %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestCmdNick(t *testing.T) {
+  setTestAccounts(t, map[string]*Account{"Alice": {Token: "atok"}})
+  oldHooks := incomingWebhooks
+  incomingWebhooks = map[string]*IncomingWebhook{"ci": {Bot: "nick-ci"}}
+  t.Cleanup(func() {
+    incomingWebhooks = oldHooks
+  })
+  other := newTestClient(t, "nick-other", "", "nick")
+  other.SetName("taken")
+  names.Store("taken", other.id)
+  signedIn := newTestClient(t, "nick-signed-in", "Alice", "nick")
+  ircClient := newTestClient(t, "nick-irc", "", "nick")
+  ircClient.irc = true
+
+  client := newTestClient(t, "nick-client", "", "nick")
+  tests := []struct {
+    client *Client
+    args string
+    wantErr string
+    want string
+  }{
+    {client: client, args: "first", want: "first"},
+    // Case changes keep the name.
+    {client: client, args: "First", want: "First"},
+    {client: client, args: "second", want: "second"},
+    {client: client, args: "TAKEN", wantErr: "name already in use", want: "second"},
+    {client: client, args: "alice", wantErr: "name already in use", want: "second"},
+    {client: client, args: "Nick-CI", wantErr: "name already in use", want: "second"},
+    {client: client, args: "two words", wantErr: "invalid name", want: "second"},
+    {client: client, args: "", wantErr: "invalid name", want: "second"},
+    {client: signedIn, args: "bob", wantErr: "signed-in users are named by their identity", want: "Alice"},
+    {client: ircClient, args: "bob", wantErr: "IRC users are named by their nick"},
+  }
+  for _, tt := range tests {
+    err := cmdNick(&CommandContext{Client: tt.client, Room: "nick", Args: tt.args})
+    if tt.wantErr == "" && err != nil {
+      t.Errorf("/nick %s: %v", tt.args, err)
+    } else if tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)) {
+      t.Errorf("/nick %s: err = %v, want %q", tt.args, err, tt.wantErr)
+    }
+    if name := tt.client.Name(); name != tt.want {
+      t.Errorf("/nick %s: name = %q, want %q", tt.args, name, tt.want)
+    }
+  }
+
+  // The old names were released, and the change broadcast.
+  for _, name := range []string{"first", "second"} {
+    id, ok := names.Load(name)
+    if want := name == "second"; ok != want || ok && id != client.id {
+      t.Errorf("names[%q] = %v, %v", name, id, ok)
+    }
+  }
+  var nicks []string
+  for _, msg := range received(t, other) {
+    if msg.Action == common.ActionNick && msg.Contents == client.id {
+      nicks = append(nicks, msg.Name)
+    }
+  }
+  if want := []string{"first", "First", "second"}; strings.Join(nicks, ",") != strings.Join(want, ",") {
+    t.Errorf("broadcast nicks %q, want %q", nicks, want)
+  }
+}
@@ -0,0 +1,40 @@
+package common
+
+import (
+  "crypto/sha256"
+  "math/bits"
+  "strconv"
+)
+
+// Challenge is a hashcash-style puzzle a server may send before connect. The
+// solution is a string that, appended to the nonce, has a SHA-256 hash
+// starting with at least difficulty zero bits.
+type Challenge struct {
+  Nonce string `json:"nonce"`
+  Difficulty int `json:"difficulty"`
+}
+
+// Verify reports whether the solution solves the challenge.
+func (c *Challenge) Verify(solution string) bool {
+  sum := sha256.Sum256([]byte(c.Nonce + solution))
+  zeros := 0
+  for _, b := range sum {
+    if b != 0 {
+      zeros += bits.LeadingZeros8(b)
+      break
+    }
+    zeros += 8
+  }
+  return zeros >= c.Difficulty
+}
+
+// Solve finds a solution to the challenge by counting up from 0, taking
+// about 2^difficulty hashes.
+func (c *Challenge) Solve() string {
+  for i := uint64(0); ; i++ {
+    solution := strconv.FormatUint(i, 10)
+    if c.Verify(solution) {
+      return solution
+    }
+  }
+}
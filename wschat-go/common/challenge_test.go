@@ -0,0 +1,51 @@
+package common
+
+import "testing"
+
+func TestChallengeVerify(t *testing.T) {
+  // The SHA-256 of "wschat" and each solution has exactly zeros leading
+  // zero bits.
+  tests := []struct {
+    solution string
+    zeros int
+  }{
+    {"0", 0},
+    {"2", 1},
+    {"11", 3},
+    {"172", 8},
+    {"1429", 9},
+    {"17379", 16},
+  }
+  for _, tt := range tests {
+    for _, difficulty := range []int{0, tt.zeros, tt.zeros + 1} {
+      c := &Challenge{Nonce: "wschat", Difficulty: difficulty}
+      if got, want := c.Verify(tt.solution), difficulty <= tt.zeros; got != want {
+        t.Errorf("Verify(%q) with difficulty %d = %v, want %v", tt.solution, difficulty, got, want)
+      }
+    }
+  }
+  // The nonce is part of what's hashed.
+  c := &Challenge{Nonce: "other", Difficulty: 16}
+  if c.Verify("17379") {
+    t.Error("solution verified with another nonce")
+  }
+}
+
+func TestChallengeSolve(t *testing.T) {
+  tests := []struct {
+    difficulty int
+    want string
+  }{
+    {0, "0"},
+    {1, "2"},
+    {4, "43"},
+    {8, "172"},
+    {16, "17379"},
+  }
+  for _, tt := range tests {
+    c := &Challenge{Nonce: "wschat", Difficulty: tt.difficulty}
+    if got := c.Solve(); got != tt.want {
+      t.Errorf("Solve with difficulty %d = %q, want %q", tt.difficulty, got, tt.want)
+    }
+  }
+}
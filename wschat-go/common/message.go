@@ -2,15 +2,179 @@ package common
 
 import (
   "encoding/json"
+  "errors"
   "fmt"
   "time"
 )
 
 type Message struct {
+  // Assigned by the server to chats, increasing with each one, so it doubles
+  // as a sequence number. For edits and deletes, the chat acted on.
+  ID uint64 `json:"id,omitempty"`
   Sender string `json:"sender,omitempty"`
   Action Action `json:"action,omitempty"`
   Contents string `json:"contents,omitempty"`
   Timestamp int64 `json:"timestamp,omitempty"`
+  // The room the message belongs to. Empty is the default (global) room.
+  Room string `json:"room,omitempty"`
+  // The display name of the sender, or of the user a system message is about.
+  // Empty if the user hasn't set one.
+  Name string `json:"name,omitempty"`
+  // Set on some error messages.
+  Error *ErrorInfo `json:"error,omitempty"`
+  // When the chat was last edited, if it has been.
+  Edited int64 `json:"edited,omitempty"`
+  // Reaction counts of the chat in history replay. On react and unreact
+  // messages, the new count of the reaction in contents.
+  Reactions map[string]int `json:"reactions,omitempty"`
+  // The chat a chat replies to, set by the sender.
+  ReplyTo uint64 `json:"replyTo,omitempty"`
+  // The thread of a reply. In history replay and thread messages, also set on
+  // chats with replies.
+  Thread *ThreadInfo `json:"thread,omitempty"`
+  // The chats of thread messages (oldest first), query results, and pin and
+  // pins messages.
+  Messages []Message `json:"messages,omitempty"`
+  // The users mentioned (with "@name") in a chat, in order.
+  Mentions []Mention `json:"mentions,omitempty"`
+  // The number of chats after the user's read marker, on read messages sent
+  // to them on connect.
+  Unread int `json:"unread,omitempty"`
+  // What a query message asks for. Results are in messages.
+  Query *Query `json:"query,omitempty"`
+  // Set on query results if there are more matches than were sent.
+  More bool `json:"more,omitempty"`
+  // Sent by clients with a chat to have it expire after this many seconds.
+  TTL int64 `json:"ttl,omitempty"`
+  // When the chat expires, in Unix nanoseconds.
+  Expires int64 `json:"expires,omitempty"`
+  // Files uploaded to the server. Clients send only their hashes (and
+  // optionally names); the rest is filled in by the server.
+  Attachments []Attachment `json:"attachments,omitempty"`
+  // The state of the room, on room messages.
+  RoomInfo *RoomInfo `json:"roomInfo,omitempty"`
+  // The poll of poll messages, whose question is the contents. On vote and
+  // close messages, the poll's tallies.
+  Poll *Poll `json:"poll,omitempty"`
+  // The indexes of the options voted for, sent by clients with votes.
+  Choices []int `json:"choices,omitempty"`
+  // The puzzle of challenge messages.
+  Challenge *Challenge `json:"challenge,omitempty"`
+}
+
+// Poll is a question users vote on.
+type Poll struct {
+  Options []string `json:"options"`
+  // Whether users can vote for more than one option.
+  Multi bool `json:"multi,omitempty"`
+  // When voting closes, in Unix nanoseconds. 0 is when its creator or a
+  // moderator closes it.
+  Closes int64 `json:"closes,omitempty"`
+  // Set by the server: the number of votes for each option, the number of
+  // users who voted and whether voting has closed.
+  Votes []int `json:"votes"`
+  Voters int `json:"voters"`
+  Closed bool `json:"closed,omitempty"`
+}
+
+// RoomInfo is a room's descriptive state.
+type RoomInfo struct {
+  Topic string `json:"topic,omitempty"`
+  // The message of the day, sent to users when they join.
+  MOTD string `json:"motd,omitempty"`
+  // When the room was created, in Unix nanoseconds.
+  Created int64 `json:"created,omitempty"`
+  // The display name of who created it.
+  Creator string `json:"creator,omitempty"`
+  // The max number of users in the room. 0 is unlimited.
+  MaxMembers int `json:"maxMembers,omitempty"`
+  // The number of users in the room.
+  Members int `json:"members"`
+  // Who can join: "public", "password" or "invite".
+  Access string `json:"access,omitempty"`
+  // The min number of seconds between each user's posts (besides
+  // moderators'). 0 is off.
+  SlowMode int64 `json:"slowMode,omitempty"`
+  // Whether only moderators and bots can post.
+  ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+// Attachment is a file uploaded to the server.
+type Attachment struct {
+  Name string `json:"name"`
+  // In bytes.
+  Size int64 `json:"size"`
+  // The MIME type.
+  Type string `json:"type"`
+  // The hex SHA-256 of the file, which it's downloaded by.
+  Hash string `json:"hash"`
+}
+
+// Query selects chats from a room's history. Zero fields aren't filtered on.
+type Query struct {
+  // Only chats with IDs after or before these.
+  After uint64 `json:"after,omitempty"`
+  Before uint64 `json:"before,omitempty"`
+  // Only chats sent at or after since and before until, in Unix nanoseconds.
+  Since int64 `json:"since,omitempty"`
+  Until int64 `json:"until,omitempty"`
+  // Only chats from the connection ID, display name or identity.
+  Sender string `json:"sender,omitempty"`
+  // Only chats with the action (chat, emote or poll).
+  Action Action `json:"action,omitempty"`
+  // Only chats containing the text, ignoring case.
+  Text string `json:"text,omitempty"`
+  // Matches text's words in any order instead of as a substring.
+  Tokens bool `json:"tokens,omitempty"`
+  // The max number of results.
+  Limit int `json:"limit,omitempty"`
+}
+
+// QueryResult is the response to a history query over HTTP.
+type QueryResult struct {
+  // Oldest first. If after is set, these are the oldest matches after it,
+  // otherwise the newest.
+  Messages []Message `json:"messages"`
+  // Whether there are more matches than were sent.
+  More bool `json:"more"`
+}
+
+// Mention is a user mentioned in a chat's contents.
+type Mention struct {
+  // The user's identity if they have an account, otherwise their display name.
+  Name string `json:"name"`
+  // The user's identity if they have an account, otherwise their connection's
+  // ID.
+  ID string `json:"id"`
+  // Where "@name" is in the contents, in bytes.
+  Offset int `json:"offset"`
+  Length int `json:"length"`
+}
+
+// ThreadInfo describes the thread a chat is in.
+type ThreadInfo struct {
+  // The ID of the chat that started the thread. Replies to replies are in
+  // their parent's thread.
+  Root uint64 `json:"root"`
+  // The number of replies in the thread, as of the message.
+  Replies int `json:"replies"`
+}
+
+// ErrorInfo is the machine-readable part of an error message. It's an error
+// itself so it can be returned from anywhere an error is sent to a client.
+type ErrorInfo struct {
+  Code string `json:"code"`
+  // The rule that was broken, if any.
+  Rule string `json:"rule,omitempty"`
+  // When the user may try again, in Unix nanoseconds, if they're being
+  // slowed down.
+  RetryAt int64 `json:"retryAt,omitempty"`
+  // Sent as the message's contents.
+  Message string `json:"-"`
+}
+
+func (e *ErrorInfo) Error() string {
+  return e.Message
 }
 
 func NewSystemMessage(action Action, contents string) Message {
@@ -22,6 +186,17 @@ func NewSystemMessage(action Action, contents string) Message {
   }
 }
 
+// NewErrorMessage creates an error message from the error, including its
+// ErrorInfo if it has one.
+func NewErrorMessage(err error) Message {
+  msg := NewSystemMessage(ActionError, err.Error())
+  info := &ErrorInfo{}
+  if errors.As(err, &info) {
+    msg.Error = info
+  }
+  return msg
+}
+
 func NewChatMessage(sender, contents string) Message {
   return Message{
     Sender: sender,
@@ -38,11 +213,85 @@ const (
   ActionChat = "chat"
   ActionDisconnect = "disconnect"
   ActionError = "error"
+  // A chat describing the sender, e.g., "/me waves".
+  ActionEmote = "emote"
+  // Sent by the system only to the client it concerns (e.g., command output).
+  ActionInfo = "info"
+  // The user in contents changed their display name to name.
+  ActionNick = "nick"
+  // The sender set the room's topic to contents.
+  ActionTopic = "topic"
+  // A moderator acted on a user, described by contents.
+  ActionModeration = "moderation"
+  // Sent by clients to change the contents of their chat with the ID, and
+  // broadcast with the new contents.
+  ActionEdit = "edit"
+  // Sent by clients to delete their chat with the ID, and broadcast.
+  ActionDelete = "delete"
+  // Sent by clients to add the reaction (e.g., an emoji) in contents to the
+  // chat with the ID, and broadcast.
+  ActionReact = "react"
+  // Sent by clients to remove their reaction in contents from the chat with
+  // the ID, and broadcast.
+  ActionUnreact = "unreact"
+  // Sent by clients to fetch the thread the chat with the ID is in, and sent
+  // back to only them with the thread's messages.
+  ActionThread = "thread"
+  // Sent by the system to users mentioned in a chat, wherever they are. The
+  // rest of the message is the chat's.
+  ActionMention = "mention"
+  // Sent by clients to mark the room read up to the chat with the ID, and
+  // broadcast (at most every few seconds per user). On connect, sent by the
+  // system with the user's marker and unread count.
+  ActionRead = "read"
+  // Sent by clients to query the room's history, and sent back to only them
+  // with the results.
+  ActionQuery = "query"
+  // Sent by the system when the chat with the ID expires.
+  ActionExpire = "expire"
+  // The room's state (with its MOTD as contents), sent by the system to users
+  // when they join, and broadcast when the sender changes it.
+  ActionRoom = "room"
+  // Sent by clients to create the poll with the question in contents, and
+  // broadcast with its ID. Kept in history like chats.
+  ActionPoll = "poll"
+  // Sent by clients to vote for the choices in the poll with the ID,
+  // replacing their earlier vote (no choices takes it back), and broadcast
+  // with the poll's tallies but not the choices.
+  ActionVote = "vote"
+  // Sent by clients to close the poll with the ID, and broadcast with its
+  // final tallies. Also sent by the system when its close time passes.
+  ActionClose = "close"
+  // Sent by moderators to pin the chat with the ID to the room, and broadcast
+  // with the chat in messages.
+  ActionPin = "pin"
+  // Sent by moderators to unpin the chat with the ID, and broadcast.
+  ActionUnpin = "unpin"
+  // The room's pinned chats in messages, oldest pin first, sent by the system
+  // to users when they join.
+  ActionPins = "pins"
+  // Sent by the system before connect, if the server requires it, with a
+  // challenge for the client to solve. Clients send it back with the
+  // solution as contents before they're connected.
+  ActionChallenge = "challenge"
 )
 
-func (a Action) MarshalJSON() ([]byte, error) {
+func (a Action) IsValid() bool {
   switch a {
   case ActionConnect, ActionChat, ActionDisconnect, ActionError:
+  case ActionEmote, ActionInfo, ActionNick, ActionTopic, ActionModeration:
+  case ActionEdit, ActionDelete, ActionReact, ActionUnreact, ActionThread:
+  case ActionMention, ActionRead, ActionQuery, ActionExpire, ActionRoom:
+  case ActionPoll, ActionVote, ActionClose, ActionPin, ActionUnpin, ActionPins:
+  case ActionChallenge:
+  default:
+    return false
+  }
+  return true
+}
+
+func (a Action) MarshalJSON() ([]byte, error) {
+  if a.IsValid() {
     return json.Marshal(string(a))
   }
   return nil, fmt.Errorf("invalid action: %s", a)
@@ -54,8 +303,7 @@ func (a *Action) UnmarshalJSON(b []byte) error {
     return err
   }
   action := Action(str)
-  switch action {
-  case ActionConnect, ActionChat, ActionDisconnect, ActionError:
+  if action.IsValid() {
     *a = action
     return nil
   }
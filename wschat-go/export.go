@@ -0,0 +1,234 @@
+package main
+
+import (
+  "bufio"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "html/template"
+  "io"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// exportRow is a chat in an exported transcript.
+type exportRow struct {
+  ID uint64 `json:"id"`
+  // RFC 3339 in UTC.
+  Time string `json:"time"`
+  // The sender's display name.
+  Sender string `json:"sender"`
+  SenderID string `json:"senderId"`
+  Action common.Action `json:"action"`
+  Contents string `json:"contents"`
+  ReplyTo uint64 `json:"replyTo,omitempty"`
+  // When it was last edited, if it was.
+  Edited string `json:"edited,omitempty"`
+}
+
+// Transcript writers by format, with their file extensions and content
+// types.
+var exportFormats = map[string]struct {
+  ext, contentType string
+  write func(w io.Writer, room string, rows []exportRow) error
+}{
+  "jsonl": {"jsonl", "application/x-ndjson", writeExportJSONL},
+  "csv": {"csv", "text/csv; charset=utf-8", writeExportCSV},
+  "text": {"txt", "text/plain; charset=utf-8", writeExportText},
+  "html": {"html", "text/html; charset=utf-8", writeExportHTML},
+}
+
+func exportTime(nanos int64) string {
+  return time.Unix(0, nanos).UTC().Format(time.RFC3339)
+}
+
+// exportRows converts the entries, resolving senders to the names they used
+// in the transcript, or the names they're connected with now. Those with
+// neither are given a name from their ID.
+func exportRows(entries []*HistoryEntry) []exportRow {
+  names := make(map[string]string)
+  for _, entry := range entries {
+    if entry.Msg.Name != "" {
+      names[entry.Msg.Sender] = entry.Msg.Name
+    }
+  }
+  rows := make([]exportRow, len(entries))
+  for i, entry := range entries {
+    msg := &entry.Msg
+    name := msg.Name
+    if name == "" {
+      name = names[msg.Sender]
+    }
+    if name == "" {
+      if iClient, ok := clients.Load(msg.Sender); ok {
+        name = iClient.(*Client).Name()
+      }
+    }
+    if name == "" {
+      name = "anonymous-" + strings.SplitN(msg.Sender, "-", 2)[0]
+    }
+    rows[i] = exportRow{
+      ID: msg.ID,
+      Time: exportTime(msg.Timestamp),
+      Sender: name,
+      SenderID: msg.Sender,
+      Action: msg.Action,
+      Contents: msg.Contents,
+      ReplyTo: msg.ReplyTo,
+    }
+    if msg.Edited != 0 {
+      rows[i].Edited = exportTime(msg.Edited)
+    }
+  }
+  return rows
+}
+
+func writeExportJSONL(w io.Writer, _ string, rows []exportRow) error {
+  enc := json.NewEncoder(w)
+  for _, row := range rows {
+    if err := enc.Encode(row); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func writeExportCSV(w io.Writer, _ string, rows []exportRow) error {
+  cw := csv.NewWriter(w)
+  cw.Write([]string{
+    "id", "time", "sender", "sender_id", "action", "contents", "reply_to", "edited",
+  })
+  for _, row := range rows {
+    replyTo := ""
+    if row.ReplyTo != 0 {
+      replyTo = strconv.FormatUint(row.ReplyTo, 10)
+    }
+    cw.Write([]string{
+      strconv.FormatUint(row.ID, 10), row.Time, row.Sender, row.SenderID,
+      string(row.Action), row.Contents, replyTo, row.Edited,
+    })
+  }
+  cw.Flush()
+  return cw.Error()
+}
+
+func writeExportText(w io.Writer, room string, rows []exportRow) error {
+  bw := bufio.NewWriter(w)
+  fmt.Fprintf(bw, "Transcript of %s\n\n", roomDisplayName(room))
+  for _, row := range rows {
+    // Continuation lines are indented under the first.
+    contents := strings.ReplaceAll(row.Contents, "\n", "\n    ")
+    if row.Action == common.ActionEmote {
+      fmt.Fprintf(bw, "[%s] * %s %s", row.Time, row.Sender, contents)
+    } else {
+      fmt.Fprintf(bw, "[%s] <%s> %s", row.Time, row.Sender, contents)
+    }
+    if row.Edited != "" {
+      bw.WriteString(" (edited)")
+    }
+    bw.WriteString("\n")
+  }
+  return bw.Flush()
+}
+
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Transcript of {{.Room}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+.msg { margin: 0.25em 0; white-space: pre-wrap; }
+.time, .edited { color: #888; font-size: 0.85em; }
+.sender { font-weight: bold; }
+.emote { font-style: italic; }
+</style>
+</head>
+<body>
+<h1>Transcript of {{.Room}}</h1>
+{{range .Rows}}<div class="msg{{if eq .Action "emote"}} emote{{end}}" id="msg-{{.ID}}"><span class="time">{{.Time}}</span> <span class="sender" title="{{.SenderID}}">{{if eq .Action "emote"}}* {{end}}{{.Sender}}</span> {{.Contents}}{{if .Edited}} <span class="edited">(edited {{.Edited}})</span>{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+func writeExportHTML(w io.Writer, room string, rows []exportRow) error {
+  return exportHTMLTemplate.Execute(w, struct {
+    Room string
+    Rows []exportRow
+  }{roomDisplayName(room), rows})
+}
+
+func roomDisplayName(room string) string {
+  if room == "" {
+    return "the default room"
+  }
+  return room
+}
+
+// exportHandler serves GET /export?room=...&format=...: the room's history as
+// a transcript in the format (jsonl, csv, text or html). By default, it's
+// read from the durable log, if there is one; source=memory uses the history
+// in memory instead.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    w.Header().Set("Allow", http.MethodGet)
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  params := r.URL.Query()
+  room := params.Get("room")
+  if !isValidRoomName(room) {
+    http.Error(w, "Invalid room name", http.StatusBadRequest)
+    return
+  }
+  if !httpRoomAccess(r, room) {
+    http.Error(w, "Forbidden", http.StatusForbidden)
+    return
+  }
+  formatName := params.Get("format")
+  if formatName == "" {
+    formatName = "text"
+  }
+  format, ok := exportFormats[formatName]
+  if !ok {
+    http.Error(w, "Invalid format", http.StatusBadRequest)
+    return
+  }
+  var entries []*HistoryEntry
+  switch params.Get("source") {
+  case "":
+    if historyLogPath == "" {
+      entries = historyEntries(room)
+      break
+    }
+    fallthrough
+  case "log":
+    if historyLogPath == "" {
+      http.Error(w, "No history log", http.StatusBadRequest)
+      return
+    }
+    var err error
+    entries, err = loggedEntries(room, func(*common.Message) bool { return true })
+    if err != nil {
+      http.Error(w, "Internal server error", http.StatusInternalServerError)
+      return
+    }
+  case "memory":
+    entries = historyEntries(room)
+  default:
+    http.Error(w, "Invalid source", http.StatusBadRequest)
+    return
+  }
+  filename := "wschat"
+  if room != "" {
+    filename += "-" + room
+  }
+  filename += "-" + time.Now().UTC().Format("20060102T150405Z") + "." + format.ext
+  w.Header().Set("Content-Type", format.contentType)
+  w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+  format.write(w, room, exportRows(entries))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+  "bytes"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+func TestExportRows(t *testing.T) {
+  connected := newTestClient(t, "export-conn", "")
+  connected.SetName("connected")
+  at := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC).UnixNano()
+  entries := []*HistoryEntry{
+    {Msg: common.Message{ID: 1, Sender: "abc-1", Action: common.ActionChat, Contents: "hi", Timestamp: at}},
+    // The name used in the transcript is used for all of a sender's chats.
+    {Msg: common.Message{ID: 2, Sender: "abc-1", Name: "alice", Action: common.ActionEmote, Contents: "waves", Timestamp: at}},
+    {Msg: common.Message{ID: 3, Sender: "export-conn", Action: common.ActionChat, Contents: "yo", ReplyTo: 1, Timestamp: at}},
+    {Msg: common.Message{ID: 4, Sender: "def-2", Action: common.ActionChat, Contents: "?", Timestamp: at, Edited: at + int64(time.Hour)}},
+  }
+  want := []exportRow{
+    {ID: 1, Time: "2024-05-06T07:08:09Z", Sender: "alice", SenderID: "abc-1", Action: common.ActionChat, Contents: "hi"},
+    {ID: 2, Time: "2024-05-06T07:08:09Z", Sender: "alice", SenderID: "abc-1", Action: common.ActionEmote, Contents: "waves"},
+    {ID: 3, Time: "2024-05-06T07:08:09Z", Sender: "connected", SenderID: "export-conn", Action: common.ActionChat, Contents: "yo", ReplyTo: 1},
+    {
+      ID: 4, Time: "2024-05-06T07:08:09Z", Sender: "anonymous-def", SenderID: "def-2", Action: common.ActionChat,
+      Contents: "?", Edited: "2024-05-06T08:08:09Z",
+    },
+  }
+  if got := exportRows(entries); !reflect.DeepEqual(got, want) {
+    t.Errorf("exportRows = %+v, want %+v", got, want)
+  }
+}
+
+func TestExportFormats(t *testing.T) {
+  rows := []exportRow{
+    {ID: 1, Time: "2024-05-06T07:08:09Z", Sender: "alice", SenderID: "a-1", Action: common.ActionChat, Contents: "two\nlines, <b>"},
+    {ID: 2, Time: "2024-05-06T07:08:10Z", Sender: "bob", SenderID: "b-2", Action: common.ActionEmote, Contents: "waves", ReplyTo: 1, Edited: "2024-05-06T07:09:00Z"},
+  }
+  tests := []struct {
+    format, room string
+    want []string
+  }{
+    {"jsonl", "r", []string{
+      `{"id":1,"time":"2024-05-06T07:08:09Z","sender":"alice","senderId":"a-1","action":"chat","contents":"two\nlines, \u003cb\u003e"}` + "\n",
+      `{"id":2,"time":"2024-05-06T07:08:10Z","sender":"bob","senderId":"b-2","action":"emote","contents":"waves","replyTo":1,"edited":"2024-05-06T07:09:00Z"}` + "\n",
+    }},
+    {"csv", "r", []string{
+      "id,time,sender,sender_id,action,contents,reply_to,edited\n",
+      "1,2024-05-06T07:08:09Z,alice,a-1,chat,\"two\nlines, <b>\",,\n",
+      "2,2024-05-06T07:08:10Z,bob,b-2,emote,waves,1,2024-05-06T07:09:00Z\n",
+    }},
+    {"text", "", []string{
+      "Transcript of the default room\n\n",
+      "[2024-05-06T07:08:09Z] <alice> two\n    lines, <b>\n",
+      "[2024-05-06T07:08:10Z] * bob waves (edited)\n",
+    }},
+    {"html", "r", []string{
+      "<title>Transcript of r</title>",
+      `<div class="msg" id="msg-1"><span class="time">2024-05-06T07:08:09Z</span> <span class="sender" title="a-1">alice</span> two` + "\nlines, &lt;b&gt;</div>",
+      `<div class="msg emote" id="msg-2">`,
+      `<span class="sender" title="b-2">* bob</span> waves <span class="edited">(edited 2024-05-06T07:09:00Z)</span>`,
+    }},
+  }
+  for _, tt := range tests {
+    var buf bytes.Buffer
+    if err := exportFormats[tt.format].write(&buf, tt.room, rows); err != nil {
+      t.Errorf("%s: %v", tt.format, err)
+      continue
+    }
+    got := buf.String()
+    if tt.format != "html" && got != strings.Join(tt.want, "") {
+      t.Errorf("%s: got %q, want %q", tt.format, got, strings.Join(tt.want, ""))
+      continue
+    }
+    for _, want := range tt.want {
+      if !strings.Contains(got, want) {
+        t.Errorf("%s: %q doesn't contain %q", tt.format, got, want)
+      }
+    }
+  }
+}
+
+func TestExportHandler(t *testing.T) {
+  useTestHistory(t)
+  oldSize := historySize
+  historySize = 1
+  t.Cleanup(func() {
+    historySize = oldSize
+  })
+  alice := NewClient("export-alice", "", 0)
+  alice.SetName("alice")
+  recordTestChat(alice, "exports", "only in the log")
+  recordTestChat(alice, "exports", "in memory too")
+
+  tests := []struct {
+    method, query string
+    wantStatus int
+    wantType string
+    // Whether the chat that's only in the log is exported.
+    fromLog bool
+  }{
+    {"GET", "room=exports", http.StatusOK, "text/plain; charset=utf-8", true},
+    {"GET", "room=exports&format=jsonl&source=log", http.StatusOK, "application/x-ndjson", true},
+    {"GET", "room=exports&format=csv&source=memory", http.StatusOK, "text/csv; charset=utf-8", false},
+    {"GET", "room=exports&format=pdf", http.StatusBadRequest, "", false},
+    {"GET", "room=exports&source=disk", http.StatusBadRequest, "", false},
+    {"GET", "room=not%20a%20room", http.StatusBadRequest, "", false},
+    {"HEAD", "room=exports", http.StatusMethodNotAllowed, "", false},
+  }
+  for _, tt := range tests {
+    w := httptest.NewRecorder()
+    exportHandler(w, httptest.NewRequest(tt.method, "/export?"+tt.query, nil))
+    if w.Code != tt.wantStatus {
+      t.Errorf("%s %s: status %d, want %d", tt.method, tt.query, w.Code, tt.wantStatus)
+      continue
+    }
+    if w.Code != http.StatusOK {
+      continue
+    }
+    if got := w.Header().Get("Content-Type"); got != tt.wantType {
+      t.Errorf("%s: Content-Type %q, want %q", tt.query, got, tt.wantType)
+    }
+    if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, `attachment; filename="wschat-exports-`) {
+      t.Errorf("%s: Content-Disposition %q", tt.query, got)
+    }
+    body := w.Body.String()
+    if !strings.Contains(body, "in memory too") || strings.Contains(body, "only in the log") != tt.fromLog {
+      t.Errorf("%s: exported %q, want from the log: %v", tt.query, body, tt.fromLog)
+    }
+  }
+}
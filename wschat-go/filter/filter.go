@@ -0,0 +1,236 @@
+// Package filter validates and filters the contents of inbound messages.
+package filter
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/url"
+  "os"
+  "regexp"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "golang.org/x/text/unicode/norm"
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+// Error codes sent in the ErrorInfo of rejections.
+const (
+  CodeEmpty = "empty"
+  CodeTooLong = "too_long"
+  CodeBlocked = "blocked"
+  CodeLinkNotAllowed = "link_not_allowed"
+)
+
+// Config is the filter's config file.
+type Config struct {
+  // In characters, after normalization and stripping. 0 is unlimited.
+  MaxLength int `json:"maxLength,omitempty"`
+  AllowEmpty bool `json:"allowEmpty,omitempty"`
+  // One of NFC, NFD, NFKC or NFKD. Empty doesn't normalize.
+  Normalize string `json:"normalize,omitempty"`
+  // Removes control characters (other than newlines and tabs) and
+  // bidirectional overrides.
+  StripControl bool `json:"stripControl,omitempty"`
+  // Applied in order.
+  Rules []*Rule `json:"rules,omitempty"`
+  Links LinkConfig `json:"links,omitempty"`
+}
+
+// Rule acts on contents matching its pattern.
+type Rule struct {
+  Name string `json:"name"`
+  Pattern string `json:"pattern"`
+  // "replace" or "reject".
+  Action string `json:"action"`
+  // What matches are replaced with ("replace" only). Can use $1, etc.
+  Replacement string `json:"replacement,omitempty"`
+  // Sent to the client on rejection.
+  Message string `json:"message,omitempty"`
+
+  re *regexp.Regexp
+}
+
+// LinkConfig lists the hosts http(s) links may point to. Subdomains of a
+// listed host match it.
+type LinkConfig struct {
+  // If non-empty, only links to these hosts are allowed.
+  Allow []string `json:"allow,omitempty"`
+  Deny []string `json:"deny,omitempty"`
+}
+
+var linkRegexp = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// Filter is a middleware enforcing a Config on inbound messages.
+type Filter struct {
+  middleware.Base
+  config Config
+  // Nil if contents aren't normalized.
+  form *norm.Form
+}
+
+// Load reads the config file and creates a filter with it.
+func Load(path string) (*Filter, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var config Config
+  if err := json.NewDecoder(f).Decode(&config); err != nil {
+    return nil, err
+  }
+  return New(config)
+}
+
+func New(config Config) (*Filter, error) {
+  filter := &Filter{config: config}
+  var form norm.Form
+  switch strings.ToUpper(config.Normalize) {
+  case "":
+  case "NFC":
+    form = norm.NFC
+  case "NFD":
+    form = norm.NFD
+  case "NFKC":
+    form = norm.NFKC
+  case "NFKD":
+    form = norm.NFKD
+  default:
+    return nil, fmt.Errorf("invalid normalization form: %q", config.Normalize)
+  }
+  if config.Normalize != "" {
+    filter.form = &form
+  }
+  for i, rule := range config.Rules {
+    if rule.Name == "" {
+      rule.Name = fmt.Sprintf("rule-%d", i+1)
+    }
+    var err error
+    if rule.re, err = regexp.Compile(rule.Pattern); err != nil {
+      return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+    }
+    if rule.Action != "replace" && rule.Action != "reject" {
+      return nil, fmt.Errorf("rule %q: invalid action: %q", rule.Name, rule.Action)
+    }
+  }
+  return filter, nil
+}
+
+func (f *Filter) OnMessage(_ middleware.Conn, msg *common.Message) error {
+  // Only chats, edits and polls (their questions and options) have contents
+  // to check.
+  if msg.Action != common.ActionChat && msg.Action != common.ActionEdit &&
+    msg.Action != common.ActionPoll {
+    return nil
+  }
+  // Poll options are checked like contents.
+  if msg.Action == common.ActionPoll && msg.Poll != nil {
+    for i, option := range msg.Poll.Options {
+      filtered, err := f.Apply(option)
+      if err != nil {
+        return err
+      }
+      msg.Poll.Options[i] = filtered
+    }
+  }
+  // Chats can be just attachments.
+  if msg.Contents == "" && len(msg.Attachments) != 0 {
+    return nil
+  }
+  contents, err := f.Apply(msg.Contents)
+  if err != nil {
+    return err
+  }
+  msg.Contents = contents
+  return nil
+}
+
+// Apply returns the filtered contents, or an *common.ErrorInfo if they're
+// rejected.
+func (f *Filter) Apply(contents string) (string, error) {
+  contents = strings.ToValidUTF8(contents, "\ufffd")
+  if f.form != nil {
+    contents = f.form.String(contents)
+  }
+  if f.config.StripControl {
+    contents = strings.Map(func(r rune) rune {
+      if r == '\n' || r == '\t' {
+        return r
+      }
+      if unicode.IsControl(r) || isBidiControl(r) {
+        return -1
+      }
+      return r
+    }, contents)
+  }
+  for _, rule := range f.config.Rules {
+    if !rule.re.MatchString(contents) {
+      continue
+    }
+    if rule.Action == "replace" {
+      contents = rule.re.ReplaceAllString(contents, rule.Replacement)
+      continue
+    }
+    message := rule.Message
+    if message == "" {
+      message = "message blocked by filter"
+    }
+    return "", &common.ErrorInfo{Code: CodeBlocked, Rule: rule.Name, Message: message}
+  }
+  for _, link := range linkRegexp.FindAllString(contents, -1) {
+    if !f.linkAllowed(link) {
+      return "", &common.ErrorInfo{
+        Code: CodeLinkNotAllowed,
+        Rule: "links",
+        Message: fmt.Sprintf("links like %s aren't allowed", link),
+      }
+    }
+  }
+  if strings.TrimSpace(contents) == "" && !f.config.AllowEmpty {
+    return "", &common.ErrorInfo{
+      Code: CodeEmpty, Rule: "allowEmpty", Message: "message is empty",
+    }
+  }
+  if max := f.config.MaxLength; max > 0 && utf8.RuneCountInString(contents) > max {
+    return "", &common.ErrorInfo{
+      Code: CodeTooLong,
+      Rule: "maxLength",
+      Message: fmt.Sprintf("message is longer than %d characters", max),
+    }
+  }
+  return contents, nil
+}
+
+func (f *Filter) linkAllowed(link string) bool {
+  u, err := url.Parse(link)
+  if err != nil {
+    return len(f.config.Links.Allow) == 0
+  }
+  host := strings.ToLower(u.Hostname())
+  for _, denied := range f.config.Links.Deny {
+    if hostMatches(host, denied) {
+      return false
+    }
+  }
+  if len(f.config.Links.Allow) == 0 {
+    return true
+  }
+  for _, allowed := range f.config.Links.Allow {
+    if hostMatches(host, allowed) {
+      return true
+    }
+  }
+  return false
+}
+
+func hostMatches(host, pattern string) bool {
+  pattern = strings.ToLower(pattern)
+  return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func isBidiControl(r rune) bool {
+  return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
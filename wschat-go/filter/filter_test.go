@@ -0,0 +1,200 @@
+package filter
+
+import (
+  "errors"
+  "reflect"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+func TestApply(t *testing.T) {
+  f, err := New(Config{
+    MaxLength: 10,
+    Normalize: "NFKC",
+    StripControl: true,
+    Rules: []*Rule{
+      {Name: "shout", Pattern: `!{2,}`, Action: "replace", Replacement: "!"},
+      {Pattern: `(?i)\bheck\b`, Action: "replace", Replacement: "h*ck"},
+      {Name: "spam", Pattern: `(?i)buy now`, Action: "reject", Message: "no ads"},
+      {Pattern: `forbidden`, Action: "reject"},
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    contents, want string
+    code, rule string
+  }{
+    {contents: "hi", want: "hi"},
+    {contents: "hi!!!!", want: "hi!"},
+    {contents: "HECK no", want: "h*ck no"},
+    {contents: "checkers", want: "checkers"},
+    // NFKC folds the ligature.
+    {contents: "ﬁne", want: "fine"},
+    {contents: "a‮b\x00c\td", want: "abc\td"},
+    {contents: "bad\xffutf8", want: "bad\ufffdutf8"},
+    {contents: "Buy Now", code: CodeBlocked, rule: "spam"},
+    {contents: "forbidden", code: CodeBlocked, rule: "rule-4"},
+    {contents: "   ", code: CodeEmpty, rule: "allowEmpty"},
+    {contents: "\x01\x02", code: CodeEmpty, rule: "allowEmpty"},
+    {contents: "12345678901", code: CodeTooLong, rule: "maxLength"},
+    // Replacements count toward the length.
+    {contents: "hi!!!!!!!!!!", want: "hi!"},
+  }
+  for _, tt := range tests {
+    got, err := f.Apply(tt.contents)
+    checkResult(t, tt.contents, got, err, tt.want, tt.code, tt.rule)
+  }
+}
+
+func TestApplyLinks(t *testing.T) {
+  tests := []struct {
+    name string
+    links LinkConfig
+    contents string
+    allowed bool
+  }{
+    {"no lists", LinkConfig{}, "see https://anywhere.net/x", true},
+    {"allowed", LinkConfig{Allow: []string{"example.com"}}, "see https://example.com/x", true},
+    {"subdomain", LinkConfig{Allow: []string{"example.com"}}, "see http://docs.Example.com", true},
+    {"not allowed", LinkConfig{Allow: []string{"example.com"}}, "see https://example.net", false},
+    {"suffix isn't a subdomain", LinkConfig{Allow: []string{"example.com"}}, "https://badexample.com", false},
+    {"denied", LinkConfig{Deny: []string{"evil.com"}}, "HTTPS://www.evil.com/x", false},
+    {
+      "denied over allowed",
+      LinkConfig{Allow: []string{"example.com"}, Deny: []string{"bad.example.com"}},
+      "https://bad.example.com", false,
+    },
+    {"one of many", LinkConfig{Deny: []string{"evil.com"}}, "https://ok.com and https://evil.com", false},
+    {"not a link", LinkConfig{Allow: []string{"example.com"}}, "ftp://evil.com evil.com", true},
+  }
+  for _, tt := range tests {
+    f, err := New(Config{Links: tt.links})
+    if err != nil {
+      t.Fatal(err)
+    }
+    got, err := f.Apply(tt.contents)
+    if tt.allowed {
+      checkResult(t, tt.name, got, err, tt.contents, "", "")
+    } else {
+      checkResult(t, tt.name, got, err, "", CodeLinkNotAllowed, "links")
+    }
+  }
+}
+
+// checkResult checks Apply's result is want, or an error with the code and
+// rule if code is set.
+func checkResult(t *testing.T, name, got string, err error, want, code, rule string) {
+  t.Helper()
+  if code == "" {
+    if err != nil || got != want {
+      t.Errorf("%q: got %q, %v, want %q", name, got, err, want)
+    }
+    return
+  }
+  var info *common.ErrorInfo
+  if !errors.As(err, &info) {
+    t.Errorf("%q: got %q, %v, want a %s error", name, got, err, code)
+    return
+  }
+  if info.Code != code || info.Rule != rule {
+    t.Errorf("%q: got code %q, rule %q, want %q, %q", name, info.Code, info.Rule, code, rule)
+  }
+}
+
+func TestNew(t *testing.T) {
+  tests := []struct {
+    name string
+    config Config
+    wantErr string
+  }{
+    {"empty", Config{}, ""},
+    {"normalize lowercase", Config{Normalize: "nfc"}, ""},
+    {"invalid normalize", Config{Normalize: "NFX"}, "invalid normalization form"},
+    {"invalid pattern", Config{Rules: []*Rule{{Pattern: "(", Action: "reject"}}}, `rule "rule-1"`},
+    {"invalid action", Config{Rules: []*Rule{{Name: "r", Pattern: "x", Action: "drop"}}}, "invalid action"},
+  }
+  for _, tt := range tests {
+    _, err := New(tt.config)
+    if tt.wantErr == "" {
+      if err != nil {
+        t.Errorf("%s: %v", tt.name, err)
+      }
+    } else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+      t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+    }
+  }
+}
+
+func TestOnMessage(t *testing.T) {
+  f, err := New(Config{Rules: []*Rule{
+    {Pattern: "darn", Action: "replace", Replacement: "****"},
+    {Name: "nope", Pattern: "nope", Action: "reject"},
+  }})
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    msg common.Message
+    want common.Message
+    rejected bool
+  }{
+    {
+      name: "chat",
+      msg: common.Message{Action: common.ActionChat, Contents: "darn it"},
+      want: common.Message{Action: common.ActionChat, Contents: "**** it"},
+    },
+    {
+      name: "edit",
+      msg: common.Message{Action: common.ActionEdit, Contents: "nope"},
+      rejected: true,
+    },
+    {
+      name: "attachment only",
+      msg: common.Message{Action: common.ActionChat, Attachments: []common.Attachment{{Name: "a"}}},
+      want: common.Message{Action: common.ActionChat, Attachments: []common.Attachment{{Name: "a"}}},
+    },
+    {
+      name: "unchecked action",
+      msg: common.Message{Action: common.ActionReact, Contents: "nope"},
+      want: common.Message{Action: common.ActionReact, Contents: "nope"},
+    },
+    {
+      name: "poll options",
+      msg: common.Message{
+        Action: common.ActionPoll, Contents: "darn?", Poll: &common.Poll{Options: []string{"darn", "ok"}},
+      },
+      want: common.Message{
+        Action: common.ActionPoll, Contents: "****?", Poll: &common.Poll{Options: []string{"****", "ok"}},
+      },
+    },
+    {
+      name: "rejected poll option",
+      msg: common.Message{
+        Action: common.ActionPoll, Contents: "ok?", Poll: &common.Poll{Options: []string{"ok", "nope"}},
+      },
+      rejected: true,
+    },
+  }
+  for _, tt := range tests {
+    err := f.OnMessage(middleware.Conn{}, &tt.msg)
+    if tt.rejected {
+      if err == nil {
+        t.Errorf("%s: not rejected", tt.name)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", tt.name, err)
+      continue
+    }
+    if !reflect.DeepEqual(tt.msg, tt.want) {
+      t.Errorf("%s: got %+v, want %+v", tt.name, tt.msg, tt.want)
+    }
+  }
+}
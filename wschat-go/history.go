@@ -0,0 +1,665 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "io"
+  "log"
+  "os"
+  "sync"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// HistoryEntry is a chat in a room's history.
+type HistoryEntry struct {
+  Msg common.Message
+  // The author's identity, empty if they weren't signed in.
+  Identity string
+  // Previous versions, oldest first.
+  Edits []Edit
+  // map[reaction]map[userKey]bool
+  reactions map[string]map[string]bool
+  // Of polls. map[voterKey]choices
+  votes map[string][]int
+  // The IPs votes were cast from, and by whom. map[IP]voterKey
+  voterIPs map[string]string
+}
+
+// reactionCounts returns the number of users with each reaction.
+func (entry *HistoryEntry) reactionCounts() map[string]int {
+  if len(entry.reactions) == 0 {
+    return nil
+  }
+  counts := make(map[string]int, len(entry.reactions))
+  for reaction, users := range entry.reactions {
+    counts[reaction] = len(users)
+  }
+  return counts
+}
+
+// message returns the chat with its current reaction counts, and if it's a
+// poll, its tallies.
+func (entry *HistoryEntry) message() common.Message {
+  msg := entry.Msg
+  msg.Reactions = entry.reactionCounts()
+  if msg.Poll != nil {
+    msg.Poll = entry.pollTally()
+  }
+  return msg
+}
+
+// Edit is a previous version of a chat.
+type Edit struct {
+  Contents string `json:"contents"`
+  // Who replaced these contents.
+  By string `json:"by"`
+  Timestamp int64 `json:"timestamp"`
+}
+
+type roomHistory struct {
+  // Oldest first.
+  entries []*HistoryEntry
+  byID map[uint64]*HistoryEntry
+  // Counts replies even after they're out of memory.
+  // map[root ID]number of replies
+  threads map[uint64]int
+  index *searchIndex
+  // The max number of entries.
+  limit int
+  // Whether older chats were dropped for the limit, so are only in the
+  // durable log (if there is one).
+  trimmed bool
+}
+
+// logRecord is a line in the durable log.
+type logRecord struct {
+  // "msg", "edit", "delete", "react", "unreact", "read", "vote", "close" or
+  // "seq" (the last ID given out, written at compaction).
+  Op string `json:"op"`
+  // Set for "msg".
+  Msg *common.Message `json:"msg,omitempty"`
+  Identity string `json:"identity,omitempty"`
+  // Set for the rest. For reactions, contents is the reaction and by is the
+  // user's key. For reads and votes, by is the user's key, and for votes,
+  // contents is the IP voted from.
+  Room string `json:"room,omitempty"`
+  ID uint64 `json:"id,omitempty"`
+  Contents string `json:"contents,omitempty"`
+  By string `json:"by,omitempty"`
+  Timestamp int64 `json:"timestamp,omitempty"`
+  // Set for "vote".
+  Choices []int `json:"choices,omitempty"`
+}
+
+var (
+  // The max number of chats kept in memory per room.
+  historySize = 1000
+  // The number of chats replayed to clients on connect.
+  replaySize int
+
+  historyMtx sync.RWMutex
+  // map[room]*roomHistory
+  histories = make(map[string]*roomHistory)
+  lastID uint64
+  // The durable log, nil if there isn't one. Guarded by historyMtx, since
+  // compaction reopens it.
+  historyLog *os.File
+  // The path of the durable log, empty if there isn't one. Set on startup,
+  // so it can be read without historyMtx.
+  historyLogPath string
+
+  errMsgNotFound = &common.ErrorInfo{Code: "not_found", Message: "message not found"}
+  errNotAuthor = &common.ErrorInfo{
+    Code: "forbidden", Message: "only the author or a moderator can do that",
+  }
+)
+
+// isRecorded reports whether messages with the action are kept in history.
+func isRecorded(action common.Action) bool {
+  return action == common.ActionChat || action == common.ActionEmote ||
+    action == common.ActionPoll
+}
+
+func roomHistoryLocked(room string) *roomHistory {
+  rh, ok := histories[room]
+  if !ok {
+    rh = &roomHistory{
+      byID: make(map[uint64]*HistoryEntry),
+      threads: make(map[uint64]int),
+      index: newSearchIndex(),
+      limit: historyLimit(room),
+    }
+    histories[room] = rh
+  }
+  return rh
+}
+
+func (rh *roomHistory) add(entry *HistoryEntry) {
+  rh.entries = append(rh.entries, entry)
+  rh.byID[entry.Msg.ID] = entry
+  rh.index.add(entry.Msg.ID, entry.Msg.Contents)
+  if over := len(rh.entries) - rh.limit; over > 0 {
+    rh.trimmed = true
+    for _, old := range rh.entries[:over] {
+      delete(rh.byID, old.Msg.ID)
+      rh.index.remove(old.Msg.ID, old.Msg.Contents)
+    }
+    rh.entries = append(rh.entries[:0:0], rh.entries[over:]...)
+  }
+}
+
+func (rh *roomHistory) remove(id uint64) {
+  entry, ok := rh.byID[id]
+  if !ok {
+    return
+  }
+  delete(rh.byID, id)
+  rh.index.remove(id, entry.Msg.Contents)
+  if thread := entry.Msg.Thread; thread != nil {
+    if rh.threads[thread.Root]--; rh.threads[thread.Root] <= 0 {
+      delete(rh.threads, thread.Root)
+    }
+  }
+  for i, entry := range rh.entries {
+    if entry.Msg.ID == id {
+      rh.entries = append(rh.entries[:i:i], rh.entries[i+1:]...)
+      break
+    }
+  }
+}
+
+// openHistoryLog rebuilds history from the log at the path, then opens it for
+// appending.
+func openHistoryLog(path string) error {
+  f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+  if err != nil {
+    return err
+  }
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  if err := readLog(f, replayRecordLocked); err != nil {
+    f.Close()
+    return err
+  }
+  historyLog, historyLogPath = f, path
+  return nil
+}
+
+// compactHistoryLog compacts the durable log in place.
+func compactHistoryLog() error {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  path := historyLog.Name()
+  historyLog.Close()
+  err := compactLog(path)
+  f, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+  if openErr != nil {
+    // Nothing more can be logged.
+    log.Printf("error reopening history log: %v", openErr)
+    historyLog = nil
+  } else {
+    historyLog = f
+  }
+  return err
+}
+
+// compactLog rewrites the log at the path without the records of chats that
+// were deleted, have expired or are outside their room's retention policy,
+// or of read markers that have since moved.
+func compactLog(path string) error {
+  f, err := os.Open(path)
+  if os.IsNotExist(err) {
+    return nil
+  } else if err != nil {
+    return err
+  }
+  defer f.Close()
+  now := time.Now()
+  kept := make(map[uint64]bool)
+  // map[room]IDs, oldest first
+  roomIDs := make(map[string][]uint64)
+  // map[room and user key]index of the last read record
+  lastReads := make(map[string]int)
+  readKey := func(rec *logRecord) string { return rec.Room + "\x00" + rec.By }
+  // So IDs aren't reused if the last chats are dropped.
+  var maxID uint64
+  i := 0
+  err = readLog(f, func(rec *logRecord) {
+    switch rec.Op {
+    case "msg":
+      if rec.Msg != nil && rec.Msg.ID > maxID {
+        maxID = rec.Msg.ID
+      }
+      if rec.Msg != nil && isRetained(rec.Msg, now) {
+        kept[rec.Msg.ID] = true
+        roomIDs[rec.Msg.Room] = append(roomIDs[rec.Msg.Room], rec.Msg.ID)
+      }
+    case "delete":
+      delete(kept, rec.ID)
+    case "read":
+      lastReads[readKey(rec)] = i
+    }
+    i++
+  })
+  if err != nil {
+    return err
+  }
+  for room, ids := range roomIDs {
+    policy := retentionPolicy(room)
+    if policy == nil || policy.MaxMessages == 0 {
+      continue
+    }
+    var live []uint64
+    for _, id := range ids {
+      if kept[id] {
+        live = append(live, id)
+      }
+    }
+    if over := len(live) - policy.MaxMessages; over > 0 {
+      for _, id := range live[:over] {
+        delete(kept, id)
+      }
+    }
+  }
+
+  if _, err := f.Seek(0, io.SeekStart); err != nil {
+    return err
+  }
+  tmpPath := path + ".tmp"
+  tmp, err := os.Create(tmpPath)
+  if err != nil {
+    return err
+  }
+  w := bufio.NewWriter(tmp)
+  i, dropped := 0, 0
+  err = readLog(f, func(rec *logRecord) {
+    var keep bool
+    switch rec.Op {
+    case "msg":
+      keep = rec.Msg != nil && kept[rec.Msg.ID]
+    case "delete":
+      // Deleted chats are dropped.
+    case "read":
+      keep = lastReads[readKey(rec)] == i
+    default:
+      keep = kept[rec.ID]
+    }
+    i++
+    if !keep {
+      dropped++
+      return
+    }
+    if b, err := json.Marshal(rec); err == nil {
+      w.Write(append(b, '\n'))
+    }
+  })
+  if err == nil && maxID != 0 {
+    b, _ := json.Marshal(&logRecord{Op: "seq", ID: maxID})
+    w.Write(append(b, '\n'))
+  }
+  if err == nil {
+    err = w.Flush()
+  }
+  if err == nil {
+    err = tmp.Sync()
+  }
+  if closeErr := tmp.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    os.Remove(tmpPath)
+    return err
+  }
+  if err := os.Rename(tmpPath, path); err != nil {
+    return err
+  }
+  log.Printf("compacted history log: dropped %d of %d records", dropped, i)
+  return nil
+}
+
+// readLog calls fn with each record in the log, skipping bad lines.
+func readLog(r io.Reader, fn func(rec *logRecord)) error {
+  reader := bufio.NewReader(r)
+  for lineNum := 1; ; lineNum++ {
+    line, err := reader.ReadBytes('\n')
+    if err != nil && err != io.EOF {
+      return err
+    }
+    if len(line) != 0 {
+      var rec logRecord
+      if err := json.Unmarshal(line, &rec); err != nil {
+        // Likely a partial write from a crash.
+        log.Printf("skipping bad history log line %d: %v", lineNum, err)
+      } else {
+        fn(&rec)
+      }
+    }
+    if err == io.EOF {
+      return nil
+    }
+  }
+}
+
+// loggedEntries rebuilds the chats in the room matching the predicate from the
+// durable log, oldest first, with later edits, deletes, reactions and votes
+// applied.
+// It returns nil if there's no log.
+func loggedEntries(room string, match func(msg *common.Message) bool) ([]*HistoryEntry, error) {
+  if historyLogPath == "" {
+    return nil, nil
+  }
+  // A separate file so reading doesn't block (or move) appends.
+  f, err := os.Open(historyLogPath)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var entries []*HistoryEntry
+  byID := make(map[uint64]*HistoryEntry)
+  now := time.Now()
+  err = readLog(f, func(rec *logRecord) {
+    if rec.Op == "msg" {
+      if rec.Msg != nil && rec.Msg.Room == room && isRetained(rec.Msg, now) && match(rec.Msg) {
+        entry := &HistoryEntry{Msg: *rec.Msg, Identity: rec.Identity}
+        entries = append(entries, entry)
+        byID[rec.Msg.ID] = entry
+      }
+      return
+    }
+    entry, ok := byID[rec.ID]
+    if !ok || rec.Room != room {
+      return
+    }
+    switch rec.Op {
+    case "edit":
+      applyEditLocked(entry, rec.Contents, rec.By, rec.Timestamp)
+    case "delete":
+      delete(byID, rec.ID)
+    case "react", "unreact":
+      applyReactionLocked(entry, rec.Contents, rec.By, rec.Op == "react")
+    case "vote":
+      applyVoteLocked(entry, rec.By, rec.Contents, rec.Choices)
+    case "close":
+      closePollLocked(entry)
+    }
+  })
+  if err != nil {
+    return nil, err
+  }
+  // Drop deleted chats.
+  live := entries[:0]
+  for _, entry := range entries {
+    if byID[entry.Msg.ID] == entry {
+      live = append(live, entry)
+    }
+  }
+  return live, nil
+}
+
+func replayRecordLocked(rec *logRecord) {
+  switch rec.Op {
+  case "msg":
+    if rec.Msg == nil {
+      return
+    }
+    if rec.Msg.ID > lastID {
+      lastID = rec.Msg.ID
+    }
+    if !isRetained(rec.Msg, time.Now()) {
+      return
+    }
+    rh := roomHistoryLocked(rec.Msg.Room)
+    if rec.Msg.Thread != nil {
+      rh.threads[rec.Msg.Thread.Root]++
+    }
+    rh.add(&HistoryEntry{
+      Msg: *rec.Msg,
+      Identity: rec.Identity,
+    })
+    scheduleExpiryLocked(rec.Msg)
+    schedulePollCloseLocked(rec.Msg)
+  case "edit":
+    rh := roomHistoryLocked(rec.Room)
+    if entry, ok := rh.byID[rec.ID]; ok {
+      rh.edit(entry, rec.Contents, rec.By, rec.Timestamp)
+    }
+  case "delete":
+    roomHistoryLocked(rec.Room).remove(rec.ID)
+  case "react", "unreact":
+    if entry, ok := roomHistoryLocked(rec.Room).byID[rec.ID]; ok {
+      applyReactionLocked(entry, rec.Contents, rec.By, rec.Op == "react")
+    }
+  case "vote":
+    if entry, ok := roomHistoryLocked(rec.Room).byID[rec.ID]; ok {
+      applyVoteLocked(entry, rec.By, rec.Contents, rec.Choices)
+    }
+  case "close":
+    if entry, ok := roomHistoryLocked(rec.Room).byID[rec.ID]; ok {
+      closePollLocked(entry)
+    }
+  case "read":
+    advanceReadMarkerLocked(rec.Room, rec.By, rec.ID)
+  case "seq":
+    if rec.ID > lastID {
+      lastID = rec.ID
+    }
+  }
+}
+
+// historySnapshot returns up to the last n chats in the room, oldest first,
+// leaving out those by ignored users.
+func historySnapshot(room string, n int, ignored map[string]bool) []common.Message {
+  historyMtx.RLock()
+  defer historyMtx.RUnlock()
+  rh, ok := histories[room]
+  if !ok || n <= 0 {
+    return nil
+  }
+  entries := rh.entries
+  if len(entries) > n {
+    entries = entries[len(entries)-n:]
+  }
+  msgs := make([]common.Message, 0, len(entries))
+  now := time.Now()
+  for _, entry := range entries {
+    // Those just expired may not have been removed yet.
+    if !isRetained(&entry.Msg, now) || entry.ignoredBy(ignored) {
+      continue
+    }
+    msg := entry.message()
+    msg.Thread = rh.threadInfo(&entry.Msg)
+    msgs = append(msgs, msg)
+  }
+  return msgs
+}
+
+// historyEntries returns copies of the room's history entries, oldest first.
+func historyEntries(room string) []*HistoryEntry {
+  historyMtx.RLock()
+  defer historyMtx.RUnlock()
+  rh, ok := histories[room]
+  if !ok {
+    return nil
+  }
+  entries := make([]*HistoryEntry, len(rh.entries))
+  for i, entry := range rh.entries {
+    entries[i] = &HistoryEntry{Msg: entry.Msg, Identity: entry.Identity}
+  }
+  return entries
+}
+
+// threadInfo returns the current state of the chat's thread, or nil if it
+// isn't in one.
+func (rh *roomHistory) threadInfo(msg *common.Message) *common.ThreadInfo {
+  root := msg.ID
+  if msg.Thread != nil {
+    root = msg.Thread.Root
+  }
+  replies, ok := rh.threads[root]
+  if !ok {
+    return nil
+  }
+  return &common.ThreadInfo{Root: root, Replies: replies}
+}
+
+// appendLogLocked writes the record to the durable log, if there is one.
+func appendLogLocked(rec *logRecord) {
+  if historyLog == nil {
+    return
+  }
+  b, err := json.Marshal(rec)
+  if err != nil {
+    log.Printf("error marshaling history log record: %v", err)
+    return
+  }
+  if _, err := historyLog.Write(append(b, '\n')); err != nil {
+    log.Printf("error writing history log: %v", err)
+  }
+}
+
+// recordMsg assigns the message an ID and adds it to its room's history,
+// counting it in its thread if it's a reply.
+func recordMsg(msg *common.Message, identity string) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  lastID++
+  msg.ID = lastID
+  rh := roomHistoryLocked(msg.Room)
+  if msg.Thread != nil {
+    rh.threads[msg.Thread.Root]++
+    msg.Thread.Replies = rh.threads[msg.Thread.Root]
+  }
+  rh.add(&HistoryEntry{Msg: *msg, Identity: identity})
+  scheduleExpiryLocked(msg)
+  schedulePollCloseLocked(msg)
+  appendLogLocked(&logRecord{Op: "msg", Msg: msg, Identity: identity})
+}
+
+func applyEditLocked(entry *HistoryEntry, contents, by string, timestamp int64) {
+  entry.Edits = append(entry.Edits, Edit{
+    Contents: entry.Msg.Contents,
+    By: by,
+    Timestamp: timestamp,
+  })
+  entry.Msg.Contents, entry.Msg.Edited = contents, timestamp
+}
+
+// edit applies the edit to the entry, reindexing it.
+func (rh *roomHistory) edit(entry *HistoryEntry, contents, by string, timestamp int64) {
+  rh.index.remove(entry.Msg.ID, entry.Msg.Contents)
+  applyEditLocked(entry, contents, by, timestamp)
+  rh.index.add(entry.Msg.ID, entry.Msg.Contents)
+}
+
+// canChange reports whether the client may edit or delete the entry.
+func canChange(client *Client, entry *HistoryEntry) bool {
+  if client.role.AtLeast(RoleModerator) || entry.Msg.Sender == client.id {
+    return true
+  }
+  return client.identity != "" && entry.Identity == client.identity
+}
+
+// editMsg changes the contents of a chat, returning the edit to broadcast.
+func editMsg(client *Client, room string, id uint64, contents string) (common.Message, error) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  rh := roomHistoryLocked(room)
+  entry, ok := rh.byID[id]
+  if !ok {
+    return common.Message{}, errMsgNotFound
+  }
+  if !canChange(client, entry) {
+    return common.Message{}, errNotAuthor
+  }
+  // Votes were cast on the question as it was.
+  if entry.Msg.Poll != nil {
+    return common.Message{}, errPollNotEditable
+  }
+  now := time.Now().UnixNano()
+  rh.edit(entry, contents, client.id, now)
+  appendLogLocked(&logRecord{
+    Op: "edit", Room: room, ID: id, Contents: contents, By: client.id, Timestamp: now,
+  })
+  return common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: common.ActionEdit,
+    Contents: contents,
+    Timestamp: now,
+    Room: room,
+    Name: client.Name(),
+    Edited: now,
+  }, nil
+}
+
+// deleteMsg removes a chat, returning the delete to broadcast.
+func deleteMsg(client *Client, room string, id uint64) (common.Message, error) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  rh := roomHistoryLocked(room)
+  entry, ok := rh.byID[id]
+  if !ok {
+    return common.Message{}, errMsgNotFound
+  }
+  if !canChange(client, entry) {
+    return common.Message{}, errNotAuthor
+  }
+  rh.remove(id)
+  now := time.Now().UnixNano()
+  appendLogLocked(&logRecord{
+    Op: "delete", Room: room, ID: id, By: client.id, Timestamp: now,
+  })
+  return common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: common.ActionDelete,
+    Timestamp: now,
+    Room: room,
+    Name: client.Name(),
+  }, nil
+}
+
+// receiveEdit handles an edit sent by a client.
+func receiveEdit(client *Client, room string, in common.Message) {
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: common.ActionEdit,
+    Contents: in.Contents,
+    Room: room,
+    Name: client.Name(),
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  edit, err := editMsg(client, room, msg.ID, msg.Contents)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastMsg(edit)
+}
+
+// receiveDelete handles a delete sent by a client.
+func receiveDelete(client *Client, room string, in common.Message) {
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: common.ActionDelete,
+    Room: room,
+    Name: client.Name(),
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  del, err := deleteMsg(client, room, msg.ID)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastMsg(del)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// useTestHistory starts the test with no history or read markers, logged to
+// a temp file, and restores them when it ends. It returns the log's path.
+func useTestHistory(t *testing.T) string {
+  historyMtx.Lock()
+  oldHistories, oldLastID := histories, lastID
+  oldLog, oldLogPath := historyLog, historyLogPath
+  histories, lastID, historyLog, historyLogPath = make(map[string]*roomHistory), 0, nil, ""
+  historyMtx.Unlock()
+  readMtx.Lock()
+  oldMarkers := readMarkers
+  readMarkers = make(map[string]map[string]*readMarker)
+  readMtx.Unlock()
+  path := filepath.Join(t.TempDir(), "history.jsonl")
+  if err := openHistoryLog(path); err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    historyMtx.Lock()
+    if historyLog != nil {
+      historyLog.Close()
+    }
+    histories, lastID = oldHistories, oldLastID
+    historyLog, historyLogPath = oldLog, oldLogPath
+    historyMtx.Unlock()
+    readMtx.Lock()
+    readMarkers = oldMarkers
+    readMtx.Unlock()
+  })
+  return path
+}
+
+// reloadTestHistory forgets the history and read markers in memory, and
+// rebuilds them from the log, as on startup.
+func reloadTestHistory(t *testing.T) {
+  historyMtx.Lock()
+  historyLog.Close()
+  path := historyLogPath
+  histories, lastID, historyLog, historyLogPath = make(map[string]*roomHistory), 0, nil, ""
+  historyMtx.Unlock()
+  readMtx.Lock()
+  readMarkers = make(map[string]map[string]*readMarker)
+  readMtx.Unlock()
+  if err := openHistoryLog(path); err != nil {
+    t.Fatal(err)
+  }
+}
+
+// recordTestChat records a chat by the client in the room, returning its ID.
+func recordTestChat(client *Client, room, contents string) uint64 {
+  msg := common.NewChatMessage(client.id, contents)
+  msg.Room, msg.Name = room, client.Name()
+  recordMsg(&msg, client.identity)
+  return msg.ID
+}
+
+// readLogOps returns the ops of the records in the log, in order.
+func readLogOps(t *testing.T, path string) []string {
+  t.Helper()
+  f, err := os.Open(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer f.Close()
+  var ops []string
+  scanner := bufio.NewScanner(f)
+  for scanner.Scan() {
+    var rec logRecord
+    if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+      t.Fatalf("invalid log line %q: %v", scanner.Text(), err)
+    }
+    ops = append(ops, rec.Op)
+  }
+  return ops
+}
+
+// roomContents returns the contents of the chats in the room's history.
+func roomContents(room string) []string {
+  var contents []string
+  for _, entry := range historyEntries(room) {
+    contents = append(contents, entry.Msg.Contents)
+  }
+  return contents
+}
+
+func TestCanChange(t *testing.T) {
+  client := func(id, identity string, role Role) *Client {
+    c := NewClient(id, "", 0)
+    c.identity, c.role = identity, role
+    return c
+  }
+  anonEntry := &HistoryEntry{Msg: common.Message{Sender: "conn-1"}}
+  aliceEntry := &HistoryEntry{Msg: common.Message{Sender: "conn-2"}, Identity: "alice"}
+  tests := []struct {
+    name string
+    client *Client
+    entry *HistoryEntry
+    want bool
+  }{
+    {"anonymous author", client("conn-1", "", RoleUser), anonEntry, true},
+    // No identity doesn't match no identity.
+    {"anonymous other", client("conn-3", "", RoleUser), anonEntry, false},
+    {"signed-in other of anonymous chat", client("conn-3", "bob", RoleUser), anonEntry, false},
+    {"author's connection", client("conn-2", "alice", RoleUser), aliceEntry, true},
+    {"author on another connection", client("conn-4", "alice", RoleUser), aliceEntry, true},
+    {"other identity", client("conn-4", "bob", RoleUser), aliceEntry, false},
+    {"anonymous other of signed-in chat", client("conn-4", "", RoleUser), aliceEntry, false},
+    {"moderator", client("conn-5", "mod", RoleModerator), aliceEntry, true},
+    {"admin", client("conn-6", "admin", RoleAdmin), anonEntry, true},
+  }
+  for _, tt := range tests {
+    if got := canChange(tt.client, tt.entry); got != tt.want {
+      t.Errorf("%s: canChange = %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestEditDelete(t *testing.T) {
+  useTestHistory(t)
+  alice := NewClient("edit-alice", "", 0)
+  alice.identity = "alice"
+  aliceAgain := NewClient("edit-alice-2", "", 0)
+  aliceAgain.identity = "alice"
+  anon := NewClient("edit-anon", "", 0)
+  mod := NewClient("edit-mod", "", 0)
+  mod.identity, mod.role = "mod", RoleModerator
+
+  first := recordTestChat(alice, "edits", "first")
+  second := recordTestChat(anon, "edits", "second")
+  third := recordTestChat(anon, "edits", "third")
+  poll := common.Message{
+    Sender: alice.id, Action: common.ActionPoll, Contents: "q?", Room: "edits",
+    Poll: &common.Poll{Options: []string{"a", "b"}},
+  }
+  recordMsg(&poll, alice.identity)
+
+  tests := []struct {
+    name string
+    client *Client
+    del bool
+    id uint64
+    contents string
+    wantErr error
+  }{
+    {name: "edit own", client: alice, id: first, contents: "first!"},
+    {name: "edit own from another connection", client: aliceAgain, id: first, contents: "first!!"},
+    {name: "edit other's", client: alice, id: second, contents: "x", wantErr: errNotAuthor},
+    {name: "edit as moderator", client: mod, id: second, contents: "[removed]"},
+    {name: "edit missing", client: alice, id: 999, contents: "x", wantErr: errMsgNotFound},
+    {name: "edit in another room", client: alice, id: first, contents: "x", wantErr: errMsgNotFound},
+    {name: "edit poll", client: alice, id: poll.ID, contents: "q2?", wantErr: errPollNotEditable},
+    {name: "delete other's", client: alice, del: true, id: third, wantErr: errNotAuthor},
+    {name: "delete own", client: anon, del: true, id: third},
+    {name: "delete deleted", client: anon, del: true, id: third, wantErr: errMsgNotFound},
+    {name: "delete as moderator", client: mod, del: true, id: poll.ID},
+  }
+  for _, tt := range tests {
+    room := "edits"
+    if tt.name == "edit in another room" {
+      room = "other"
+    }
+    var msg common.Message
+    var err error
+    if tt.del {
+      msg, err = deleteMsg(tt.client, room, tt.id)
+    } else {
+      msg, err = editMsg(tt.client, room, tt.id, tt.contents)
+    }
+    if err != tt.wantErr {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+      continue
+    }
+    if err == nil && (msg.ID != tt.id || msg.Sender != tt.client.id || msg.Room != room) {
+      t.Errorf("%s: sent %+v", tt.name, msg)
+    }
+  }
+
+  want := []string{"first!!", "[removed]"}
+  if got := roomContents("edits"); !reflect.DeepEqual(got, want) {
+    t.Errorf("history = %q, want %q", got, want)
+  }
+  wantEdits := []Edit{{Contents: "first", By: alice.id}, {Contents: "first!", By: aliceAgain.id}}
+  checkEdits := func(entry *HistoryEntry) {
+    t.Helper()
+    edits := append([]Edit(nil), entry.Edits...)
+    for i := range edits {
+      edits[i].Timestamp = 0
+    }
+    if !reflect.DeepEqual(edits, wantEdits) {
+      t.Errorf("edits = %+v, want %+v", edits, wantEdits)
+    }
+  }
+  historyMtx.RLock()
+  checkEdits(histories["edits"].byID[first])
+  historyMtx.RUnlock()
+
+  // The log rebuilds the same history.
+  entries, err := loggedEntries("edits", func(*common.Message) bool { return true })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(entries) != 2 || entries[0].Msg.Contents != "first!!" || entries[1].Msg.Contents != "[removed]" {
+    t.Errorf("logged entries = %+v", entries)
+  } else {
+    checkEdits(entries[0])
+  }
+  reloadTestHistory(t)
+  if got := roomContents("edits"); !reflect.DeepEqual(got, want) {
+    t.Errorf("replayed history = %q, want %q", got, want)
+  }
+  if lastID != poll.ID {
+    t.Errorf("replayed lastID = %d, want %d", lastID, poll.ID)
+  }
+}
+
+func TestCompactHistoryLog(t *testing.T) {
+  path := useTestHistory(t)
+  alice := NewClient("compact-alice", "", 0)
+  kept := recordTestChat(alice, "compact", "kept")
+  gone := recordTestChat(alice, "compact", "gone")
+  if _, err := editMsg(alice, "compact", kept, "kept, edited"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := editMsg(alice, "compact", gone, "gone, edited"); err != nil {
+    t.Fatal(err)
+  }
+  historyMtx.Lock()
+  for _, id := range []uint64{kept, gone} {
+    advanceReadMarkerLocked("compact", "identity:alice", id)
+    appendLogLocked(&logRecord{Op: "read", Room: "compact", ID: id, By: "identity:alice"})
+  }
+  historyMtx.Unlock()
+  // The last chat is deleted, so only the seq record keeps its ID.
+  last := recordTestChat(alice, "compact", "last")
+  for _, id := range []uint64{gone, last} {
+    if _, err := deleteMsg(alice, "compact", id); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  wantOps := []string{"msg", "msg", "edit", "edit", "read", "read", "msg", "delete", "delete"}
+  if ops := readLogOps(t, path); !reflect.DeepEqual(ops, wantOps) {
+    t.Fatalf("log ops = %q, want %q", ops, wantOps)
+  }
+  if err := compactHistoryLog(); err != nil {
+    t.Fatal(err)
+  }
+  // Only the kept chat, its edit and the last read are left.
+  wantOps = []string{"msg", "edit", "read", "seq"}
+  if ops := readLogOps(t, path); !reflect.DeepEqual(ops, wantOps) {
+    t.Errorf("compacted log ops = %q, want %q", ops, wantOps)
+  }
+
+  // Still appended to after compacting.
+  after := recordTestChat(alice, "compact", "after")
+  reloadTestHistory(t)
+  if got, want := roomContents("compact"), []string{"kept, edited", "after"}; !reflect.DeepEqual(got, want) {
+    t.Errorf("replayed history = %q, want %q", got, want)
+  }
+  if after != last+1 || lastID != after {
+    t.Errorf("IDs after compaction: %d, lastID %d, want %d", after, lastID, last+1)
+  }
+  readMtx.Lock()
+  marker := readMarkers["compact"]["identity:alice"]
+  readMtx.Unlock()
+  if marker == nil || marker.id != gone {
+    t.Errorf("replayed read marker = %+v, want %d", marker, gone)
+  }
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+
+  "wschat/wschat-go/common"
+)
+
+// The max number of users someone can ignore.
+const maxIgnores = 500
+
+var (
+  // Where ignore lists are persisted to. They're only kept in memory if empty.
+  ignoresPath string
+  ignoresMtx sync.RWMutex
+  // The users signed-in users ignore.
+  // map[identity (lowercase)]map[userKey]display name
+  ignores = make(map[string]map[string]string)
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "ignore",
+    Usage: "/ignore <user>",
+    Help: "Stop receiving a user's chats (you must be signed in)",
+    Run: cmdIgnore,
+  })
+  RegisterCommand(&Command{
+    Name: "unignore",
+    Usage: "/unignore <user>",
+    Help: "Receive a user's chats again",
+    Run: cmdUnignore,
+  })
+  RegisterCommand(&Command{
+    Name: "ignored",
+    Usage: "/ignored",
+    Help: "List the users you ignore",
+    Run: cmdIgnored,
+  })
+}
+
+// loadIgnores reads the ignores file, if there is one.
+func loadIgnores() error {
+  if ignoresPath == "" {
+    return nil
+  }
+  f, err := os.Open(ignoresPath)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  defer f.Close()
+  loaded := make(map[string]map[string]string)
+  if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+    return err
+  }
+  ignoresMtx.Lock()
+  ignores = loaded
+  ignoresMtx.Unlock()
+  return nil
+}
+
+// saveIgnores writes the ignore lists to the ignores file. ignoresMtx must be
+// held.
+func saveIgnores() error {
+  if ignoresPath == "" {
+    return nil
+  }
+  b, err := json.MarshalIndent(ignores, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := ignoresPath + ".tmp"
+  if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, ignoresPath)
+}
+
+// isIgnoredAction reports whether messages with the action are withheld from
+// those ignoring the sender.
+func isIgnoredAction(action common.Action) bool {
+  switch action {
+  case common.ActionChat, common.ActionEmote, common.ActionPoll, common.ActionEdit,
+    common.ActionReact, common.ActionUnreact:
+    return true
+  }
+  return false
+}
+
+// senderKey returns the user key of who sent the message, if it's withheld
+// from those ignoring them. The client is the sender if known.
+func senderKey(client *Client, msg *common.Message) string {
+  if !isIgnoredAction(msg.Action) || msg.Sender == "system" {
+    return ""
+  }
+  if client == nil {
+    iClient, ok := clients.Load(msg.Sender)
+    if !ok {
+      return userKey(msg.Sender, "")
+    }
+    client = iClient.(*Client)
+  }
+  return userKey(client.id, client.identity)
+}
+
+// isIgnoring reports whether the client ignores the user with the key.
+func isIgnoring(client *Client, key string) bool {
+  if key == "" || client.identity == "" {
+    return false
+  }
+  ignoresMtx.RLock()
+  defer ignoresMtx.RUnlock()
+  _, ok := ignores[strings.ToLower(client.identity)][key]
+  return ok
+}
+
+// ignoredKeys returns a copy of the user keys the client ignores, nil if
+// none, for filtering many messages with.
+func ignoredKeys(client *Client) map[string]bool {
+  if client == nil || client.identity == "" {
+    return nil
+  }
+  ignoresMtx.RLock()
+  defer ignoresMtx.RUnlock()
+  ignored := ignores[strings.ToLower(client.identity)]
+  if len(ignored) == 0 {
+    return nil
+  }
+  keys := make(map[string]bool, len(ignored))
+  for key := range ignored {
+    keys[key] = true
+  }
+  return keys
+}
+
+// ignoredBy reports whether the entry's chat is withheld from those ignoring
+// the user keys.
+func (entry *HistoryEntry) ignoredBy(ignored map[string]bool) bool {
+  if len(ignored) == 0 || !isIgnoredAction(entry.Msg.Action) || entry.Msg.Sender == "system" {
+    return false
+  }
+  return ignored[userKey(entry.Msg.Sender, entry.Identity)]
+}
+
+// findIgnoreTarget returns the user key and name of the user, who's an
+// account (connected or not) or a connected user.
+func findIgnoreTarget(target string) (string, string, error) {
+  for identity := range accounts {
+    if strings.EqualFold(identity, target) {
+      return userKey("", identity), identity, nil
+    }
+  }
+  found := findClients(target)
+  if len(found) == 0 {
+    return "", "", fmt.Errorf("no such user: %s", target)
+  }
+  return userKey(found[0].id, found[0].identity), found[0].DisplayName(), nil
+}
+
+func cmdIgnore(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    return errors.New("usage: /ignore <user>")
+  }
+  if ctx.Client.identity == "" {
+    return errNotSignedIn
+  }
+  key, name, err := findIgnoreTarget(ctx.Args)
+  if err != nil {
+    return err
+  }
+  if key == userKey(ctx.Client.id, ctx.Client.identity) {
+    return errors.New("you can't ignore yourself")
+  }
+  identity := strings.ToLower(ctx.Client.identity)
+  ignoresMtx.Lock()
+  defer ignoresMtx.Unlock()
+  ignored := ignores[identity]
+  if len(ignored) >= maxIgnores {
+    return fmt.Errorf("you can ignore at most %d users", maxIgnores)
+  }
+  if ignored == nil {
+    ignored = make(map[string]string)
+    ignores[identity] = ignored
+  }
+  ignored[key] = name
+  if err := saveIgnores(); err != nil {
+    log.Printf("error saving ignores: %v", err)
+  }
+  ctx.Reply("Ignoring " + name)
+  return nil
+}
+
+func cmdUnignore(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    return errors.New("usage: /unignore <user>")
+  }
+  identity := strings.ToLower(ctx.Client.identity)
+  ignoresMtx.Lock()
+  defer ignoresMtx.Unlock()
+  for key, name := range ignores[identity] {
+    if strings.EqualFold(name, ctx.Args) || key == ctx.Args {
+      delete(ignores[identity], key)
+      if len(ignores[identity]) == 0 {
+        delete(ignores, identity)
+      }
+      if err := saveIgnores(); err != nil {
+        log.Printf("error saving ignores: %v", err)
+      }
+      ctx.Reply("No longer ignoring " + name)
+      return nil
+    }
+  }
+  return fmt.Errorf("you aren't ignoring %s", ctx.Args)
+}
+
+func cmdIgnored(ctx *CommandContext) error {
+  ignoresMtx.RLock()
+  var names []string
+  for _, name := range ignores[strings.ToLower(ctx.Client.identity)] {
+    names = append(names, name)
+  }
+  ignoresMtx.RUnlock()
+  if len(names) == 0 {
+    ctx.Reply("You aren't ignoring anyone")
+    return nil
+  }
+  sort.Strings(names)
+  ctx.Reply("Ignoring: " + strings.Join(names, ", "))
+  return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// useTestIgnores starts the test with no ignore lists, persisted to a temp
+// file, and restores them when it ends.
+func useTestIgnores(t *testing.T) {
+  ignoresMtx.Lock()
+  oldIgnores, oldPath := ignores, ignoresPath
+  ignores, ignoresPath = make(map[string]map[string]string), filepath.Join(t.TempDir(), "ignores.json")
+  ignoresMtx.Unlock()
+  t.Cleanup(func() {
+    ignoresMtx.Lock()
+    ignores, ignoresPath = oldIgnores, oldPath
+    ignoresMtx.Unlock()
+  })
+}
+
+func TestSenderKey(t *testing.T) {
+  alice := newTestClient(t, "sender-alice", "alice")
+  anon := newTestClient(t, "sender-anon", "")
+  tests := []struct {
+    name string
+    client *Client
+    msg common.Message
+    want string
+  }{
+    {"signed in", alice, common.Message{Sender: alice.id, Action: common.ActionChat}, "identity:alice"},
+    {"looked up", nil, common.Message{Sender: alice.id, Action: common.ActionEmote}, "identity:alice"},
+    {"anonymous", nil, common.Message{Sender: anon.id, Action: common.ActionPoll}, "id:" + anon.id},
+    {"disconnected", nil, common.Message{Sender: "gone", Action: common.ActionEdit}, "id:gone"},
+    {"reaction", alice, common.Message{Sender: alice.id, Action: common.ActionUnreact}, "identity:alice"},
+    {"system", nil, common.Message{Sender: "system", Action: common.ActionChat}, ""},
+    // Everyone sees these.
+    {"nick", alice, common.Message{Sender: alice.id, Action: common.ActionNick}, ""},
+    {"delete", alice, common.Message{Sender: alice.id, Action: common.ActionDelete}, ""},
+    {"vote", alice, common.Message{Sender: alice.id, Action: common.ActionVote}, ""},
+  }
+  for _, tt := range tests {
+    if got := senderKey(tt.client, &tt.msg); got != tt.want {
+      t.Errorf("%s: senderKey = %q, want %q", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestIgnoreCommands(t *testing.T) {
+  useTestIgnores(t)
+  setTestAccounts(t, map[string]*Account{
+    "alice": {Token: "a", Role: RoleUser},
+    "bob": {Token: "b", Role: RoleUser},
+    "offline": {Token: "o", Role: RoleUser},
+  })
+  alice := newTestClient(t, "ignore-alice", "alice", "ignoring")
+  bob := newTestClient(t, "ignore-bob", "bob", "ignoring")
+  anon := newTestClient(t, "ignore-anon", "", "ignoring")
+  anon.SetName("lurker")
+
+  tests := []struct {
+    client *Client
+    command string
+    wantInfo, wantErr string
+  }{
+    {client: alice, command: "/ignored", wantInfo: "You aren't ignoring anyone"},
+    {client: alice, command: "/ignore", wantErr: "usage"},
+    {client: anon, command: "/ignore bob", wantErr: errNotSignedIn.Error()},
+    {client: alice, command: "/ignore nobody", wantErr: "no such user"},
+    {client: alice, command: "/ignore ALICE", wantErr: "yourself"},
+    {client: alice, command: "/ignore lurker", wantInfo: "Ignoring lurker"},
+    // Accounts can be ignored while they're offline.
+    {client: alice, command: "/ignore Offline", wantInfo: "Ignoring offline"},
+    {client: alice, command: "/ignore bob", wantInfo: "Ignoring bob"},
+    {client: alice, command: "/ignored", wantInfo: "Ignoring: bob, lurker, offline"},
+    {client: bob, command: "/ignored", wantInfo: "You aren't ignoring anyone"},
+    {client: alice, command: "/unignore", wantErr: "usage"},
+    {client: alice, command: "/unignore nobody", wantErr: "you aren't ignoring nobody"},
+    {client: alice, command: "/unignore OFFLINE", wantInfo: "No longer ignoring offline"},
+    {client: alice, command: "/ignored", wantInfo: "Ignoring: bob, lurker"},
+  }
+  for _, tt := range tests {
+    info, err := runTestCommand(t, tt.client, "ignoring", tt.command)
+    if !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    if info != tt.wantInfo {
+      t.Errorf("%s: info %q, want %q", tt.command, info, tt.wantInfo)
+    }
+  }
+
+  // Ignored users' chats aren't delivered, but other messages are.
+  broadcasts := []struct {
+    msg common.Message
+    wantAlice, wantBob bool
+  }{
+    {common.NewChatMessage(bob.id, "from bob"), false, true},
+    {common.NewChatMessage(anon.id, "from the lurker"), false, true},
+    {common.NewSystemMessage(common.ActionInfo, "for everyone"), true, true},
+    {common.Message{Sender: bob.id, Action: common.ActionNick, Contents: "robert"}, true, true},
+  }
+  for _, tt := range broadcasts {
+    received(t, alice)
+    received(t, bob)
+    tt.msg.Room = "ignoring"
+    broadcastMsg(tt.msg)
+    if got := len(received(t, alice)) != 0; got != tt.wantAlice {
+      t.Errorf("%q: alice received it: %v, want %v", tt.msg.Contents, got, tt.wantAlice)
+    }
+    if got := len(received(t, bob)) != 0; got != tt.wantBob {
+      t.Errorf("%q: bob received it: %v, want %v", tt.msg.Contents, got, tt.wantBob)
+    }
+  }
+
+  // They're persisted.
+  ignoresMtx.Lock()
+  ignores = make(map[string]map[string]string)
+  ignoresMtx.Unlock()
+  if err := loadIgnores(); err != nil {
+    t.Fatal(err)
+  }
+  if !isIgnoring(alice, userKey("", "bob")) || !isIgnoring(alice, userKey(anon.id, "")) {
+    t.Error("ignores weren't reloaded")
+  }
+  if isIgnoring(bob, userKey(alice.id, "alice")) || isIgnoring(anon, userKey("", "bob")) {
+    t.Error("ignoring without ignoring anyone")
+  }
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net"
+  "strings"
+  "sync"
+  "time"
+
+  uuidpkg "github.com/google/uuid"
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+const (
+  ircServerName = "wschat"
+  // The IRC channel that maps onto the default (global) room.
+  ircDefaultChannel = "#wschat"
+  ircMaxNickLen = 30
+  // Large enough to accept IRCv3 message tags, which are ignored.
+  ircMaxLineLen = 8192
+)
+
+var (
+  // Connections accepted per second from each IP (0 is unlimited) and the
+  // burst size, since the gateway has no join challenge.
+  ircAcceptRate = 1.0
+  ircAcceptBurst = 10
+)
+
+func serveIRC(ln net.Listener) {
+  limiter := NewIPRateLimiter(ircAcceptRate, ircAcceptBurst)
+  for {
+    conn, err := ln.Accept()
+    if err != nil {
+      log.Printf("error accepting IRC connection: %v", err)
+      continue
+    }
+    if allowed, _ := limiter.Allow(conn.RemoteAddr().String()); !allowed {
+      go func() {
+        conn.SetWriteDeadline(time.Now().Add(time.Second))
+        fmt.Fprint(conn, "ERROR :Closing link: too many connections\r\n")
+        conn.Close()
+      }()
+      continue
+    }
+    go newIRCSession(conn).run()
+  }
+}
+
+// ircMessage is a parsed IRC protocol line. Tags are discarded.
+type ircMessage struct {
+  prefix string
+  command string
+  params []string
+}
+
+func parseIRCLine(line string) ircMessage {
+  var msg ircMessage
+  if strings.HasPrefix(line, "@") {
+    _, line, _ = strings.Cut(line, " ")
+  }
+  line = strings.TrimLeft(line, " ")
+  if strings.HasPrefix(line, ":") {
+    msg.prefix, line, _ = strings.Cut(line[1:], " ")
+  }
+  for {
+    line = strings.TrimLeft(line, " ")
+    if line == "" {
+      break
+    }
+    if strings.HasPrefix(line, ":") && msg.command != "" {
+      msg.params = append(msg.params, line[1:])
+      break
+    }
+    var field string
+    field, line, _ = strings.Cut(line, " ")
+    if msg.command == "" {
+      msg.command = strings.ToUpper(field)
+    } else {
+      msg.params = append(msg.params, field)
+    }
+  }
+  return msg
+}
+
+// ircChannelToRoom maps an IRC channel name onto a room name.
+func ircChannelToRoom(channel string) (string, bool) {
+  if strings.EqualFold(channel, ircDefaultChannel) {
+    return "", true
+  }
+  if len(channel) < 2 || channel[0] != '#' {
+    return "", false
+  }
+  room := channel[1:]
+  return room, isValidRoomName(room)
+}
+
+func roomToIRCChannel(room string) string {
+  if room == "" {
+    return ircDefaultChannel
+  }
+  return "#" + room
+}
+
+func isValidIRCNick(nick string) bool {
+  if nick == "" || len(nick) > ircMaxNickLen || strings.EqualFold(nick, "system") {
+    return false
+  }
+  for i, r := range nick {
+    switch {
+    case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+    case strings.ContainsRune("[]\\`_^{|}", r):
+    case i != 0 && (r >= '0' && r <= '9' || r == '-'):
+    default:
+      return false
+    }
+  }
+  return true
+}
+
+// ircSafeName makes a chat identity (e.g., a UUID) usable as an IRC nick in a
+// message prefix.
+func ircSafeName(name string) string {
+  if name == "" {
+    return "*"
+  }
+  return strings.Map(func(r rune) rune {
+    switch r {
+    case ' ', '!', '@', ':', ',', '\r', '\n', 0:
+      return '_'
+    }
+    return r
+  }, name)
+}
+
+type ircSession struct {
+  conn net.Conn
+  writeMtx sync.Mutex
+  // The client's ID, which is new for each session so a nick's next holder
+  // can't act as its last (editing their chats, managing their rooms, etc.).
+  id string
+  // Set once registered (NICK and USER received).
+  client *Client
+
+  nick, user string
+  // The token given with PASS.
+  pass string
+}
+
+func newIRCSession(conn net.Conn) *ircSession {
+  return &ircSession{conn: conn, id: uuidpkg.New().String()}
+}
+
+func (s *ircSession) logf(format string, args ...any) {
+  log.Output(
+    2,
+    fmt.Sprintf(
+      fmt.Sprintf("[irc|%s|%s] %s", s.conn.RemoteAddr(), s.nick, format),
+      args...,
+    ),
+  )
+}
+
+// send sends a line to the client. Contents from users can't break it into
+// more lines: CRs and LFs become spaces and NULs are dropped.
+func (s *ircSession) send(format string, args ...any) {
+  line := strings.Map(func(r rune) rune {
+    switch r {
+    case '\r', '\n':
+      return ' '
+    case 0:
+      return -1
+    }
+    return r
+  }, fmt.Sprintf(format, args...))
+  s.writeMtx.Lock()
+  defer s.writeMtx.Unlock()
+  if _, err := s.conn.Write([]byte(line + "\r\n")); err != nil {
+    s.conn.Close()
+  }
+}
+
+// reply sends a numeric reply.
+func (s *ircSession) reply(numeric string, params string) {
+  nick := s.nick
+  if nick == "" {
+    nick = "*"
+  }
+  s.send(":%s %s %s %s", ircServerName, numeric, nick, params)
+}
+
+func (s *ircSession) prefix() string {
+  return fmt.Sprintf("%s!%s@%s", s.nick, s.user, ircServerName)
+}
+
+func (s *ircSession) run() {
+  defer s.close()
+
+  scanner := bufio.NewScanner(s.conn)
+  scanner.Buffer(make([]byte, 0, 512), ircMaxLineLen)
+  for scanner.Scan() {
+    msg := parseIRCLine(strings.TrimRight(scanner.Text(), "\r"))
+    if msg.command == "" {
+      continue
+    }
+    if !s.handle(msg) {
+      return
+    }
+  }
+  if err := scanner.Err(); err != nil {
+    s.logf("error reading from client: %v", err)
+  }
+}
+
+// handle handles a single command, returning false if the session should end.
+func (s *ircSession) handle(msg ircMessage) bool {
+  switch msg.command {
+  case "CAP":
+    // No capabilities are supported, but clients wait for the LS reply.
+    if len(msg.params) != 0 && strings.ToUpper(msg.params[0]) == "LS" {
+      s.send(":%s CAP * LS :", ircServerName)
+    }
+    return true
+  case "PASS":
+    if s.client != nil {
+      s.reply("462", ":You may not reregister")
+    } else if len(msg.params) != 0 {
+      s.pass = msg.params[0]
+    }
+    return true
+  case "PONG":
+    return true
+  case "PING":
+    s.send(":%s PONG %s :%s", ircServerName, ircServerName, strings.Join(msg.params, " "))
+    return true
+  case "QUIT":
+    s.send("ERROR :Closing link")
+    return false
+  case "NICK":
+    s.handleNick(msg)
+    return true
+  case "USER":
+    if s.client != nil {
+      s.reply("462", ":You may not reregister")
+    } else if len(msg.params) < 4 {
+      s.reply("461", "USER :Not enough parameters")
+    } else {
+      s.user = ircSafeName(msg.params[0])
+      return s.tryRegister()
+    }
+    return true
+  }
+  if s.client == nil {
+    s.reply("451", ":You have not registered")
+    return true
+  }
+  switch msg.command {
+  case "JOIN":
+    s.handleJoin(msg)
+  case "PART":
+    s.handlePart(msg)
+  case "PRIVMSG", "NOTICE":
+    s.handlePrivmsg(msg)
+  case "TOPIC":
+    s.handleTopic(msg)
+  default:
+    s.reply("421", msg.command+" :Unknown command")
+  }
+  return true
+}
+
+func (s *ircSession) handleNick(msg ircMessage) {
+  if len(msg.params) == 0 {
+    s.reply("431", ":No nickname given")
+    return
+  }
+  nick := msg.params[0]
+  if !isValidIRCNick(nick) {
+    s.reply("432", nick+" :Erroneous nickname")
+    return
+  }
+  if s.client != nil {
+    // Chat identities can't be renamed.
+    s.reply("447", ":Cannot change nickname after registration")
+    return
+  }
+  if isReservedName(nick) {
+    if identity, _, ok := authenticate(s.pass); !ok || !strings.EqualFold(identity, nick) {
+      s.reply("433", nick+" :Nickname is reserved")
+      return
+    }
+  }
+  // Nicks are the sessions' display names.
+  if _, loaded := names.LoadOrStore(strings.ToLower(nick), s.id); loaded {
+    s.reply("433", nick+" :Nickname is already in use")
+    return
+  }
+  if s.nick != "" {
+    names.Delete(strings.ToLower(s.nick))
+  }
+  s.nick = nick
+  if !s.tryRegister() {
+    s.conn.Close()
+  }
+}
+
+// tryRegister registers the session if NICK and USER have both been sent,
+// returning false if the session should end.
+func (s *ircSession) tryRegister() bool {
+  if s.nick == "" || s.user == "" || s.client != nil {
+    return true
+  }
+  client := NewClient(s.id, s.conn.RemoteAddr().String(), 50)
+  client.SetName(s.nick)
+  client.irc = true
+  if s.pass != "" {
+    identity, role, ok := authenticate(s.pass)
+    if !ok {
+      s.reply("464", ":Password incorrect")
+      s.send("ERROR :Closing link (bad password)")
+      return false
+    }
+    client.identity, client.role = identity, role
+  }
+  client.kick = func(reason string) {
+    s.send("ERROR :Closing link (%s)", reason)
+    s.conn.Close()
+  }
+  s.client = client
+  clients.Store(s.id, s.client)
+  go s.relay()
+
+  s.reply("001", fmt.Sprintf(":Welcome to %s, %s", ircServerName, s.prefix()))
+  s.reply("002", fmt.Sprintf(":Your host is %s", ircServerName))
+  s.reply("422", ":MOTD File is missing")
+  s.logf("registered")
+  return true
+}
+
+func (s *ircSession) handleJoin(msg ircMessage) {
+  if len(msg.params) == 0 {
+    s.reply("461", "JOIN :Not enough parameters")
+    return
+  }
+  if msg.params[0] == "0" {
+    s.client.rooms.Range(func(iRoom, _ any) bool {
+      s.part(iRoom.(string), "")
+      return true
+    })
+    return
+  }
+  var keys []string
+  if len(msg.params) > 1 {
+    keys = strings.Split(msg.params[1], ",")
+  }
+  for i, channel := range strings.Split(msg.params[0], ",") {
+    // Keys are passwords or invite codes.
+    key := ""
+    if i < len(keys) {
+      key = keys[i]
+    }
+    room, ok := ircChannelToRoom(channel)
+    if !ok {
+      s.reply("403", channel+" :No such channel")
+      continue
+    }
+    if s.client.InRoom(room) {
+      continue
+    }
+    channel = roomToIRCChannel(room)
+    if err := pipeline.Connect(s.client.Conn(room)); err != nil {
+      if !errors.Is(err, middleware.ErrDrop) {
+        s.reply("474", fmt.Sprintf("%s :Cannot join channel (%v)", channel, err))
+      }
+      continue
+    }
+    ensureRoom(room, s.client)
+    if err := checkRoomAccess(s.client, room, key, key); err != nil {
+      switch err {
+      case errInviteRequired, errInvalidInvite:
+        s.reply("473", channel+" :Cannot join channel (+i)")
+      default:
+        s.reply("475", channel+" :Cannot join channel (+k)")
+      }
+      pipeline.Disconnect(s.client.Conn(room))
+      continue
+    }
+    if err := checkRoomCap(s.client, room); err != nil {
+      s.reply("471", channel+" :Cannot join channel (room is full)")
+      pipeline.Disconnect(s.client.Conn(room))
+      continue
+    }
+    // Same as websocket clients, announce before joining so the session
+    // doesn't receive its own connect.
+    connectMsg := common.NewSystemMessage(common.ActionConnect, s.id)
+    connectMsg.Room, connectMsg.Name = room, s.nick
+    broadcastMsg(connectMsg)
+    s.send(":%s JOIN %s", s.prefix(), channel)
+    s.client.JoinRoom(room)
+
+    members := []string{s.nick}
+    clients.Range(func(_, iClient any) bool {
+      client := iClient.(*Client)
+      if client != s.client && client.InRoom(room) {
+        members = append(members, ircSafeName(client.DisplayName()))
+      }
+      return true
+    })
+    state := roomState(room)
+    if state.Topic != "" {
+      s.reply("332", fmt.Sprintf("%s :%s", channel, state.Topic))
+    }
+    s.reply("353", fmt.Sprintf("= %s :%s", channel, strings.Join(members, " ")))
+    s.reply("366", channel+" :End of /NAMES list")
+    if state.MOTD != "" {
+      s.send(":%s NOTICE %s :%s", ircServerName, channel, state.MOTD)
+    }
+    for _, pinned := range pinsMsg(room, ignoredKeys(s.client)).Messages {
+      s.send(":%s NOTICE %s :Pinned message %d: %s", ircServerName, channel, pinned.ID, pinned.Contents)
+    }
+  }
+}
+
+func (s *ircSession) handlePart(msg ircMessage) {
+  if len(msg.params) == 0 {
+    s.reply("461", "PART :Not enough parameters")
+    return
+  }
+  reason := ""
+  if len(msg.params) > 1 {
+    reason = msg.params[1]
+  }
+  for _, channel := range strings.Split(msg.params[0], ",") {
+    room, ok := ircChannelToRoom(channel)
+    if !ok || !s.client.InRoom(room) {
+      s.reply("442", channel+" :You're not on that channel")
+      continue
+    }
+    s.part(room, reason)
+  }
+}
+
+func (s *ircSession) part(room, reason string) {
+  s.client.LeaveRoom(room)
+  s.send(":%s PART %s :%s", s.prefix(), roomToIRCChannel(room), reason)
+  msg := common.NewSystemMessage(common.ActionDisconnect, s.id)
+  msg.Room, msg.Name = room, s.nick
+  broadcastMsg(msg)
+  forgetReadMarker(s.client, room)
+  pipeline.Disconnect(s.client.Conn(room))
+}
+
+func (s *ircSession) handlePrivmsg(msg ircMessage) {
+  // NOTICE must never generate error replies.
+  isNotice := msg.command == "NOTICE"
+  if len(msg.params) == 0 {
+    if !isNotice {
+      s.reply("411", ":No recipient given (PRIVMSG)")
+    }
+    return
+  }
+  if len(msg.params) < 2 || msg.params[1] == "" {
+    if !isNotice {
+      s.reply("412", ":No text to send")
+    }
+    return
+  }
+  target, text := msg.params[0], msg.params[1]
+  room, ok := ircChannelToRoom(target)
+  if !ok {
+    if !isNotice {
+      s.reply("401", target+" :No such nick/channel (direct messages are not supported)")
+    }
+    return
+  }
+  if !s.client.InRoom(room) {
+    if !isNotice {
+      s.reply("404", target+" :Cannot send to channel")
+    }
+    return
+  }
+  if strings.HasPrefix(text, "\x01ACTION ") {
+    text = "/me " + strings.TrimSuffix(text[len("\x01ACTION "):], "\x01")
+  } else if strings.HasPrefix(text, "\x01") {
+    // Other CTCP requests aren't supported.
+    return
+  }
+  receiveChat(s.client, room, common.Message{Contents: text})
+}
+
+func (s *ircSession) handleTopic(msg ircMessage) {
+  if len(msg.params) == 0 {
+    s.reply("461", "TOPIC :Not enough parameters")
+    return
+  }
+  channel := msg.params[0]
+  room, ok := ircChannelToRoom(channel)
+  if !ok || !s.client.InRoom(room) {
+    s.reply("442", channel+" :You're not on that channel")
+    return
+  }
+  if len(msg.params) == 1 {
+    if topic := roomState(room).Topic; topic != "" {
+      s.reply("332", fmt.Sprintf("%s :%s", channel, topic))
+    } else {
+      s.reply("331", channel+" :No topic is set")
+    }
+    return
+  }
+  receiveChat(s.client, room, common.Message{Contents: "/topic " + msg.params[1]})
+}
+
+// relay translates broadcasts received by the session's client into IRC
+// lines.
+func (s *ircSession) relay() {
+  for b := range s.client.channel.c {
+    var msg common.Message
+    if err := json.Unmarshal(b, &msg); err != nil {
+      s.logf("error unmarshaling broadcast: %v", err)
+      continue
+    }
+    channel := roomToIRCChannel(msg.Room)
+    sender := msg.Sender
+    if msg.Name != "" {
+      sender = msg.Name
+    }
+    sender = ircSafeName(sender)
+    switch msg.Action {
+    case common.ActionChat, common.ActionEmote:
+      // IRC clients don't expect their own messages to be echoed.
+      if msg.Sender == s.id {
+        continue
+      }
+      for _, line := range strings.Split(msg.Contents, "\n") {
+        if line = strings.TrimRight(line, "\r"); line == "" {
+          continue
+        }
+        if msg.Action == common.ActionEmote {
+          line = "\x01ACTION " + line + "\x01"
+        }
+        s.send(":%s!%s@%s PRIVMSG %s :%s", sender, sender, ircServerName, channel, line)
+      }
+      for _, att := range msg.Attachments {
+        s.send(
+          ":%s!%s@%s PRIVMSG %s :[attachment: %s (%s, %d bytes) /blobs/%s]",
+          sender, sender, ircServerName, channel, att.Name, att.Type, att.Size, att.Hash,
+        )
+      }
+    case common.ActionEdit:
+      s.send(":%s NOTICE %s :%s edited message %d: %s", ircServerName, channel, sender, msg.ID, msg.Contents)
+    case common.ActionDelete:
+      s.send(":%s NOTICE %s :%s deleted message %d", ircServerName, channel, sender, msg.ID)
+    case common.ActionRoom:
+      info := msg.RoomInfo
+      if info == nil {
+        continue
+      }
+      limit := "none"
+      if info.MaxMembers != 0 {
+        limit = fmt.Sprint(info.MaxMembers)
+      }
+      s.send(
+        ":%s NOTICE %s :%s updated the room (MOTD: %q, member limit: %s)",
+        ircServerName, channel, sender, info.MOTD, limit,
+      )
+    case common.ActionPin:
+      if len(msg.Messages) == 0 {
+        continue
+      }
+      s.send(
+        ":%s NOTICE %s :%s pinned message %d: %s",
+        ircServerName, channel, sender, msg.ID, msg.Messages[0].Contents,
+      )
+    case common.ActionUnpin:
+      s.send(":%s NOTICE %s :%s unpinned message %d", ircServerName, channel, sender, msg.ID)
+    case common.ActionPoll:
+      s.send(":%s NOTICE %s :%s started poll %d: %s", ircServerName, channel, sender, msg.ID, msg.Contents)
+      if msg.Poll != nil {
+        for i, option := range msg.Poll.Options {
+          s.send(":%s NOTICE %s :  %d. %s", ircServerName, channel, i+1, option)
+        }
+      }
+    case common.ActionClose:
+      if msg.Poll == nil {
+        continue
+      }
+      results := make([]string, len(msg.Poll.Options))
+      for i, option := range msg.Poll.Options {
+        results[i] = fmt.Sprintf("%s (%d)", option, msg.Poll.Votes[i])
+      }
+      s.send(
+        ":%s NOTICE %s :Poll %d closed: %s", ircServerName, channel, msg.ID, strings.Join(results, ", "),
+      )
+    case common.ActionExpire:
+      s.send(":%s NOTICE %s :Message %d expired", ircServerName, channel, msg.ID)
+    case common.ActionReact, common.ActionUnreact:
+      verb := "reacted"
+      if msg.Action == common.ActionUnreact {
+        verb = "removed their reaction"
+      }
+      s.send(":%s NOTICE %s :%s %s %s to message %d", ircServerName, channel, sender, verb, msg.Contents, msg.ID)
+    case common.ActionMention:
+      // Channels they're in already highlight it.
+      if s.client.InRoom(msg.Room) {
+        continue
+      }
+      s.send(":%s NOTICE %s :%s mentioned you in %s: %s", ircServerName, s.nick, sender, channel, msg.Contents)
+    case common.ActionTopic:
+      s.send(":%s!%s@%s TOPIC %s :%s", sender, sender, ircServerName, channel, msg.Contents)
+    case common.ActionConnect, common.ActionDisconnect, common.ActionNick:
+      if msg.Contents == s.id {
+        continue
+      }
+      name := msg.Contents
+      if msg.Name != "" {
+        name = msg.Name
+      }
+      name = ircSafeName(name)
+      switch msg.Action {
+      case common.ActionConnect:
+        s.send(":%s!%s@%s JOIN %s", name, name, ircServerName, channel)
+      case common.ActionDisconnect:
+        s.send(":%s!%s@%s PART %s :", name, name, ircServerName, channel)
+      default:
+        s.send(":%s NOTICE %s :%s is now known as %s", ircServerName, channel, msg.Contents, name)
+      }
+    case common.ActionInfo:
+      for _, line := range strings.Split(strings.ReplaceAll(msg.Contents, "\r\n", "\n"), "\n") {
+        s.send(":%s NOTICE %s :%s", ircServerName, channel, line)
+      }
+    case common.ActionError:
+      s.send(":%s NOTICE %s :%s", ircServerName, s.nick, msg.Contents)
+    }
+  }
+}
+
+func (s *ircSession) close() {
+  if s.client != nil {
+    s.client.rooms.Range(func(iRoom, _ any) bool {
+      room := iRoom.(string)
+      s.client.LeaveRoom(room)
+      msg := common.NewSystemMessage(common.ActionDisconnect, s.id)
+      msg.Room, msg.Name = room, s.nick
+      go broadcastMsg(msg)
+      forgetReadMarker(s.client, room)
+      pipeline.Disconnect(s.client.Conn(room))
+      return true
+    })
+    s.client.channel.Close()
+    clients.Delete(s.id)
+  }
+  if s.nick != "" {
+    names.Delete(strings.ToLower(s.nick))
+  }
+  s.conn.Close()
+}
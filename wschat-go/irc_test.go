@@ -0,0 +1,236 @@
+package main
+
+import (
+  "bufio"
+  "net"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestParseIRCLine(t *testing.T) {
+  tests := []struct {
+    line string
+    want ircMessage
+  }{
+    {"", ircMessage{}},
+    {"PING", ircMessage{command: "PING"}},
+    {"nick alice", ircMessage{command: "NICK", params: []string{"alice"}}},
+    {
+      "USER alice 0 * :Alice Smith",
+      ircMessage{command: "USER", params: []string{"alice", "0", "*", "Alice Smith"}},
+    },
+    {
+      "PRIVMSG #dev :hello :world",
+      ircMessage{command: "PRIVMSG", params: []string{"#dev", "hello :world"}},
+    },
+    {"PRIVMSG #dev :", ircMessage{command: "PRIVMSG", params: []string{"#dev", ""}}},
+    {
+      ":alice!a@host PRIVMSG #dev :hi",
+      ircMessage{prefix: "alice!a@host", command: "PRIVMSG", params: []string{"#dev", "hi"}},
+    },
+    {
+      "@time=2024-01-01T00:00:00Z;msgid=1 PRIVMSG #dev :tagged",
+      ircMessage{command: "PRIVMSG", params: []string{"#dev", "tagged"}},
+    },
+    {
+      "@a=b :alice PART #dev :bye now",
+      ircMessage{prefix: "alice", command: "PART", params: []string{"#dev", "bye now"}},
+    },
+    {"  JOIN   #a,#b   key ", ircMessage{command: "JOIN", params: []string{"#a,#b", "key"}}},
+    // A colon can't start the command.
+    {":prefix-only", ircMessage{prefix: "prefix-only"}},
+  }
+  for _, tt := range tests {
+    if got := parseIRCLine(tt.line); !reflect.DeepEqual(got, tt.want) {
+      t.Errorf("parseIRCLine(%q) = %+v, want %+v", tt.line, got, tt.want)
+    }
+  }
+}
+
+func TestIRCChannelToRoom(t *testing.T) {
+  tests := []struct {
+    channel, room string
+    ok bool
+  }{
+    {"#wschat", "", true},
+    {"#WSChat", "", true},
+    {"#dev", "dev", true},
+    {"dev", "", false},
+    {"#", "", false},
+    {"", "", false},
+  }
+  for _, tt := range tests {
+    room, ok := ircChannelToRoom(tt.channel)
+    if room != tt.room || ok != tt.ok {
+      t.Errorf("ircChannelToRoom(%q) = %q, %v, want %q, %v", tt.channel, room, ok, tt.room, tt.ok)
+    }
+  }
+}
+
+func TestIsValidIRCNick(t *testing.T) {
+  tests := []struct {
+    nick string
+    want bool
+  }{
+    {"alice", true},
+    {"a[1]-_^{|}`", true},
+    {"system", false},
+    {"System", false},
+    {"", false},
+    {"1alice", false},
+    {"-alice", false},
+    {"al ice", false},
+    {"al!ce", false},
+    {strings.Repeat("a", ircMaxNickLen), true},
+    {strings.Repeat("a", ircMaxNickLen+1), false},
+  }
+  for _, tt := range tests {
+    if got := isValidIRCNick(tt.nick); got != tt.want {
+      t.Errorf("isValidIRCNick(%q) = %v, want %v", tt.nick, got, tt.want)
+    }
+  }
+}
+
+// ircTestClient is the client end of an IRC session over a pipe.
+type ircTestClient struct {
+  conn net.Conn
+  lines chan string
+}
+
+// dialIRCSession starts a session, which is closed (and waited for) when the
+// test ends. Sessions should leave their rooms first, since the disconnects
+// of those left on close are broadcast in the background.
+func dialIRCSession(t *testing.T) *ircTestClient {
+  serverConn, conn := net.Pipe()
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    newIRCSession(serverConn).run()
+  }()
+  c := &ircTestClient{conn: conn, lines: make(chan string, 100)}
+  go func() {
+    defer close(c.lines)
+    r := bufio.NewReader(conn)
+    for {
+      line, err := r.ReadString('\n')
+      if err != nil {
+        return
+      }
+      c.lines <- line
+    }
+  }()
+  t.Cleanup(func() {
+    conn.Close()
+    <-done
+  })
+  return c
+}
+
+func (c *ircTestClient) send(t *testing.T, lines ...string) {
+  t.Helper()
+  for _, line := range lines {
+    c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+    if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+      t.Fatalf("sending %q: %v", line, err)
+    }
+  }
+}
+
+// expect reads lines until one is want.
+func (c *ircTestClient) expect(t *testing.T, want string) {
+  t.Helper()
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case line, ok := <-c.lines:
+      if !ok {
+        t.Fatalf("connection closed waiting for %q", want)
+      }
+      if !strings.HasSuffix(line, "\r\n") {
+        t.Fatalf("line %q doesn't end in CRLF", line)
+      }
+      if strings.TrimSuffix(line, "\r\n") == want {
+        return
+      }
+    case <-timeout:
+      t.Fatalf("timed out waiting for %q", want)
+    }
+  }
+}
+
+// expectClosed reads lines until the session closes the connection.
+func (c *ircTestClient) expectClosed(t *testing.T) {
+  t.Helper()
+  timeout := time.After(5 * time.Second)
+  for {
+    select {
+    case _, ok := <-c.lines:
+      if !ok {
+        return
+      }
+    case <-timeout:
+      t.Fatal("timed out waiting for the connection to close")
+    }
+  }
+}
+
+func TestIRCSession(t *testing.T) {
+  alice := dialIRCSession(t)
+  alice.send(t, "CAP LS 302", "NICK ircalice", "USER ircalice 0 * :Alice", "CAP END")
+  alice.expect(t, ":wschat CAP * LS :")
+  alice.expect(t, ":wschat 001 ircalice :Welcome to wschat, ircalice!ircalice@wschat")
+
+  bob := dialIRCSession(t)
+  bob.send(t, "NICK ircalice")
+  bob.expect(t, ":wschat 433 * ircalice :Nickname is already in use")
+  bob.send(t, "NICK ircbob", "USER ircbob 0 * :Bob")
+  bob.expect(t, ":wschat 001 ircbob :Welcome to wschat, ircbob!ircbob@wschat")
+
+  bob.send(t, "PRIVMSG #irctest :too soon")
+  bob.expect(t, ":wschat 404 ircbob #irctest :Cannot send to channel")
+
+  alice.send(t, "JOIN #irctest")
+  alice.expect(t, ":ircalice!ircalice@wschat JOIN #irctest")
+  alice.expect(t, ":wschat 353 ircalice = #irctest :ircalice")
+  alice.expect(t, ":wschat 366 ircalice #irctest :End of /NAMES list")
+
+  bob.send(t, "JOIN #irctest")
+  bob.expect(t, ":ircbob!ircbob@wschat JOIN #irctest")
+  bob.expect(t, ":wschat 353 ircbob = #irctest :ircbob ircalice")
+  alice.expect(t, ":ircbob!ircbob@wschat JOIN #irctest")
+
+  bob.send(t, "PRIVMSG #irctest :hello, alice", "PRIVMSG #irctest :\x01ACTION waves\x01")
+  alice.expect(t, ":ircbob!ircbob@wschat PRIVMSG #irctest :hello, alice")
+  alice.expect(t, ":ircbob!ircbob@wschat PRIVMSG #irctest :\x01ACTION waves\x01")
+
+  // Contents can't inject lines.
+  alice.send(t, "PRIVMSG #irctest :/me hi\rQUIT")
+  bob.expect(t, ":ircalice!ircalice@wschat PRIVMSG #irctest :\x01ACTION hi QUIT\x01")
+
+  bob.send(t, "PART #irctest :bye")
+  bob.expect(t, ":ircbob!ircbob@wschat PART #irctest :bye")
+  alice.expect(t, ":ircbob!ircbob@wschat PART #irctest :")
+  bob.send(t, "PRIVMSG #irctest :gone")
+  bob.expect(t, ":wschat 404 ircbob #irctest :Cannot send to channel")
+
+  bob.send(t, "PING :token")
+  bob.expect(t, ":wschat PONG wschat :token")
+  bobID, _ := names.Load("ircbob")
+  bob.send(t, "QUIT :done")
+  bob.expect(t, "ERROR :Closing link")
+  bob.expectClosed(t)
+
+  // The nick is free again.
+  carol := dialIRCSession(t)
+  carol.send(t, "NICK ircbob", "USER ircbob 0 * :Carol")
+  carol.expect(t, ":wschat 001 ircbob :Welcome to wschat, ircbob!ircbob@wschat")
+  // But not the ID, so carol can't act as bob.
+  if carolID, _ := names.Load("ircbob"); carolID == bobID {
+    t.Errorf("the nick's next holder has the same ID: %v", carolID)
+  }
+
+  alice.send(t, "JOIN 0")
+  alice.expect(t, ":ircalice!ircalice@wschat PART #irctest :")
+}
@@ -3,19 +3,24 @@ package main
 import (
   "encoding/json"
   "errors"
+  "flag"
   "fmt"
   "io"
   "log"
+  "net"
   "net/http"
   _ "net/http/pprof"
   "os"
+  "strings"
   "sync"
   "sync/atomic"
-  //"time"
+  "time"
 
   uuidpkg "github.com/google/uuid"
   webs "golang.org/x/net/websocket"
   "wschat/wschat-go/common"
+  "wschat/wschat-go/filter"
+  "wschat/wschat-go/middleware"
 )
 
 type Channel[T any] struct {
@@ -44,19 +49,249 @@ func (c *Channel[T]) Close() {
   }
 }
 
+// Client is anything that receives broadcasts (websocket connections and IRC
+// gateway sessions). A client only receives messages for the rooms it's in.
+type Client struct {
+  id string
+  addr string
+  channel *Channel[[]byte]
+  // map[string]bool
+  rooms sync.Map
+
+  nameMtx sync.RWMutex
+  name string
+
+  // The signed-in identity, empty if anonymous.
+  identity string
+  role Role
+  // Closes the client's connection, telling it why.
+  kick func(reason string)
+  // IRC sessions are named by their nick, which can't change.
+  irc bool
+}
+
+func NewClient(id, addr string, l int) *Client {
+  return &Client{
+    id: id,
+    addr: addr,
+    role: RoleUser,
+    channel: NewChannel[[]byte](l),
+  }
+}
+
+func (c *Client) InRoom(room string) bool {
+  _, ok := c.rooms.Load(room)
+  return ok
+}
+
+func (c *Client) JoinRoom(room string) {
+  c.rooms.Store(room, true)
+}
+
+func (c *Client) LeaveRoom(room string) {
+  c.rooms.Delete(room)
+}
+
+// Name returns the client's display name, empty if not set.
+func (c *Client) Name() string {
+  c.nameMtx.RLock()
+  defer c.nameMtx.RUnlock()
+  return c.name
+}
+
+func (c *Client) SetName(name string) {
+  c.nameMtx.Lock()
+  c.name = name
+  c.nameMtx.Unlock()
+}
+
+// DisplayName returns the client's name, or its ID if it doesn't have one.
+func (c *Client) DisplayName() string {
+  if name := c.Name(); name != "" {
+    return name
+  }
+  return c.id
+}
+
+// Conn describes the client in the room for middlewares.
+func (c *Client) Conn(room string) middleware.Conn {
+  return middleware.Conn{
+    ID: c.id,
+    Name: c.Name(),
+    Identity: c.identity,
+    Room: room,
+    RemoteAddr: c.addr,
+  }
+}
+
+// Kick disconnects the client.
+func (c *Client) Kick(reason string) {
+  if c.kick != nil {
+    c.kick(reason)
+  }
+}
+
+// SendMsg sends a message to only this client.
+func (c *Client) SendMsg(msg common.Message) error {
+  msgJSONBytes, err := json.Marshal(msg)
+  if err != nil {
+    return err
+  }
+  c.channel.Send(msgJSONBytes)
+  return nil
+}
+
 var (
-  // map[UUID]*webs.Conn
-  // map[UUID]chan Message
+  // map[ID]*Client
   clients sync.Map
+  // Display names in use (including IRC nicks), so they can't be
+  // impersonated.
+  // map[lowercase name]ID
+  names sync.Map
+
+  // Middlewares are added with pipeline.Use before the server starts.
+  pipeline = &middleware.Chain{}
 )
 
 func main() {
   log.SetFlags(log.Lshortfile)
-  if len(os.Args) != 2 {
+  ircAddr := flag.String("irc-addr", "", "Address to serve the IRC gateway on (disabled if empty)")
+  flag.Float64Var(&ircAcceptRate, "irc-accept-rate", ircAcceptRate, "IRC connections accepted per second from each IP (unlimited if 0)")
+  flag.IntVar(&ircAcceptBurst, "irc-accept-burst", ircAcceptBurst, "Burst size of IRC connections accepted from each IP")
+  accountsPath := flag.String("accounts", "", "Path to JSON file of accounts (an object of identities to tokens and roles)")
+  flag.StringVar(&bansPath, "bans", "", "Path to JSON file bans are persisted to")
+  flag.StringVar(&roomsPath, "rooms", "", "Path to JSON file room topics, MOTDs and settings are persisted to (defaults to next to the -log, if there is one)")
+  flag.StringVar(&schedulesPath, "schedules", "", "Path to JSON file scheduled messages are persisted to")
+  flag.StringVar(&ignoresPath, "ignores", "", "Path to JSON file users' ignore lists are persisted to")
+  logPath := flag.String("log", "", "Path to the durable history log (history is only kept in memory if empty)")
+  flag.IntVar(&historySize, "history-size", historySize, "Max number of chats kept in memory per room")
+  flag.IntVar(&replaySize, "replay", 0, "Number of recent chats sent to clients after they connect")
+  flag.IntVar(&maxPins, "max-pins", maxPins, "Max number of pinned chats per room")
+  retentionPath := flag.String("retention", "", "Path to JSON file of retention policies (an object of rooms to policies)")
+  flag.StringVar(&blobDir, "blob-dir", "", "Directory uploaded files are stored in (uploads are disabled if empty)")
+  flag.Int64Var(&maxUploadSize, "max-upload-size", maxUploadSize, "Max size of uploaded files, in bytes")
+  flag.Int64Var(&blobQuota, "blob-quota", blobQuota, "Max total size of uploaded files, in bytes (0 for no limit)")
+  flag.Float64Var(&uploadRate, "upload-rate", uploadRate, "Uploads per second allowed from each IP (0 for no limit)")
+  flag.IntVar(&uploadBurst, "upload-burst", uploadBurst, "Uploads allowed from each IP at once")
+  uploadTypesStr := flag.String("upload-types", strings.Join(uploadTypes, ","), "Comma-separated MIME types that can be uploaded (\"type/*\" allows all subtypes)")
+  compactInterval := flag.Duration("compact-interval", 24*time.Hour, "How often the history log is compacted, besides on startup (never if 0)")
+  filterPath := flag.String("filter", "", "Path to JSON file of content filtering and validation rules")
+  spamPath := flag.String("spam", "", "Path to JSON file of spam detection rules")
+  webhooksPath := flag.String("webhooks", "", "Path to JSON file of incoming webhooks (an object of names to webhooks)")
+  outgoingPath := flag.String("outgoing-webhooks", "", "Path to JSON file of outgoing webhooks (an array of webhooks)")
+  flag.IntVar(&challengeDifficulty, "challenge", 0, "Leading zero bits of the SHA-256 proof-of-work challenge clients solve before connecting (disabled if 0)")
+  flag.IntVar(&challengeLoadStep, "challenge-load-step", challengeLoadStep, "Challenges require another bit each time the number of connections doubles past this")
+  flag.DurationVar(&challengeTimeout, "challenge-timeout", challengeTimeout, "How long clients have to solve challenges")
+  flag.StringVar(&deadLetterPath, "dead-letter", "", "Path to append failed outgoing webhook deliveries to")
+  flag.Parse()
+  if flag.NArg() != 1 {
     log.Fatal("must provide the address (and only the address)")
   }
-  addr := os.Args[1]
+  addr := flag.Arg(0)
+  if *accountsPath != "" {
+    accts, err := loadAccounts(*accountsPath)
+    if err != nil {
+      log.Fatalf("error loading accounts: %v", err)
+    }
+    accounts = accts
+  }
+  if *retentionPath != "" {
+    policies, err := loadRetentionPolicies(*retentionPath)
+    if err != nil {
+      log.Fatalf("error loading retention policies: %v", err)
+    }
+    retentionPolicies = policies
+  }
+  if *logPath != "" {
+    // Private rooms mustn't come back public with their history.
+    if roomsPath == "" {
+      roomsPath = *logPath + ".rooms.json"
+    }
+    if err := compactLog(*logPath); err != nil {
+      log.Fatalf("error compacting history log: %v", err)
+    }
+    if err := openHistoryLog(*logPath); err != nil {
+      log.Fatalf("error opening history log: %v", err)
+    }
+  }
+  go runRetention(*compactInterval)
+  if err := loadBans(); err != nil {
+    log.Fatalf("error loading bans: %v", err)
+  }
+  if bansPath != "" {
+    mutesPath = bansPath + ".mutes.json"
+  }
+  if err := loadMutes(); err != nil {
+    log.Fatalf("error loading mutes: %v", err)
+  }
+  if err := loadRooms(); err != nil {
+    log.Fatalf("error loading rooms: %v", err)
+  }
+  if err := loadIgnores(); err != nil {
+    log.Fatalf("error loading ignores: %v", err)
+  }
+  pipeline.Use("moderation", moderationMiddleware{})
+  pipeline.Use("room-modes", newRoomModeMiddleware())
+  if *filterPath != "" {
+    f, err := filter.Load(*filterPath)
+    if err != nil {
+      log.Fatalf("error loading filter: %v", err)
+    }
+    pipeline.Use("filter", f)
+  }
+  if *spamPath != "" {
+    sm, err := loadSpamConfig(*spamPath)
+    if err != nil {
+      log.Fatalf("error loading spam rules: %v", err)
+    }
+    pipeline.Use("spam", sm)
+  }
+  if *webhooksPath != "" {
+    hooks, err := loadIncomingWebhooks(*webhooksPath)
+    if err != nil {
+      log.Fatalf("error loading webhooks: %v", err)
+    }
+    incomingWebhooks = hooks
+  }
+  if *outgoingPath != "" {
+    hooks, err := loadOutgoingWebhooks(*outgoingPath)
+    if err != nil {
+      log.Fatalf("error loading outgoing webhooks: %v", err)
+    }
+    outgoingWebhooks = hooks
+    startOutgoingWebhooks()
+  }
+  // After the middlewares, which scheduled chats go through.
+  if err := loadSchedules(); err != nil {
+    log.Fatalf("error loading schedules: %v", err)
+  }
+  go runSchedules()
+  http.HandleFunc("/webhooks/", webhookHandler)
+  if blobDir != "" {
+    if err := os.MkdirAll(blobDir, 0755); err != nil {
+      log.Fatalf("error creating blob dir: %v", err)
+    }
+    if err := loadBlobsSize(); err != nil {
+      log.Fatalf("error reading blob dir: %v", err)
+    }
+    uploadLimiter = NewIPRateLimiter(uploadRate, uploadBurst)
+    uploadTypes = strings.Split(*uploadTypesStr, ",")
+    http.HandleFunc("/uploads", uploadHandler)
+    http.HandleFunc("/blobs/", blobHandler)
+  }
+  http.HandleFunc("/history", historyHandler)
+  http.HandleFunc("/export", exportHandler)
+  http.HandleFunc("/debug/middleware", middlewareMetricsHandler)
   http.Handle("/", webs.Handler(handler))
+  // After everything sessions use (accounts, webhooks' bots, etc.) is loaded.
+  if *ircAddr != "" {
+    ln, err := net.Listen("tcp", *ircAddr)
+    if err != nil {
+      log.Fatalf("error starting IRC gateway: %v", err)
+    }
+    log.Printf("IRC gateway listening on %s", *ircAddr)
+    go serveIRC(ln)
+  }
   log.Printf("Listening on %s", addr)
   log.Fatal(http.ListenAndServe(addr, nil))
 }
@@ -74,7 +309,54 @@ func handler(ws *webs.Conn) {
     )
   }
 
+  room := ws.Request().URL.Query().Get("room")
+  if !isValidRoomName(room) {
+    webs.JSON.Send(ws, common.NewSystemMessage(common.ActionError, "invalid room name"))
+    return
+  }
+
+  if err := runChallenge(ws); err != nil {
+    webs.JSON.Send(ws, common.NewErrorMessage(err))
+    return
+  }
+
+  client := NewClient(uuid, ws.Request().RemoteAddr, 50)
+  if token := ws.Request().URL.Query().Get("token"); token != "" {
+    identity, role, ok := authenticate(token)
+    if !ok {
+      webs.JSON.Send(ws, common.NewSystemMessage(common.ActionError, "invalid token"))
+      return
+    }
+    client.identity, client.role = identity, role
+    client.SetName(identity)
+  }
+  client.kick = func(reason string) {
+    webs.JSON.Send(ws, common.NewSystemMessage(common.ActionError, reason))
+    ws.Close()
+  }
+  if err := pipeline.Connect(client.Conn(room)); err != nil {
+    if !errors.Is(err, middleware.ErrDrop) {
+      webs.JSON.Send(ws, common.NewErrorMessage(err))
+    }
+    return
+  }
+  ensureRoom(room, client)
+  query := ws.Request().URL.Query()
+  // The middlewares saw the connect, so they're told it didn't happen.
+  if err := checkRoomAccess(client, room, query.Get("password"), query.Get("invite")); err != nil {
+    webs.JSON.Send(ws, common.NewErrorMessage(err))
+    pipeline.Disconnect(client.Conn(room))
+    return
+  }
+  if err := checkRoomCap(client, room); err != nil {
+    webs.JSON.Send(ws, common.NewErrorMessage(err))
+    pipeline.Disconnect(client.Conn(room))
+    return
+  }
+
   msg := common.NewSystemMessage(common.ActionConnect, uuid)
+  msg.Room, msg.Name = room, client.Name()
+  vetoed := pipeline.Broadcast(&msg) != nil
   msgJSONBytes, err := json.Marshal(msg)
   if err != nil {
     webs.JSON.Send(ws, common.NewSystemMessage(common.ActionError, "internal server error"))
@@ -83,14 +365,37 @@ func handler(ws *webs.Conn) {
   }
   // Don't add ws to clients until after sending connect so that messages
   // aren't received before the connect is sent to all.
-  broadcastMsgBytes(msgJSONBytes)
+  if !vetoed {
+    broadcastMsgBytes(room, msgJSONBytes, "")
+    notifyOutgoingWebhooks(msg, msgJSONBytes)
+  }
   ws.Write(msgJSONBytes)
-  channel := NewChannel[[]byte](50)
-  //clients.Store(uuid, ws)
-  clients.Store(uuid, channel)
+  client.JoinRoom(room)
+  clients.Store(uuid, client)
+  wsConns.Add(1)
+  // After joining so the room's member count includes the client, but before
+  // the writer starts so these are sent first.
+  if b, err := json.Marshal(roomMsg(room, roomState(room))); err == nil {
+    ws.Write(b)
+  }
+  if pins := pinsMsg(room, ignoredKeys(client)); len(pins.Messages) != 0 {
+    if b, err := json.Marshal(pins); err == nil {
+      ws.Write(b)
+    }
+  }
+  for _, histMsg := range historySnapshot(room, replaySize, ignoredKeys(client)) {
+    if b, err := json.Marshal(histMsg); err == nil {
+      ws.Write(b)
+    }
+  }
+  if unread, ok := unreadMsg(client, room); ok {
+    if b, err := json.Marshal(unread); err == nil {
+      ws.Write(b)
+    }
+  }
 
   go func() {
-    for msg := range channel.c {
+    for msg := range client.channel.c {
       ws.Write(msg)
     }
   }()
@@ -98,19 +403,29 @@ func handler(ws *webs.Conn) {
   defer func() {
     //clients.Delete(uuid)
     msg := common.NewSystemMessage(common.ActionDisconnect, uuid)
+    msg.Room = room
     /*
     if msgJSONBytes, err := json.Marshal(msg); err == nil {
       ws.Write(msgJSONBytes)
       broadcastMsgBytes(msgJSONBytes)
     }
     */
+    msg.Name = client.Name()
     go broadcastMsg(msg)
-    channel.Close()
+    client.channel.Close()
     clients.Delete(uuid)
+    wsConns.Add(-1)
+    // Identities are reserved, so they aren't in names.
+    if msg.Name != "" && client.identity == "" {
+      names.Delete(strings.ToLower(msg.Name))
+    }
+    forgetReadMarker(client, room)
+    pipeline.Disconnect(client.Conn(room))
   }()
 
   unmarshalTypeError := &json.UnmarshalTypeError{}
   for {
+    msg = common.Message{}
     if err := webs.JSON.Receive(ws, &msg); err != nil {
       if errors.As(err, &unmarshalTypeError) {
         webs.JSON.Send(ws, common.NewSystemMessage(common.ActionError, "bad message"))
@@ -119,24 +434,156 @@ func handler(ws *webs.Conn) {
       }
       return
     }
-    go broadcastMsg(common.NewChatMessage(uuid, msg.Contents))
+    go receiveMsg(client, room, msg)
+  }
+}
+
+// receiveMsg handles a message sent by a client to a room.
+func receiveMsg(client *Client, room string, msg common.Message) {
+  switch msg.Action {
+  case "", common.ActionChat:
+    receiveChat(client, room, msg)
+  case common.ActionEdit:
+    receiveEdit(client, room, msg)
+  case common.ActionDelete:
+    receiveDelete(client, room, msg)
+  case common.ActionReact, common.ActionUnreact:
+    receiveReact(client, room, msg)
+  case common.ActionThread:
+    receiveThread(client, room, msg)
+  case common.ActionRead:
+    receiveRead(client, room, msg)
+  case common.ActionQuery:
+    receiveQuery(client, room, msg)
+  case common.ActionPoll:
+    receivePoll(client, room, msg)
+  case common.ActionVote:
+    receiveVote(client, room, msg)
+  case common.ActionClose:
+    receiveClose(client, room, msg)
+  case common.ActionPin, common.ActionUnpin:
+    receivePin(client, room, msg)
+  default:
+    sendVeto(client, room, &common.ErrorInfo{
+      Code: "unsupported_action",
+      Message: fmt.Sprintf("can't send %q messages", msg.Action),
+    })
+  }
+}
+
+// receiveChat handles a chat sent by a client to a room, running it as a
+// command if it is one. A leading "//" sends a chat starting with "/". Only
+// the contents, replyTo, ttl and attachments of the chat sent are used.
+func receiveChat(client *Client, room string, in common.Message) {
+  msg := common.NewChatMessage(client.id, in.Contents)
+  msg.Room, msg.Name, msg.ReplyTo = room, client.Name(), in.ReplyTo
+  if len(in.Attachments) != 0 {
+    attachments, err := resolveAttachments(in.Attachments)
+    if err != nil {
+      sendVeto(client, room, err)
+      return
+    }
+    msg.Attachments = attachments
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  if strings.HasPrefix(msg.Contents, "//") {
+    msg.Contents = msg.Contents[1:]
+  } else if runCommand(client, room, msg.Contents) {
+    return
+  }
+  if msg.ReplyTo != 0 {
+    if err := setReplyThread(room, &msg); err != nil {
+      sendVeto(client, room, err)
+      return
+    }
+  }
+  if in.TTL != 0 {
+    if err := setExpiry(&msg, in.TTL); err != nil {
+      sendVeto(client, room, err)
+      return
+    }
+  }
+  broadcastFrom(client, msg)
+}
+
+// sendVeto tells the client why a middleware rejected what it sent.
+func sendVeto(client *Client, room string, err error) {
+  if errors.Is(err, middleware.ErrDrop) {
+    return
   }
+  msg := common.NewErrorMessage(err)
+  msg.Room = room
+  client.SendMsg(msg)
 }
 
+// isValidRoomName reports whether the name can be used as a room. The empty
+// name is the default room.
+func isValidRoomName(name string) bool {
+  if len(name) > 64 {
+    return false
+  }
+  for _, r := range name {
+    switch {
+    case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+    case r == '-', r == '_', r == '.':
+    default:
+      return false
+    }
+  }
+  return true
+}
+
+// broadcastMsg sends the message to its room, unless a middleware vetoes it.
 func broadcastMsg(msg common.Message) error {
+  _, _, err := broadcastFrom(nil, msg)
+  return err
+}
+
+// broadcastFrom broadcasts a message sent by the client (nil for the system
+// and bots), recording it in history and notifying mentioned users if it's a
+// chat. It returns the message as it was sent (with its ID and mentions if
+// it's recorded), and false if a middleware vetoed it.
+func broadcastFrom(client *Client, msg common.Message) (common.Message, bool, error) {
+  if err := pipeline.Broadcast(&msg); err != nil {
+    return msg, false, nil
+  }
+  if isRecorded(msg.Action) {
+    msg.Mentions = parseMentions(msg.Contents)
+    identity := ""
+    if client != nil {
+      identity = client.identity
+    }
+    recordMsg(&msg, identity)
+  }
   msgJSONBytes, err := json.Marshal(msg)
   if err != nil {
-    return err
+    return msg, false, err
   }
-  broadcastMsgBytes(msgJSONBytes)
-  return nil
+  from := senderKey(client, &msg)
+  broadcastMsgBytes(msg.Room, msgJSONBytes, from)
+  notifyOutgoingWebhooks(msg, msgJSONBytes)
+  notifyMentions(msg, from)
+  return msg, true, nil
 }
 
-func broadcastMsgBytes(b []byte) {
+// broadcastMsgBytes sends the message to the room, except to those ignoring
+// the user with the key from (if any).
+func broadcastMsgBytes(room string, b []byte, from string) {
   //clients.Range(func(_, iWs any) bool {
     //iWs.(*webs.Conn).Write(b)
-  clients.Range(func(_, iChannel any) bool {
-    iChannel.(*Channel[[]byte]).Send(b)
+  clients.Range(func(_, iClient any) bool {
+    client := iClient.(*Client)
+    if client.InRoom(room) && !isIgnoring(client, from) {
+      client.channel.Send(b)
+    }
     return true
   })
 }
+
+func middlewareMetricsHandler(w http.ResponseWriter, r *http.Request) {
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(pipeline.Metrics())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+  "regexp"
+  "strings"
+
+  "wschat/wschat-go/common"
+)
+
+// Matches "@" and what follows it, up to whitespace, unless it's in the
+// middle of a word (e.g., an email address).
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\pL\pN_@])(@[^\s@]+)`)
+
+// Trimmed from the end of mentions that don't match anyone, so "@bob," works.
+const mentionTrailing = ".,:;!?)]}'\""
+
+// parseMentions returns the users mentioned in the contents: those signed in
+// as (or with an account for) the name, or connected with it as their display
+// name.
+func parseMentions(contents string) []common.Mention {
+  var mentions []common.Mention
+  for _, loc := range mentionRegexp.FindAllStringSubmatchIndex(contents, -1) {
+    start, end := loc[2], loc[3]
+    for name := contents[start+1 : end]; name != ""; {
+      if mention, ok := resolveMention(name); ok {
+        mention.Offset, mention.Length = start, len(name)+1
+        mentions = append(mentions, mention)
+        break
+      }
+      trimmed := strings.TrimRight(name, mentionTrailing)
+      if trimmed == name {
+        break
+      }
+      name = trimmed
+    }
+  }
+  return mentions
+}
+
+func resolveMention(name string) (common.Mention, bool) {
+  for identity := range accounts {
+    if strings.EqualFold(identity, name) {
+      return common.Mention{Name: identity, ID: identity}, true
+    }
+  }
+  if iID, ok := names.Load(strings.ToLower(name)); ok {
+    if iClient, ok := clients.Load(iID); ok {
+      client := iClient.(*Client)
+      return common.Mention{Name: client.Name(), ID: client.id}, true
+    }
+  }
+  return common.Mention{}, false
+}
+
+// notifyMentions sends a mention message to every connection of the users
+// mentioned in the chat, whatever room they're in, unless they ignore the
+// sender with the key from.
+func notifyMentions(msg common.Message, from string) {
+  if len(msg.Mentions) == 0 {
+    return
+  }
+  mentioned := make(map[string]bool, len(msg.Mentions))
+  for _, mention := range msg.Mentions {
+    mentioned[mention.ID] = true
+  }
+  // Users aren't notified of mentioning themselves.
+  senderIdentity := ""
+  if iSender, ok := clients.Load(msg.Sender); ok {
+    senderIdentity = iSender.(*Client).identity
+  }
+  notification := msg
+  notification.Action = common.ActionMention
+  clients.Range(func(_, iClient any) bool {
+    client := iClient.(*Client)
+    if client.id == msg.Sender || (senderIdentity != "" && client.identity == senderIdentity) {
+      return true
+    }
+    if !mentioned[client.id] && !(client.identity != "" && mentioned[client.identity]) {
+      return true
+    }
+    // Chats in rooms that aren't public don't leak to non-members.
+    if canAccessRoom(client, msg.Room) && !isIgnoring(client, from) {
+      client.SendMsg(notification)
+    }
+    return true
+  })
+}
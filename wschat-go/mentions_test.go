@@ -0,0 +1,51 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+func TestParseMentions(t *testing.T) {
+  oldAccounts := accounts
+  accounts = map[string]*Account{"Alice": {Token: "atok"}}
+  client := NewClient("mention-bob-id", "", 1)
+  client.SetName("Bob")
+  clients.Store(client.id, client)
+  names.Store("bob", client.id)
+  t.Cleanup(func() {
+    accounts = oldAccounts
+    clients.Delete(client.id)
+    names.Delete("bob")
+  })
+
+  alice := func(offset, length int) common.Mention {
+    return common.Mention{Name: "Alice", ID: "Alice", Offset: offset, Length: length}
+  }
+  bob := func(offset, length int) common.Mention {
+    return common.Mention{Name: "Bob", ID: client.id, Offset: offset, Length: length}
+  }
+  tests := []struct {
+    contents string
+    want []common.Mention
+  }{
+    {"no mentions", nil},
+    {"@alice", []common.Mention{alice(0, 6)}},
+    {"hi @ALICE and @bob", []common.Mention{alice(3, 6), bob(14, 4)}},
+    {"@bob, @alice!", []common.Mention{bob(0, 4), alice(6, 6)}},
+    {"(@bob)", []common.Mention{bob(1, 4)}},
+    {"@bob's turn", nil},
+    {"@carol", nil},
+    {"mail alice@example.com", nil},
+    {"@@bob", nil},
+    {"@", nil},
+    {"héllo @bob", []common.Mention{bob(7, 4)}},
+    {"line\n@alice", []common.Mention{alice(5, 6)}},
+  }
+  for _, tt := range tests {
+    if got := parseMentions(tt.contents); !reflect.DeepEqual(got, tt.want) {
+      t.Errorf("parseMentions(%q) = %+v, want %+v", tt.contents, got, tt.want)
+    }
+  }
+}
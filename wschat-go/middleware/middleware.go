@@ -0,0 +1,183 @@
+// Package middleware hooks into the flow of messages through the server.
+package middleware
+
+import (
+  "errors"
+  "sync/atomic"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// ErrDrop vetoes silently; the client isn't told.
+var ErrDrop = errors.New("dropped")
+
+// Conn describes a client in a room.
+type Conn struct {
+  ID string
+  // Empty if the client hasn't set a display name.
+  Name string
+  // Empty if the client isn't signed in.
+  Identity string
+  Room string
+  RemoteAddr string
+  // Whether it's a bot posting through an incoming webhook.
+  Bot bool
+}
+
+// Middleware hooks into the message flow. Returning a non-nil error vetoes
+// the connect or message, and the error is sent to the client (unless it's
+// ErrDrop). Embed Base to only implement some of the hooks.
+type Middleware interface {
+  // OnConnect is called before a client joins a room.
+  OnConnect(conn Conn) error
+  // OnMessage is called for each message a client sends, before commands are
+  // run. The message can be modified.
+  OnMessage(conn Conn, msg *common.Message) error
+  // BeforeBroadcast is called for everything broadcast to a room, including
+  // system messages. The message can be modified.
+  BeforeBroadcast(msg *common.Message) error
+  // OnDisconnect is called after a client leaves a room.
+  OnDisconnect(conn Conn)
+}
+
+// Base implements Middleware, doing nothing.
+type Base struct{}
+
+func (Base) OnConnect(Conn) error {
+  return nil
+}
+
+func (Base) OnMessage(Conn, *common.Message) error {
+  return nil
+}
+
+func (Base) BeforeBroadcast(*common.Message) error {
+  return nil
+}
+
+func (Base) OnDisconnect(Conn) {}
+
+// HookMetrics counts calls to one of a middleware's hooks.
+type HookMetrics struct {
+  Calls atomic.Uint64
+  Vetoes atomic.Uint64
+  Nanos atomic.Int64
+}
+
+func (hm *HookMetrics) record(start time.Time, err error) {
+  hm.Calls.Add(1)
+  if err != nil {
+    hm.Vetoes.Add(1)
+  }
+  hm.Nanos.Add(int64(time.Since(start)))
+}
+
+// HookSnapshot is a point-in-time copy of HookMetrics.
+type HookSnapshot struct {
+  Calls uint64 `json:"calls"`
+  Vetoes uint64 `json:"vetoes"`
+  Nanos int64 `json:"nanos"`
+}
+
+func (hm *HookMetrics) Snapshot() HookSnapshot {
+  return HookSnapshot{
+    Calls: hm.Calls.Load(),
+    Vetoes: hm.Vetoes.Load(),
+    Nanos: hm.Nanos.Load(),
+  }
+}
+
+// Metrics are the metrics of one middleware.
+type Metrics struct {
+  Connect HookMetrics
+  Message HookMetrics
+  Broadcast HookMetrics
+  Disconnect HookMetrics
+}
+
+// Snapshot is a point-in-time copy of a middleware's metrics.
+type Snapshot struct {
+  Name string `json:"name"`
+  Connect HookSnapshot `json:"connect"`
+  Message HookSnapshot `json:"message"`
+  Broadcast HookSnapshot `json:"broadcast"`
+  Disconnect HookSnapshot `json:"disconnect"`
+}
+
+type entry struct {
+  name string
+  mw Middleware
+  metrics Metrics
+}
+
+// Chain runs middlewares in the order they were added, stopping at the first
+// veto. Middlewares must all be added before the chain is used.
+type Chain struct {
+  entries []*entry
+}
+
+// Use adds a middleware to the end of the chain.
+func (c *Chain) Use(name string, mw Middleware) {
+  c.entries = append(c.entries, &entry{name: name, mw: mw})
+}
+
+func (c *Chain) Connect(conn Conn) error {
+  for _, e := range c.entries {
+    start := time.Now()
+    err := e.mw.OnConnect(conn)
+    e.metrics.Connect.record(start, err)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (c *Chain) Message(conn Conn, msg *common.Message) error {
+  for _, e := range c.entries {
+    start := time.Now()
+    err := e.mw.OnMessage(conn, msg)
+    e.metrics.Message.record(start, err)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+func (c *Chain) Broadcast(msg *common.Message) error {
+  for _, e := range c.entries {
+    start := time.Now()
+    err := e.mw.BeforeBroadcast(msg)
+    e.metrics.Broadcast.record(start, err)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Disconnect runs every middleware's OnDisconnect.
+func (c *Chain) Disconnect(conn Conn) {
+  for _, e := range c.entries {
+    start := time.Now()
+    e.mw.OnDisconnect(conn)
+    e.metrics.Disconnect.record(start, nil)
+  }
+}
+
+// Metrics returns the metrics of each middleware, in order.
+func (c *Chain) Metrics() []Snapshot {
+  snapshots := make([]Snapshot, len(c.entries))
+  for i, e := range c.entries {
+    snapshots[i] = Snapshot{
+      Name: e.name,
+      Connect: e.metrics.Connect.Snapshot(),
+      Message: e.metrics.Message.Snapshot(),
+      Broadcast: e.metrics.Broadcast.Snapshot(),
+      Disconnect: e.metrics.Disconnect.Snapshot(),
+    }
+  }
+  return snapshots
+}
@@ -0,0 +1,162 @@
+package middleware
+
+import (
+  "errors"
+  "reflect"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// recorder records its hook calls in calls, appending its name to messages'
+// contents and vetoing what's in veto.
+type recorder struct {
+  name string
+  calls *[]string
+  veto map[string]bool
+}
+
+func (r recorder) hook(hook string) error {
+  *r.calls = append(*r.calls, r.name+"."+hook)
+  if r.veto[hook] {
+    return errors.New(r.name + " vetoed " + hook)
+  }
+  return nil
+}
+
+func (r recorder) OnConnect(Conn) error {
+  return r.hook("connect")
+}
+
+func (r recorder) OnMessage(_ Conn, msg *common.Message) error {
+  msg.Contents += "+" + r.name
+  return r.hook("message")
+}
+
+func (r recorder) BeforeBroadcast(msg *common.Message) error {
+  msg.Contents += "+" + r.name
+  return r.hook("broadcast")
+}
+
+func (r recorder) OnDisconnect(Conn) {
+  r.hook("disconnect")
+}
+
+func TestChain(t *testing.T) {
+  tests := []struct {
+    name string
+    // The hooks b vetoes.
+    veto map[string]bool
+    hook string
+    wantCalls []string
+    wantContents string
+    wantErr string
+  }{
+    {
+      name: "connect", hook: "connect",
+      wantCalls: []string{"a.connect", "b.connect", "c.connect"},
+    },
+    {
+      name: "connect vetoed", veto: map[string]bool{"connect": true}, hook: "connect",
+      wantCalls: []string{"a.connect", "b.connect"}, wantErr: "b vetoed connect",
+    },
+    {
+      name: "message", hook: "message",
+      wantCalls: []string{"a.message", "b.message", "c.message"}, wantContents: "hi+a+b+c",
+    },
+    {
+      name: "message vetoed", veto: map[string]bool{"message": true}, hook: "message",
+      wantCalls: []string{"a.message", "b.message"}, wantContents: "hi+a+b", wantErr: "b vetoed message",
+    },
+    {
+      name: "broadcast", hook: "broadcast",
+      wantCalls: []string{"a.broadcast", "b.broadcast", "c.broadcast"}, wantContents: "hi+a+b+c",
+    },
+    {
+      name: "broadcast vetoed", veto: map[string]bool{"broadcast": true}, hook: "broadcast",
+      wantCalls: []string{"a.broadcast", "b.broadcast"}, wantContents: "hi+a+b",
+      wantErr: "b vetoed broadcast",
+    },
+    {
+      // Disconnects can't be vetoed.
+      name: "disconnect", veto: map[string]bool{"disconnect": true}, hook: "disconnect",
+      wantCalls: []string{"a.disconnect", "b.disconnect", "c.disconnect"},
+    },
+  }
+  for _, tt := range tests {
+    var calls []string
+    chain := &Chain{}
+    chain.Use("a", recorder{name: "a", calls: &calls})
+    chain.Use("b", recorder{name: "b", calls: &calls, veto: tt.veto})
+    chain.Use("c", recorder{name: "c", calls: &calls})
+    msg := common.Message{Contents: "hi"}
+    var err error
+    switch tt.hook {
+    case "connect":
+      err = chain.Connect(Conn{ID: "x"})
+    case "message":
+      err = chain.Message(Conn{ID: "x"}, &msg)
+    case "broadcast":
+      err = chain.Broadcast(&msg)
+    case "disconnect":
+      chain.Disconnect(Conn{ID: "x"})
+    }
+    if !reflect.DeepEqual(calls, tt.wantCalls) {
+      t.Errorf("%s: calls = %q, want %q", tt.name, calls, tt.wantCalls)
+    }
+    if tt.wantContents != "" && msg.Contents != tt.wantContents {
+      t.Errorf("%s: contents = %q, want %q", tt.name, msg.Contents, tt.wantContents)
+    }
+    if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+      t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+    }
+  }
+}
+
+func TestChainMetrics(t *testing.T) {
+  var calls []string
+  chain := &Chain{}
+  chain.Use("a", recorder{name: "a", calls: &calls})
+  chain.Use("b", recorder{name: "b", calls: &calls, veto: map[string]bool{"message": true}})
+  // Embedding Base does nothing.
+  chain.Use("base", Base{})
+  msg := common.Message{}
+  chain.Connect(Conn{})
+  chain.Connect(Conn{})
+  chain.Message(Conn{}, &msg)
+  chain.Broadcast(&msg)
+  chain.Disconnect(Conn{})
+
+  snapshots := chain.Metrics()
+  for i := range snapshots {
+    for _, hook := range []*HookSnapshot{
+      &snapshots[i].Connect, &snapshots[i].Message, &snapshots[i].Broadcast, &snapshots[i].Disconnect,
+    } {
+      if hook.Nanos < 0 {
+        t.Errorf("%s: negative nanos", snapshots[i].Name)
+      }
+      hook.Nanos = 0
+    }
+  }
+  want := []Snapshot{
+    {
+      Name: "a",
+      Connect: HookSnapshot{Calls: 2}, Message: HookSnapshot{Calls: 1},
+      Broadcast: HookSnapshot{Calls: 1}, Disconnect: HookSnapshot{Calls: 1},
+    },
+    {
+      Name: "b",
+      Connect: HookSnapshot{Calls: 2}, Message: HookSnapshot{Calls: 1, Vetoes: 1},
+      Broadcast: HookSnapshot{Calls: 1}, Disconnect: HookSnapshot{Calls: 1},
+    },
+    {
+      // Not reached by the vetoed message.
+      Name: "base",
+      Connect: HookSnapshot{Calls: 2},
+      Broadcast: HookSnapshot{Calls: 1}, Disconnect: HookSnapshot{Calls: 1},
+    },
+  }
+  if !reflect.DeepEqual(snapshots, want) {
+    t.Errorf("metrics = %+v, want %+v", snapshots, want)
+  }
+}
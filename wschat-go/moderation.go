@@ -0,0 +1,617 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net"
+  "os"
+  "strings"
+  "sync"
+  "time"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+// Ban keeps an identity or network from joining.
+type Ban struct {
+  Identity string `json:"identity,omitempty"`
+  CIDR string `json:"cidr,omitempty"`
+  Reason string `json:"reason,omitempty"`
+  By string `json:"by"`
+  Created int64 `json:"created"`
+  // Unix nanoseconds, 0 for never.
+  Expires int64 `json:"expires,omitempty"`
+
+  network *net.IPNet
+}
+
+func (b *Ban) expired(now time.Time) bool {
+  return b.Expires != 0 && now.UnixNano() >= b.Expires
+}
+
+func (b *Ban) matches(identity string, ip net.IP) bool {
+  if b.Identity != "" {
+    return identity != "" && strings.EqualFold(b.Identity, identity)
+  }
+  return ip != nil && b.network.Contains(ip)
+}
+
+func (b *Ban) target() string {
+  if b.Identity != "" {
+    return b.Identity
+  }
+  return b.CIDR
+}
+
+var (
+  // Where bans are persisted, empty if they aren't.
+  bansPath string
+  bans []*Ban
+  bansMtx sync.RWMutex
+
+  // Where mutes are persisted (next to bans), empty if they aren't.
+  mutesPath string
+  // map[muteKey]when the mute ends, in Unix nanoseconds
+  mutes = make(map[string]int64)
+  mutesMtx sync.Mutex
+)
+
+// loadBans reads the bans file, if there is one.
+func loadBans() error {
+  if bansPath == "" {
+    return nil
+  }
+  f, err := os.Open(bansPath)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  defer f.Close()
+  var loaded []*Ban
+  if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+    return err
+  }
+  for i, ban := range loaded {
+    if ban.Identity == "" && ban.CIDR == "" {
+      return fmt.Errorf("ban %d: needs an identity or cidr", i+1)
+    }
+    if ban.CIDR != "" {
+      if _, ban.network, err = net.ParseCIDR(ban.CIDR); err != nil {
+        return err
+      }
+    }
+  }
+  bansMtx.Lock()
+  bans = loaded
+  bansMtx.Unlock()
+  return nil
+}
+
+// saveBans writes the bans to the bans file. bansMtx must be held.
+func saveBans() error {
+  if bansPath == "" {
+    return nil
+  }
+  b, err := json.MarshalIndent(bans, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := bansPath + ".tmp"
+  if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, bansPath)
+}
+
+func addBan(ban *Ban) {
+  bansMtx.Lock()
+  defer bansMtx.Unlock()
+  bans = append(bans, ban)
+  if err := saveBans(); err != nil {
+    log.Printf("error saving bans: %v", err)
+  }
+}
+
+// removeBans removes the bans of the identity or network, returning how many
+// there were.
+func removeBans(target string) int {
+  if _, network, err := net.ParseCIDR(normalizeCIDR(target)); err == nil {
+    target = network.String()
+  }
+  bansMtx.Lock()
+  defer bansMtx.Unlock()
+  kept := bans[:0]
+  for _, ban := range bans {
+    if !strings.EqualFold(ban.target(), target) {
+      kept = append(kept, ban)
+    }
+  }
+  n := len(bans) - len(kept)
+  bans = kept
+  if n != 0 {
+    if err := saveBans(); err != nil {
+      log.Printf("error saving bans: %v", err)
+    }
+  }
+  return n
+}
+
+func findBan(identity, addr string) *Ban {
+  ip := addrIP(addr)
+  now := time.Now()
+  bansMtx.RLock()
+  defer bansMtx.RUnlock()
+  for _, ban := range bans {
+    if !ban.expired(now) && ban.matches(identity, ip) {
+      return ban
+    }
+  }
+  return nil
+}
+
+// addrIP gets the IP from a "host:port" address.
+func addrIP(addr string) net.IP {
+  host, _, err := net.SplitHostPort(addr)
+  if err != nil {
+    host = addr
+  }
+  return net.ParseIP(host)
+}
+
+// normalizeCIDR turns a lone IP into a single address network.
+func normalizeCIDR(s string) string {
+  if ip := net.ParseIP(s); ip != nil {
+    if ip.To4() != nil {
+      return s + "/32"
+    }
+    return s + "/128"
+  }
+  return s
+}
+
+// userKey identifies a user by identity if they're signed in, and connection
+// otherwise. Reactions are by user key.
+func userKey(id, identity string) string {
+  if identity != "" {
+    return "identity:" + strings.ToLower(identity)
+  }
+  return "id:" + id
+}
+
+// muteKey identifies a user for mutes: by identity if they're signed in, and
+// otherwise by IP (like bans), so they can't escape by reconnecting.
+func muteKey(id, identity, addr string) string {
+  if identity == "" {
+    if ip := addrIP(addr); ip != nil {
+      return "ip:" + ip.String()
+    }
+  }
+  return userKey(id, identity)
+}
+
+// loadMutes reads the mutes file, if there is one.
+func loadMutes() error {
+  if mutesPath == "" {
+    return nil
+  }
+  f, err := os.Open(mutesPath)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  defer f.Close()
+  loaded := make(map[string]int64)
+  if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+    return err
+  }
+  mutesMtx.Lock()
+  mutes = loaded
+  mutesMtx.Unlock()
+  return nil
+}
+
+// saveMutesLocked writes the mutes that haven't ended to the mutes file.
+// mutesMtx must be held.
+func saveMutesLocked() error {
+  if mutesPath == "" {
+    return nil
+  }
+  now := time.Now().UnixNano()
+  for key, until := range mutes {
+    if now >= until {
+      delete(mutes, key)
+    }
+  }
+  b, err := json.MarshalIndent(mutes, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := mutesPath + ".tmp"
+  if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, mutesPath)
+}
+
+func addMute(key string, until time.Time) {
+  mutesMtx.Lock()
+  defer mutesMtx.Unlock()
+  mutes[key] = until.UnixNano()
+  if err := saveMutesLocked(); err != nil {
+    log.Printf("error saving mutes: %v", err)
+  }
+}
+
+// removeMute removes the mute, returning whether there was one.
+func removeMute(key string) bool {
+  mutesMtx.Lock()
+  defer mutesMtx.Unlock()
+  if _, ok := mutes[key]; !ok {
+    return false
+  }
+  delete(mutes, key)
+  if err := saveMutesLocked(); err != nil {
+    log.Printf("error saving mutes: %v", err)
+  }
+  return true
+}
+
+func mutedUntil(key string) (time.Time, bool) {
+  mutesMtx.Lock()
+  defer mutesMtx.Unlock()
+  until, ok := mutes[key]
+  if !ok {
+    return time.Time{}, false
+  }
+  if time.Now().UnixNano() >= until {
+    delete(mutes, key)
+    return time.Time{}, false
+  }
+  return time.Unix(0, until), true
+}
+
+// moderationMiddleware enforces bans and mutes.
+type moderationMiddleware struct {
+  middleware.Base
+}
+
+func (moderationMiddleware) OnConnect(conn middleware.Conn) error {
+  if ban := findBan(conn.Identity, conn.RemoteAddr); ban != nil {
+    if ban.Reason != "" {
+      return fmt.Errorf("you are banned: %s", ban.Reason)
+    }
+    return errors.New("you are banned")
+  }
+  return nil
+}
+
+func (moderationMiddleware) OnMessage(conn middleware.Conn, _ *common.Message) error {
+  if until, ok := mutedUntil(muteKey(conn.ID, conn.Identity, conn.RemoteAddr)); ok {
+    return fmt.Errorf(
+      "you are muted for another %s", time.Until(until).Round(time.Second),
+    )
+  }
+  return nil
+}
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "mute",
+    Usage: "/mute <user> <duration> [reason]",
+    Help: "Keep a user from sending messages (moderators)",
+    Run: cmdMute,
+  })
+  RegisterCommand(&Command{
+    Name: "unmute",
+    Usage: "/unmute <user|IP>",
+    Help: "Unmute a user, or anonymous users at an IP (moderators)",
+    Run: cmdUnmute,
+  })
+  RegisterCommand(&Command{
+    Name: "kick",
+    Usage: "/kick <user> [reason]",
+    Help: "Disconnect a user (moderators)",
+    Run: cmdKick,
+  })
+  RegisterCommand(&Command{
+    Name: "ban",
+    Usage: "/ban <user|identity|IP|CIDR> [duration] [reason]",
+    Help: "Ban and disconnect a user or network (moderators)",
+    Run: cmdBan,
+  })
+  RegisterCommand(&Command{
+    Name: "unban",
+    Usage: "/unban <identity|IP|CIDR>",
+    Help: "Remove a ban (moderators)",
+    Run: cmdUnban,
+  })
+  RegisterCommand(&Command{
+    Name: "bans",
+    Usage: "/bans",
+    Help: "List bans (moderators)",
+    Run: cmdBans,
+  })
+}
+
+func requireModerator(ctx *CommandContext) error {
+  if !ctx.Client.role.AtLeast(RoleModerator) {
+    return errors.New("permission denied")
+  }
+  return nil
+}
+
+// canModerate reports whether the actor outranks the target.
+func canModerate(actor, target *Client) bool {
+  return actor.role.rank() > target.role.rank()
+}
+
+// findClients finds the connected clients with the ID, name or identity.
+func findClients(target string) []*Client {
+  var found []*Client
+  clients.Range(func(_, iClient any) bool {
+    client := iClient.(*Client)
+    if client.id == target ||
+      strings.EqualFold(client.Name(), target) ||
+      strings.EqualFold(client.identity, target) {
+      found = append(found, client)
+    }
+    return true
+  })
+  return found
+}
+
+// findModeratable finds the clients the command targets, making sure the
+// actor outranks each.
+func findModeratable(ctx *CommandContext, target string) ([]*Client, error) {
+  found := findClients(target)
+  if len(found) == 0 {
+    return nil, fmt.Errorf("no such user: %s", target)
+  }
+  for _, client := range found {
+    if !canModerate(ctx.Client, client) {
+      return nil, errors.New("permission denied")
+    }
+  }
+  return found, nil
+}
+
+// announce broadcasts the moderation action to the room.
+func announce(ctx *CommandContext, contents string) {
+  msg := common.NewSystemMessage(common.ActionModeration, contents)
+  msg.Room = ctx.Room
+  broadcastMsg(msg)
+}
+
+func withReason(s, reason string) string {
+  if reason != "" {
+    return s + ": " + reason
+  }
+  return s
+}
+
+func cmdMute(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  fields := strings.SplitN(ctx.Args, " ", 3)
+  if len(fields) < 2 {
+    return errors.New("usage: /mute <user> <duration> [reason]")
+  }
+  dur, err := time.ParseDuration(fields[1])
+  if err != nil || dur <= 0 {
+    return fmt.Errorf("invalid duration: %s", fields[1])
+  }
+  targets, err := findModeratable(ctx, fields[0])
+  if err != nil {
+    return err
+  }
+  until := time.Now().Add(dur)
+  for _, client := range targets {
+    addMute(muteKey(client.id, client.identity, client.addr), until)
+  }
+  reason := ""
+  if len(fields) == 3 {
+    reason = strings.TrimSpace(fields[2])
+  }
+  announce(ctx, withReason(fmt.Sprintf(
+    "%s was muted by %s for %s",
+    targets[0].DisplayName(), ctx.Client.DisplayName(), dur,
+  ), reason))
+  return nil
+}
+
+func cmdUnmute(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  if ctx.Args == "" {
+    return errors.New("usage: /unmute <user|IP>")
+  }
+  // Anonymous users muted by IP may not be connected.
+  if ip := net.ParseIP(ctx.Args); ip != nil {
+    if !removeMute("ip:" + ip.String()) {
+      return fmt.Errorf("no mute for %s", ctx.Args)
+    }
+    announce(ctx, "a network was unmuted by "+ctx.Client.DisplayName())
+    return nil
+  }
+  targets, err := findModeratable(ctx, ctx.Args)
+  if err != nil {
+    return err
+  }
+  for _, client := range targets {
+    removeMute(muteKey(client.id, client.identity, client.addr))
+  }
+  announce(ctx, fmt.Sprintf(
+    "%s was unmuted by %s", targets[0].DisplayName(), ctx.Client.DisplayName(),
+  ))
+  return nil
+}
+
+func cmdKick(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  target, reason, _ := strings.Cut(ctx.Args, " ")
+  if target == "" {
+    return errors.New("usage: /kick <user> [reason]")
+  }
+  targets, err := findModeratable(ctx, target)
+  if err != nil {
+    return err
+  }
+  reason = strings.TrimSpace(reason)
+  announce(ctx, withReason(fmt.Sprintf(
+    "%s was kicked by %s", targets[0].DisplayName(), ctx.Client.DisplayName(),
+  ), reason))
+  for _, client := range targets {
+    client.Kick(withReason("kicked by "+ctx.Client.DisplayName(), reason))
+  }
+  return nil
+}
+
+func cmdBan(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  fields := strings.SplitN(ctx.Args, " ", 3)
+  if fields[0] == "" {
+    return errors.New("usage: /ban <user|identity|IP|CIDR> [duration] [reason]")
+  }
+  target, reason := fields[0], ""
+  var dur time.Duration
+  if len(fields) > 1 {
+    if d, err := time.ParseDuration(fields[1]); err == nil && d > 0 {
+      dur = d
+      fields = append(fields[:1], fields[2:]...)
+    }
+    reason = strings.TrimSpace(strings.Join(fields[1:], " "))
+  }
+
+  now := time.Now()
+  ban := &Ban{
+    Reason: reason,
+    By: ctx.Client.DisplayName(),
+    Created: now.UnixNano(),
+  }
+  if dur != 0 {
+    ban.Expires = now.Add(dur).UnixNano()
+  }
+  // The name shown in the announcement; IPs aren't shown.
+  shown := target
+  if _, network, err := net.ParseCIDR(normalizeCIDR(target)); err == nil {
+    ban.CIDR, ban.network, shown = network.String(), network, "a network"
+  } else if found := findClients(target); len(found) != 0 {
+    if !canModerate(ctx.Client, found[0]) {
+      return errors.New("permission denied")
+    }
+    shown = found[0].DisplayName()
+    if found[0].identity != "" {
+      ban.Identity = found[0].identity
+    } else {
+      // Anonymous users can only be banned by address.
+      ip := addrIP(found[0].addr)
+      if ip == nil {
+        return errors.New("user has no address to ban")
+      }
+      _, ban.network, _ = net.ParseCIDR(normalizeCIDR(ip.String()))
+      ban.CIDR = ban.network.String()
+    }
+  } else if acct := findAccount(target); acct != "" {
+    if ctx.Client.role.rank() <= accounts[acct].Role.rank() {
+      return errors.New("permission denied")
+    }
+    ban.Identity, shown = acct, acct
+  } else {
+    return fmt.Errorf("no such user: %s", target)
+  }
+
+  // Everyone connected that the ban covers is disconnected, so the moderator
+  // must outrank them all.
+  var banned []*Client
+  allowed := true
+  clients.Range(func(_, iClient any) bool {
+    client := iClient.(*Client)
+    if ban.matches(client.identity, addrIP(client.addr)) {
+      allowed = canModerate(ctx.Client, client)
+      banned = append(banned, client)
+    }
+    return allowed
+  })
+  if !allowed {
+    return errors.New("permission denied")
+  }
+  addBan(ban)
+
+  text := fmt.Sprintf("%s was banned by %s", shown, ctx.Client.DisplayName())
+  if dur != 0 {
+    text += " for " + dur.String()
+  }
+  announce(ctx, withReason(text, reason))
+  for _, client := range banned {
+    client.Kick(withReason("banned by "+ctx.Client.DisplayName(), reason))
+  }
+  return nil
+}
+
+// findAccount returns the identity of the account with the name, empty if
+// there isn't one.
+func findAccount(name string) string {
+  for identity := range accounts {
+    if strings.EqualFold(identity, name) {
+      return identity
+    }
+  }
+  return ""
+}
+
+func cmdUnban(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  if ctx.Args == "" {
+    return errors.New("usage: /unban <identity|IP|CIDR>")
+  }
+  if removeBans(ctx.Args) == 0 {
+    return fmt.Errorf("no bans for %s", ctx.Args)
+  }
+  shown := ctx.Args
+  if _, _, err := net.ParseCIDR(normalizeCIDR(shown)); err == nil {
+    shown = "a network"
+  }
+  announce(ctx, fmt.Sprintf("%s was unbanned by %s", shown, ctx.Client.DisplayName()))
+  return nil
+}
+
+func cmdBans(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  now := time.Now()
+  var lines []string
+  bansMtx.RLock()
+  for _, ban := range bans {
+    if ban.expired(now) {
+      continue
+    }
+    line := fmt.Sprintf("%s (by %s)", ban.target(), ban.By)
+    if ban.Expires != 0 {
+      line += " until " + time.Unix(0, ban.Expires).UTC().Format(time.RFC3339)
+    }
+    lines = append(lines, withReason(line, ban.Reason))
+  }
+  bansMtx.RUnlock()
+  if len(lines) == 0 {
+    ctx.Reply("No bans")
+  } else {
+    ctx.Reply(fmt.Sprintf("%d ban(s):\n%s", len(lines), strings.Join(lines, "\n")))
+  }
+  return nil
+}
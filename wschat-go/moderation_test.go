@@ -0,0 +1,218 @@
+package main
+
+import (
+  "net"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+// resetModeration clears bans and mutes, persisting them in a temp dir, and
+// restores them when the test ends.
+func resetModeration(t *testing.T) {
+  oldBans, oldBansPath := bans, bansPath
+  oldMutes, oldMutesPath := mutes, mutesPath
+  bansPath = filepath.Join(t.TempDir(), "bans.json")
+  mutesPath = bansPath + ".mutes.json"
+  bans, mutes = nil, make(map[string]int64)
+  t.Cleanup(func() {
+    bans, bansPath = oldBans, oldBansPath
+    mutes, mutesPath = oldMutes, oldMutesPath
+  })
+}
+
+func TestMuteKey(t *testing.T) {
+  tests := []struct {
+    id, identity, addr string
+    want string
+  }{
+    {"c1", "Alice", "192.0.2.1:1234", "identity:alice"},
+    {"c1", "", "192.0.2.1:1234", "ip:192.0.2.1"},
+    // Reconnecting gets the same key.
+    {"c2", "", "192.0.2.1:5678", "ip:192.0.2.1"},
+    {"c1", "", "[2001:db8::1]:1234", "ip:2001:db8::1"},
+    {"c1", "", "", "id:c1"},
+  }
+  for _, tt := range tests {
+    if got := muteKey(tt.id, tt.identity, tt.addr); got != tt.want {
+      t.Errorf("muteKey(%q, %q, %q) = %q, want %q", tt.id, tt.identity, tt.addr, got, tt.want)
+    }
+  }
+}
+
+func TestFindBan(t *testing.T) {
+  resetModeration(t)
+  now := time.Now()
+  for _, target := range []string{"Alice", "198.51.100.0/24", "2001:db8::1"} {
+    ban := &Ban{By: "mod", Created: now.UnixNano()}
+    if _, network, err := net.ParseCIDR(normalizeCIDR(target)); err == nil {
+      ban.CIDR, ban.network = network.String(), network
+    } else {
+      ban.Identity = target
+    }
+    addBan(ban)
+  }
+  addBan(&Ban{Identity: "Expired", Expires: now.Add(-time.Minute).UnixNano()})
+
+  tests := []struct {
+    identity, addr string
+    banned bool
+  }{
+    {"alice", "192.0.2.1:1", true},
+    {"bob", "192.0.2.1:1", false},
+    {"", "198.51.100.7:1", true},
+    {"bob", "198.51.100.255:1", true},
+    {"", "198.51.101.1:1", false},
+    {"", "[2001:db8::1]:1", true},
+    {"", "[2001:db8::2]:1", false},
+    {"expired", "192.0.2.1:1", false},
+    {"", "", false},
+  }
+  for _, tt := range tests {
+    if got := findBan(tt.identity, tt.addr); (got != nil) != tt.banned {
+      t.Errorf("findBan(%q, %q) = %+v, want banned: %v", tt.identity, tt.addr, got, tt.banned)
+    }
+  }
+
+  // They're persisted.
+  bans = nil
+  if err := loadBans(); err != nil {
+    t.Fatal(err)
+  }
+  if got := findBan("", "198.51.100.7:1"); got == nil {
+    t.Error("network ban wasn't reloaded")
+  }
+  if n := removeBans("198.51.100.0/24"); n != 1 {
+    t.Errorf("removeBans = %d, want 1", n)
+  }
+  if n := removeBans("2001:db8::1"); n != 1 {
+    t.Errorf("removeBans of a lone IP = %d, want 1", n)
+  }
+  if got := findBan("", "198.51.100.7:1"); got != nil {
+    t.Errorf("removed ban still found: %+v", got)
+  }
+}
+
+func TestModerationCommands(t *testing.T) {
+  resetModeration(t)
+  setTestAccounts(t, map[string]*Account{
+    "mod": {Token: "m", Role: RoleModerator},
+    "admin": {Token: "a", Role: RoleAdmin},
+    "bob": {Token: "b", Role: RoleUser},
+  })
+  mod := newTestClient(t, "mod-conn", "mod", "mod-room")
+  admin := newTestClient(t, "admin-conn", "admin", "mod-room")
+  bob := newTestClient(t, "bob-conn", "bob", "mod-room")
+  anon := newTestClient(t, "anon-conn", "", "mod-room")
+  anon.SetName("anon")
+  anon.addr = "203.0.113.5:4000"
+  var kicked []string
+  for _, client := range []*Client{mod, admin, bob, anon} {
+    client := client
+    client.kick = func(reason string) {
+      kicked = append(kicked, client.id+": "+reason)
+    }
+  }
+  mw := moderationMiddleware{}
+  // Reconnecting from the same IP, and connecting from another.
+  anonAgain := newTestClient(t, "anon-again", "", "mod-room")
+  anonAgain.addr = "203.0.113.5:4001"
+  elsewhere := newTestClient(t, "elsewhere", "", "mod-room")
+  elsewhere.addr = "203.0.113.6:4000"
+
+  tests := []struct {
+    client *Client
+    command string
+    wantErr string
+    // Whether each of anon, anonAgain, elsewhere and bob is then muted.
+    muted [4]bool
+    // Whether each of them is then banned.
+    banned [4]bool
+  }{
+    {client: bob, command: "/mute anon 1m", wantErr: "permission denied"},
+    {client: mod, command: "/mute admin 1m", wantErr: "permission denied"},
+    {client: mod, command: "/mute anon", wantErr: "usage"},
+    {client: mod, command: "/mute anon soon", wantErr: "invalid duration"},
+    {client: mod, command: "/mute nobody 1m", wantErr: "no such user"},
+    {client: mod, command: "/mute anon 1m spamming", muted: [4]bool{true, true, false, false}},
+    {client: mod, command: "/mute bob 1m", muted: [4]bool{true, true, false, true}},
+    {client: mod, command: "/unmute bob", muted: [4]bool{true, true, false, false}},
+    {client: mod, command: "/unmute 203.0.113.6", wantErr: "no mute for", muted: [4]bool{true, true, false, false}},
+    {client: mod, command: "/unmute 203.0.113.5"},
+    {client: mod, command: "/ban admin", wantErr: "permission denied"},
+    {client: bob, command: "/ban anon", wantErr: "permission denied"},
+    {client: mod, command: "/ban anon 1h flooding", banned: [4]bool{true, true, false, false}},
+    {client: mod, command: "/ban bob", banned: [4]bool{true, true, false, true}},
+    {client: mod, command: "/unban 203.0.113.5", banned: [4]bool{false, false, false, true}},
+    {client: mod, command: "/unban bob"},
+    {client: mod, command: "/unban bob", wantErr: "no bans for bob"},
+    {client: mod, command: "/ban 203.0.113.0/24", banned: [4]bool{true, true, true, false}},
+    {client: mod, command: "/unban 203.0.113.0/24"},
+  }
+  targets := []*Client{anon, anonAgain, elsewhere, bob}
+  for _, tt := range tests {
+    received(t, tt.client)
+    runCommand(tt.client, "mod-room", tt.command)
+    msgs := received(t, tt.client)
+    var err string
+    for _, msg := range msgs {
+      if msg.Action == "error" {
+        err = msg.Contents
+      }
+    }
+    if tt.wantErr == "" && err != "" || !strings.Contains(err, tt.wantErr) {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    for i, client := range targets {
+      muted := mw.OnMessage(client.Conn("mod-room"), nil) != nil
+      banned := mw.OnConnect(client.Conn("mod-room")) != nil
+      if muted != tt.muted[i] || banned != tt.banned[i] {
+        t.Errorf("%s: %s muted, banned = %v, %v, want %v, %v",
+          tt.command, client.id, muted, banned, tt.muted[i], tt.banned[i])
+      }
+    }
+  }
+
+  want := []string{
+    "anon-conn: banned by mod: flooding",
+    "bob-conn: banned by mod",
+    "anon-conn: banned by mod",
+  }
+  if strings.Join(kicked, "\n") != strings.Join(want, "\n") {
+    t.Errorf("kicked %q, want %q", kicked, want)
+  }
+}
+
+func TestMutesPersisted(t *testing.T) {
+  resetModeration(t)
+  now := time.Now()
+  addMute("ip:192.0.2.1", now.Add(time.Hour))
+  addMute("identity:alice", now.Add(time.Hour))
+  // Dropped when saved.
+  mutes["identity:gone"] = now.Add(-time.Second).UnixNano()
+  addMute("identity:bob", now.Add(time.Minute))
+
+  mutes = make(map[string]int64)
+  if err := loadMutes(); err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    key string
+    want bool
+  }{
+    {"ip:192.0.2.1", true},
+    {"identity:alice", true},
+    {"identity:bob", true},
+    {"identity:gone", false},
+    {"ip:192.0.2.2", false},
+  }
+  for _, tt := range tests {
+    if _, ok := mutedUntil(tt.key); ok != tt.want {
+      t.Errorf("mutedUntil(%q) = %v, want %v", tt.key, ok, tt.want)
+    }
+  }
+  if _, ok := mutes["identity:gone"]; ok {
+    t.Error("expired mute was saved")
+  }
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "strconv"
+  "strings"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+var (
+  // The max number of pinned chats per room.
+  maxPins = 10
+
+  errAlreadyPinned = &common.ErrorInfo{Code: "already_pinned", Message: "message is already pinned"}
+  errNotPinned = &common.ErrorInfo{Code: "not_pinned", Message: "message isn't pinned"}
+  errNotModerator = &common.ErrorInfo{
+    Code: "forbidden", Message: "only moderators can do that",
+  }
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "pin",
+    Usage: "/pin <message ID>",
+    Help: "Pin a message to the room (moderators only)",
+    Run: cmdPin,
+  })
+  RegisterCommand(&Command{
+    Name: "unpin",
+    Usage: "/unpin <message ID>",
+    Help: "Unpin a message (moderators only)",
+    Run: cmdUnpin,
+  })
+  RegisterCommand(&Command{
+    Name: "pins",
+    Usage: "/pins",
+    Help: "List the room's pinned messages",
+    Run: cmdPins,
+  })
+}
+
+func errTooManyPins() error {
+  return &common.ErrorInfo{
+    Code: "too_many_pins",
+    Message: fmt.Sprintf("rooms can have at most %d pinned messages", maxPins),
+  }
+}
+
+// pinnedMsgs returns the chats in the room with the IDs, in order, from
+// history or the durable log. Those deleted or expired, or by ignored users,
+// are left out.
+func pinnedMsgs(room string, ids []uint64, ignored map[string]bool) []common.Message {
+  found := make(map[uint64]common.Message, len(ids))
+  missing := make(map[uint64]bool)
+  historyMtx.RLock()
+  rh, ok := histories[room]
+  for _, id := range ids {
+    if ok && rh.byID[id] != nil {
+      if !rh.byID[id].ignoredBy(ignored) {
+        found[id] = rh.byID[id].message()
+      }
+    } else {
+      missing[id] = true
+    }
+  }
+  historyMtx.RUnlock()
+  if len(missing) != 0 {
+    // One pass over the log for all of them.
+    entries, err := loggedEntries(room, func(msg *common.Message) bool {
+      return missing[msg.ID]
+    })
+    if err != nil {
+      log.Printf("error reading history log: %v", err)
+    }
+    for _, entry := range entries {
+      if !entry.ignoredBy(ignored) {
+        found[entry.Msg.ID] = entry.message()
+      }
+    }
+  }
+  msgs := make([]common.Message, 0, len(ids))
+  for _, id := range ids {
+    if msg, ok := found[id]; ok {
+      msgs = append(msgs, msg)
+    }
+  }
+  return msgs
+}
+
+// pinsMsg returns a pins message of the room's pinned chats, leaving out those
+// by ignored users.
+func pinsMsg(room string, ignored map[string]bool) common.Message {
+  msg := common.NewSystemMessage(common.ActionPins, "")
+  msg.Room = room
+  msg.Messages = pinnedMsgs(room, roomState(room).Pins, ignored)
+  return msg
+}
+
+// pinMsg pins or unpins the chat in the room, returning the message to
+// broadcast.
+func pinMsg(client *Client, room string, id uint64, pin bool) (common.Message, error) {
+  if !client.role.AtLeast(RoleModerator) {
+    return common.Message{}, errNotModerator
+  }
+  out := common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: common.ActionUnpin,
+    Room: room,
+    Name: client.Name(),
+  }
+  if pin {
+    chat, err := findMsg(room, id)
+    if err != nil {
+      return common.Message{}, err
+    }
+    out.Action, out.Messages = common.ActionPin, []common.Message{chat}
+  }
+  // Pins of chats since deleted or expired are dropped to make space.
+  var live map[uint64]bool
+  if pins := roomState(room).Pins; pin && len(pins) >= maxPins {
+    live = make(map[uint64]bool)
+    for _, msg := range pinnedMsgs(room, pins, nil) {
+      live[msg.ID] = true
+    }
+  }
+  var err error
+  updateRoom(room, func(state *RoomState) {
+    if live != nil {
+      var kept []uint64
+      for _, pinned := range state.Pins {
+        if live[pinned] {
+          kept = append(kept, pinned)
+        }
+      }
+      state.Pins = kept
+    }
+    i := indexOfPin(state.Pins, id)
+    switch {
+    case pin && i != -1:
+      err = errAlreadyPinned
+    case pin && len(state.Pins) >= maxPins:
+      err = errTooManyPins()
+    case pin:
+      state.Pins = append(append([]uint64{}, state.Pins...), id)
+    case i == -1:
+      err = errNotPinned
+    default:
+      state.Pins = append(append([]uint64{}, state.Pins[:i]...), state.Pins[i+1:]...)
+    }
+  })
+  if err != nil {
+    return common.Message{}, err
+  }
+  out.Timestamp = time.Now().UnixNano()
+  return out, nil
+}
+
+func indexOfPin(pins []uint64, id uint64) int {
+  for i, pinned := range pins {
+    if pinned == id {
+      return i
+    }
+  }
+  return -1
+}
+
+// receivePin handles a pin or unpin sent by a client.
+func receivePin(client *Client, room string, in common.Message) {
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: in.Action,
+    Room: room,
+    Name: client.Name(),
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  out, err := pinMsg(client, room, msg.ID, msg.Action == common.ActionPin)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastMsg(out)
+}
+
+func runPinCommand(ctx *CommandContext, pin bool) error {
+  id, err := strconv.ParseUint(ctx.Args, 10, 64)
+  if err != nil {
+    if pin {
+      return errors.New("usage: /pin <message ID>")
+    }
+    return errors.New("usage: /unpin <message ID>")
+  }
+  out, err := pinMsg(ctx.Client, ctx.Room, id, pin)
+  if err != nil {
+    return err
+  }
+  broadcastMsg(out)
+  return nil
+}
+
+func cmdPin(ctx *CommandContext) error {
+  return runPinCommand(ctx, true)
+}
+
+func cmdUnpin(ctx *CommandContext) error {
+  return runPinCommand(ctx, false)
+}
+
+func cmdPins(ctx *CommandContext) error {
+  msgs := pinsMsg(ctx.Room, ignoredKeys(ctx.Client)).Messages
+  if len(msgs) == 0 {
+    ctx.Reply("No pinned messages")
+    return nil
+  }
+  lines := make([]string, len(msgs))
+  for i, msg := range msgs {
+    name := msg.Name
+    if name == "" {
+      name = msg.Sender
+    }
+    lines[i] = fmt.Sprintf("%d <%s> %s", msg.ID, name, msg.Contents)
+  }
+  ctx.Reply(fmt.Sprintf("%d pinned message(s):\n%s", len(msgs), strings.Join(lines, "\n")))
+  return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+  "reflect"
+  "strconv"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+func TestPinMsg(t *testing.T) {
+  useTestHistory(t)
+  useTestRooms(t)
+  oldMax, oldSize := maxPins, historySize
+  maxPins, historySize = 3, 3
+  t.Cleanup(func() {
+    maxPins, historySize = oldMax, oldSize
+  })
+  mod := NewClient("pin-mod", "", 0)
+  mod.identity, mod.role = "mod", RoleModerator
+  user := NewClient("pin-user", "", 0)
+  user.identity = "bob"
+  var ids []uint64
+  for _, contents := range []string{"zero", "one", "two", "three", "four", "five"} {
+    ids = append(ids, recordTestChat(user, "pins", contents))
+  }
+
+  tests := []struct {
+    name string
+    client *Client
+    id uint64
+    pin bool
+    wantCode string
+    wantPins []uint64
+  }{
+    {name: "not a moderator", client: user, id: ids[5], pin: true, wantCode: "forbidden"},
+    // Chats no longer in memory are found in the log.
+    {name: "pin from the log", client: mod, id: ids[0], pin: true, wantPins: ids[:1]},
+    {name: "pin again", client: mod, id: ids[0], pin: true, wantCode: "already_pinned", wantPins: ids[:1]},
+    {name: "pin missing", client: mod, id: 999, pin: true, wantCode: "not_found", wantPins: ids[:1]},
+    {name: "pin", client: mod, id: ids[4], pin: true, wantPins: []uint64{ids[0], ids[4]}},
+    {name: "unpin not pinned", client: mod, id: ids[5], wantCode: "not_pinned", wantPins: []uint64{ids[0], ids[4]}},
+    {name: "pin to the max", client: mod, id: ids[5], pin: true, wantPins: []uint64{ids[0], ids[4], ids[5]}},
+    {name: "pin past the max", client: mod, id: ids[3], pin: true, wantCode: "too_many_pins", wantPins: []uint64{ids[0], ids[4], ids[5]}},
+    {name: "unpin", client: mod, id: ids[4], wantPins: []uint64{ids[0], ids[5]}},
+    {name: "unpin not a moderator", client: user, id: ids[0], wantCode: "forbidden", wantPins: []uint64{ids[0], ids[5]}},
+  }
+  for _, tt := range tests {
+    msg, err := pinMsg(tt.client, "pins", tt.id, tt.pin)
+    var code string
+    if info, ok := err.(*common.ErrorInfo); ok {
+      code = info.Code
+    }
+    if code != tt.wantCode || err != nil && code == "" {
+      t.Errorf("%s: err = %v, want %s", tt.name, err, tt.wantCode)
+    } else if err == nil {
+      var wantAction common.Action = common.ActionUnpin
+      if tt.pin {
+        wantAction = common.ActionPin
+      }
+      if msg.Action != wantAction || msg.ID != tt.id || msg.Sender != tt.client.id ||
+        tt.pin && (len(msg.Messages) != 1 || msg.Messages[0].ID != tt.id) {
+        t.Errorf("%s: sent %+v", tt.name, msg)
+      }
+    }
+    if got := roomState("pins").Pins; !reflect.DeepEqual(got, tt.wantPins) {
+      t.Errorf("%s: pins = %v, want %v", tt.name, got, tt.wantPins)
+    }
+  }
+
+  // Pins of deleted chats are left out, and dropped to make space.
+  if _, err := pinMsg(mod, "pins", ids[4], true); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := deleteMsg(mod, "pins", ids[4]); err != nil {
+    t.Fatal(err)
+  }
+  var contents []string
+  for _, msg := range pinsMsg("pins", nil).Messages {
+    contents = append(contents, msg.Contents)
+  }
+  if want := []string{"zero", "five"}; !reflect.DeepEqual(contents, want) {
+    t.Errorf("pinned = %q, want %q", contents, want)
+  }
+  if _, err := pinMsg(mod, "pins", ids[3], true); err != nil {
+    t.Errorf("pinning with a deleted pin at the max: %v", err)
+  }
+  if got, want := roomState("pins").Pins, []uint64{ids[0], ids[5], ids[3]}; !reflect.DeepEqual(got, want) {
+    t.Errorf("pins = %v, want %v", got, want)
+  }
+
+  // Pins by ignored users are left out.
+  ignored := map[string]bool{userKey("", "bob"): true}
+  if msgs := pinsMsg("pins", ignored).Messages; len(msgs) != 0 {
+    t.Errorf("pinned by an ignored user: %+v", msgs)
+  }
+}
+
+func TestPinCommands(t *testing.T) {
+  useTestHistory(t)
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "mod": {Token: "m", Role: RoleModerator},
+    "bob": {Token: "b", Role: RoleUser},
+  })
+  mod := newTestClient(t, "pincmd-mod", "mod", "pinned")
+  bob := newTestClient(t, "pincmd-bob", "bob", "pinned")
+  bob.SetName("bob")
+  idStr := strconv.FormatUint(recordTestChat(bob, "pinned", "remember this"), 10)
+
+  tests := []struct {
+    client *Client
+    command string
+    wantInfo, wantErr string
+  }{
+    {client: bob, command: "/pins", wantInfo: "No pinned messages"},
+    {client: mod, command: "/pin", wantErr: "usage: /pin"},
+    {client: mod, command: "/unpin x", wantErr: "usage: /unpin"},
+    {client: bob, command: "/pin " + idStr, wantErr: errNotModerator.Message},
+    {client: mod, command: "/pin " + idStr},
+    {client: bob, command: "/pins", wantInfo: "1 pinned message(s):\n" + idStr + " <bob> remember this"},
+    {client: mod, command: "/unpin " + idStr},
+    {client: bob, command: "/pins", wantInfo: "No pinned messages"},
+  }
+  for _, tt := range tests {
+    info, err := runTestCommand(t, tt.client, "pinned", tt.command)
+    if !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    if info != tt.wantInfo {
+      t.Errorf("%s: info %q, want %q", tt.command, info, tt.wantInfo)
+    }
+  }
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+  "container/heap"
+  "errors"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+
+  "wschat/wschat-go/common"
+)
+
+const (
+  maxPollQuestionLen = 300
+  maxPollOptionLen = 100
+  minPollOptions = 2
+  maxPollOptions = 10
+  // The longest a poll can be open for, if it has a close time.
+  maxPollDuration = 30 * 24 * time.Hour
+)
+
+var (
+  errInvalidPoll = &common.ErrorInfo{
+    Code: "invalid_poll",
+    Message: "polls need a question of up to 300 characters and 2-10 options of up to 100",
+  }
+  errInvalidPollCloses = &common.ErrorInfo{
+    Code: "invalid_poll",
+    Message: "polls must close within 30 days",
+  }
+  errNotPoll = &common.ErrorInfo{Code: "not_poll", Message: "message isn't a poll"}
+  errPollClosed = &common.ErrorInfo{Code: "poll_closed", Message: "poll is closed"}
+  errInvalidChoices = &common.ErrorInfo{
+    Code: "invalid_choices", Message: "choices must be different options of the poll",
+  }
+  errSingleChoice = &common.ErrorInfo{
+    Code: "invalid_choices", Message: "poll allows only one choice",
+  }
+  errVotedFromIP = &common.ErrorInfo{
+    Code: "already_voted", Message: "someone else has voted from your network",
+  }
+  errPollNotEditable = &common.ErrorInfo{
+    Code: "not_editable", Message: "polls can't be edited",
+  }
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "vote",
+    Usage: "/vote <poll ID> [option number,...]",
+    Help: "Vote for options of a poll (numbered from 1), or with none, take back your vote",
+    Run: cmdVote,
+  })
+}
+
+// pollTally returns the entry's poll with its current tallies.
+func (entry *HistoryEntry) pollTally() *common.Poll {
+  poll := *entry.Msg.Poll
+  poll.Votes = make([]int, len(poll.Options))
+  for _, choices := range entry.votes {
+    for _, choice := range choices {
+      poll.Votes[choice]++
+    }
+  }
+  poll.Voters = len(entry.votes)
+  return &poll
+}
+
+// applyVoteLocked replaces the user's vote on the poll with the choices, cast
+// from the IP (if known).
+func applyVoteLocked(entry *HistoryEntry, key, ip string, choices []int) {
+  if entry.Msg.Poll == nil || entry.Msg.Poll.Closed {
+    return
+  }
+  for _, choice := range choices {
+    if choice < 0 || choice >= len(entry.Msg.Poll.Options) {
+      return
+    }
+  }
+  if len(choices) == 0 {
+    delete(entry.votes, key)
+    // Their IPs can be voted from again.
+    for voterIP, voter := range entry.voterIPs {
+      if voter == key {
+        delete(entry.voterIPs, voterIP)
+      }
+    }
+    return
+  }
+  if entry.votes == nil {
+    entry.votes = make(map[string][]int)
+  }
+  entry.votes[key] = choices
+  if ip != "" {
+    if entry.voterIPs == nil {
+      entry.voterIPs = make(map[string]string)
+    }
+    entry.voterIPs[ip] = key
+  }
+}
+
+func closePollLocked(entry *HistoryEntry) {
+  if entry.Msg.Poll == nil {
+    return
+  }
+  // The poll may be shared with copies of the message.
+  poll := *entry.Msg.Poll
+  poll.Closed = true
+  entry.Msg.Poll = &poll
+}
+
+func isPollOpen(poll *common.Poll, now time.Time) bool {
+  return !poll.Closed && (poll.Closes == 0 || poll.Closes > now.UnixNano())
+}
+
+// Polls in memory that close at a set time, guarded by historyMtx.
+var pollCloses expiryHeap
+
+// schedulePollCloseLocked adds the poll to pollCloses if it has a close time.
+func schedulePollCloseLocked(msg *common.Message) {
+  if msg.Poll != nil && msg.Poll.Closes != 0 && !msg.Poll.Closed {
+    heap.Push(&pollCloses, expiry{msg.Poll.Closes, msg.Room, msg.ID})
+  }
+}
+
+// closeDuePolls closes the polls whose close times have passed, broadcasting
+// their final tallies.
+func closeDuePolls(now time.Time) {
+  var closed []common.Message
+  historyMtx.Lock()
+  for len(pollCloses) != 0 && pollCloses[0].expires <= now.UnixNano() {
+    exp := heap.Pop(&pollCloses).(expiry)
+    rh, ok := histories[exp.room]
+    if !ok {
+      continue
+    }
+    entry, ok := rh.byID[exp.id]
+    if !ok || entry.Msg.Poll.Closed {
+      // Deleted or closed already.
+      continue
+    }
+    closePollLocked(entry)
+    appendLogLocked(&logRecord{
+      Op: "close", Room: exp.room, ID: exp.id, Timestamp: now.UnixNano(),
+    })
+    msg := common.NewSystemMessage(common.ActionClose, "")
+    msg.ID, msg.Room, msg.Poll = exp.id, exp.room, entry.pollTally()
+    closed = append(closed, msg)
+  }
+  historyMtx.Unlock()
+  for _, msg := range closed {
+    broadcastMsg(msg)
+  }
+}
+
+// newPoll checks the poll sent by a client with its question, returning the
+// poll to broadcast.
+func newPoll(question string, in *common.Poll, now time.Time) (*common.Poll, error) {
+  if in == nil || question == "" || utf8.RuneCountInString(question) > maxPollQuestionLen {
+    return nil, errInvalidPoll
+  }
+  if len(in.Options) < minPollOptions || len(in.Options) > maxPollOptions {
+    return nil, errInvalidPoll
+  }
+  poll := &common.Poll{
+    Options: make([]string, len(in.Options)),
+    Multi: in.Multi,
+    Closes: in.Closes,
+    Votes: make([]int, len(in.Options)),
+  }
+  for i, option := range in.Options {
+    option = strings.TrimSpace(option)
+    if option == "" || utf8.RuneCountInString(option) > maxPollOptionLen {
+      return nil, errInvalidPoll
+    }
+    poll.Options[i] = option
+  }
+  if poll.Closes != 0 &&
+    (poll.Closes <= now.UnixNano() || poll.Closes > now.Add(maxPollDuration).UnixNano()) {
+    return nil, errInvalidPollCloses
+  }
+  return poll, nil
+}
+
+// receivePoll handles a poll created by a client.
+func receivePoll(client *Client, room string, in common.Message) {
+  now := time.Now()
+  question := strings.TrimSpace(in.Contents)
+  poll, err := newPoll(question, in.Poll, now)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  msg := common.Message{
+    Sender: client.id,
+    Action: common.ActionPoll,
+    Contents: question,
+    Timestamp: now.UnixNano(),
+    Room: room,
+    Name: client.Name(),
+    Poll: poll,
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastFrom(client, msg)
+}
+
+// checkChoices returns why the choices can't be voted for in the poll, if
+// they can't.
+func checkChoices(poll *common.Poll, choices []int) error {
+  if len(choices) > 1 && !poll.Multi {
+    return errSingleChoice
+  }
+  seen := make(map[int]bool, len(choices))
+  for _, choice := range choices {
+    if choice < 0 || choice >= len(poll.Options) || seen[choice] {
+      return errInvalidChoices
+    }
+    seen[choice] = true
+  }
+  return nil
+}
+
+// voterKey returns who the client votes as, and the IP they vote from (empty
+// if unknown): their identity if they're signed in, otherwise their IP, so
+// reconnecting doesn't get anonymous users another vote.
+//
+// Each IP can only vote as one voter, so signing in (or out) doesn't get
+// anyone another vote either. The trade-off is that users behind the same
+// NAT share one vote until its voter takes it back.
+func voterKey(client *Client) (key, ip string) {
+  if addr := addrIP(client.addr); addr != nil {
+    ip = addr.String()
+  }
+  if client.identity == "" && ip != "" {
+    return "ip:" + ip, ip
+  }
+  return userKey(client.id, client.identity), ip
+}
+
+// voteMsg replaces the client's vote on a poll, returning the vote to
+// broadcast. Each user (by voterKey) has one vote, and each IP votes as one
+// user.
+func voteMsg(client *Client, room string, id uint64, choices []int) (common.Message, error) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  entry, ok := roomHistoryLocked(room).byID[id]
+  if !ok {
+    return common.Message{}, errMsgNotFound
+  }
+  if entry.Msg.Poll == nil {
+    return common.Message{}, errNotPoll
+  }
+  now := time.Now()
+  if !isPollOpen(entry.Msg.Poll, now) {
+    return common.Message{}, errPollClosed
+  }
+  if err := checkChoices(entry.Msg.Poll, choices); err != nil {
+    return common.Message{}, err
+  }
+  key, ip := voterKey(client)
+  if voter, ok := entry.voterIPs[ip]; ok && voter != key {
+    return common.Message{}, errVotedFromIP
+  }
+  applyVoteLocked(entry, key, ip, choices)
+  appendLogLocked(&logRecord{
+    Op: "vote", Room: room, ID: id, By: key, Contents: ip, Timestamp: now.UnixNano(),
+    Choices: choices,
+  })
+  return common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: common.ActionVote,
+    Timestamp: now.UnixNano(),
+    Room: room,
+    Name: client.Name(),
+    Poll: entry.pollTally(),
+  }, nil
+}
+
+// receiveVote handles a vote sent by a client.
+func receiveVote(client *Client, room string, in common.Message) {
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: common.ActionVote,
+    Room: room,
+    Name: client.Name(),
+    Choices: in.Choices,
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  vote, err := voteMsg(client, room, msg.ID, msg.Choices)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastMsg(vote)
+}
+
+// closePoll closes a poll, returning the close to broadcast.
+func closePoll(client *Client, room string, id uint64) (common.Message, error) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  entry, ok := roomHistoryLocked(room).byID[id]
+  if !ok {
+    return common.Message{}, errMsgNotFound
+  }
+  if entry.Msg.Poll == nil {
+    return common.Message{}, errNotPoll
+  }
+  if !canChange(client, entry) {
+    return common.Message{}, errNotAuthor
+  }
+  now := time.Now()
+  if !isPollOpen(entry.Msg.Poll, now) {
+    return common.Message{}, errPollClosed
+  }
+  closePollLocked(entry)
+  appendLogLocked(&logRecord{
+    Op: "close", Room: room, ID: id, Timestamp: now.UnixNano(),
+  })
+  return common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: common.ActionClose,
+    Timestamp: now.UnixNano(),
+    Room: room,
+    Name: client.Name(),
+    Poll: entry.pollTally(),
+  }, nil
+}
+
+// receiveClose handles a client closing a poll.
+func receiveClose(client *Client, room string, in common.Message) {
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: common.ActionClose,
+    Room: room,
+    Name: client.Name(),
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  closed, err := closePoll(client, room, msg.ID)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  broadcastMsg(closed)
+}
+
+func cmdVote(ctx *CommandContext) error {
+  usage := errors.New("usage: /vote <poll ID> [option number,...]")
+  idArg, choicesArg, _ := strings.Cut(ctx.Args, " ")
+  id, err := strconv.ParseUint(idArg, 10, 64)
+  if err != nil {
+    return usage
+  }
+  var choices []int
+  for _, field := range strings.FieldsFunc(choicesArg, func(r rune) bool {
+    return r == ',' || r == ' '
+  }) {
+    n, err := strconv.Atoi(field)
+    if err != nil {
+      return usage
+    }
+    choices = append(choices, n-1)
+  }
+  vote, err := voteMsg(ctx.Client, ctx.Room, id, choices)
+  if err != nil {
+    return err
+  }
+  broadcastMsg(vote)
+  return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// recordTestPoll records a poll by the client with the options, returning
+// its ID.
+func recordTestPoll(client *Client, room string, multi bool, closes int64, options ...string) uint64 {
+  msg := common.Message{
+    Sender: client.id, Action: common.ActionPoll, Contents: "?", Room: room,
+    Timestamp: time.Now().UnixNano(),
+    Poll: &common.Poll{Options: options, Multi: multi, Closes: closes, Votes: make([]int, len(options))},
+  }
+  recordMsg(&msg, client.identity)
+  return msg.ID
+}
+
+func TestNewPoll(t *testing.T) {
+  now := time.Now()
+  tests := []struct {
+    name, question string
+    in *common.Poll
+    wantOptions []string
+    wantErr error
+  }{
+    {name: "poll", question: "lunch?", in: &common.Poll{Options: []string{" pizza ", "tacos"}}, wantOptions: []string{"pizza", "tacos"}},
+    {name: "no poll", question: "lunch?", wantErr: errInvalidPoll},
+    {name: "no question", in: &common.Poll{Options: []string{"a", "b"}}, wantErr: errInvalidPoll},
+    {name: "long question", question: strings.Repeat("?", maxPollQuestionLen+1), in: &common.Poll{Options: []string{"a", "b"}}, wantErr: errInvalidPoll},
+    {name: "one option", question: "?", in: &common.Poll{Options: []string{"a"}}, wantErr: errInvalidPoll},
+    {name: "too many options", question: "?", in: &common.Poll{Options: make([]string, maxPollOptions+1)}, wantErr: errInvalidPoll},
+    {name: "blank option", question: "?", in: &common.Poll{Options: []string{"a", "  "}}, wantErr: errInvalidPoll},
+    {name: "long option", question: "?", in: &common.Poll{Options: []string{"a", strings.Repeat("é", maxPollOptionLen+1)}}, wantErr: errInvalidPoll},
+    {name: "closes", question: "?", in: &common.Poll{Options: []string{"a", "b"}, Closes: now.Add(time.Hour).UnixNano()}, wantOptions: []string{"a", "b"}},
+    {name: "closed already", question: "?", in: &common.Poll{Options: []string{"a", "b"}, Closes: now.UnixNano()}, wantErr: errInvalidPollCloses},
+    {name: "closes too late", question: "?", in: &common.Poll{Options: []string{"a", "b"}, Closes: now.Add(maxPollDuration + time.Hour).UnixNano()}, wantErr: errInvalidPollCloses},
+  }
+  for _, tt := range tests {
+    poll, err := newPoll(tt.question, tt.in, now)
+    if err != tt.wantErr {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+    // Clients can't set the tallies.
+    if !reflect.DeepEqual(poll.Options, tt.wantOptions) || len(poll.Votes) != len(tt.wantOptions) || poll.Voters != 0 || poll.Closed {
+      t.Errorf("%s: poll = %+v, want options %q", tt.name, poll, tt.wantOptions)
+    }
+  }
+}
+
+func TestCheckChoices(t *testing.T) {
+  single := &common.Poll{Options: []string{"a", "b", "c"}}
+  multi := &common.Poll{Options: []string{"a", "b", "c"}, Multi: true}
+  tests := []struct {
+    poll *common.Poll
+    choices []int
+    want error
+  }{
+    {single, []int{0}, nil},
+    {single, []int{2}, nil},
+    {single, nil, nil},
+    {single, []int{0, 1}, errSingleChoice},
+    {single, []int{3}, errInvalidChoices},
+    {single, []int{-1}, errInvalidChoices},
+    {multi, []int{0, 2}, nil},
+    {multi, []int{0, 0}, errInvalidChoices},
+    {multi, []int{1, 5}, errInvalidChoices},
+  }
+  for _, tt := range tests {
+    if got := checkChoices(tt.poll, tt.choices); got != tt.want {
+      t.Errorf("checkChoices(multi: %v, %v) = %v, want %v", tt.poll.Multi, tt.choices, got, tt.want)
+    }
+  }
+}
+
+func TestVoteMsg(t *testing.T) {
+  useTestHistory(t)
+  historyMtx.Lock()
+  oldCloses := pollCloses
+  pollCloses = nil
+  historyMtx.Unlock()
+  t.Cleanup(func() {
+    historyMtx.Lock()
+    pollCloses = oldCloses
+    historyMtx.Unlock()
+  })
+  client := func(id, addr, identity string) *Client {
+    c := NewClient(id, addr, 0)
+    c.identity = identity
+    return c
+  }
+  alice := client("vote-alice", "192.0.2.1:1000", "alice")
+  aliceElsewhere := client("vote-alice-2", "192.0.2.2:1000", "alice")
+  anonSameIP := client("vote-anon-1", "192.0.2.1:2000", "")
+  anon := client("vote-anon-2", "192.0.2.3:1000", "")
+  anonReconnected := client("vote-anon-3", "192.0.2.3:2000", "")
+  bobSameIP := client("vote-bob", "192.0.2.3:3000", "bob")
+  carol := client("vote-carol", "192.0.2.4:1000", "carol")
+  single := recordTestPoll(alice, "polls", false, 0, "a", "b", "c")
+  multi := recordTestPoll(alice, "polls", true, 0, "a", "b", "c")
+  notPoll := recordTestChat(alice, "polls", "not a poll")
+
+  tests := []struct {
+    name string
+    client *Client
+    id uint64
+    choices []int
+    wantErr error
+    wantVotes []int
+    wantVoters int
+  }{
+    {name: "vote", client: alice, id: single, choices: []int{0}, wantVotes: []int{1, 0, 0}, wantVoters: 1},
+    {name: "change vote", client: alice, id: single, choices: []int{1}, wantVotes: []int{0, 1, 0}, wantVoters: 1},
+    // Signed-in users vote as their identity, from any IP.
+    {name: "change from another IP", client: aliceElsewhere, id: single, choices: []int{2}, wantVotes: []int{0, 0, 1}, wantVoters: 1},
+    // The IP's already voted as alice.
+    {name: "anonymous from a voter's IP", client: anonSameIP, id: single, choices: []int{0}, wantErr: errVotedFromIP},
+    {name: "anonymous", client: anon, id: single, choices: []int{0}, wantVotes: []int{1, 0, 1}, wantVoters: 2},
+    // Anonymous users vote as their IP, so reconnecting replaces their vote.
+    {name: "anonymous reconnected", client: anonReconnected, id: single, choices: []int{1}, wantVotes: []int{0, 1, 1}, wantVoters: 2},
+    {name: "signing in from a voter's IP", client: bobSameIP, id: single, choices: []int{0}, wantErr: errVotedFromIP},
+    {name: "take back", client: anon, id: single, wantVotes: []int{0, 0, 1}, wantVoters: 1},
+    {name: "from the IP taken back", client: bobSameIP, id: single, choices: []int{0}, wantVotes: []int{1, 0, 1}, wantVoters: 2},
+    {name: "two choices in a single-choice poll", client: carol, id: single, choices: []int{0, 1}, wantErr: errSingleChoice},
+    {name: "invalid choice", client: carol, id: single, choices: []int{3}, wantErr: errInvalidChoices},
+    {name: "multiple choices", client: carol, id: multi, choices: []int{0, 2}, wantVotes: []int{1, 0, 1}, wantVoters: 1},
+    {name: "more multiple choices", client: alice, id: multi, choices: []int{0, 1}, wantVotes: []int{2, 1, 1}, wantVoters: 2},
+    {name: "not a poll", client: carol, id: notPoll, choices: []int{0}, wantErr: errNotPoll},
+    {name: "missing", client: carol, id: 999, choices: []int{0}, wantErr: errMsgNotFound},
+  }
+  for _, tt := range tests {
+    msg, err := voteMsg(tt.client, "polls", tt.id, tt.choices)
+    if err != tt.wantErr {
+      t.Errorf("%s: err = %v, want %v", tt.name, err, tt.wantErr)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+    if msg.Action != common.ActionVote || msg.ID != tt.id || msg.Sender != tt.client.id ||
+      !reflect.DeepEqual(msg.Poll.Votes, tt.wantVotes) || msg.Poll.Voters != tt.wantVoters {
+      t.Errorf("%s: vote = %+v with %+v, want votes %v from %d",
+        tt.name, msg, msg.Poll, tt.wantVotes, tt.wantVoters)
+    }
+  }
+
+  // Votes, and the IPs they're bound to, are replayed from the log.
+  reloadTestHistory(t)
+  historyMtx.RLock()
+  tally := histories["polls"].byID[single].pollTally()
+  historyMtx.RUnlock()
+  if want := []int{1, 0, 1}; !reflect.DeepEqual(tally.Votes, want) || tally.Voters != 2 {
+    t.Errorf("replayed tally = %+v, want %v from 2", tally, want)
+  }
+  if _, err := voteMsg(anon, "polls", single, []int{0}); err != errVotedFromIP {
+    t.Errorf("replayed IP binding: err = %v, want %v", err, errVotedFromIP)
+  }
+
+  // Only the creator or a moderator can close a poll, and it can't be voted
+  // on after.
+  if _, err := closePoll(carol, "polls", single); err != errNotAuthor {
+    t.Errorf("closing someone else's poll: err = %v, want %v", err, errNotAuthor)
+  }
+  closed, err := closePoll(aliceElsewhere, "polls", single)
+  if err != nil || closed.Action != common.ActionClose || !closed.Poll.Closed || closed.Poll.Voters != 2 {
+    t.Errorf("closing: %+v, %v", closed, err)
+  }
+  if _, err := closePoll(alice, "polls", single); err != errPollClosed {
+    t.Errorf("closing again: err = %v, want %v", err, errPollClosed)
+  }
+  if _, err := voteMsg(carol, "polls", single, []int{0}); err != errPollClosed {
+    t.Errorf("voting on a closed poll: err = %v, want %v", err, errPollClosed)
+  }
+  reloadTestHistory(t)
+  if _, err := voteMsg(carol, "polls", single, []int{0}); err != errPollClosed {
+    t.Errorf("voting on a replayed closed poll: err = %v, want %v", err, errPollClosed)
+  }
+}
+
+func TestCloseDuePolls(t *testing.T) {
+  useTestHistory(t)
+  historyMtx.Lock()
+  oldCloses := pollCloses
+  pollCloses = nil
+  historyMtx.Unlock()
+  t.Cleanup(func() {
+    historyMtx.Lock()
+    pollCloses = oldCloses
+    historyMtx.Unlock()
+  })
+  alice := newTestClient(t, "due-alice", "", "due")
+  alice.addr = "192.0.2.9:1000"
+  now := time.Now()
+  soon := recordTestPoll(alice, "due", false, now.Add(time.Minute).UnixNano(), "a", "b")
+  later := recordTestPoll(alice, "due", false, now.Add(time.Hour).UnixNano(), "a", "b")
+  recordTestPoll(alice, "due", false, 0, "a", "b")
+  deleted := recordTestPoll(alice, "due", false, now.Add(time.Minute).UnixNano(), "a", "b")
+  if _, err := deleteMsg(alice, "due", deleted); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := voteMsg(alice, "due", soon, []int{1}); err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    after time.Duration
+    wantClosed []uint64
+  }{
+    {30 * time.Second, nil},
+    {time.Minute, []uint64{soon}},
+    {2 * time.Hour, []uint64{later}},
+  }
+  for _, tt := range tests {
+    received(t, alice)
+    closeDuePolls(now.Add(tt.after))
+    var closed []uint64
+    for _, msg := range received(t, alice) {
+      if msg.Action != common.ActionClose || !msg.Poll.Closed {
+        t.Errorf("after %v: got %+v", tt.after, msg)
+        continue
+      }
+      closed = append(closed, msg.ID)
+      if msg.ID == soon && !reflect.DeepEqual(msg.Poll.Votes, []int{0, 1}) {
+        t.Errorf("final tally = %v, want [0 1]", msg.Poll.Votes)
+      }
+    }
+    if !reflect.DeepEqual(closed, tt.wantClosed) {
+      t.Errorf("after %v: closed %v, want %v", tt.after, closed, tt.wantClosed)
+    }
+  }
+}
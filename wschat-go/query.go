@@ -0,0 +1,247 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+const (
+  defaultQueryLimit = 50
+  maxQueryLimit = 500
+)
+
+func invalidQuery(format string, args ...any) *common.ErrorInfo {
+  return &common.ErrorInfo{Code: "invalid_query", Message: fmt.Sprintf(format, args...)}
+}
+
+// normalizeQuery checks the query, defaulting and capping its limit.
+func normalizeQuery(q *common.Query) error {
+  if q.Action != "" && !isRecorded(q.Action) {
+    return invalidQuery("only chats, emotes and polls are in history")
+  }
+  if q.Limit < 0 {
+    return invalidQuery("limit can't be negative")
+  }
+  if q.Limit == 0 {
+    q.Limit = defaultQueryLimit
+  } else if q.Limit > maxQueryLimit {
+    q.Limit = maxQueryLimit
+  }
+  return nil
+}
+
+func queryMatches(entry *HistoryEntry, q *common.Query, text string, tokens []string) bool {
+  msg := &entry.Msg
+  switch {
+  case q.After != 0 && msg.ID <= q.After, q.Before != 0 && msg.ID >= q.Before:
+    return false
+  case q.Since != 0 && msg.Timestamp < q.Since, q.Until != 0 && msg.Timestamp >= q.Until:
+    return false
+  case q.Action != "" && msg.Action != q.Action:
+    return false
+  }
+  if q.Sender != "" && msg.Sender != q.Sender &&
+    !strings.EqualFold(msg.Name, q.Sender) &&
+    !(entry.Identity != "" && strings.EqualFold(entry.Identity, q.Sender)) {
+    return false
+  }
+  if q.Tokens {
+    return containsTokens(msg.Contents, tokens)
+  }
+  return strings.Contains(strings.ToLower(msg.Contents), text)
+}
+
+// queryHistory returns the chats in the room's history matching the query,
+// oldest first, and whether there are more. If after is set, they're the
+// oldest matches after it; otherwise, they're the newest. Chats by ignored
+// users are left out. If the matches may go past what's in memory, they're
+// found in the durable log.
+func queryHistory(room string, q common.Query, ignored map[string]bool) ([]common.Message, bool) {
+  text, tokens := strings.ToLower(q.Text), searchTokens(q.Text)
+  historyMtx.RLock()
+  rh, ok := histories[room]
+  if !ok {
+    historyMtx.RUnlock()
+    return nil, false
+  }
+  entries := rh.entries
+  if q.Text != "" {
+    if ids, ok := rh.index.candidates(q.Text, q.Tokens); ok {
+      entries = make([]*HistoryEntry, len(ids))
+      for i, id := range ids {
+        entries[i] = rh.byID[id]
+      }
+    }
+  }
+  matches, more := selectMatches(entries, &q, text, tokens, ignored)
+  // Unless there are more matches in memory than are wanted (or they're
+  // after a chat that's still in memory), older ones may be in the log.
+  inLog := historyLogPath != "" && rh.trimmed &&
+    (!more || q.After != 0 && len(rh.entries) != 0 && q.After < rh.entries[0].Msg.ID)
+  if !inLog {
+    defer historyMtx.RUnlock()
+    return queryResults(rh, matches), more
+  }
+  historyMtx.RUnlock()
+  logged, err := loggedEntries(room, func(*common.Message) bool { return true })
+  if err != nil {
+    log.Printf("error reading history log: %v", err)
+  }
+  matches, more = selectMatches(logged, &q, text, tokens, ignored)
+  historyMtx.RLock()
+  defer historyMtx.RUnlock()
+  return queryResults(rh, matches), more
+}
+
+// selectMatches returns up to the query's limit of matching entries, oldest
+// first, and whether there are more. The entries are oldest first.
+func selectMatches(
+  entries []*HistoryEntry, q *common.Query, text string, tokens []string,
+  ignored map[string]bool,
+) ([]*HistoryEntry, bool) {
+  var matches []*HistoryEntry
+  if q.After != 0 {
+    for i := 0; i < len(entries) && len(matches) <= q.Limit; i++ {
+      if queryMatches(entries[i], q, text, tokens) && !entries[i].ignoredBy(ignored) {
+        matches = append(matches, entries[i])
+      }
+    }
+  } else {
+    for i := len(entries) - 1; i >= 0 && len(matches) <= q.Limit; i-- {
+      if queryMatches(entries[i], q, text, tokens) && !entries[i].ignoredBy(ignored) {
+        matches = append(matches, entries[i])
+      }
+    }
+  }
+  more := len(matches) > q.Limit
+  if more {
+    matches = matches[:q.Limit]
+  }
+  if q.After == 0 {
+    // Newest matches were found newest first.
+    for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+      matches[i], matches[j] = matches[j], matches[i]
+    }
+  }
+  return matches, more
+}
+
+// queryResults returns the messages of the matches. historyMtx must be held.
+func queryResults(rh *roomHistory, matches []*HistoryEntry) []common.Message {
+  msgs := make([]common.Message, len(matches))
+  for i, entry := range matches {
+    msgs[i] = entry.message()
+    msgs[i].Thread = rh.threadInfo(&entry.Msg)
+  }
+  return msgs
+}
+
+// receiveQuery sends the client the results of their history query of the
+// room.
+func receiveQuery(client *Client, room string, in common.Message) {
+  var q common.Query
+  if in.Query != nil {
+    q = *in.Query
+  }
+  if err := normalizeQuery(&q); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  msg := common.NewSystemMessage(common.ActionQuery, "")
+  msg.Room, msg.Query = room, &q
+  msg.Messages, msg.More = queryHistory(room, q, ignoredKeys(client))
+  client.SendMsg(msg)
+}
+
+// parseTimeParam parses Unix nanoseconds or an RFC 3339 time.
+func parseTimeParam(s string) (int64, error) {
+  if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+    return n, nil
+  }
+  t, err := time.Parse(time.RFC3339Nano, s)
+  if err != nil {
+    return 0, err
+  }
+  return t.UnixNano(), nil
+}
+
+// historyHandler serves GET /history?room=...: the room's history matching
+// the query parameters (after, before, since, until, sender, action, q,
+// tokens and limit), as a common.QueryResult.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+  if r.Method != http.MethodGet {
+    w.Header().Set("Allow", http.MethodGet)
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  params := r.URL.Query()
+  room := params.Get("room")
+  if !isValidRoomName(room) {
+    http.Error(w, "Invalid room name", http.StatusBadRequest)
+    return
+  }
+  if !httpRoomAccess(r, room) {
+    http.Error(w, "Forbidden", http.StatusForbidden)
+    return
+  }
+  // Signed-in users' ignores apply here too.
+  var ignored map[string]bool
+  if client, ok := httpClient(r); ok {
+    ignored = ignoredKeys(client)
+  }
+  q := common.Query{
+    Sender: params.Get("sender"),
+    Action: common.Action(params.Get("action")),
+    Text: params.Get("q"),
+  }
+  var err error
+  parseUint := func(name string, dest *uint64) {
+    if s := params.Get(name); s != "" && err == nil {
+      if *dest, err = strconv.ParseUint(s, 10, 64); err != nil {
+        err = invalidQuery("invalid %s: %q", name, s)
+      }
+    }
+  }
+  parseTime := func(name string, dest *int64) {
+    if s := params.Get(name); s != "" && err == nil {
+      if *dest, err = parseTimeParam(s); err != nil {
+        err = invalidQuery("invalid %s: %q", name, s)
+      }
+    }
+  }
+  parseUint("after", &q.After)
+  parseUint("before", &q.Before)
+  parseTime("since", &q.Since)
+  parseTime("until", &q.Until)
+  if s := params.Get("limit"); s != "" && err == nil {
+    if q.Limit, err = strconv.Atoi(s); err != nil {
+      err = invalidQuery("invalid limit: %q", s)
+    }
+  }
+  if s := params.Get("tokens"); s != "" && err == nil {
+    if q.Tokens, err = strconv.ParseBool(s); err != nil {
+      err = invalidQuery("invalid tokens: %q", s)
+    }
+  }
+  if err == nil {
+    err = normalizeQuery(&q)
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  var result common.QueryResult
+  result.Messages, result.More = queryHistory(room, q, ignored)
+  if result.Messages == nil {
+    result.Messages = []common.Message{}
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(result)
+}
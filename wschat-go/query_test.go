@@ -0,0 +1,167 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+func TestNormalizeQuery(t *testing.T) {
+  tests := []struct {
+    q common.Query
+    wantLimit int
+    wantErr bool
+  }{
+    {common.Query{}, defaultQueryLimit, false},
+    {common.Query{Limit: 10}, 10, false},
+    {common.Query{Limit: maxQueryLimit + 1}, maxQueryLimit, false},
+    {common.Query{Limit: -1}, 0, true},
+    {common.Query{Action: common.ActionEmote}, defaultQueryLimit, false},
+    {common.Query{Action: common.ActionPoll}, defaultQueryLimit, false},
+    {common.Query{Action: common.ActionNick}, 0, true},
+  }
+  for _, tt := range tests {
+    q := tt.q
+    err := normalizeQuery(&q)
+    if (err != nil) != tt.wantErr {
+      t.Errorf("normalizeQuery(%+v): err = %v, want error: %v", tt.q, err, tt.wantErr)
+      continue
+    }
+    if err == nil && q.Limit != tt.wantLimit {
+      t.Errorf("normalizeQuery(%+v): limit = %d, want %d", tt.q, q.Limit, tt.wantLimit)
+    }
+  }
+}
+
+func TestQueryHistory(t *testing.T) {
+  useTestHistory(t)
+  oldSize := historySize
+  historySize = 4
+  t.Cleanup(func() {
+    historySize = oldSize
+  })
+  alice := NewClient("query-alice", "", 0)
+  alice.identity = "alice"
+  anon := NewClient("query-anon", "", 0)
+  anon.SetName("anon")
+  var ids []uint64
+  record := func(client *Client, action common.Action, contents string) {
+    msg := common.NewChatMessage(client.id, contents)
+    msg.Room, msg.Name, msg.Action = "queries", client.Name(), action
+    msg.Timestamp = int64(len(ids)+1) * 100
+    recordMsg(&msg, client.identity)
+    ids = append(ids, msg.ID)
+  }
+  // The first four are only in the log.
+  record(alice, common.ActionChat, "hello world")
+  record(anon, common.ActionChat, "world peace")
+  record(alice, common.ActionEmote, "waves")
+  record(anon, common.ActionChat, "Hello again")
+  record(alice, common.ActionChat, "the world is round")
+  record(anon, common.ActionEmote, "nods")
+  record(alice, common.ActionChat, "goodbye, world")
+  record(anon, common.ActionChat, "bye")
+
+  tests := []struct {
+    name string
+    q common.Query
+    ignored map[string]bool
+    want []string
+    wantMore bool
+  }{
+    {name: "newest", q: common.Query{Limit: 2}, want: []string{"goodbye, world", "bye"}, wantMore: true},
+    {name: "all", q: common.Query{Limit: 8}, want: []string{
+      "hello world", "world peace", "waves", "Hello again",
+      "the world is round", "nods", "goodbye, world", "bye",
+    }},
+    {name: "oldest after", q: common.Query{After: ids[0], Limit: 2}, want: []string{"world peace", "waves"}, wantMore: true},
+    {name: "after in memory", q: common.Query{After: ids[5], Limit: 2}, want: []string{"goodbye, world", "bye"}},
+    {name: "before", q: common.Query{Before: ids[2], Limit: 5}, want: []string{"hello world", "world peace"}},
+    {name: "time range", q: common.Query{Since: 300, Until: 500, Limit: 5}, want: []string{"waves", "Hello again"}},
+    {name: "text ignores case", q: common.Query{Text: "HELLO", Limit: 5}, want: []string{"hello world", "Hello again"}},
+    {name: "substring", q: common.Query{Text: "ello w", Limit: 5}, want: []string{"hello world"}},
+    {name: "tokens", q: common.Query{Text: "world hello", Tokens: true, Limit: 5}, want: []string{"hello world"}},
+    {name: "text in memory only", q: common.Query{Text: "world", Limit: 2}, want: []string{"the world is round", "goodbye, world"}, wantMore: true},
+    {name: "text past memory", q: common.Query{Text: "world", Limit: 5}, want: []string{
+      "hello world", "world peace", "the world is round", "goodbye, world",
+    }},
+    {name: "action", q: common.Query{Action: common.ActionEmote, Limit: 5}, want: []string{"waves", "nods"}},
+    {name: "sender by name", q: common.Query{Sender: "ANON", Limit: 2}, want: []string{"nods", "bye"}, wantMore: true},
+    {name: "sender by identity", q: common.Query{Sender: "Alice", Action: common.ActionChat, Limit: 5}, want: []string{
+      "hello world", "the world is round", "goodbye, world",
+    }},
+    {name: "sender by ID", q: common.Query{Sender: anon.id, Text: "bye", Limit: 5}, want: []string{"bye"}},
+    {
+      name: "ignored", q: common.Query{Text: "world", Limit: 5},
+      ignored: map[string]bool{userKey("", "alice"): true}, want: []string{"world peace"},
+    },
+    {name: "no matches", q: common.Query{Text: "nothing", Limit: 5}},
+  }
+  for _, tt := range tests {
+    msgs, more := queryHistory("queries", tt.q, tt.ignored)
+    var got []string
+    for _, msg := range msgs {
+      got = append(got, msg.Contents)
+    }
+    if !reflect.DeepEqual(got, tt.want) || more != tt.wantMore {
+      t.Errorf("%s: got %q, %v, want %q, %v", tt.name, got, more, tt.want, tt.wantMore)
+    }
+  }
+  if msgs, more := queryHistory("nowhere", common.Query{Limit: 5}, nil); msgs != nil || more {
+    t.Errorf("query of a room without history = %+v, %v", msgs, more)
+  }
+}
+
+func TestHistoryHandler(t *testing.T) {
+  useTestHistory(t)
+  alice := NewClient("query-alice", "", 0)
+  for _, contents := range []string{"one", "two", "three"} {
+    recordTestChat(alice, "http-queries", contents)
+  }
+
+  tests := []struct {
+    method, query string
+    wantStatus int
+    want []string
+    wantMore bool
+  }{
+    {"GET", "room=http-queries&limit=2", http.StatusOK, []string{"two", "three"}, true},
+    {"GET", "room=http-queries&q=T&tokens=false", http.StatusOK, []string{"two", "three"}, false},
+    {"GET", "room=http-queries&since=2000-01-01T00:00:00Z", http.StatusOK, []string{"one", "two", "three"}, false},
+    {"GET", "room=nowhere", http.StatusOK, []string{}, false},
+    {"GET", "room=not%20a%20room", http.StatusBadRequest, nil, false},
+    {"GET", "room=http-queries&after=x", http.StatusBadRequest, nil, false},
+    {"GET", "room=http-queries&since=yesterday", http.StatusBadRequest, nil, false},
+    {"GET", "room=http-queries&limit=-1", http.StatusBadRequest, nil, false},
+    {"GET", "room=http-queries&tokens=maybe", http.StatusBadRequest, nil, false},
+    {"GET", "room=http-queries&action=nick", http.StatusBadRequest, nil, false},
+    {"POST", "room=http-queries", http.StatusMethodNotAllowed, nil, false},
+  }
+  for _, tt := range tests {
+    w := httptest.NewRecorder()
+    historyHandler(w, httptest.NewRequest(tt.method, "/history?"+tt.query, nil))
+    if w.Code != tt.wantStatus {
+      t.Errorf("%s %s: status %d, want %d", tt.method, tt.query, w.Code, tt.wantStatus)
+      continue
+    }
+    if w.Code != http.StatusOK {
+      continue
+    }
+    var result common.QueryResult
+    if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+      t.Errorf("%s: invalid result: %v", tt.query, err)
+      continue
+    }
+    got := []string{}
+    for _, msg := range result.Messages {
+      got = append(got, msg.Contents)
+    }
+    if !reflect.DeepEqual(got, tt.want) || result.More != tt.wantMore {
+      t.Errorf("%s: got %q, %v, want %q, %v", tt.query, got, result.More, tt.want, tt.wantMore)
+    }
+  }
+}
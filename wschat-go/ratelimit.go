@@ -0,0 +1,105 @@
+package main
+
+import (
+  "net"
+  "sync"
+  "time"
+)
+
+// RateLimiter is a token bucket. A zero rate means no limit.
+type RateLimiter struct {
+  rate float64
+  burst float64
+
+  mtx sync.Mutex
+  tokens float64
+  last time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate events per second, with up
+// to burst at once.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+  if burst < 1 {
+    burst = 1
+  }
+  return &RateLimiter{
+    rate: rate,
+    burst: float64(burst),
+    tokens: float64(burst),
+    last: time.Now(),
+  }
+}
+
+// Allow takes a token if one is available. If not, it returns how long until
+// one will be.
+func (rl *RateLimiter) Allow() (bool, time.Duration) {
+  if rl.rate <= 0 {
+    return true, 0
+  }
+  rl.mtx.Lock()
+  defer rl.mtx.Unlock()
+  now := time.Now()
+  rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+  if rl.tokens > rl.burst {
+    rl.tokens = rl.burst
+  }
+  rl.last = now
+  if rl.tokens >= 1 {
+    rl.tokens--
+    return true, 0
+  }
+  return false, time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+}
+
+// isFull reports whether the limiter would have its whole burst by now.
+func (rl *RateLimiter) isFull(now time.Time) bool {
+  rl.mtx.Lock()
+  defer rl.mtx.Unlock()
+  return rl.tokens+now.Sub(rl.last).Seconds()*rl.rate >= rl.burst
+}
+
+// IPRateLimiter rate-limits each IP separately. A zero rate means no limit.
+type IPRateLimiter struct {
+  rate float64
+  burst int
+
+  mtx sync.Mutex
+  // map[IP]*RateLimiter
+  limiters map[string]*RateLimiter
+  lastSweep time.Time
+}
+
+func NewIPRateLimiter(rate float64, burst int) *IPRateLimiter {
+  return &IPRateLimiter{rate: rate, burst: burst, limiters: make(map[string]*RateLimiter)}
+}
+
+// Allow takes a token from the limiter of the IP in the address ("host:port"
+// or a lone host). If there isn't one, it returns how long until there will
+// be.
+func (l *IPRateLimiter) Allow(addr string) (bool, time.Duration) {
+  if l.rate <= 0 {
+    return true, 0
+  }
+  ip, _, err := net.SplitHostPort(addr)
+  if err != nil {
+    ip = addr
+  }
+  l.mtx.Lock()
+  now := time.Now()
+  // Limiters that have refilled are the same as new ones.
+  if now.Sub(l.lastSweep) >= time.Minute {
+    l.lastSweep = now
+    for key, rl := range l.limiters {
+      if rl.isFull(now) {
+        delete(l.limiters, key)
+      }
+    }
+  }
+  rl, ok := l.limiters[ip]
+  if !ok {
+    rl = NewRateLimiter(l.rate, l.burst)
+    l.limiters[ip] = rl
+  }
+  l.mtx.Unlock()
+  return rl.Allow()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+  "time"
+  "unicode"
+  "unicode/utf8"
+
+  "wschat/wschat-go/common"
+)
+
+const (
+  maxReactionLen = 16
+  // The max number of different reactions on a chat.
+  maxReactionsPerMsg = 20
+)
+
+var (
+  errInvalidReaction = &common.ErrorInfo{
+    Code: "invalid_reaction",
+    Message: "reactions must be 1-16 characters without spaces",
+  }
+  errTooManyReactions = &common.ErrorInfo{
+    Code: "too_many_reactions",
+    Message: "message has too many different reactions",
+  }
+)
+
+func isValidReaction(reaction string) bool {
+  if reaction == "" || utf8.RuneCountInString(reaction) > maxReactionLen {
+    return false
+  }
+  for _, r := range reaction {
+    if unicode.IsSpace(r) || unicode.IsControl(r) {
+      return false
+    }
+  }
+  return true
+}
+
+// applyReactionLocked adds or removes the user's reaction, returning whether
+// anything changed.
+func applyReactionLocked(entry *HistoryEntry, reaction, key string, add bool) bool {
+  users := entry.reactions[reaction]
+  if add {
+    if users[key] {
+      return false
+    }
+    if users == nil {
+      if entry.reactions == nil {
+        entry.reactions = make(map[string]map[string]bool)
+      }
+      users = make(map[string]bool)
+      entry.reactions[reaction] = users
+    }
+    users[key] = true
+    return true
+  }
+  if !users[key] {
+    return false
+  }
+  delete(users, key)
+  if len(users) == 0 {
+    delete(entry.reactions, reaction)
+  }
+  return true
+}
+
+// reactMsg adds or removes the client's reaction on a chat, returning the
+// delta to broadcast, if anything changed.
+func reactMsg(
+  client *Client, room string, id uint64, reaction string, add bool,
+) (common.Message, bool, error) {
+  historyMtx.Lock()
+  defer historyMtx.Unlock()
+  entry, ok := roomHistoryLocked(room).byID[id]
+  if !ok {
+    return common.Message{}, false, errMsgNotFound
+  }
+  if add && entry.reactions[reaction] == nil && len(entry.reactions) >= maxReactionsPerMsg {
+    return common.Message{}, false, errTooManyReactions
+  }
+  key := userKey(client.id, client.identity)
+  if !applyReactionLocked(entry, reaction, key, add) {
+    return common.Message{}, false, nil
+  }
+  action, op := common.Action(common.ActionReact), "react"
+  if !add {
+    action, op = common.ActionUnreact, "unreact"
+  }
+  now := time.Now().UnixNano()
+  appendLogLocked(&logRecord{
+    Op: op, Room: room, ID: id, Contents: reaction, By: key, Timestamp: now,
+  })
+  return common.Message{
+    ID: id,
+    Sender: client.id,
+    Action: action,
+    Contents: reaction,
+    Timestamp: now,
+    Room: room,
+    Name: client.Name(),
+    Reactions: map[string]int{reaction: len(entry.reactions[reaction])},
+  }, true, nil
+}
+
+// receiveReact handles a react or unreact sent by a client.
+func receiveReact(client *Client, room string, in common.Message) {
+  if !isValidReaction(in.Contents) {
+    sendVeto(client, room, errInvalidReaction)
+    return
+  }
+  msg := common.Message{
+    ID: in.ID,
+    Sender: client.id,
+    Action: in.Action,
+    Contents: in.Contents,
+    Room: room,
+    Name: client.Name(),
+  }
+  if err := pipeline.Message(client.Conn(room), &msg); err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  delta, changed, err := reactMsg(
+    client, room, msg.ID, msg.Contents, msg.Action == common.ActionReact,
+  )
+  if err != nil {
+    sendVeto(client, room, err)
+  } else if changed {
+    broadcastMsg(delta)
+  }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+  "fmt"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestIsValidReaction(t *testing.T) {
+  tests := []struct {
+    reaction string
+    want bool
+  }{
+    {"👍", true},
+    {"+1", true},
+    {":party:", true},
+    {"👨‍👩‍👧", true},
+    {"", false},
+    {"thumbs up", false},
+    {"a\tb", false},
+    {"a\x00", false},
+    {strings.Repeat("x", maxReactionLen), true},
+    {strings.Repeat("é", maxReactionLen+1), false},
+  }
+  for _, tt := range tests {
+    if got := isValidReaction(tt.reaction); got != tt.want {
+      t.Errorf("isValidReaction(%q) = %v, want %v", tt.reaction, got, tt.want)
+    }
+  }
+}
+
+func TestReactMsg(t *testing.T) {
+  useTestHistory(t)
+  alice := NewClient("react-alice", "", 0)
+  alice.identity = "alice"
+  aliceAgain := NewClient("react-alice-2", "", 0)
+  aliceAgain.identity = "alice"
+  anon := NewClient("react-anon", "", 0)
+  id := recordTestChat(anon, "reacts", "react to me")
+
+  tests := []struct {
+    name string
+    client *Client
+    reaction string
+    add bool
+    wantChanged bool
+    wantCount int
+    wantErr error
+  }{
+    {name: "react", client: alice, reaction: "👍", add: true, wantChanged: true, wantCount: 1},
+    // Signed-in users react as their identity.
+    {name: "again from another connection", client: aliceAgain, reaction: "👍", add: true},
+    {name: "another user", client: anon, reaction: "👍", add: true, wantChanged: true, wantCount: 2},
+    {name: "another reaction", client: anon, reaction: "🎉", add: true, wantChanged: true, wantCount: 1},
+    {name: "unreact from another connection", client: aliceAgain, reaction: "👍", wantChanged: true, wantCount: 1},
+    {name: "unreact again", client: alice, reaction: "👍"},
+    {name: "unreact never reacted", client: alice, reaction: "🎉"},
+    {name: "unreact last", client: anon, reaction: "🎉", wantChanged: true, wantCount: 0},
+  }
+  for _, tt := range tests {
+    delta, changed, err := reactMsg(tt.client, "reacts", id, tt.reaction, tt.add)
+    if err != tt.wantErr || changed != tt.wantChanged {
+      t.Errorf("%s: changed, err = %v, %v, want %v, %v", tt.name, changed, err, tt.wantChanged, tt.wantErr)
+      continue
+    }
+    if !changed {
+      continue
+    }
+    wantAction := "react"
+    if !tt.add {
+      wantAction = "unreact"
+    }
+    want := map[string]int{tt.reaction: tt.wantCount}
+    if string(delta.Action) != wantAction || delta.ID != id || delta.Contents != tt.reaction ||
+      !reflect.DeepEqual(delta.Reactions, want) {
+      t.Errorf("%s: delta = %+v, want %s with %v", tt.name, delta, wantAction, want)
+    }
+  }
+
+  historyMtx.RLock()
+  counts := histories["reacts"].byID[id].reactionCounts()
+  historyMtx.RUnlock()
+  if want := map[string]int{"👍": 1}; !reflect.DeepEqual(counts, want) {
+    t.Errorf("counts = %v, want %v", counts, want)
+  }
+  reloadTestHistory(t)
+  historyMtx.RLock()
+  counts = histories["reacts"].byID[id].reactionCounts()
+  historyMtx.RUnlock()
+  if want := map[string]int{"👍": 1}; !reflect.DeepEqual(counts, want) {
+    t.Errorf("replayed counts = %v, want %v", counts, want)
+  }
+
+  if _, _, err := reactMsg(anon, "reacts", 999, "👍", true); err != errMsgNotFound {
+    t.Errorf("reacting to a missing chat: err = %v", err)
+  }
+  // Up to maxReactionsPerMsg different reactions, but existing ones can
+  // still be added to.
+  for i := 1; i < maxReactionsPerMsg; i++ {
+    if _, _, err := reactMsg(anon, "reacts", id, fmt.Sprint(i), true); err != nil {
+      t.Fatalf("reaction %d: %v", i, err)
+    }
+  }
+  if _, _, err := reactMsg(anon, "reacts", id, "one-too-many", true); err != errTooManyReactions {
+    t.Errorf("reaction past the max: err = %v, want %v", err, errTooManyReactions)
+  }
+  if _, changed, err := reactMsg(alice, "reacts", id, "1", true); err != nil || !changed {
+    t.Errorf("adding to an existing reaction at the max: %v, %v", changed, err)
+  }
+}
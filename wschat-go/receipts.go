@@ -0,0 +1,144 @@
+package main
+
+import (
+  "sync"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// The min time between broadcasts of a user's read marker in a room. Later
+// updates are broadcast together once it's passed.
+const readBroadcastInterval = 2 * time.Second
+
+type readMarker struct {
+  id uint64
+  lastBroadcast time.Time
+  // Whether a broadcast is scheduled.
+  pending bool
+}
+
+var (
+  readMtx sync.Mutex
+  // Markers of signed-in users are kept in the durable log; others are
+  // forgotten when they disconnect.
+  // map[room]map[userKey]*readMarker
+  readMarkers = make(map[string]map[string]*readMarker)
+)
+
+// advanceReadMarkerLocked moves the user's marker in the room forward to the
+// ID, returning the marker if it moved. historyMtx must be held.
+func advanceReadMarkerLocked(room, key string, id uint64) *readMarker {
+  readMtx.Lock()
+  defer readMtx.Unlock()
+  markers, ok := readMarkers[room]
+  if !ok {
+    markers = make(map[string]*readMarker)
+    readMarkers[room] = markers
+  }
+  marker, ok := markers[key]
+  if !ok {
+    marker = &readMarker{}
+    markers[key] = marker
+  }
+  if id <= marker.id {
+    return nil
+  }
+  marker.id = id
+  return marker
+}
+
+// markRead records that the client has read the room up to the chat with the
+// ID, broadcasting it (at most once every readBroadcastInterval).
+func markRead(client *Client, room string, id uint64) {
+  key := userKey(client.id, client.identity)
+  historyMtx.Lock()
+  if id > lastID {
+    id = lastID
+  }
+  marker := advanceReadMarkerLocked(room, key, id)
+  if marker != nil && client.identity != "" {
+    appendLogLocked(&logRecord{
+      Op: "read", Room: room, ID: id, By: key, Timestamp: time.Now().UnixNano(),
+    })
+  }
+  historyMtx.Unlock()
+  if marker == nil {
+    return
+  }
+  readMtx.Lock()
+  defer readMtx.Unlock()
+  if marker.pending {
+    // The scheduled broadcast will include this.
+    return
+  }
+  marker.pending = true
+  wait := readBroadcastInterval - time.Since(marker.lastBroadcast)
+  sender, name := client.id, client.Name()
+  time.AfterFunc(wait, func() {
+    readMtx.Lock()
+    marker.pending, marker.lastBroadcast = false, time.Now()
+    id := marker.id
+    readMtx.Unlock()
+    broadcastMsg(common.Message{
+      ID: id,
+      Sender: sender,
+      Action: common.ActionRead,
+      Timestamp: time.Now().UnixNano(),
+      Room: room,
+      Name: name,
+    })
+  })
+}
+
+// unreadMsg returns the message telling the client where their read marker
+// in the room is and how many chats (by others) are after it, or false if
+// they don't have one.
+func unreadMsg(client *Client, room string) (common.Message, bool) {
+  readMtx.Lock()
+  marker, ok := readMarkers[room][userKey(client.id, client.identity)]
+  var id uint64
+  if ok {
+    id = marker.id
+  }
+  readMtx.Unlock()
+  if !ok {
+    return common.Message{}, false
+  }
+  unread := 0
+  historyMtx.RLock()
+  if rh, ok := histories[room]; ok {
+    for i := len(rh.entries) - 1; i >= 0 && rh.entries[i].Msg.ID > id; i-- {
+      entry := rh.entries[i]
+      if client.identity == "" || entry.Identity != client.identity {
+        unread++
+      }
+    }
+  }
+  historyMtx.RUnlock()
+  msg := common.NewSystemMessage(common.ActionRead, "")
+  msg.ID, msg.Room, msg.Unread = id, room, unread
+  return msg, true
+}
+
+// forgetReadMarker removes the marker of a client that isn't signed in, since
+// it can't be restored.
+func forgetReadMarker(client *Client, room string) {
+  if client.identity != "" {
+    return
+  }
+  readMtx.Lock()
+  defer readMtx.Unlock()
+  delete(readMarkers[room], userKey(client.id, ""))
+}
+
+// receiveRead handles a read marker sent by a client.
+func receiveRead(client *Client, room string, in common.Message) {
+  if in.ID == 0 {
+    sendVeto(client, room, &common.ErrorInfo{
+      Code: "invalid_id", Message: "read markers need the ID of the last chat read",
+    })
+    return
+  }
+  markRead(client, room, in.ID)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+func TestAdvanceReadMarker(t *testing.T) {
+  useTestHistory(t)
+  tests := []struct {
+    id uint64
+    moved bool
+    want uint64
+  }{
+    {5, true, 5},
+    {5, false, 5},
+    {3, false, 5},
+    {8, true, 8},
+  }
+  for _, tt := range tests {
+    historyMtx.Lock()
+    marker := advanceReadMarkerLocked("reads", "id:a", tt.id)
+    historyMtx.Unlock()
+    if (marker != nil) != tt.moved {
+      t.Errorf("advancing to %d: moved = %v, want %v", tt.id, marker != nil, tt.moved)
+    }
+    readMtx.Lock()
+    got := readMarkers["reads"]["id:a"].id
+    readMtx.Unlock()
+    if got != tt.want {
+      t.Errorf("advancing to %d: marker = %d, want %d", tt.id, got, tt.want)
+    }
+  }
+}
+
+func TestMarkRead(t *testing.T) {
+  path := useTestHistory(t)
+  alice := newTestClient(t, "read-alice", "alice", "reads")
+  anon := newTestClient(t, "read-anon", "", "reads")
+  bob := newTestClient(t, "read-bob", "bob", "reads")
+  ids := []uint64{
+    recordTestChat(bob, "reads", "1"),
+    recordTestChat(alice, "reads", "2"),
+    recordTestChat(bob, "reads", "3"),
+    recordTestChat(alice, "reads", "4"),
+  }
+  // Broadcasts are already scheduled, so none are started.
+  for _, client := range []*Client{alice, anon} {
+    historyMtx.Lock()
+    advanceReadMarkerLocked("reads", userKey(client.id, client.identity), 0)
+    historyMtx.Unlock()
+    readMtx.Lock()
+    readMarkers["reads"][userKey(client.id, client.identity)].pending = true
+    readMtx.Unlock()
+  }
+
+  tests := []struct {
+    client *Client
+    id uint64
+    // The marker and unread count after.
+    want uint64
+    unread int
+  }{
+    // Signed-in users' own chats aren't unread.
+    {client: alice, id: ids[0], want: ids[0], unread: 1},
+    {client: alice, id: ids[2], want: ids[2], unread: 0},
+    // Markers don't move back.
+    {client: alice, id: ids[1], want: ids[2], unread: 0},
+    {client: anon, id: ids[1], want: ids[1], unread: 2},
+    // Or past the last chat.
+    {client: anon, id: 999, want: ids[3], unread: 0},
+  }
+  for _, tt := range tests {
+    markRead(tt.client, "reads", tt.id)
+    msg, ok := unreadMsg(tt.client, "reads")
+    if !ok || msg.Action != common.ActionRead || msg.ID != tt.want || msg.Unread != tt.unread {
+      t.Errorf("%s read %d: got %+v, %v, want marker %d with %d unread",
+        tt.client.id, tt.id, msg, ok, tt.want, tt.unread)
+    }
+  }
+  if _, ok := unreadMsg(bob, "reads"); ok {
+    t.Error("bob has a marker without reading")
+  }
+  if got := received(t, bob); len(got) != 0 {
+    t.Errorf("pending markers were broadcast: %+v", got)
+  }
+
+  // Only signed-in users' markers are logged, and forgotten on leaving.
+  var reads int
+  for _, op := range readLogOps(t, path) {
+    if op == "read" {
+      reads++
+    }
+  }
+  if reads != 2 {
+    t.Errorf("logged %d reads, want 2", reads)
+  }
+  forgetReadMarker(alice, "reads")
+  forgetReadMarker(anon, "reads")
+  if _, ok := unreadMsg(alice, "reads"); !ok {
+    t.Error("signed-in marker was forgotten")
+  }
+  if _, ok := unreadMsg(anon, "reads"); ok {
+    t.Error("anonymous marker wasn't forgotten")
+  }
+  reloadTestHistory(t)
+  if msg, ok := unreadMsg(alice, "reads"); !ok || msg.ID != ids[2] {
+    t.Errorf("replayed marker = %+v, %v, want %d", msg, ok, ids[2])
+  }
+
+  receiveRead(anon, "reads", common.Message{})
+  if msg := lastReceived(t, anon); msg.Error == nil || msg.Error.Code != "invalid_id" {
+    t.Errorf("reading ID 0: got %+v, want an invalid_id error", msg)
+  }
+}
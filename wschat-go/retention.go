@@ -0,0 +1,187 @@
+package main
+
+import (
+  "container/heap"
+  "encoding/json"
+  "fmt"
+  "log"
+  "os"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// The max TTL of a chat.
+const maxTTL = 30 * 24 * time.Hour
+
+var errInvalidTTL = &common.ErrorInfo{
+  Code: "invalid_ttl",
+  Message: fmt.Sprintf("ttl must be 1-%d seconds", int64(maxTTL/time.Second)),
+}
+
+// RetentionPolicy limits which chats in a room are kept. Chats outside of it
+// are dropped from history and purged from the log at compaction.
+type RetentionPolicy struct {
+  // How long chats are kept, e.g., "168h". Empty keeps them forever.
+  MaxAge string `json:"maxAge,omitempty"`
+  // The max number of chats kept. 0 is unlimited (but no more than
+  // -history-size are kept in memory).
+  MaxMessages int `json:"maxMessages,omitempty"`
+
+  maxAge time.Duration
+}
+
+var (
+  // map[room]*RetentionPolicy, set once on startup. "*" applies to rooms not
+  // listed.
+  retentionPolicies map[string]*RetentionPolicy
+)
+
+// loadRetentionPolicies reads a JSON file containing an object of rooms to
+// policies.
+func loadRetentionPolicies(path string) (map[string]*RetentionPolicy, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var policies map[string]*RetentionPolicy
+  if err := json.NewDecoder(f).Decode(&policies); err != nil {
+    return nil, err
+  }
+  for room, policy := range policies {
+    if room != "*" && !isValidRoomName(room) {
+      return nil, fmt.Errorf("invalid room name: %q", room)
+    }
+    if policy.MaxAge != "" {
+      if policy.maxAge, err = time.ParseDuration(policy.MaxAge); err != nil || policy.maxAge <= 0 {
+        return nil, fmt.Errorf("room %q: invalid maxAge: %q", room, policy.MaxAge)
+      }
+    }
+    if policy.MaxMessages < 0 {
+      return nil, fmt.Errorf("room %q: maxMessages can't be negative", room)
+    }
+  }
+  return policies, nil
+}
+
+// retentionPolicy returns the room's policy, or nil if it has none.
+func retentionPolicy(room string) *RetentionPolicy {
+  if policy, ok := retentionPolicies[room]; ok {
+    return policy
+  }
+  return retentionPolicies["*"]
+}
+
+// historyLimit returns the max number of chats kept in memory for the room.
+func historyLimit(room string) int {
+  if policy := retentionPolicy(room); policy != nil && policy.MaxMessages > 0 &&
+    policy.MaxMessages < historySize {
+    return policy.MaxMessages
+  }
+  return historySize
+}
+
+// isRetained reports whether the chat is still within its TTL and its room's
+// max age.
+func isRetained(msg *common.Message, now time.Time) bool {
+  if msg.Expires != 0 && msg.Expires <= now.UnixNano() {
+    return false
+  }
+  policy := retentionPolicy(msg.Room)
+  return policy == nil || policy.maxAge == 0 ||
+    msg.Timestamp > now.Add(-policy.maxAge).UnixNano()
+}
+
+// setExpiry makes the chat expire after the TTL, in seconds.
+func setExpiry(msg *common.Message, ttl int64) error {
+  if ttl <= 0 || ttl > int64(maxTTL/time.Second) {
+    return errInvalidTTL
+  }
+  msg.TTL = ttl
+  msg.Expires = msg.Timestamp + ttl*int64(time.Second)
+  return nil
+}
+
+type expiry struct {
+  expires int64
+  room string
+  id uint64
+}
+
+// expiryHeap is a min-heap of when chats expire.
+type expiryHeap []expiry
+
+func (h expiryHeap) Len() int { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires < h[j].expires }
+func (h expiryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x any) { *h = append(*h, x.(expiry)) }
+func (h *expiryHeap) Pop() any {
+  old := *h
+  x := old[len(old)-1]
+  *h = old[:len(old)-1]
+  return x
+}
+
+// Chats in memory that expire, guarded by historyMtx.
+var expiries expiryHeap
+
+// scheduleExpiryLocked adds the chat to expiries if it has a TTL.
+func scheduleExpiryLocked(msg *common.Message) {
+  if msg.Expires != 0 {
+    heap.Push(&expiries, expiry{msg.Expires, msg.Room, msg.ID})
+  }
+}
+
+// expireHistory removes expired chats from memory, broadcasting their
+// expiry, and drops chats older than their room's max age.
+func expireHistory(now time.Time) {
+  var expired []common.Message
+  historyMtx.Lock()
+  for len(expiries) != 0 && expiries[0].expires <= now.UnixNano() {
+    exp := heap.Pop(&expiries).(expiry)
+    rh, ok := histories[exp.room]
+    if !ok || rh.byID[exp.id] == nil {
+      // Already deleted.
+      continue
+    }
+    rh.remove(exp.id)
+    msg := common.NewSystemMessage(common.ActionExpire, "")
+    msg.ID, msg.Room = exp.id, exp.room
+    expired = append(expired, msg)
+  }
+  for room, rh := range histories {
+    policy := retentionPolicy(room)
+    if policy == nil || policy.maxAge == 0 {
+      continue
+    }
+    for len(rh.entries) != 0 && !isRetained(&rh.entries[0].Msg, now) {
+      rh.remove(rh.entries[0].Msg.ID)
+    }
+  }
+  historyMtx.Unlock()
+  for _, msg := range expired {
+    broadcastMsg(msg)
+  }
+}
+
+// runRetention expires chats and closes due polls every second, and compacts
+// the log every interval (never if 0).
+func runRetention(compactInterval time.Duration) {
+  var compact <-chan time.Time
+  if compactInterval > 0 && historyLogPath != "" {
+    compact = time.NewTicker(compactInterval).C
+  }
+  tick := time.NewTicker(time.Second)
+  for {
+    select {
+    case now := <-tick.C:
+      expireHistory(now)
+      closeDuePolls(now)
+    case <-compact:
+      if err := compactHistoryLog(); err != nil {
+        log.Printf("error compacting history log: %v", err)
+      }
+    }
+  }
+}
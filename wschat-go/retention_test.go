@@ -0,0 +1,246 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// setTestRetention replaces the retention policies and expiries, restoring
+// them when the test ends.
+func setTestRetention(t *testing.T, policies map[string]*RetentionPolicy) {
+  oldPolicies := retentionPolicies
+  retentionPolicies = policies
+  historyMtx.Lock()
+  oldExpiries := expiries
+  expiries = nil
+  historyMtx.Unlock()
+  t.Cleanup(func() {
+    retentionPolicies = oldPolicies
+    historyMtx.Lock()
+    expiries = oldExpiries
+    historyMtx.Unlock()
+  })
+}
+
+func TestLoadRetentionPolicies(t *testing.T) {
+  tests := []struct {
+    json string
+    wantErr bool
+    wantMaxAge map[string]time.Duration
+  }{
+    {json: `{}`, wantMaxAge: map[string]time.Duration{}},
+    {
+      json: `{"*": {"maxAge": "168h"}, "lobby": {"maxMessages": 100}}`,
+      wantMaxAge: map[string]time.Duration{"*": 168 * time.Hour, "lobby": 0},
+    },
+    {json: `{"bad room": {}}`, wantErr: true},
+    {json: `{"lobby": {"maxAge": "a week"}}`, wantErr: true},
+    {json: `{"lobby": {"maxAge": "-1h"}}`, wantErr: true},
+    {json: `{"lobby": {"maxMessages": -1}}`, wantErr: true},
+    {json: `[]`, wantErr: true},
+  }
+  for _, tt := range tests {
+    path := filepath.Join(t.TempDir(), "retention.json")
+    if err := os.WriteFile(path, []byte(tt.json), 0644); err != nil {
+      t.Fatal(err)
+    }
+    policies, err := loadRetentionPolicies(path)
+    if (err != nil) != tt.wantErr {
+      t.Errorf("%s: err = %v, want error: %v", tt.json, err, tt.wantErr)
+      continue
+    }
+    if err != nil {
+      continue
+    }
+    maxAges := make(map[string]time.Duration)
+    for room, policy := range policies {
+      maxAges[room] = policy.maxAge
+    }
+    if !reflect.DeepEqual(maxAges, tt.wantMaxAge) {
+      t.Errorf("%s: max ages = %v, want %v", tt.json, maxAges, tt.wantMaxAge)
+    }
+  }
+}
+
+func TestIsRetained(t *testing.T) {
+  setTestRetention(t, map[string]*RetentionPolicy{
+    "*": {maxAge: 24 * time.Hour},
+    "short": {maxAge: time.Hour, MaxMessages: 5},
+    "forever": {},
+  })
+  oldSize := historySize
+  historySize = 10
+  t.Cleanup(func() {
+    historySize = oldSize
+  })
+  now := time.Now()
+  ago := func(d time.Duration) int64 { return now.Add(-d).UnixNano() }
+  tests := []struct {
+    name string
+    msg common.Message
+    want bool
+  }{
+    {"new", common.Message{Room: "short", Timestamp: ago(time.Minute)}, true},
+    {"past the room's max age", common.Message{Room: "short", Timestamp: ago(2 * time.Hour)}, false},
+    {"within the default max age", common.Message{Room: "other", Timestamp: ago(2 * time.Hour)}, true},
+    {"past the default max age", common.Message{Room: "other", Timestamp: ago(48 * time.Hour)}, false},
+    {"no max age", common.Message{Room: "forever", Timestamp: ago(48 * time.Hour)}, true},
+    {"expired", common.Message{Room: "forever", Timestamp: ago(time.Minute), Expires: ago(time.Second)}, false},
+    {"expiring now", common.Message{Room: "forever", Timestamp: ago(time.Minute), Expires: now.UnixNano()}, false},
+    {"not expired yet", common.Message{Room: "forever", Timestamp: ago(time.Minute), Expires: now.Add(time.Second).UnixNano()}, true},
+  }
+  for _, tt := range tests {
+    if got := isRetained(&tt.msg, now); got != tt.want {
+      t.Errorf("%s: isRetained = %v, want %v", tt.name, got, tt.want)
+    }
+  }
+
+  limits := []struct {
+    room string
+    want int
+  }{
+    {"short", 5},
+    // Unlimited, or more than the history size, is the history size.
+    {"forever", 10},
+    {"other", 10},
+  }
+  for _, tt := range limits {
+    if got := historyLimit(tt.room); got != tt.want {
+      t.Errorf("historyLimit(%q) = %d, want %d", tt.room, got, tt.want)
+    }
+  }
+  retentionPolicies["huge"] = &RetentionPolicy{MaxMessages: 100}
+  if got := historyLimit("huge"); got != 10 {
+    t.Errorf("historyLimit past the history size = %d, want 10", got)
+  }
+}
+
+func TestSetExpiry(t *testing.T) {
+  maxSeconds := int64(maxTTL / time.Second)
+  tests := []struct {
+    ttl int64
+    wantErr error
+  }{
+    {1, nil},
+    {60, nil},
+    {maxSeconds, nil},
+    {maxSeconds + 1, errInvalidTTL},
+    {0, errInvalidTTL},
+    {-5, errInvalidTTL},
+  }
+  for _, tt := range tests {
+    msg := common.Message{Timestamp: 1000}
+    if err := setExpiry(&msg, tt.ttl); err != tt.wantErr {
+      t.Errorf("setExpiry(%d): err = %v, want %v", tt.ttl, err, tt.wantErr)
+      continue
+    }
+    if tt.wantErr != nil {
+      if msg.TTL != 0 || msg.Expires != 0 {
+        t.Errorf("setExpiry(%d) failed but set %+v", tt.ttl, msg)
+      }
+      continue
+    }
+    if want := 1000 + tt.ttl*int64(time.Second); msg.TTL != tt.ttl || msg.Expires != want {
+      t.Errorf("setExpiry(%d): TTL, Expires = %d, %d, want %d, %d", tt.ttl, msg.TTL, msg.Expires, tt.ttl, want)
+    }
+  }
+}
+
+func TestExpireHistory(t *testing.T) {
+  path := useTestHistory(t)
+  setTestRetention(t, map[string]*RetentionPolicy{
+    "aging": {maxAge: time.Hour},
+    "capped": {MaxMessages: 2},
+  })
+  alice := newTestClient(t, "expire-alice", "", "ttls", "aging", "capped")
+  now := time.Now()
+  record := func(room, contents string, age time.Duration, ttl int64) uint64 {
+    msg := common.NewChatMessage(alice.id, contents)
+    msg.Room, msg.Timestamp = room, now.Add(-age).UnixNano()
+    if ttl != 0 {
+      if err := setExpiry(&msg, ttl); err != nil {
+        t.Fatal(err)
+      }
+    }
+    recordMsg(&msg, "")
+    return msg.ID
+  }
+  // Already expired.
+  soon := record("ttls", "soon", 2*time.Second, 1)
+  later := record("ttls", "later", 0, 60)
+  record("ttls", "kept", 0, 0)
+  deleted := record("ttls", "deleted", 0, 1)
+  if _, err := deleteMsg(alice, "ttls", deleted); err != nil {
+    t.Fatal(err)
+  }
+  record("aging", "old", 2*time.Hour, 0)
+  record("aging", "new", 0, 0)
+  for _, contents := range []string{"one", "two", "three"} {
+    record("capped", contents, 0, 0)
+  }
+
+  tests := []struct {
+    after time.Duration
+    wantExpired []uint64
+    want map[string][]string
+  }{
+    {0, []uint64{soon}, map[string][]string{
+      "ttls": {"later", "kept"}, "aging": {"new"}, "capped": {"two", "three"},
+    }},
+    {30 * time.Second, nil, map[string][]string{
+      "ttls": {"later", "kept"}, "aging": {"new"}, "capped": {"two", "three"},
+    }},
+    {2 * time.Hour, []uint64{later}, map[string][]string{
+      "ttls": {"kept"}, "aging": nil, "capped": {"two", "three"},
+    }},
+  }
+  for _, tt := range tests {
+    received(t, alice)
+    expireHistory(now.Add(tt.after))
+    var expired []uint64
+    for _, msg := range received(t, alice) {
+      if msg.Action == common.ActionExpire {
+        expired = append(expired, msg.ID)
+      }
+    }
+    if !reflect.DeepEqual(expired, tt.wantExpired) {
+      t.Errorf("after %v: expired %v, want %v", tt.after, expired, tt.wantExpired)
+    }
+    for room, want := range tt.want {
+      if got := roomContents(room); !reflect.DeepEqual(got, want) {
+        t.Errorf("after %v: %s history = %q, want %q", tt.after, room, got, want)
+      }
+    }
+  }
+
+  // Compacting purges what's expired, too old or over the max messages from
+  // the log, and it stays purged when replayed. (It's not really 2 hours
+  // later, so later and new are kept.)
+  if err := compactHistoryLog(); err != nil {
+    t.Fatal(err)
+  }
+  var msgs int
+  for _, op := range readLogOps(t, path) {
+    if op == "msg" {
+      msgs++
+    }
+  }
+  // later, kept, new, two and three.
+  if msgs != 5 {
+    t.Errorf("compacted log has %d chats, want 5", msgs)
+  }
+  reloadTestHistory(t)
+  want := map[string][]string{
+    "ttls": {"later", "kept"}, "aging": {"new"}, "capped": {"two", "three"},
+  }
+  for room, want := range want {
+    if got := roomContents(room); !reflect.DeepEqual(got, want) {
+      t.Errorf("replayed %s history = %q, want %q", room, got, want)
+    }
+  }
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// RoomState is a room's descriptive state, persisted to the rooms file.
+type RoomState struct {
+  Topic string `json:"topic,omitempty"`
+  // Sent to users when they join.
+  MOTD string `json:"motd,omitempty"`
+  // When the room was first joined, in Unix nanoseconds.
+  Created int64 `json:"created"`
+  // The display name of who first joined the room, and their user key, which
+  // lets them manage it.
+  Creator string `json:"creator,omitempty"`
+  CreatorKey string `json:"creatorKey,omitempty"`
+  // The max number of users in the room (besides moderators). 0 is
+  // unlimited.
+  MaxMembers int `json:"maxMembers,omitempty"`
+  // Who can join: AccessPublic (if empty), AccessPassword or AccessInvite.
+  Access string `json:"access,omitempty"`
+  // The salted SHA-256 of the password of AccessPassword rooms.
+  PasswordHash string `json:"passwordHash,omitempty"`
+  PasswordSalt string `json:"passwordSalt,omitempty"`
+  // map[code]*Invite
+  Invites map[string]*Invite `json:"invites,omitempty"`
+  // The signed-in users who've been let in, by user key, so they don't need
+  // the password or an invite again.
+  Members map[string]bool `json:"members,omitempty"`
+  // The IDs of the pinned chats, oldest pin first.
+  Pins []uint64 `json:"pins,omitempty"`
+  // The min time between each user's posts, in seconds (besides moderators
+  // and bots). 0 is off.
+  SlowMode int64 `json:"slowMode,omitempty"`
+  // Whether only moderators and bots can post.
+  ReadOnly bool `json:"readOnly,omitempty"`
+}
+
+var (
+  // Where room states are persisted to. They're only kept in memory if
+  // empty.
+  roomsPath string
+  roomsMtx sync.Mutex
+  // map[room]*RoomState
+  roomStates = make(map[string]*RoomState)
+
+  errRoomFull = &common.ErrorInfo{Code: "room_full", Message: "room is full"}
+  errNotRoomManager = errors.New("only the room's creator or a moderator can do that")
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "motd",
+    Usage: "/motd [message|-]",
+    Help: "Show or set (or with -, clear) the message sent to users joining the room",
+    Run: cmdMOTD,
+  })
+  RegisterCommand(&Command{
+    Name: "room",
+    Usage: "/room",
+    Help: "Show the room's info",
+    Run: cmdRoom,
+  })
+  RegisterCommand(&Command{
+    Name: "limit",
+    Usage: "/limit [max members]",
+    Help: "Show or set (0 removes) the max number of users in the room",
+    Run: cmdLimit,
+  })
+}
+
+// loadRooms reads the rooms file, if there is one.
+func loadRooms() error {
+  if roomsPath == "" {
+    return nil
+  }
+  f, err := os.Open(roomsPath)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  defer f.Close()
+  loaded := make(map[string]*RoomState)
+  if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+    return err
+  }
+  roomsMtx.Lock()
+  roomStates = loaded
+  roomsMtx.Unlock()
+  return nil
+}
+
+// isConfigured reports whether anything about the room has been set, beyond
+// when and by whom it was created.
+func (state *RoomState) isConfigured() bool {
+  return state.Topic != "" || state.MOTD != "" || state.MaxMembers != 0 ||
+    state.Access != "" || len(state.Invites) != 0 || len(state.Members) != 0 ||
+    len(state.Pins) != 0 || state.SlowMode != 0 || state.ReadOnly
+}
+
+// saveRooms writes the states of configured rooms to the rooms file. roomsMtx
+// must be held.
+func saveRooms() error {
+  if roomsPath == "" {
+    return nil
+  }
+  configured := make(map[string]*RoomState)
+  for room, state := range roomStates {
+    if state.isConfigured() {
+      configured[room] = state
+    }
+  }
+  b, err := json.MarshalIndent(configured, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := roomsPath + ".tmp"
+  if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, roomsPath)
+}
+
+// ensureRoom creates the room's state, if it doesn't have one, with the
+// client as its creator. The default room has no creator.
+func ensureRoom(room string, client *Client) {
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  if _, ok := roomStates[room]; ok {
+    return
+  }
+  state := &RoomState{Created: time.Now().UnixNano()}
+  if room != "" {
+    state.Creator = client.DisplayName()
+    state.CreatorKey = userKey(client.id, client.identity)
+  }
+  // It's saved once it's configured.
+  roomStates[room] = state
+}
+
+// updateRoom changes the room's state with fn and saves it, returning the new
+// state.
+func updateRoom(room string, fn func(state *RoomState)) RoomState {
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  state, ok := roomStates[room]
+  if !ok {
+    state = &RoomState{Created: time.Now().UnixNano()}
+    roomStates[room] = state
+  }
+  fn(state)
+  if err := saveRooms(); err != nil {
+    log.Printf("error saving rooms: %v", err)
+  }
+  return *state
+}
+
+// roomState returns a copy of the room's state.
+func roomState(room string) RoomState {
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  if state, ok := roomStates[room]; ok {
+    return *state
+  }
+  return RoomState{}
+}
+
+func roomMembers(room string) int {
+  n := 0
+  clients.Range(func(_, iClient any) bool {
+    if iClient.(*Client).InRoom(room) {
+      n++
+    }
+    return true
+  })
+  return n
+}
+
+// checkRoomCap returns errRoomFull if the room has no space for the client.
+// Moderators can always join.
+func checkRoomCap(client *Client, room string) error {
+  state := roomState(room)
+  if state.MaxMembers == 0 || client.role.AtLeast(RoleModerator) {
+    return nil
+  }
+  if roomMembers(room) >= state.MaxMembers {
+    return errRoomFull
+  }
+  return nil
+}
+
+// canManageRoom reports whether the client may change the room's state.
+func canManageRoom(client *Client, room string) bool {
+  if client.role.AtLeast(RoleModerator) {
+    return true
+  }
+  key := roomState(room).CreatorKey
+  return key != "" && key == userKey(client.id, client.identity)
+}
+
+// roomMsg returns a room message describing the room's state, with its MOTD
+// as the contents.
+func roomMsg(room string, state RoomState) common.Message {
+  msg := common.NewSystemMessage(common.ActionRoom, state.MOTD)
+  msg.Room = room
+  msg.RoomInfo = &common.RoomInfo{
+    Topic: state.Topic,
+    MOTD: state.MOTD,
+    Created: state.Created,
+    Creator: state.Creator,
+    MaxMembers: state.MaxMembers,
+    Members: roomMembers(room),
+    Access: state.roomAccess(),
+    SlowMode: state.SlowMode,
+    ReadOnly: state.ReadOnly,
+  }
+  return msg
+}
+
+// broadcastRoomChange tells the room its state was changed by the client.
+func broadcastRoomChange(ctx *CommandContext, state RoomState) {
+  msg := roomMsg(ctx.Room, state)
+  msg.Sender, msg.Name = ctx.Client.id, ctx.Client.Name()
+  broadcastMsg(msg)
+}
+
+func cmdMOTD(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    if motd := roomState(ctx.Room).MOTD; motd != "" {
+      ctx.Reply("MOTD: " + motd)
+    } else {
+      ctx.Reply("No MOTD is set")
+    }
+    return nil
+  }
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  motd := ctx.Args
+  if motd == "-" {
+    motd = ""
+  }
+  broadcastRoomChange(ctx, updateRoom(ctx.Room, func(state *RoomState) {
+    state.MOTD = motd
+  }))
+  return nil
+}
+
+func cmdRoom(ctx *CommandContext) error {
+  state := roomState(ctx.Room)
+  lines := []string{"Room: " + roomDisplayName(ctx.Room)}
+  if state.Created != 0 {
+    lines = append(lines, "Created: "+time.Unix(0, state.Created).UTC().Format(time.RFC3339))
+  }
+  if state.Creator != "" {
+    lines = append(lines, "Creator: "+state.Creator)
+  }
+  lines = append(lines, "Access: "+state.roomAccess())
+  members := fmt.Sprintf("Members: %d", roomMembers(ctx.Room))
+  if state.MaxMembers != 0 {
+    members += fmt.Sprintf("/%d", state.MaxMembers)
+  }
+  lines = append(lines, members)
+  if state.SlowMode != 0 {
+    lines = append(lines, "Slow mode: "+(time.Duration(state.SlowMode)*time.Second).String())
+  }
+  if state.ReadOnly {
+    lines = append(lines, "Read-only: yes")
+  }
+  if state.Topic != "" {
+    lines = append(lines, "Topic: "+state.Topic)
+  }
+  if state.MOTD != "" {
+    lines = append(lines, "MOTD: "+state.MOTD)
+  }
+  ctx.Reply(strings.Join(lines, "\n"))
+  return nil
+}
+
+func cmdLimit(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    if max := roomState(ctx.Room).MaxMembers; max != 0 {
+      ctx.Reply(fmt.Sprintf("Max members: %d", max))
+    } else {
+      ctx.Reply("No member limit is set")
+    }
+    return nil
+  }
+  if !canManageRoom(ctx.Client, ctx.Room) {
+    return errNotRoomManager
+  }
+  max, err := strconv.Atoi(ctx.Args)
+  if err != nil || max < 0 {
+    return errors.New("usage: /limit [max members]")
+  }
+  broadcastRoomChange(ctx, updateRoom(ctx.Room, func(state *RoomState) {
+    state.MaxMembers = max
+  }))
+  return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// useTestRooms starts the test with no room states, persisted to a temp
+// file, and restores them when it ends.
+func useTestRooms(t *testing.T) {
+  roomsMtx.Lock()
+  oldStates, oldPath := roomStates, roomsPath
+  roomStates, roomsPath = make(map[string]*RoomState), filepath.Join(t.TempDir(), "rooms.json")
+  roomsMtx.Unlock()
+  t.Cleanup(func() {
+    roomsMtx.Lock()
+    roomStates, roomsPath = oldStates, oldPath
+    roomsMtx.Unlock()
+  })
+}
+
+// runTestCommand runs the command as the client, returning the contents of
+// the info it's sent and of the error, if any.
+func runTestCommand(t *testing.T, client *Client, room, command string) (info, err string) {
+  t.Helper()
+  received(t, client)
+  runCommand(client, room, command)
+  for _, msg := range received(t, client) {
+    switch msg.Action {
+    case common.ActionInfo:
+      info = msg.Contents
+    case common.ActionError:
+      err = msg.Contents
+    }
+  }
+  return info, err
+}
+
+func TestCanManageRoom(t *testing.T) {
+  useTestRooms(t)
+  client := func(id, identity string, role Role) *Client {
+    c := NewClient(id, "", 0)
+    c.identity, c.role = identity, role
+    return c
+  }
+  ensureRoom("by-alice", client("conn-1", "alice", RoleUser))
+  ensureRoom("by-anon", client("conn-2", "", RoleUser))
+  // The default room has no creator.
+  ensureRoom("", client("conn-1", "alice", RoleUser))
+  tests := []struct {
+    name string
+    client *Client
+    room string
+    want bool
+  }{
+    {"creator", client("conn-1", "alice", RoleUser), "by-alice", true},
+    {"creator on another connection", client("conn-3", "Alice", RoleUser), "by-alice", true},
+    {"other user", client("conn-3", "bob", RoleUser), "by-alice", false},
+    {"anonymous creator", client("conn-2", "", RoleUser), "by-anon", true},
+    {"anonymous creator reconnected", client("conn-4", "", RoleUser), "by-anon", false},
+    {"moderator", client("conn-5", "mod", RoleModerator), "by-alice", true},
+    {"default room", client("conn-1", "alice", RoleUser), "", false},
+    {"moderator in the default room", client("conn-5", "mod", RoleModerator), "", true},
+    {"room nobody joined", client("conn-1", "alice", RoleUser), "nowhere", false},
+  }
+  for _, tt := range tests {
+    if got := canManageRoom(tt.client, tt.room); got != tt.want {
+      t.Errorf("%s: canManageRoom = %v, want %v", tt.name, got, tt.want)
+    }
+  }
+}
+
+func TestRoomCommands(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "alice": {Token: "a", Role: RoleUser},
+    "bob": {Token: "b", Role: RoleUser},
+    "mod": {Token: "m", Role: RoleModerator},
+  })
+  alice := newTestClient(t, "rooms-alice", "alice", "lounge")
+  bob := newTestClient(t, "rooms-bob", "bob", "lounge")
+  mod := newTestClient(t, "rooms-mod", "mod", "lounge")
+  ensureRoom("lounge", alice)
+
+  tests := []struct {
+    client *Client
+    command string
+    wantInfo, wantErr string
+    wantTopic, wantMOTD string
+    wantMax int
+  }{
+    {client: bob, command: "/topic", wantInfo: "No topic is set"},
+    {client: bob, command: "/topic bob's room", wantErr: errNotRoomManager.Error()},
+    {client: alice, command: "/topic Alice's room", wantTopic: "Alice's room"},
+    {client: bob, command: "/topic", wantInfo: "Topic: Alice's room", wantTopic: "Alice's room"},
+    {client: mod, command: "/topic -"},
+    {client: bob, command: "/motd", wantInfo: "No MOTD is set"},
+    {client: bob, command: "/motd hi", wantErr: errNotRoomManager.Error()},
+    {client: alice, command: "/motd Be nice", wantMOTD: "Be nice"},
+    {client: bob, command: "/motd", wantInfo: "MOTD: Be nice", wantMOTD: "Be nice"},
+    {client: mod, command: "/motd -"},
+    {client: bob, command: "/limit", wantInfo: "No member limit is set"},
+    {client: bob, command: "/limit 5", wantErr: errNotRoomManager.Error()},
+    {client: alice, command: "/limit -1", wantErr: "usage"},
+    {client: alice, command: "/limit lots", wantErr: "usage"},
+    {client: alice, command: "/limit 3", wantMax: 3},
+    {client: bob, command: "/limit", wantInfo: "Max members: 3", wantMax: 3},
+    {client: bob, command: "/room", wantInfo: "Room: lounge\n", wantMax: 3},
+    {client: mod, command: "/limit 0"},
+  }
+  for _, tt := range tests {
+    info, err := runTestCommand(t, tt.client, "lounge", tt.command)
+    if !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    if !strings.HasPrefix(info, tt.wantInfo) {
+      t.Errorf("%s: info %q, want %q", tt.command, info, tt.wantInfo)
+    }
+    state := roomState("lounge")
+    if state.Topic != tt.wantTopic || state.MOTD != tt.wantMOTD || state.MaxMembers != tt.wantMax {
+      t.Errorf("%s: state = %+v, want topic %q, MOTD %q and max %d",
+        tt.command, state, tt.wantTopic, tt.wantMOTD, tt.wantMax)
+    }
+  }
+
+  // Changes are broadcast.
+  runTestCommand(t, alice, "lounge", "/motd Welcome")
+  msg := lastReceived(t, bob)
+  if msg.Action != common.ActionRoom || msg.RoomInfo == nil || msg.RoomInfo.MOTD != "Welcome" || msg.Sender != alice.id {
+    t.Errorf("MOTD change broadcast %+v", msg)
+  }
+}
+
+func TestCheckRoomCap(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{"mod": {Token: "m", Role: RoleModerator}})
+  newTestClient(t, "cap-1", "", "capped")
+  newTestClient(t, "cap-2", "", "capped")
+  joining := newTestClient(t, "cap-3", "")
+  mod := newTestClient(t, "cap-mod", "mod")
+  tests := []struct {
+    max int
+    client *Client
+    want error
+  }{
+    {0, joining, nil},
+    {3, joining, nil},
+    {2, joining, errRoomFull},
+    {1, joining, errRoomFull},
+    {1, mod, nil},
+  }
+  for _, tt := range tests {
+    updateRoom("capped", func(state *RoomState) {
+      state.MaxMembers = tt.max
+    })
+    if err := checkRoomCap(tt.client, "capped"); err != tt.want {
+      t.Errorf("%s joining with max %d: err = %v, want %v", tt.client.id, tt.max, err, tt.want)
+    }
+  }
+}
+
+func TestRoomsPersisted(t *testing.T) {
+  useTestRooms(t)
+  alice := NewClient("persist-alice", "", 0)
+  ensureRoom("joined", alice)
+  ensureRoom("configured", alice)
+  updateRoom("configured", func(state *RoomState) {
+    state.Topic = "kept"
+  })
+  updateRoom("cleared", func(state *RoomState) {
+    state.MOTD = "gone"
+  })
+  updateRoom("cleared", func(state *RoomState) {
+    state.MOTD = ""
+  })
+
+  roomsMtx.Lock()
+  roomStates = make(map[string]*RoomState)
+  roomsMtx.Unlock()
+  if err := loadRooms(); err != nil {
+    t.Fatal(err)
+  }
+  roomsMtx.Lock()
+  defer roomsMtx.Unlock()
+  // Only configured rooms are saved.
+  if len(roomStates) != 1 || roomStates["configured"] == nil {
+    t.Fatalf("loaded rooms %v, want only configured", roomStates)
+  }
+  if state := roomStates["configured"]; state.Topic != "kept" || state.CreatorKey != userKey(alice.id, "") {
+    t.Errorf("loaded state = %+v", state)
+  }
+}
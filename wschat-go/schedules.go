@@ -0,0 +1,411 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "unicode"
+
+  "wschat/wschat-go/common"
+)
+
+const (
+  // How far ahead messages can be scheduled.
+  maxScheduleDelay = 365 * 24 * time.Hour
+  minScheduleInterval = time.Minute
+  // The max number of pending scheduled messages per user.
+  maxSchedulesPerUser = 20
+)
+
+// Schedule is a message to be sent to a room later, possibly repeatedly.
+type Schedule struct {
+  ID string `json:"id"`
+  Room string `json:"room"`
+  // Who scheduled it: their display name, identity and user key.
+  Creator string `json:"creator"`
+  Identity string `json:"identity"`
+  CreatorKey string `json:"creatorKey"`
+  // Sent by the system instead of the creator.
+  Announcement bool `json:"announcement,omitempty"`
+  Contents string `json:"contents"`
+  // When it's next sent, in Unix nanoseconds.
+  Next int64 `json:"next"`
+  // How often it repeats, e.g., "24h". Empty sends it once.
+  Every string `json:"every,omitempty"`
+  // Skips Saturdays and Sundays (in the server's time zone).
+  Weekdays bool `json:"weekdays,omitempty"`
+
+  every time.Duration
+}
+
+var (
+  // Where schedules are persisted to. They're only kept in memory if empty.
+  schedulesPath string
+  schedulesMtx sync.Mutex
+  schedules []*Schedule
+
+  errNotSignedIn = errors.New("you must be signed in to do that")
+)
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "schedule",
+    Usage: "/schedule <in <duration>|at <[date ]time>> [every <interval>|every weekday] <message>",
+    Help: "Send a chat later, e.g., /schedule at 09:55 every weekday Standup in 5 minutes",
+    Run: cmdSchedule,
+  })
+  RegisterCommand(&Command{
+    Name: "announce",
+    Usage: "/announce <in <duration>|at <[date ]time>> [every <interval>|every weekday] <message>",
+    Help: "Schedule a system announcement (moderators only)",
+    Run: cmdAnnounce,
+  })
+  RegisterCommand(&Command{
+    Name: "scheduled",
+    Usage: "/scheduled",
+    Help: "List your scheduled messages (moderators see everyone's in the room)",
+    Run: cmdScheduled,
+  })
+  RegisterCommand(&Command{
+    Name: "unschedule",
+    Usage: "/unschedule <ID>",
+    Help: "Cancel a scheduled message",
+    Run: cmdUnschedule,
+  })
+}
+
+// loadSchedules reads the schedules file, if there is one.
+func loadSchedules() error {
+  if schedulesPath == "" {
+    return nil
+  }
+  f, err := os.Open(schedulesPath)
+  if err != nil {
+    if errors.Is(err, os.ErrNotExist) {
+      return nil
+    }
+    return err
+  }
+  defer f.Close()
+  var loaded []*Schedule
+  if err := json.NewDecoder(f).Decode(&loaded); err != nil {
+    return err
+  }
+  for _, s := range loaded {
+    if s.Every != "" {
+      if s.every, err = time.ParseDuration(s.Every); err != nil {
+        return fmt.Errorf("schedule %s: invalid interval: %q", s.ID, s.Every)
+      }
+    }
+  }
+  schedulesMtx.Lock()
+  schedules = loaded
+  schedulesMtx.Unlock()
+  return nil
+}
+
+// saveSchedules writes the schedules to the schedules file. schedulesMtx must
+// be held.
+func saveSchedules() error {
+  if schedulesPath == "" {
+    return nil
+  }
+  b, err := json.MarshalIndent(schedules, "", "  ")
+  if err != nil {
+    return err
+  }
+  tmpPath := schedulesPath + ".tmp"
+  if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+    return err
+  }
+  return os.Rename(tmpPath, schedulesPath)
+}
+
+func isWeekend(t time.Time) bool {
+  day := t.Weekday()
+  return day == time.Saturday || day == time.Sunday
+}
+
+// advance moves the schedule's next time past now, skipping weekends if it's
+// only sent on weekdays. It returns false if the schedule doesn't repeat.
+func (s *Schedule) advance(now time.Time) bool {
+  if s.every == 0 {
+    return false
+  }
+  next := time.Unix(0, s.Next)
+  for !next.After(now) || (s.Weekdays && isWeekend(next)) {
+    // Repeats of whole days keep their time of day across DST changes.
+    if days := s.every / (24 * time.Hour); s.every%(24*time.Hour) == 0 {
+      next = next.AddDate(0, 0, int(days))
+    } else {
+      next = next.Add(s.every)
+    }
+  }
+  s.Next = next.UnixNano()
+  return true
+}
+
+// parseScheduleTime parses "in <duration>" or "at <[date ]time>" from the
+// front of the fields, returning the time and the rest. Times without dates
+// are the next time of day they occur, in the server's time zone.
+func parseScheduleTime(fields []string, now time.Time) (time.Time, []string, error) {
+  if len(fields) < 2 {
+    return time.Time{}, nil, errors.New("missing time")
+  }
+  switch fields[0] {
+  case "in":
+    d, err := time.ParseDuration(fields[1])
+    if err != nil || d <= 0 {
+      return time.Time{}, nil, fmt.Errorf("invalid duration: %s", fields[1])
+    }
+    return now.Add(d), fields[2:], nil
+  case "at":
+    if t, err := time.Parse(time.RFC3339, fields[1]); err == nil {
+      return t, fields[2:], nil
+    }
+    if len(fields) > 2 {
+      t, err := time.ParseInLocation("2006-01-02 15:04", fields[1]+" "+fields[2], time.Local)
+      if err == nil {
+        return t, fields[3:], nil
+      }
+    }
+    clock, err := time.ParseInLocation("15:04", fields[1], time.Local)
+    if err != nil {
+      return time.Time{}, nil, fmt.Errorf("invalid time: %s", fields[1])
+    }
+    t := time.Date(
+      now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local,
+    )
+    if !t.After(now) {
+      t = t.AddDate(0, 0, 1)
+    }
+    return t, fields[2:], nil
+  }
+  return time.Time{}, nil, errors.New(`the time must start with "in" or "at"`)
+}
+
+// parseSchedule parses the arguments of /schedule and /announce into a
+// schedule for the room.
+func parseSchedule(ctx *CommandContext, now time.Time) (*Schedule, error) {
+  fields := strings.Fields(ctx.Args)
+  next, fields, err := parseScheduleTime(fields, now)
+  if err != nil {
+    return nil, err
+  }
+  s := &Schedule{Room: ctx.Room}
+  if len(fields) >= 2 && fields[0] == "every" {
+    if fields[1] == "weekday" {
+      s.every, s.Weekdays = 24*time.Hour, true
+    } else if s.every, err = time.ParseDuration(fields[1]); err != nil {
+      return nil, fmt.Errorf("invalid interval: %s", fields[1])
+    } else if s.every < minScheduleInterval {
+      return nil, fmt.Errorf("the interval must be at least %s", minScheduleInterval)
+    }
+    s.Every = s.every.String()
+    fields = fields[2:]
+  }
+  if !next.After(now) || next.After(now.Add(maxScheduleDelay)) {
+    return nil, errors.New("the time must be in the next year")
+  }
+  if s.Weekdays {
+    for isWeekend(next) {
+      next = next.AddDate(0, 0, 1)
+    }
+  }
+  s.Next = next.UnixNano()
+  // Cut from the arguments to keep the message's own spacing.
+  s.Contents = cutFields(ctx.Args, len(strings.Fields(ctx.Args))-len(fields))
+  if s.Contents == "" {
+    return nil, errors.New("missing message")
+  }
+  return s, nil
+}
+
+// cutFields returns s without its first n fields, trimmed.
+func cutFields(s string, n int) string {
+  for i := 0; i < n; i++ {
+    s = strings.TrimLeftFunc(s, unicode.IsSpace)
+    if j := strings.IndexFunc(s, unicode.IsSpace); j != -1 {
+      s = s[j:]
+    } else {
+      s = ""
+    }
+  }
+  return strings.TrimSpace(s)
+}
+
+func addSchedule(ctx *CommandContext, announcement bool) error {
+  client := ctx.Client
+  if client.identity == "" {
+    return errNotSignedIn
+  }
+  now := time.Now()
+  s, err := parseSchedule(ctx, now)
+  if err != nil {
+    return err
+  }
+  s.ID = randomString(5)
+  s.Creator, s.Identity = client.DisplayName(), client.identity
+  s.CreatorKey = userKey(client.id, client.identity)
+  s.Announcement = announcement
+  schedulesMtx.Lock()
+  n := 0
+  for _, other := range schedules {
+    if other.CreatorKey == s.CreatorKey {
+      n++
+    }
+  }
+  if n >= maxSchedulesPerUser && !client.role.AtLeast(RoleModerator) {
+    schedulesMtx.Unlock()
+    return fmt.Errorf("you can have at most %d scheduled messages", maxSchedulesPerUser)
+  }
+  schedules = append(schedules, s)
+  if err := saveSchedules(); err != nil {
+    log.Printf("error saving schedules: %v", err)
+  }
+  schedulesMtx.Unlock()
+  ctx.Reply(fmt.Sprintf("Scheduled %s for %s", s.ID, describeSchedule(s)))
+  return nil
+}
+
+func describeSchedule(s *Schedule) string {
+  desc := time.Unix(0, s.Next).Format("2006-01-02 15:04 MST")
+  if s.Weekdays {
+    desc += ", every weekday"
+  } else if s.Every != "" {
+    desc += ", every " + s.Every
+  }
+  return desc
+}
+
+func cmdSchedule(ctx *CommandContext) error {
+  return addSchedule(ctx, false)
+}
+
+func cmdAnnounce(ctx *CommandContext) error {
+  if err := requireModerator(ctx); err != nil {
+    return err
+  }
+  return addSchedule(ctx, true)
+}
+
+func cmdScheduled(ctx *CommandContext) error {
+  key := userKey(ctx.Client.id, ctx.Client.identity)
+  isMod := ctx.Client.role.AtLeast(RoleModerator)
+  var mine []*Schedule
+  schedulesMtx.Lock()
+  for _, s := range schedules {
+    if s.CreatorKey == key || (isMod && s.Room == ctx.Room) {
+      copied := *s
+      mine = append(mine, &copied)
+    }
+  }
+  schedulesMtx.Unlock()
+  if len(mine) == 0 {
+    ctx.Reply("No scheduled messages")
+    return nil
+  }
+  sort.Slice(mine, func(i, j int) bool { return mine[i].Next < mine[j].Next })
+  lines := make([]string, len(mine))
+  for i, s := range mine {
+    kind := ""
+    if s.Announcement {
+      kind = " announcement"
+    }
+    lines[i] = fmt.Sprintf(
+      "%s: %s%s in %s by %s: %s",
+      s.ID, describeSchedule(s), kind, roomDisplayName(s.Room), s.Creator, s.Contents,
+    )
+  }
+  ctx.Reply(fmt.Sprintf("%d scheduled message(s):\n%s", len(lines), strings.Join(lines, "\n")))
+  return nil
+}
+
+func cmdUnschedule(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    return errors.New("usage: /unschedule <ID>")
+  }
+  key := userKey(ctx.Client.id, ctx.Client.identity)
+  schedulesMtx.Lock()
+  defer schedulesMtx.Unlock()
+  for i, s := range schedules {
+    if s.ID != ctx.Args {
+      continue
+    }
+    if s.CreatorKey != key && !ctx.Client.role.AtLeast(RoleModerator) {
+      return errors.New("only its creator or a moderator can cancel it")
+    }
+    schedules = append(schedules[:i], schedules[i+1:]...)
+    if err := saveSchedules(); err != nil {
+      log.Printf("error saving schedules: %v", err)
+    }
+    ctx.Reply("Cancelled " + s.ID)
+    return nil
+  }
+  return fmt.Errorf("no such scheduled message: %s", ctx.Args)
+}
+
+// sendScheduled sends the scheduled message to its room, as its creator (run
+// through the middlewares, as if they'd sent it) or the system.
+func sendScheduled(s *Schedule) {
+  if s.Announcement {
+    msg := common.NewChatMessage("system", s.Contents)
+    msg.Room = s.Room
+    broadcastMsg(msg)
+    return
+  }
+  // The creator may not be connected, so they're stood in for.
+  client := NewClient("scheduled-"+s.ID, "", 0)
+  client.identity = s.Identity
+  client.SetName(s.Creator)
+  msg := common.NewChatMessage(client.id, s.Contents)
+  msg.Room, msg.Name = s.Room, s.Creator
+  if err := pipeline.Message(client.Conn(s.Room), &msg); err != nil {
+    log.Printf("scheduled message %s by %s was vetoed: %v", s.ID, s.Identity, err)
+    return
+  }
+  broadcastFrom(client, msg)
+}
+
+// runSchedules sends scheduled messages when they're due, checking every
+// second.
+func runSchedules() {
+  for now := range time.NewTicker(time.Second).C {
+    var due []Schedule
+    dropped := false
+    schedulesMtx.Lock()
+    kept := schedules[:0]
+    for _, s := range schedules {
+      // Those of users since banned are dropped.
+      if !s.Announcement && findBan(s.Identity, "") != nil {
+        log.Printf("dropping scheduled message %s: %s is banned", s.ID, s.Identity)
+        dropped = true
+        continue
+      }
+      if s.Next > now.UnixNano() {
+        kept = append(kept, s)
+        continue
+      }
+      due = append(due, *s)
+      if s.advance(now) {
+        kept = append(kept, s)
+      }
+    }
+    schedules = kept
+    if len(due) != 0 || dropped {
+      if err := saveSchedules(); err != nil {
+        log.Printf("error saving schedules: %v", err)
+      }
+    }
+    schedulesMtx.Unlock()
+    for i := range due {
+      sendScheduled(&due[i])
+    }
+  }
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+  "os"
+  "reflect"
+  "testing"
+  "time"
+  _ "time/tzdata"
+)
+
+// Schedules are in the server's time zone, so tests run in one with DST
+// (which starts on 2024-03-10 at 2:00).
+func TestMain(m *testing.M) {
+  loc, err := time.LoadLocation("America/New_York")
+  if err != nil {
+    panic(err)
+  }
+  time.Local = loc
+  os.Exit(m.Run())
+}
+
+func localTime(year int, month time.Month, day, hour, min int) time.Time {
+  return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+}
+
+func TestParseScheduleTime(t *testing.T) {
+  // A Saturday, the day before DST starts.
+  now := localTime(2024, time.March, 9, 10, 0)
+  tests := []struct {
+    fields []string
+    want time.Time
+    rest []string
+    wantErr bool
+  }{
+    {fields: []string{"in", "90m", "hi"}, want: now.Add(90 * time.Minute), rest: []string{"hi"}},
+    {fields: []string{"in", "1h30m"}, want: now.Add(90 * time.Minute), rest: []string{}},
+    {fields: []string{"in", "-5m", "hi"}, wantErr: true},
+    {fields: []string{"in", "0s", "hi"}, wantErr: true},
+    {fields: []string{"in", "soon", "hi"}, wantErr: true},
+    {fields: []string{"at", "11:15", "hi"}, want: localTime(2024, time.March, 9, 11, 15), rest: []string{"hi"}},
+    // Times that have passed today are tomorrow, at the same time of day
+    // after DST starts.
+    {fields: []string{"at", "09:30", "hi"}, want: localTime(2024, time.March, 10, 9, 30), rest: []string{"hi"}},
+    {fields: []string{"at", "10:00", "hi"}, want: localTime(2024, time.March, 10, 10, 0), rest: []string{"hi"}},
+    {
+      fields: []string{"at", "2024-03-12", "08:05", "hi", "there"},
+      want: localTime(2024, time.March, 12, 8, 5), rest: []string{"hi", "there"},
+    },
+    {
+      fields: []string{"at", "2024-03-12T08:05:00Z", "hi"},
+      want: time.Date(2024, time.March, 12, 8, 5, 0, 0, time.UTC), rest: []string{"hi"},
+    },
+    {fields: []string{"at", "2024-03-12"}, wantErr: true},
+    {fields: []string{"at", "noon", "hi"}, wantErr: true},
+    {fields: []string{"at", "25:00", "hi"}, wantErr: true},
+    {fields: []string{"tomorrow", "hi"}, wantErr: true},
+    {fields: []string{"in"}, wantErr: true},
+    {fields: nil, wantErr: true},
+  }
+  for _, tt := range tests {
+    got, rest, err := parseScheduleTime(tt.fields, now)
+    if tt.wantErr {
+      if err == nil {
+        t.Errorf("parseScheduleTime(%q) = %s, want an error", tt.fields, got)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parseScheduleTime(%q): %v", tt.fields, err)
+      continue
+    }
+    if !got.Equal(tt.want) || !reflect.DeepEqual(rest, tt.rest) {
+      t.Errorf("parseScheduleTime(%q) = %s, %q, want %s, %q", tt.fields, got, rest, tt.want, tt.rest)
+    }
+  }
+}
+
+func TestParseSchedule(t *testing.T) {
+  // A Friday.
+  now := localTime(2024, time.March, 8, 10, 0)
+  tests := []struct {
+    args string
+    want Schedule
+    wantErr bool
+  }{
+    {
+      args: "in 1h stand  up",
+      want: Schedule{Room: "dev", Contents: "stand  up", Next: now.Add(time.Hour).UnixNano()},
+    },
+    {
+      args: "at 09:00 every 24h  good morning ",
+      want: Schedule{
+        Room: "dev", Contents: "good morning", Every: "24h0m0s",
+        Next: localTime(2024, time.March, 9, 9, 0).UnixNano(),
+      },
+    },
+    // Skips to Monday.
+    {
+      args: "at 09:00 every weekday standup",
+      want: Schedule{
+        Room: "dev", Contents: "standup", Every: "24h0m0s", Weekdays: true,
+        Next: localTime(2024, time.March, 11, 9, 0).UnixNano(),
+      },
+    },
+    {args: "in 1h every 30s too often", wantErr: true},
+    {args: "in 1h every often hi", wantErr: true},
+    {args: "at 2026-01-01 09:00 too far", wantErr: true},
+    {args: "at 2024-03-01 09:00 past", wantErr: true},
+    {args: "in 1h", wantErr: true},
+    {args: "in 1h every 1h", wantErr: true},
+  }
+  for _, tt := range tests {
+    s, err := parseSchedule(&CommandContext{Room: "dev", Args: tt.args}, now)
+    if tt.wantErr {
+      if err == nil {
+        t.Errorf("parseSchedule(%q) = %+v, want an error", tt.args, s)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("parseSchedule(%q): %v", tt.args, err)
+      continue
+    }
+    s.every = 0
+    if !reflect.DeepEqual(*s, tt.want) {
+      t.Errorf("parseSchedule(%q) = %+v, want %+v", tt.args, *s, tt.want)
+    }
+  }
+}
+
+func TestScheduleAdvance(t *testing.T) {
+  tests := []struct {
+    name string
+    next time.Time
+    every time.Duration
+    weekdays bool
+    now time.Time
+    want time.Time
+    repeats bool
+  }{
+    {
+      name: "once",
+      next: localTime(2024, time.March, 9, 9, 0), now: localTime(2024, time.March, 9, 9, 0),
+    },
+    {
+      name: "daily across DST",
+      next: localTime(2024, time.March, 9, 9, 0), every: 24 * time.Hour,
+      now: localTime(2024, time.March, 9, 9, 0),
+      want: localTime(2024, time.March, 10, 9, 0), repeats: true,
+    },
+    {
+      name: "weekly across DST",
+      next: localTime(2024, time.March, 5, 9, 0), every: 7 * 24 * time.Hour,
+      now: localTime(2024, time.March, 5, 9, 0),
+      want: localTime(2024, time.March, 12, 9, 0), repeats: true,
+    },
+    {
+      name: "hourly across DST",
+      next: localTime(2024, time.March, 10, 1, 30), every: time.Hour,
+      now: localTime(2024, time.March, 10, 1, 30),
+      want: localTime(2024, time.March, 10, 3, 30), repeats: true,
+    },
+    {
+      name: "missed repeats",
+      next: localTime(2024, time.March, 1, 9, 0), every: 24 * time.Hour,
+      now: localTime(2024, time.March, 4, 12, 0),
+      want: localTime(2024, time.March, 5, 9, 0), repeats: true,
+    },
+    {
+      name: "weekdays skip the weekend",
+      next: localTime(2024, time.March, 8, 9, 0), every: 24 * time.Hour, weekdays: true,
+      now: localTime(2024, time.March, 8, 9, 0),
+      want: localTime(2024, time.March, 11, 9, 0), repeats: true,
+    },
+  }
+  for _, tt := range tests {
+    s := &Schedule{Next: tt.next.UnixNano(), every: tt.every, Weekdays: tt.weekdays}
+    if repeats := s.advance(tt.now); repeats != tt.repeats {
+      t.Errorf("%s: advance = %v, want %v", tt.name, repeats, tt.repeats)
+      continue
+    }
+    if !tt.repeats {
+      continue
+    }
+    if got := time.Unix(0, s.Next); !got.Equal(tt.want) {
+      t.Errorf("%s: next = %s, want %s", tt.name, got, tt.want)
+    }
+  }
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+  "sort"
+  "strings"
+  "unicode"
+)
+
+// searchIndex maps the tokens (words) and trigrams (runs of 3 characters) of
+// the lowercased contents of a room's chats in memory to the chats' IDs.
+type searchIndex struct {
+  // map[token]set of IDs
+  tokens map[string]map[uint64]struct{}
+  // map[trigram]set of IDs
+  trigrams map[string]map[uint64]struct{}
+}
+
+func newSearchIndex() *searchIndex {
+  return &searchIndex{
+    tokens: make(map[string]map[uint64]struct{}),
+    trigrams: make(map[string]map[uint64]struct{}),
+  }
+}
+
+// searchTokens splits the contents into lowercase words.
+func searchTokens(contents string) []string {
+  return strings.FieldsFunc(strings.ToLower(contents), func(r rune) bool {
+    return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+  })
+}
+
+// searchTrigrams returns the trigrams of the lowercased contents.
+func searchTrigrams(contents string) []string {
+  runes := []rune(strings.ToLower(contents))
+  if len(runes) < 3 {
+    return nil
+  }
+  trigrams := make([]string, 0, len(runes)-2)
+  for i := 0; i+3 <= len(runes); i++ {
+    trigrams = append(trigrams, string(runes[i:i+3]))
+  }
+  return trigrams
+}
+
+func addPosting(postings map[string]map[uint64]struct{}, key string, id uint64) {
+  ids, ok := postings[key]
+  if !ok {
+    ids = make(map[uint64]struct{})
+    postings[key] = ids
+  }
+  ids[id] = struct{}{}
+}
+
+func removePosting(postings map[string]map[uint64]struct{}, key string, id uint64) {
+  if ids, ok := postings[key]; ok {
+    delete(ids, id)
+    if len(ids) == 0 {
+      delete(postings, key)
+    }
+  }
+}
+
+func (idx *searchIndex) add(id uint64, contents string) {
+  for _, token := range searchTokens(contents) {
+    addPosting(idx.tokens, token, id)
+  }
+  for _, trigram := range searchTrigrams(contents) {
+    addPosting(idx.trigrams, trigram, id)
+  }
+}
+
+func (idx *searchIndex) remove(id uint64, contents string) {
+  for _, token := range searchTokens(contents) {
+    removePosting(idx.tokens, token, id)
+  }
+  for _, trigram := range searchTrigrams(contents) {
+    removePosting(idx.trigrams, trigram, id)
+  }
+}
+
+// intersect returns the IDs under all the keys, in ascending order.
+func intersect(postings map[string]map[uint64]struct{}, keys []string) []uint64 {
+  var smallest map[uint64]struct{}
+  for _, key := range keys {
+    ids := postings[key]
+    if len(ids) == 0 {
+      return nil
+    }
+    if smallest == nil || len(ids) < len(smallest) {
+      smallest = ids
+    }
+  }
+  var result []uint64
+outer:
+  for id := range smallest {
+    for _, key := range keys {
+      if _, ok := postings[key][id]; !ok {
+        continue outer
+      }
+    }
+    result = append(result, id)
+  }
+  sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+  return result
+}
+
+// candidates returns the IDs, in ascending order, of the chats that may match
+// the text (containing all its tokens if byToken, otherwise containing it), or
+// false if the index can't narrow them down. Substring candidates still have
+// to be checked.
+func (idx *searchIndex) candidates(text string, byToken bool) ([]uint64, bool) {
+  if byToken {
+    tokens := searchTokens(text)
+    if len(tokens) == 0 {
+      return nil, false
+    }
+    return intersect(idx.tokens, tokens), true
+  }
+  trigrams := searchTrigrams(text)
+  if len(trigrams) == 0 {
+    return nil, false
+  }
+  return intersect(idx.trigrams, trigrams), true
+}
+
+// containsTokens reports whether the contents have all the tokens.
+func containsTokens(contents string, tokens []string) bool {
+  have := make(map[string]bool)
+  for _, token := range searchTokens(contents) {
+    have[token] = true
+  }
+  for _, token := range tokens {
+    if !have[token] {
+      return false
+    }
+  }
+  return true
+}
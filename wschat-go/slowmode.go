@@ -0,0 +1,216 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+  "time"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+// The longest slow mode interval a room can have.
+const maxSlowMode = 6 * time.Hour
+
+var errReadOnly = &common.ErrorInfo{
+  Code: "read_only", Message: "only moderators can post in this room",
+}
+
+func init() {
+  RegisterCommand(&Command{
+    Name: "slowmode",
+    Usage: "/slowmode [interval|off]",
+    Help: "Show or set the min time between each user's posts in the room (moderators)",
+    Run: cmdSlowMode,
+  })
+  RegisterCommand(&Command{
+    Name: "readonly",
+    Usage: "/readonly [on|off]",
+    Help: "Show or set whether only moderators and bots can post in the room (moderators)",
+    Run: cmdReadOnly,
+  })
+}
+
+// roomModeMiddleware enforces rooms' slow mode and read-only settings on
+// posts. Moderators and bots (incoming webhooks) are exempt.
+type roomModeMiddleware struct {
+  middleware.Base
+
+  mtx sync.Mutex
+  // When each user last posted to each room in slow mode.
+  // map[room]map[userKey]time.Time
+  lastPosts map[string]map[string]time.Time
+  // Posts allowed in slow mode, but not yet broadcast (the rest of the
+  // pipeline can still veto them), by sender.
+  pending map[string]pendingPost
+  lastSweep time.Time
+}
+
+// pendingPost is a post to a room in slow mode that's on its way through the
+// pipeline.
+type pendingPost struct {
+  room, key string
+  at time.Time
+}
+
+func newRoomModeMiddleware() *roomModeMiddleware {
+  return &roomModeMiddleware{
+    lastPosts: make(map[string]map[string]time.Time),
+    pending: make(map[string]pendingPost),
+  }
+}
+
+// isExemptPoster reports whether who sent a message through the pipeline is
+// a moderator or a bot. Signed-in users' roles come from their accounts, so
+// it doesn't matter whether they're still connected (or stood in for by a
+// schedule).
+func isExemptPoster(conn middleware.Conn) bool {
+  if conn.Bot {
+    return true
+  }
+  if conn.Identity != "" {
+    acct, ok := accounts[conn.Identity]
+    return ok && acct.Role.AtLeast(RoleModerator)
+  }
+  return false
+}
+
+func (rm *roomModeMiddleware) OnMessage(conn middleware.Conn, msg *common.Message) error {
+  if !isPosted(msg) || isExemptPoster(conn) {
+    return nil
+  }
+  state := roomState(conn.Room)
+  if state.ReadOnly {
+    return errReadOnly
+  }
+  if state.SlowMode == 0 {
+    return nil
+  }
+  interval := time.Duration(state.SlowMode) * time.Second
+  key := userKey(conn.ID, conn.Identity)
+  now := time.Now()
+  rm.mtx.Lock()
+  defer rm.mtx.Unlock()
+  rm.sweepLocked(now)
+  if next := rm.lastPosts[conn.Room][key].Add(interval); next.After(now) {
+    return &common.ErrorInfo{
+      Code: "slow_mode",
+      Message: fmt.Sprintf(
+        "slow mode is on: you can post again in %s",
+        next.Sub(now).Round(time.Second),
+      ),
+      RetryAt: next.UnixNano(),
+    }
+  }
+  rm.pending[conn.ID] = pendingPost{room: conn.Room, key: key, at: now}
+  return nil
+}
+
+// BeforeBroadcast counts a pending post once it's broadcast, so posts vetoed
+// after OnMessage (by later middlewares or failed commands) don't hold the
+// user back.
+func (rm *roomModeMiddleware) BeforeBroadcast(msg *common.Message) error {
+  if !isRecorded(msg.Action) {
+    return nil
+  }
+  rm.mtx.Lock()
+  defer rm.mtx.Unlock()
+  post, ok := rm.pending[msg.Sender]
+  if !ok || post.room != msg.Room {
+    return nil
+  }
+  delete(rm.pending, msg.Sender)
+  posts := rm.lastPosts[post.room]
+  if posts == nil {
+    posts = make(map[string]time.Time)
+    rm.lastPosts[post.room] = posts
+  }
+  posts[post.key] = post.at
+  return nil
+}
+
+func (rm *roomModeMiddleware) OnDisconnect(conn middleware.Conn) {
+  rm.mtx.Lock()
+  defer rm.mtx.Unlock()
+  if post, ok := rm.pending[conn.ID]; ok && post.room == conn.Room {
+    delete(rm.pending, conn.ID)
+  }
+}
+
+// sweepLocked forgets posts too old to matter, at most once a minute.
+func (rm *roomModeMiddleware) sweepLocked(now time.Time) {
+  if now.Sub(rm.lastSweep) < time.Minute {
+    return
+  }
+  rm.lastSweep = now
+  for room, posts := range rm.lastPosts {
+    for key, at := range posts {
+      if now.Sub(at) >= maxSlowMode {
+        delete(posts, key)
+      }
+    }
+    if len(posts) == 0 {
+      delete(rm.lastPosts, room)
+    }
+  }
+  // Vetoed posts by stand-ins for scheduled messages, which never disconnect.
+  for id, post := range rm.pending {
+    if now.Sub(post.at) >= time.Minute {
+      delete(rm.pending, id)
+    }
+  }
+}
+
+func cmdSlowMode(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    if secs := roomState(ctx.Room).SlowMode; secs != 0 {
+      ctx.Reply("Slow mode: " + (time.Duration(secs) * time.Second).String())
+    } else {
+      ctx.Reply("Slow mode is off")
+    }
+    return nil
+  }
+  if !ctx.Client.role.AtLeast(RoleModerator) {
+    return errNotModerator
+  }
+  var interval time.Duration
+  if !strings.EqualFold(ctx.Args, "off") {
+    var err error
+    interval, err = time.ParseDuration(ctx.Args)
+    if err != nil || interval < time.Second || interval > maxSlowMode {
+      return errors.New("usage: /slowmode [interval|off] (from 1s to 6h)")
+    }
+  }
+  broadcastRoomChange(ctx, updateRoom(ctx.Room, func(state *RoomState) {
+    state.SlowMode = int64(interval / time.Second)
+  }))
+  return nil
+}
+
+func cmdReadOnly(ctx *CommandContext) error {
+  if ctx.Args == "" {
+    if roomState(ctx.Room).ReadOnly {
+      ctx.Reply("The room is read-only")
+    } else {
+      ctx.Reply("The room isn't read-only")
+    }
+    return nil
+  }
+  if !ctx.Client.role.AtLeast(RoleModerator) {
+    return errNotModerator
+  }
+  var readOnly bool
+  switch strings.ToLower(ctx.Args) {
+  case "on":
+    readOnly = true
+  case "off":
+  default:
+    return errors.New("usage: /readonly [on|off]")
+  }
+  broadcastRoomChange(ctx, updateRoom(ctx.Room, func(state *RoomState) {
+    state.ReadOnly = readOnly
+  }))
+  return nil
+}
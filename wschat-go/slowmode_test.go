@@ -0,0 +1,162 @@
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+func TestRoomModeOnMessage(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "mod": {Token: "m", Role: RoleModerator},
+    "bob": {Token: "b", Role: RoleUser},
+  })
+  updateRoom("slow", func(state *RoomState) { state.SlowMode = 3600 })
+  updateRoom("quiet", func(state *RoomState) { state.ReadOnly = true })
+  anon := newTestClient(t, "mode-anon", "")
+  bob := newTestClient(t, "mode-bob", "bob")
+  mod := newTestClient(t, "mode-mod", "mod")
+  bot := middleware.Conn{ID: "webhook:ci", Bot: true}
+  conn := func(c *Client, room string) middleware.Conn { return c.Conn(room) }
+  botIn := func(room string) middleware.Conn {
+    c := bot
+    c.Room = room
+    return c
+  }
+
+  rm := newRoomModeMiddleware()
+  start := time.Now()
+  tests := []struct {
+    name string
+    conn middleware.Conn
+    contents string
+    // Whether the rest of the pipeline lets it through.
+    broadcast bool
+    wantCode string
+  }{
+    {name: "first post", conn: conn(anon, "slow"), contents: "hi", broadcast: true},
+    {name: "too soon", conn: conn(anon, "slow"), contents: "again", wantCode: "slow_mode"},
+    {name: "command", conn: conn(anon, "slow"), contents: "/help"},
+    {name: "other room", conn: conn(anon, "open"), contents: "hi", broadcast: true},
+    // Posts vetoed later don't count.
+    {name: "vetoed", conn: conn(bob, "slow"), contents: "hi"},
+    {name: "after a veto", conn: conn(bob, "slow"), contents: "hi", broadcast: true},
+    {name: "too soon after", conn: conn(bob, "slow"), contents: "again", wantCode: "slow_mode"},
+    {name: "moderator", conn: conn(mod, "slow"), contents: "hi", broadcast: true},
+    {name: "moderator again", conn: conn(mod, "slow"), contents: "again", broadcast: true},
+    {name: "bot", conn: botIn("slow"), contents: "hi", broadcast: true},
+    {name: "bot again", conn: botIn("slow"), contents: "again", broadcast: true},
+    {name: "read-only", conn: conn(bob, "quiet"), contents: "hi", wantCode: "read_only"},
+    {name: "read-only command", conn: conn(bob, "quiet"), contents: "/help"},
+    {name: "read-only moderator", conn: conn(mod, "quiet"), contents: "hi", broadcast: true},
+    {name: "read-only bot", conn: botIn("quiet"), contents: "hi", broadcast: true},
+  }
+  for _, tt := range tests {
+    msg := common.NewChatMessage(tt.conn.ID, tt.contents)
+    msg.Room = tt.conn.Room
+    err := rm.OnMessage(tt.conn, &msg)
+    var code string
+    if info, ok := err.(*common.ErrorInfo); ok {
+      code = info.Code
+      if code == "slow_mode" && info.RetryAt < start.Add(time.Hour).UnixNano() {
+        t.Errorf("%s: retry at %d, want an hour later", tt.name, info.RetryAt)
+      }
+    }
+    if code != tt.wantCode || err != nil && code == "" {
+      t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantCode)
+    }
+    if err == nil && tt.broadcast {
+      rm.BeforeBroadcast(&msg)
+    }
+  }
+
+  // Disconnecting from the room forgets a pending post.
+  rm.pending[anon.id] = pendingPost{room: "slow", key: userKey(anon.id, ""), at: start}
+  rm.OnDisconnect(conn(anon, "open"))
+  if _, ok := rm.pending[anon.id]; !ok {
+    t.Error("disconnecting from another room forgot the post")
+  }
+  rm.OnDisconnect(conn(anon, "slow"))
+  if _, ok := rm.pending[anon.id]; ok {
+    t.Error("disconnecting didn't forget the post")
+  }
+}
+
+func TestRoomModeSweep(t *testing.T) {
+  rm := newRoomModeMiddleware()
+  start := time.Now()
+  rm.lastPosts["a"] = map[string]time.Time{"old": start, "new": start.Add(time.Hour)}
+  rm.lastPosts["b"] = map[string]time.Time{"old": start}
+  rm.pending["conn-1"] = pendingPost{room: "a", key: "old", at: start}
+  tests := []struct {
+    at time.Duration
+    wantRooms, wantPending int
+  }{
+    {30 * time.Second, 2, 1},
+    // At most once a minute.
+    {89 * time.Second, 2, 1},
+    {90 * time.Second, 2, 0},
+    {maxSlowMode, 1, 0},
+    {maxSlowMode + time.Hour, 0, 0},
+  }
+  for _, tt := range tests {
+    rm.sweepLocked(start.Add(tt.at))
+    if len(rm.lastPosts) != tt.wantRooms || len(rm.pending) != tt.wantPending {
+      t.Errorf("at %v: %d rooms and %d pending, want %d and %d",
+        tt.at, len(rm.lastPosts), len(rm.pending), tt.wantRooms, tt.wantPending)
+    }
+  }
+}
+
+func TestRoomModeCommands(t *testing.T) {
+  useTestRooms(t)
+  setTestAccounts(t, map[string]*Account{
+    "mod": {Token: "m", Role: RoleModerator},
+    "bob": {Token: "b", Role: RoleUser},
+  })
+  mod := newTestClient(t, "modecmd-mod", "mod", "modes")
+  bob := newTestClient(t, "modecmd-bob", "bob", "modes")
+
+  tests := []struct {
+    client *Client
+    command string
+    wantInfo, wantErr string
+  }{
+    {client: bob, command: "/slowmode", wantInfo: "Slow mode is off"},
+    {client: bob, command: "/slowmode 30s", wantErr: errNotModerator.Message},
+    {client: mod, command: "/slowmode 30", wantErr: "usage: /slowmode"},
+    {client: mod, command: "/slowmode 500ms", wantErr: "usage: /slowmode"},
+    {client: mod, command: "/slowmode 7h", wantErr: "usage: /slowmode"},
+    {client: mod, command: "/slowmode 1m30s"},
+    {client: bob, command: "/slowmode", wantInfo: "Slow mode: 1m30s"},
+    {client: mod, command: "/slowmode OFF"},
+    {client: bob, command: "/slowmode", wantInfo: "Slow mode is off"},
+    {client: bob, command: "/readonly", wantInfo: "The room isn't read-only"},
+    {client: bob, command: "/readonly on", wantErr: errNotModerator.Message},
+    {client: mod, command: "/readonly yes", wantErr: "usage: /readonly"},
+    {client: mod, command: "/readonly On"},
+    {client: bob, command: "/readonly", wantInfo: "The room is read-only"},
+    {client: mod, command: "/readonly off"},
+    {client: bob, command: "/readonly", wantInfo: "The room isn't read-only"},
+  }
+  for _, tt := range tests {
+    info, err := runTestCommand(t, tt.client, "modes", tt.command)
+    if !strings.Contains(err, tt.wantErr) || tt.wantErr == "" && err != "" {
+      t.Errorf("%s: error %q, want %q", tt.command, err, tt.wantErr)
+    }
+    if info != tt.wantInfo {
+      t.Errorf("%s: info %q, want %q", tt.command, info, tt.wantInfo)
+    }
+  }
+
+  // Changes are broadcast to the room.
+  received(t, bob)
+  runCommand(mod, "modes", "/slowmode 10s")
+  if msg := lastReceived(t, bob); msg.Action != common.ActionRoom || msg.Sender != mod.id {
+    t.Errorf("change = %+v", msg)
+  }
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "hash/fnv"
+  "log"
+  "os"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+  "unicode"
+  "unicode/utf8"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+// Responses to detected spam.
+const (
+  // The message is only sent back to its sender, who isn't told it was
+  // dropped.
+  SpamDrop = "drop"
+  // The sender can only send a message every interval for the duration.
+  SpamSlow = "slow"
+  // The sender is muted for the duration.
+  SpamMute = "mute"
+)
+
+const (
+  defaultSpamDuration = 10 * time.Minute
+  defaultSpamInterval = 10 * time.Second
+  // Near-duplicates shorter than this (in letters) aren't checked, so common
+  // short replies aren't caught.
+  minFingerprintLen = 8
+  // The most recent messages kept per connection for spotting repeats.
+  maxRecentSends = 50
+)
+
+// SpamConfig is the spam detector's config file. Detectors that are nil are
+// off.
+type SpamConfig struct {
+  // The same contents sent count times by a connection within the window.
+  Repeat *SpamRule `json:"repeat,omitempty"`
+  // Contents that are the same, ignoring case, digits, punctuation and
+  // spacing, sent by count users within the window.
+  NearDuplicate *SpamRule `json:"nearDuplicate,omitempty"`
+  // Count messages sent by a connection within the window after it
+  // connected.
+  ConnectBurst *SpamRule `json:"connectBurst,omitempty"`
+}
+
+// SpamRule is when a detector triggers and what's done about it.
+type SpamRule struct {
+  Count int `json:"count"`
+  Window string `json:"window"`
+  // One of "drop", "slow" or "mute".
+  Action string `json:"action"`
+  // How long slow mode or the mute lasts. Defaults to 10m.
+  Duration string `json:"duration,omitempty"`
+  // The min time between messages in slow mode. Defaults to 10s.
+  Interval string `json:"interval,omitempty"`
+
+  name string
+  window, duration, interval time.Duration
+  // The number of times it's triggered.
+  detections atomic.Uint64
+}
+
+// slowState is a user put in slow mode.
+type slowState struct {
+  until time.Time
+  interval time.Duration
+  last time.Time
+}
+
+type recentSend struct {
+  hash uint64
+  at time.Time
+}
+
+// connSpamState is what's tracked per connection.
+type connSpamState struct {
+  connected time.Time
+  // Messages sent since connecting, while within the connect burst window.
+  sent int
+  recent []recentSend
+}
+
+// spamMiddleware detects spam in chats, emotes and polls sent by connected
+// users (moderators aren't checked).
+type spamMiddleware struct {
+  middleware.Base
+  config SpamConfig
+
+  mtx sync.Mutex
+  // map[connection ID]
+  conns map[string]*connSpamState
+  // map[fingerprint]map[userKey]when last sent
+  fingerprints map[string]map[string]time.Time
+  lastSweep time.Time
+  // map[userKey]
+  slowed map[string]*slowState
+}
+
+// loadSpamConfig reads the config file and creates a spam detector with it.
+func loadSpamConfig(path string) (*spamMiddleware, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var config SpamConfig
+  if err := json.NewDecoder(f).Decode(&config); err != nil {
+    return nil, err
+  }
+  for name, rule := range map[string]*SpamRule{
+    "repeat": config.Repeat,
+    "nearDuplicate": config.NearDuplicate,
+    "connectBurst": config.ConnectBurst,
+  } {
+    if rule == nil {
+      continue
+    }
+    if err := rule.parse(name); err != nil {
+      return nil, fmt.Errorf("%s: %w", name, err)
+    }
+  }
+  return &spamMiddleware{
+    config: config,
+    conns: make(map[string]*connSpamState),
+    fingerprints: make(map[string]map[string]time.Time),
+    slowed: make(map[string]*slowState),
+  }, nil
+}
+
+func (rule *SpamRule) parse(name string) error {
+  rule.name = name
+  if rule.Count < 1 {
+    return fmt.Errorf("count must be at least 1")
+  }
+  var err error
+  if rule.window, err = time.ParseDuration(rule.Window); err != nil || rule.window <= 0 {
+    return fmt.Errorf("invalid window: %q", rule.Window)
+  }
+  switch rule.Action {
+  case SpamDrop, SpamSlow, SpamMute:
+  default:
+    return fmt.Errorf("invalid action: %q", rule.Action)
+  }
+  rule.duration, rule.interval = defaultSpamDuration, defaultSpamInterval
+  if rule.Duration != "" {
+    if rule.duration, err = time.ParseDuration(rule.Duration); err != nil || rule.duration <= 0 {
+      return fmt.Errorf("invalid duration: %q", rule.Duration)
+    }
+  }
+  if rule.Interval != "" {
+    if rule.interval, err = time.ParseDuration(rule.Interval); err != nil || rule.interval <= 0 {
+      return fmt.Errorf("invalid interval: %q", rule.Interval)
+    }
+  }
+  return nil
+}
+
+// fingerprint returns the contents' letters, lowercased, so near-duplicates
+// (differing in case, digits, punctuation or spacing) have the same one.
+func fingerprint(contents string) string {
+  return strings.Map(func(r rune) rune {
+    if unicode.IsLetter(r) {
+      return unicode.ToLower(r)
+    }
+    return -1
+  }, contents)
+}
+
+func hashContents(contents string) uint64 {
+  h := fnv.New64a()
+  h.Write([]byte(contents))
+  return h.Sum64()
+}
+
+// isPosted reports whether the message posts to the room: chats (other than
+// commands, except emotes), emotes and polls.
+func isPosted(msg *common.Message) bool {
+  switch msg.Action {
+  case common.ActionChat:
+    contents := msg.Contents
+    if strings.HasPrefix(contents, "/") && !strings.HasPrefix(contents, "//") &&
+      !strings.HasPrefix(contents, "/me ") {
+      return false
+    }
+    return strings.TrimSpace(contents) != ""
+  case common.ActionEmote, common.ActionPoll:
+    return true
+  }
+  return false
+}
+
+// shadowMsg returns the posted message as it would have been broadcast, for
+// its sender to see when it's shadow-dropped. It's given an ID, but isn't
+// recorded.
+func shadowMsg(msg common.Message) common.Message {
+  if msg.Action == common.ActionChat {
+    if strings.HasPrefix(msg.Contents, "//") {
+      msg.Contents = msg.Contents[1:]
+    } else if strings.HasPrefix(msg.Contents, "/me ") {
+      msg.Action, msg.Contents = common.ActionEmote, strings.TrimSpace(msg.Contents[4:])
+    }
+  }
+  if msg.ReplyTo != 0 && setReplyThread(msg.Room, &msg) != nil {
+    msg.ReplyTo = 0
+  }
+  if isRecorded(msg.Action) {
+    msg.Mentions = parseMentions(msg.Contents)
+    historyMtx.Lock()
+    lastID++
+    msg.ID = lastID
+    historyMtx.Unlock()
+  }
+  return msg
+}
+
+func (sm *spamMiddleware) OnConnect(conn middleware.Conn) error {
+  sm.mtx.Lock()
+  defer sm.mtx.Unlock()
+  if _, ok := sm.conns[conn.ID]; !ok {
+    sm.conns[conn.ID] = &connSpamState{connected: time.Now()}
+  }
+  return nil
+}
+
+func (sm *spamMiddleware) OnDisconnect(conn middleware.Conn) {
+  // IRC sessions disconnect from each room they part, but are still
+  // connected if they're in others.
+  if iClient, ok := clients.Load(conn.ID); ok && inAnyRoom(iClient.(*Client)) {
+    return
+  }
+  sm.mtx.Lock()
+  delete(sm.conns, conn.ID)
+  sm.mtx.Unlock()
+}
+
+func inAnyRoom(client *Client) bool {
+  in := false
+  client.rooms.Range(func(_, _ any) bool {
+    in = true
+    return false
+  })
+  return in
+}
+
+func (sm *spamMiddleware) OnMessage(conn middleware.Conn, msg *common.Message) error {
+  iClient, ok := clients.Load(conn.ID)
+  if !ok || !isPosted(msg) {
+    // Webhooks and scheduled chats aren't from connected users.
+    return nil
+  }
+  client := iClient.(*Client)
+  if client.role.AtLeast(RoleModerator) {
+    return nil
+  }
+  key := userKey(conn.ID, conn.Identity)
+  now := time.Now()
+
+  sm.mtx.Lock()
+  if err := sm.checkSlowLocked(key, now); err != nil {
+    sm.mtx.Unlock()
+    return err
+  }
+  rule, count := sm.detectLocked(conn, key, msg.Contents, now)
+  if rule != nil && rule.Action == SpamSlow {
+    sm.slowed[key] = &slowState{until: now.Add(rule.duration), interval: rule.interval, last: now}
+  }
+  sm.mtx.Unlock()
+  if rule == nil {
+    return nil
+  }
+
+  total := rule.detections.Add(1)
+  log.Printf(
+    "spam: %s detection #%d: %s (%s) in %q, %d in %s: %s",
+    rule.name, total, client.DisplayName(), key, conn.Room, count, rule.window, rule.Action,
+  )
+  switch rule.Action {
+  case SpamDrop:
+    client.SendMsg(shadowMsg(*msg))
+    return middleware.ErrDrop
+  case SpamSlow:
+    return &common.ErrorInfo{
+      Code: "slow_mode",
+      Rule: rule.name,
+      Message: fmt.Sprintf(
+        "slow down: you can send a message every %s for the next %s",
+        rule.interval, rule.duration,
+      ),
+      RetryAt: now.Add(rule.interval).UnixNano(),
+    }
+  default:
+    until := now.Add(rule.duration)
+    addMute(muteKey(conn.ID, conn.Identity, conn.RemoteAddr), until)
+    notice := common.NewSystemMessage(common.ActionModeration, fmt.Sprintf(
+      "%s was muted automatically for %s: spam", client.DisplayName(), rule.duration,
+    ))
+    notice.Room = conn.Room
+    broadcastMsg(notice)
+    return &common.ErrorInfo{
+      Code: "muted",
+      Rule: rule.name,
+      Message: fmt.Sprintf("you are muted for %s for spamming", rule.duration),
+    }
+  }
+}
+
+// checkSlowLocked returns why the user can't send a message now, if they're
+// in slow mode and can't.
+func (sm *spamMiddleware) checkSlowLocked(key string, now time.Time) error {
+  slow, ok := sm.slowed[key]
+  if !ok {
+    return nil
+  }
+  if now.After(slow.until) {
+    delete(sm.slowed, key)
+    return nil
+  }
+  if next := slow.last.Add(slow.interval); next.After(now) {
+    return &common.ErrorInfo{
+      Code: "slow_mode",
+      Message: fmt.Sprintf(
+        "slow mode: you can send another message in %s",
+        next.Sub(now).Round(time.Second),
+      ),
+      RetryAt: next.UnixNano(),
+    }
+  }
+  slow.last = now
+  return nil
+}
+
+// detectLocked records the message, returning the first rule it trips (and
+// the count that tripped it), if any.
+func (sm *spamMiddleware) detectLocked(
+  conn middleware.Conn, key, contents string, now time.Time,
+) (*SpamRule, int) {
+  state, ok := sm.conns[conn.ID]
+  if !ok {
+    // Connected before the middleware saw it, so not in a burst.
+    state = &connSpamState{}
+    sm.conns[conn.ID] = state
+  }
+  var tripped *SpamRule
+  var trippedCount int
+  trip := func(rule *SpamRule, count int) {
+    if tripped == nil {
+      tripped, trippedCount = rule, count
+    }
+  }
+
+  if rule := sm.config.ConnectBurst; rule != nil && now.Sub(state.connected) < rule.window {
+    state.sent++
+    if state.sent >= rule.Count {
+      trip(rule, state.sent)
+    }
+  }
+
+  if rule := sm.config.Repeat; rule != nil {
+    hash := hashContents(contents)
+    kept := state.recent[:0]
+    count := 1
+    for _, send := range state.recent {
+      if now.Sub(send.at) >= rule.window {
+        continue
+      }
+      kept = append(kept, send)
+      if send.hash == hash {
+        count++
+      }
+    }
+    state.recent = append(kept, recentSend{hash, now})
+    if len(state.recent) > maxRecentSends {
+      state.recent = state.recent[1:]
+    }
+    if count >= rule.Count {
+      trip(rule, count)
+    }
+  }
+
+  if rule := sm.config.NearDuplicate; rule != nil {
+    if fp := fingerprint(contents); utf8.RuneCountInString(fp) >= minFingerprintLen {
+      sm.sweepFingerprintsLocked(rule.window, now)
+      senders := sm.fingerprints[fp]
+      if senders == nil {
+        senders = make(map[string]time.Time)
+        sm.fingerprints[fp] = senders
+      }
+      for sender, at := range senders {
+        if now.Sub(at) >= rule.window {
+          delete(senders, sender)
+        }
+      }
+      senders[key] = now
+      if len(senders) >= rule.Count {
+        trip(rule, len(senders))
+      }
+    }
+  }
+  return tripped, trippedCount
+}
+
+// sweepFingerprintsLocked forgets fingerprints not sent within the window,
+// at most once a window.
+func (sm *spamMiddleware) sweepFingerprintsLocked(window time.Duration, now time.Time) {
+  if now.Sub(sm.lastSweep) < window {
+    return
+  }
+  sm.lastSweep = now
+  for fp, senders := range sm.fingerprints {
+    for key, at := range senders {
+      if now.Sub(at) >= window {
+        delete(senders, key)
+      }
+    }
+    if len(senders) == 0 {
+      delete(sm.fingerprints, fp)
+    }
+  }
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+// newTestSpam returns a spam detector with the config, whose rules must be
+// valid.
+func newTestSpam(t *testing.T, config string) *spamMiddleware {
+  t.Helper()
+  path := filepath.Join(t.TempDir(), "spam.json")
+  if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+    t.Fatal(err)
+  }
+  sm, err := loadSpamConfig(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return sm
+}
+
+func TestLoadSpamConfig(t *testing.T) {
+  tests := []struct {
+    config string
+    wantErr bool
+  }{
+    {`{}`, false},
+    {`{"repeat": {"count": 3, "window": "10s", "action": "drop"}}`, false},
+    {`{"nearDuplicate": {"count": 2, "window": "1m", "action": "slow", "duration": "5m", "interval": "30s"}}`, false},
+    {`{"connectBurst": {"count": 5, "window": "3s", "action": "mute", "duration": "1h"}}`, false},
+    {`{"repeat": {"count": 0, "window": "10s", "action": "drop"}}`, true},
+    {`{"repeat": {"count": 3, "action": "drop"}}`, true},
+    {`{"repeat": {"count": 3, "window": "-1s", "action": "drop"}}`, true},
+    {`{"repeat": {"count": 3, "window": "10s", "action": "ban"}}`, true},
+    {`{"repeat": {"count": 3, "window": "10s", "action": "mute", "duration": "forever"}}`, true},
+    {`{"repeat": {"count": 3, "window": "10s", "action": "slow", "interval": "0s"}}`, true},
+    {`{"repeat": []}`, true},
+  }
+  for _, tt := range tests {
+    path := filepath.Join(t.TempDir(), "spam.json")
+    if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := loadSpamConfig(path); (err != nil) != tt.wantErr {
+      t.Errorf("%s: err = %v, want error: %v", tt.config, err, tt.wantErr)
+    }
+  }
+
+  sm := newTestSpam(t, `{"repeat": {"count": 3, "window": "10s", "action": "slow"}}`)
+  if rule := sm.config.Repeat; rule.duration != defaultSpamDuration || rule.interval != defaultSpamInterval {
+    t.Errorf("defaults: duration %v, interval %v", rule.duration, rule.interval)
+  }
+}
+
+func TestFingerprint(t *testing.T) {
+  tests := []struct {
+    contents, want string
+  }{
+    {"Buy cheap pills!!!", "buycheappills"},
+    {"b-u-y 4 c.h.e.a.p", "buycheap"},
+    {"Ünïcode Straße", "ünïcodestraße"},
+    {"123 !?", ""},
+  }
+  for _, tt := range tests {
+    if got := fingerprint(tt.contents); got != tt.want {
+      t.Errorf("fingerprint(%q) = %q, want %q", tt.contents, got, tt.want)
+    }
+  }
+}
+
+func TestIsPosted(t *testing.T) {
+  tests := []struct {
+    msg common.Message
+    want bool
+  }{
+    {common.Message{Action: common.ActionChat, Contents: "hi"}, true},
+    {common.Message{Action: common.ActionChat, Contents: "   "}, false},
+    {common.Message{Action: common.ActionChat, Contents: "/nick bob"}, false},
+    {common.Message{Action: common.ActionChat, Contents: "//not a command"}, true},
+    {common.Message{Action: common.ActionChat, Contents: "/me waves"}, true},
+    {common.Message{Action: common.ActionEmote, Contents: "waves"}, true},
+    {common.Message{Action: common.ActionPoll, Contents: "?"}, true},
+    {common.Message{Action: common.ActionReact, Contents: "👍"}, false},
+    {common.Message{Action: common.ActionVote}, false},
+  }
+  for _, tt := range tests {
+    if got := isPosted(&tt.msg); got != tt.want {
+      t.Errorf("isPosted(%s %q) = %v, want %v", tt.msg.Action, tt.msg.Contents, got, tt.want)
+    }
+  }
+}
+
+func TestSpamDetect(t *testing.T) {
+  type send struct {
+    // When it's sent, after the first.
+    at time.Duration
+    conn, key, contents string
+    // The rule it trips, if any.
+    want string
+  }
+  tests := []struct {
+    name, config string
+    sends []send
+  }{
+    {"repeat", `{"repeat": {"count": 3, "window": "10s", "action": "drop"}}`, []send{
+      {0, "c1", "id:c1", "buy now", ""},
+      {time.Second, "c1", "id:c1", "buy now", ""},
+      {2 * time.Second, "c1", "id:c1", "hello", ""},
+      {3 * time.Second, "c1", "id:c1", "buy now", "repeat"},
+      // Only the sends at 1s (no longer) and 3s are in the window.
+      {11 * time.Second, "c1", "id:c1", "buy now", ""},
+      {12 * time.Second, "c1", "id:c1", "buy now", "repeat"},
+      // Per connection.
+      {12 * time.Second, "c2", "id:c2", "buy now", ""},
+      // Exact repeats only.
+      {13 * time.Second, "c1", "id:c1", "Buy now", ""},
+    }},
+    {"near-duplicate", `{"nearDuplicate": {"count": 3, "window": "1m", "action": "drop"}}`, []send{
+      {0, "c1", "identity:alice", "Buy cheap pills!!!", ""},
+      // The same user again.
+      {time.Second, "c2", "identity:alice", "buy CHEAP pills 2", ""},
+      {2 * time.Second, "c3", "id:c3", "BUY cheap pills", ""},
+      // Too short to check.
+      {3 * time.Second, "c4", "id:c4", "ok ok ok", ""},
+      {4 * time.Second, "c5", "id:c5", "ok ok ok", ""},
+      {5 * time.Second, "c6", "id:c6", "ok ok ok", ""},
+      // Alice's are out of the window.
+      {61 * time.Second, "c7", "id:c7", "buy cheap pills", ""},
+      {61 * time.Second, "c8", "id:c8", "buy-cheap-pills", "nearDuplicate"},
+    }},
+    {"connect burst", `{"connectBurst": {"count": 3, "window": "5s", "action": "drop"}}`, []send{
+      {time.Second, "c1", "id:c1", "one", ""},
+      {2 * time.Second, "c1", "id:c1", "two", ""},
+      {3 * time.Second, "c1", "id:c1", "three", "connectBurst"},
+      {6 * time.Second, "c1", "id:c1", "four", ""},
+      // Connected before the detector saw it.
+      {6 * time.Second, "unseen", "id:unseen", "one", ""},
+      {6 * time.Second, "unseen", "id:unseen", "two", ""},
+      {6 * time.Second, "unseen", "id:unseen", "three", ""},
+    }},
+    {"first rule tripped", `{
+      "repeat": {"count": 2, "window": "1m", "action": "drop"},
+      "connectBurst": {"count": 2, "window": "1m", "action": "drop"}
+    }`, []send{
+      {0, "c1", "id:c1", "same", ""},
+      {time.Second, "c1", "id:c1", "same", "connectBurst"},
+    }},
+  }
+  for _, tt := range tests {
+    sm := newTestSpam(t, tt.config)
+    start := time.Now()
+    sm.conns["c1"] = &connSpamState{connected: start}
+    for i, send := range tt.sends {
+      rule, _ := sm.detectLocked(middleware.Conn{ID: send.conn}, send.key, send.contents, start.Add(send.at))
+      var got string
+      if rule != nil {
+        got = rule.name
+      }
+      if got != send.want {
+        t.Errorf("%s: send %d (%q at %v): tripped %q, want %q", tt.name, i, send.contents, send.at, got, send.want)
+      }
+    }
+  }
+}
+
+func TestCheckSlow(t *testing.T) {
+  sm := newTestSpam(t, `{}`)
+  start := time.Now()
+  sm.slowed["id:c1"] = &slowState{until: start.Add(time.Minute), interval: 10 * time.Second, last: start}
+  tests := []struct {
+    at time.Duration
+    // When the user can retry, if they can't send now.
+    wantRetry time.Duration
+  }{
+    {5 * time.Second, 10 * time.Second},
+    {10 * time.Second, 0},
+    {15 * time.Second, 20 * time.Second},
+    {61 * time.Second, 0},
+    // No longer slowed.
+    {62 * time.Second, 0},
+  }
+  for _, tt := range tests {
+    err := sm.checkSlowLocked("id:c1", start.Add(tt.at))
+    if tt.wantRetry == 0 {
+      if err != nil {
+        t.Errorf("at %v: err = %v", tt.at, err)
+      }
+      continue
+    }
+    info, ok := err.(*common.ErrorInfo)
+    if !ok || info.Code != "slow_mode" || info.RetryAt != start.Add(tt.wantRetry).UnixNano() {
+      t.Errorf("at %v: err = %+v, want retry at %v", tt.at, err, tt.wantRetry)
+    }
+  }
+  if _, ok := sm.slowed["id:c1"]; ok {
+    t.Error("slow mode wasn't lifted")
+  }
+}
+
+func TestSpamOnMessage(t *testing.T) {
+  useTestHistory(t)
+  resetModeration(t)
+  setTestAccounts(t, map[string]*Account{"mod": {Token: "m", Role: RoleModerator}})
+  spammer := newTestClient(t, "spam-user", "", "spam")
+  observer := newTestClient(t, "spam-observer", "", "spam")
+  mod := newTestClient(t, "spam-mod", "mod", "spam")
+
+  tests := []struct {
+    action string
+    // The codes of the errors for the first, second and third sends.
+    wantCodes [3]string
+  }{
+    {SpamDrop, [3]string{"", "dropped", "dropped"}},
+    {SpamSlow, [3]string{"", "slow_mode", "slow_mode"}},
+    {SpamMute, [3]string{"", "muted", "muted"}},
+  }
+  for _, tt := range tests {
+    sm := newTestSpam(t, `{"repeat": {"count": 2, "window": "1m", "action": "`+tt.action+`", "interval": "1h"}}`)
+    received(t, spammer)
+    received(t, observer)
+    var echoes []common.Message
+    start := time.Now()
+    for i := 0; i < 3; i++ {
+      msg := common.NewChatMessage(spammer.id, "/me spams")
+      msg.Room = "spam"
+      err := sm.OnMessage(spammer.Conn("spam"), &msg)
+      var code string
+      switch err := err.(type) {
+      case nil:
+      case *common.ErrorInfo:
+        code = err.Code
+        if code == "slow_mode" && err.RetryAt < start.Add(time.Hour).UnixNano() {
+          t.Errorf("%s: send %d: retry at %d, want an hour later", tt.action, i, err.RetryAt)
+        }
+      default:
+        if err == middleware.ErrDrop {
+          code = "dropped"
+        }
+      }
+      if code != tt.wantCodes[i] {
+        t.Errorf("%s: send %d: err = %v, want %q", tt.action, i, err, tt.wantCodes[i])
+      }
+      if code == "muted" {
+        // Muted users are stopped by the moderation middleware after.
+        break
+      }
+      echoes = append(echoes, received(t, spammer)...)
+    }
+
+    switch tt.action {
+    case SpamDrop:
+      // Dropped messages are echoed back to the spammer as if they were sent.
+      if len(echoes) != 2 || echoes[0].Action != common.ActionEmote || echoes[0].Contents != "spams" ||
+        echoes[0].ID == 0 || echoes[1].ID <= echoes[0].ID {
+        t.Errorf("drop: echoed %+v", echoes)
+      }
+    case SpamMute:
+      if _, ok := mutedUntil(muteKey(spammer.id, "", spammer.addr)); !ok {
+        t.Error("mute: spammer wasn't muted")
+      }
+      if msg := lastReceived(t, observer); msg.Action != common.ActionModeration {
+        t.Errorf("mute: notice = %+v", msg)
+      }
+    }
+    if got := received(t, observer); len(got) != 0 {
+      t.Errorf("%s: observer received %+v", tt.action, got)
+    }
+  }
+
+  // Moderators, commands and messages not from connected users aren't
+  // checked.
+  sm := newTestSpam(t, `{"repeat": {"count": 1, "window": "1m", "action": "drop"}}`)
+  unchecked := []struct {
+    conn middleware.Conn
+    contents string
+  }{
+    {mod.Conn("spam"), "hi"},
+    {spammer.Conn("spam"), "/help"},
+    {middleware.Conn{ID: "webhook:ci", Room: "spam", Bot: true}, "hi"},
+  }
+  for _, tt := range unchecked {
+    msg := common.NewChatMessage(tt.conn.ID, tt.contents)
+    if err := sm.OnMessage(tt.conn, &msg); err != nil {
+      t.Errorf("%s sending %q: err = %v", tt.conn.ID, tt.contents, err)
+    }
+  }
+}
+
+func TestShadowMsg(t *testing.T) {
+  useTestHistory(t)
+  alice := NewClient("shadow-alice", "", 0)
+  parent := recordTestChat(alice, "shadows", "parent")
+  tests := []struct {
+    name string
+    msg common.Message
+    wantAction common.Action
+    wantContents string
+    wantID bool
+    wantReplyTo uint64
+  }{
+    {"chat", common.Message{Action: common.ActionChat, Contents: "hi"}, common.ActionChat, "hi", true, 0},
+    {"escaped slash", common.Message{Action: common.ActionChat, Contents: "//shrug"}, common.ActionChat, "/shrug", true, 0},
+    {"/me", common.Message{Action: common.ActionChat, Contents: "/me  waves "}, common.ActionEmote, "waves", true, 0},
+    {"reply", common.Message{Action: common.ActionChat, Contents: "yes", ReplyTo: parent}, common.ActionChat, "yes", true, parent},
+    {"reply to missing", common.Message{Action: common.ActionChat, Contents: "yes", ReplyTo: 999}, common.ActionChat, "yes", true, 0},
+    {"not recorded", common.Message{Action: common.ActionInfo, Contents: "x"}, common.ActionInfo, "x", false, 0},
+  }
+  for _, tt := range tests {
+    tt.msg.Room = "shadows"
+    historyMtx.RLock()
+    before := lastID
+    historyMtx.RUnlock()
+    got := shadowMsg(tt.msg)
+    if got.Action != tt.wantAction || got.Contents != tt.wantContents || got.ReplyTo != tt.wantReplyTo ||
+      (got.ID == before+1) != tt.wantID {
+      t.Errorf("%s: shadowMsg = %+v", tt.name, got)
+    }
+    if tt.wantReplyTo != 0 && (got.Thread == nil || got.Thread.Root != parent) {
+      t.Errorf("%s: thread = %+v", tt.name, got.Thread)
+    }
+  }
+  // They aren't recorded.
+  if got := roomContents("shadows"); len(got) != 1 {
+    t.Errorf("history = %q, want only the parent", got)
+  }
+}
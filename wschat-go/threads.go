@@ -0,0 +1,113 @@
+package main
+
+import (
+  "log"
+
+  "wschat/wschat-go/common"
+)
+
+var errParentNotFound = &common.ErrorInfo{
+  Code: "not_found", Message: "the message being replied to wasn't found",
+}
+
+// findMsg returns the chat in the room with the ID from history, or from the
+// durable log if it's no longer in memory.
+func findMsg(room string, id uint64) (common.Message, error) {
+  historyMtx.RLock()
+  var msg common.Message
+  found := false
+  if rh, ok := histories[room]; ok {
+    if entry, ok := rh.byID[id]; ok {
+      msg, found = entry.message(), true
+    }
+  }
+  historyMtx.RUnlock()
+  if found {
+    return msg, nil
+  }
+  entries, err := loggedEntries(room, func(msg *common.Message) bool {
+    return msg.ID == id
+  })
+  if err != nil {
+    log.Printf("error reading history log: %v", err)
+  }
+  if len(entries) == 0 {
+    return common.Message{}, errMsgNotFound
+  }
+  return entries[0].message(), nil
+}
+
+// threadRoot returns the ID of the chat that started the chat's thread.
+func threadRoot(msg *common.Message) uint64 {
+  if msg.Thread != nil {
+    return msg.Thread.Root
+  }
+  return msg.ID
+}
+
+// setReplyThread puts the reply in its parent's thread, if the parent exists.
+func setReplyThread(room string, msg *common.Message) error {
+  parent, err := findMsg(room, msg.ReplyTo)
+  if err != nil {
+    return errParentNotFound
+  }
+  msg.Thread = &common.ThreadInfo{Root: threadRoot(&parent)}
+  return nil
+}
+
+// threadMsgs returns the chats in the thread, oldest first, leaving out those
+// by ignored users. If the root is still in memory, so is the rest of the
+// thread; otherwise, it's read from the durable log.
+func threadMsgs(room string, root uint64, ignored map[string]bool) []common.Message {
+  inThread := func(msg *common.Message) bool {
+    return threadRoot(msg) == root
+  }
+  var msgs []common.Message
+  historyMtx.RLock()
+  rh, ok := histories[room]
+  inMemory := ok && rh.byID[root] != nil
+  if inMemory {
+    for _, entry := range rh.entries {
+      if inThread(&entry.Msg) && !entry.ignoredBy(ignored) {
+        msgs = append(msgs, entry.message())
+      }
+    }
+  }
+  historyMtx.RUnlock()
+  if inMemory {
+    return msgs
+  }
+  entries, err := loggedEntries(room, inThread)
+  if err != nil {
+    log.Printf("error reading history log: %v", err)
+  }
+  for _, entry := range entries {
+    if !entry.ignoredBy(ignored) {
+      msgs = append(msgs, entry.message())
+    }
+  }
+  return msgs
+}
+
+// receiveThread sends the client the thread the chat with the ID is in.
+func receiveThread(client *Client, room string, in common.Message) {
+  msg, err := findMsg(room, in.ID)
+  if err != nil {
+    sendVeto(client, room, err)
+    return
+  }
+  root := threadRoot(&msg)
+  msgs := threadMsgs(room, root, ignoredKeys(client))
+  thread := &common.ThreadInfo{Root: root}
+  for _, msg := range msgs {
+    if msg.ID != root {
+      thread.Replies++
+    }
+  }
+  for i := range msgs {
+    msgs[i].Thread = thread
+  }
+  reply := common.NewSystemMessage(common.ActionThread, "")
+  reply.ID, reply.Room, reply.Thread, reply.Messages = root, room, thread, msgs
+  client.SendMsg(reply)
+}
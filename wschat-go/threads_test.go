@@ -0,0 +1,110 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+
+  "wschat/wschat-go/common"
+)
+
+// recordTestReply records a reply by the client to the chat with the ID,
+// returning the reply's ID.
+func recordTestReply(t *testing.T, client *Client, room, contents string, replyTo uint64) uint64 {
+  t.Helper()
+  msg := common.NewChatMessage(client.id, contents)
+  msg.Room, msg.ReplyTo = room, replyTo
+  if err := setReplyThread(room, &msg); err != nil {
+    t.Fatalf("replying to %d: %v", replyTo, err)
+  }
+  recordMsg(&msg, client.identity)
+  return msg.ID
+}
+
+func TestThreads(t *testing.T) {
+  useTestHistory(t)
+  oldSize := historySize
+  historySize = 4
+  t.Cleanup(func() {
+    historySize = oldSize
+  })
+  alice := newTestClient(t, "thread-alice", "", "threads")
+
+  root := recordTestChat(alice, "threads", "root")
+  reply := recordTestReply(t, alice, "threads", "reply", root)
+  other := recordTestChat(alice, "threads", "other")
+  nested := recordTestReply(t, alice, "threads", "reply to the reply", reply)
+  if _, err := deleteMsg(alice, "threads", nested); err != nil {
+    t.Fatal(err)
+  }
+  last := recordTestReply(t, alice, "threads", "last reply", reply)
+
+  msg := common.NewChatMessage(alice.id, "orphan")
+  if err := setReplyThread("threads", &msg); err != errParentNotFound {
+    t.Errorf("replying to nothing: err = %v, want %v", err, errParentNotFound)
+  }
+  msg.ReplyTo = 999
+  if err := setReplyThread("threads", &msg); err != errParentNotFound {
+    t.Errorf("replying to a missing chat: err = %v, want %v", err, errParentNotFound)
+  }
+
+  tests := []struct {
+    name string
+    id uint64
+    root uint64
+    wantContents []string
+  }{
+    {"root", root, root, []string{"root", "reply", "last reply"}},
+    {"reply", reply, root, []string{"root", "reply", "last reply"}},
+    // Replies to replies are in the root's thread.
+    {"nested reply", last, root, []string{"root", "reply", "last reply"}},
+    {"not in a thread", other, other, []string{"other"}},
+  }
+  check := func(when string) {
+    for _, tt := range tests {
+      found, err := findMsg("threads", tt.id)
+      if err != nil {
+        t.Errorf("%s: %s: findMsg: %v", when, tt.name, err)
+        continue
+      }
+      if got := threadRoot(&found); got != tt.root {
+        t.Errorf("%s: %s: root = %d, want %d", when, tt.name, got, tt.root)
+      }
+      received(t, alice)
+      receiveThread(alice, "threads", common.Message{ID: tt.id})
+      reply := lastReceived(t, alice)
+      var contents []string
+      for _, msg := range reply.Messages {
+        contents = append(contents, msg.Contents)
+      }
+      wantReplies := len(tt.wantContents) - 1
+      if reply.Action != common.ActionThread || reply.ID != tt.root ||
+        reply.Thread == nil || reply.Thread.Replies != wantReplies ||
+        !reflect.DeepEqual(contents, tt.wantContents) {
+        t.Errorf("%s: %s: thread = %+v, want %q", when, tt.name, reply, tt.wantContents)
+      }
+    }
+  }
+  check("in memory")
+
+  // The root is pushed out of memory, so the thread is read from the log,
+  // and the reply count is kept.
+  for i := 0; i < 3; i++ {
+    recordTestChat(alice, "threads", "filler")
+  }
+  historyMtx.RLock()
+  _, inMemory := histories["threads"].byID[root]
+  info := histories["threads"].threadInfo(&common.Message{ID: root})
+  historyMtx.RUnlock()
+  if inMemory {
+    t.Fatal("root still in memory")
+  }
+  if info == nil || info.Replies != 2 {
+    t.Errorf("threadInfo = %+v, want 2 replies", info)
+  }
+  check("from the log")
+
+  receiveThread(alice, "threads", common.Message{ID: 999})
+  if msg := lastReceived(t, alice); msg.Action != common.ActionError {
+    t.Errorf("thread of a missing chat: got %+v, want an error", msg)
+  }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math"
+  "net/http"
+  "os"
+  "strings"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+const maxWebhookBodySize = 64 << 10
+
+// IncomingWebhook posts chats sent to /webhooks/<name> as a bot.
+type IncomingWebhook struct {
+  // The secret expected as the bearer token.
+  Secret string `json:"secret"`
+  // The sender of the posted messages.
+  Bot string `json:"bot"`
+  // The room messages are posted to if the request doesn't name one.
+  Room string `json:"room,omitempty"`
+  // Messages allowed per second (0 is unlimited) and the burst size.
+  Rate float64 `json:"rate,omitempty"`
+  Burst int `json:"burst,omitempty"`
+
+  limiter *RateLimiter
+}
+
+var (
+  // map[name]*IncomingWebhook, set once on startup
+  incomingWebhooks map[string]*IncomingWebhook
+)
+
+// loadIncomingWebhooks reads a JSON file containing an object of webhook
+// names to webhooks.
+func loadIncomingWebhooks(path string) (map[string]*IncomingWebhook, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var hooks map[string]*IncomingWebhook
+  if err := json.NewDecoder(f).Decode(&hooks); err != nil {
+    return nil, err
+  }
+  for name, hook := range hooks {
+    switch {
+    case name == "" || strings.Contains(name, "/"):
+      return nil, fmt.Errorf("invalid webhook name: %q", name)
+    case hook.Secret == "":
+      return nil, fmt.Errorf("webhook %q: must have secret", name)
+    case !isValidName(hook.Bot):
+      return nil, fmt.Errorf("webhook %q: invalid bot name: %q", name, hook.Bot)
+    case !isValidRoomName(hook.Room):
+      return nil, fmt.Errorf("webhook %q: invalid room name: %q", name, hook.Room)
+    }
+    hook.limiter = NewRateLimiter(hook.Rate, hook.Burst)
+  }
+  return hooks, nil
+}
+
+// webhookHandler accepts POSTs of {"contents": "...", "room": "..."} with the
+// webhook's secret as a bearer token and responds with the broadcast message.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+  name := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+  hook, ok := incomingWebhooks[name]
+  if !ok {
+    http.Error(w, "Webhook not found", http.StatusNotFound)
+    return
+  }
+  if r.Method != http.MethodPost {
+    w.Header().Set("Allow", http.MethodPost)
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  auth := r.Header.Get("Authorization")
+  token := strings.TrimPrefix(auth, "Bearer ")
+  if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(hook.Secret)) != 1 {
+    http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    return
+  }
+  if ok, wait := hook.limiter.Allow(); !ok {
+    w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+    http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+    return
+  }
+
+  var req struct {
+    Contents string `json:"contents"`
+    Room *string `json:"room"`
+  }
+  body := http.MaxBytesReader(w, r.Body, maxWebhookBodySize)
+  if err := json.NewDecoder(body).Decode(&req); err != nil {
+    maxBytesErr := &http.MaxBytesError{}
+    if errors.As(err, &maxBytesErr) {
+      http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+    } else {
+      http.Error(w, "Malformed JSON", http.StatusBadRequest)
+    }
+    return
+  }
+  if req.Contents == "" {
+    http.Error(w, "Must provide contents", http.StatusBadRequest)
+    return
+  }
+  room := hook.Room
+  if req.Room != nil {
+    if room = *req.Room; !isValidRoomName(room) {
+      http.Error(w, "Invalid room name", http.StatusBadRequest)
+      return
+    }
+  }
+
+  msg := common.NewChatMessage(hook.Bot, req.Contents)
+  msg.Room = room
+  conn := middleware.Conn{ID: hook.Bot, Room: room, RemoteAddr: r.RemoteAddr, Bot: true}
+  if err := pipeline.Message(conn, &msg); err != nil {
+    if errors.Is(err, middleware.ErrDrop) {
+      http.Error(w, "Message dropped", http.StatusForbidden)
+    } else {
+      http.Error(w, err.Error(), http.StatusForbidden)
+    }
+    return
+  }
+  // Responded with as sent, so with its ID and mentions.
+  sent, ok, err := broadcastFrom(nil, msg)
+  if err != nil {
+    log.Printf("error broadcasting webhook %q message: %v", name, err)
+    http.Error(w, "Internal server error", http.StatusInternalServerError)
+    return
+  }
+  if !ok {
+    http.Error(w, "Message dropped", http.StatusForbidden)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(sent)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+
+  uuidpkg "github.com/google/uuid"
+  "wschat/wschat-go/common"
+)
+
+const (
+  defaultOutgoingQueueSize = 1000
+  defaultOutgoingMaxAttempts = 5
+)
+
+// OutgoingWebhook receives chat events as POSTs of the message JSON. The time
+// it's sent (X-Wschat-Timestamp, in Unix seconds), a "." and the body are
+// signed with HMAC-SHA256 using the secret, sent in the X-Wschat-Signature
+// header as "sha256=<hex>", so receivers can reject old (replayed) requests.
+type OutgoingWebhook struct {
+  URL string `json:"url"`
+  Secret string `json:"secret"`
+  // The actions to deliver. Empty means connect, chat and disconnect.
+  Events []common.Action `json:"events,omitempty"`
+  // Deliveries that don't fit in the queue go straight to the dead-letter
+  // file.
+  QueueSize int `json:"queueSize,omitempty"`
+  MaxAttempts int `json:"maxAttempts,omitempty"`
+
+  events map[common.Action]bool
+  queue chan *outgoingDelivery
+}
+
+type outgoingDelivery struct {
+  ID string `json:"delivery"`
+  URL string `json:"url"`
+  Event common.Action `json:"event"`
+  Payload json.RawMessage `json:"payload"`
+  Attempts int `json:"attempts"`
+  Error string `json:"error"`
+  Time int64 `json:"time"`
+}
+
+var (
+  outgoingWebhooks []*OutgoingWebhook
+  outgoingClient = &http.Client{Timeout: 10 * time.Second}
+  // The wait before the first retry, which doubles each retry up to the max.
+  outgoingBaseBackoff = time.Second
+  outgoingMaxBackoff = time.Minute
+
+  deadLetterPath string
+  deadLetterMtx sync.Mutex
+)
+
+// loadOutgoingWebhooks reads a JSON file containing an array of webhooks.
+func loadOutgoingWebhooks(path string) ([]*OutgoingWebhook, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer f.Close()
+  var hooks []*OutgoingWebhook
+  if err := json.NewDecoder(f).Decode(&hooks); err != nil {
+    return nil, err
+  }
+  for i, hook := range hooks {
+    if hook.URL == "" {
+      return nil, fmt.Errorf("outgoing webhook #%d: must have url", i+1)
+    }
+    if hook.Secret == "" {
+      return nil, fmt.Errorf("outgoing webhook #%d: must have secret", i+1)
+    }
+    if len(hook.Events) == 0 {
+      hook.Events = []common.Action{
+        common.ActionConnect, common.ActionChat, common.ActionDisconnect,
+      }
+    }
+    hook.events = make(map[common.Action]bool, len(hook.Events))
+    for _, event := range hook.Events {
+      hook.events[event] = true
+    }
+    if hook.QueueSize <= 0 {
+      hook.QueueSize = defaultOutgoingQueueSize
+    }
+    if hook.MaxAttempts <= 0 {
+      hook.MaxAttempts = defaultOutgoingMaxAttempts
+    }
+    hook.queue = make(chan *outgoingDelivery, hook.QueueSize)
+  }
+  return hooks, nil
+}
+
+func startOutgoingWebhooks() {
+  for _, hook := range outgoingWebhooks {
+    go hook.run()
+  }
+}
+
+// notifyOutgoingWebhooks queues the message for each webhook subscribed to its
+// action. It never blocks.
+func notifyOutgoingWebhooks(msg common.Message, msgJSONBytes []byte) {
+  for _, hook := range outgoingWebhooks {
+    if !hook.events[msg.Action] {
+      continue
+    }
+    d := &outgoingDelivery{
+      ID: uuidpkg.New().String(),
+      URL: hook.URL,
+      Event: msg.Action,
+      Payload: msgJSONBytes,
+    }
+    select {
+    case hook.queue <- d:
+    default:
+      d.Error = "queue full"
+      writeDeadLetter(d)
+    }
+  }
+}
+
+func (hook *OutgoingWebhook) run() {
+  for d := range hook.queue {
+    backoff := outgoingBaseBackoff
+    for {
+      d.Attempts++
+      err := hook.deliver(d)
+      if err == nil {
+        break
+      }
+      if d.Attempts >= hook.MaxAttempts {
+        d.Error = err.Error()
+        writeDeadLetter(d)
+        break
+      }
+      time.Sleep(backoff)
+      if backoff *= 2; backoff > outgoingMaxBackoff {
+        backoff = outgoingMaxBackoff
+      }
+    }
+  }
+}
+
+// signDelivery returns the hex HMAC-SHA256 of the timestamp, "." and the
+// payload.
+func signDelivery(secret, timestamp string, payload []byte) string {
+  mac := hmac.New(sha256.New, []byte(secret))
+  mac.Write([]byte(timestamp + "."))
+  mac.Write(payload)
+  return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (hook *OutgoingWebhook) deliver(d *outgoingDelivery) error {
+  req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+  if err != nil {
+    return err
+  }
+  req.Header.Set("Content-Type", "application/json")
+  req.Header.Set("X-Wschat-Event", string(d.Event))
+  req.Header.Set("X-Wschat-Delivery", d.ID)
+  timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+  req.Header.Set("X-Wschat-Timestamp", timestamp)
+  req.Header.Set("X-Wschat-Signature", "sha256="+signDelivery(hook.Secret, timestamp, d.Payload))
+  resp, err := outgoingClient.Do(req)
+  if err != nil {
+    return err
+  }
+  resp.Body.Close()
+  if resp.StatusCode < 200 || resp.StatusCode > 299 {
+    return fmt.Errorf("received status %s", resp.Status)
+  }
+  return nil
+}
+
+// writeDeadLetter appends the failed delivery to the dead-letter file as a
+// JSON line. Without a file, it's only logged.
+func writeDeadLetter(d *outgoingDelivery) {
+  log.Printf(
+    "outgoing webhook delivery %s to %s failed after %d attempt(s): %s",
+    d.ID, d.URL, d.Attempts, d.Error,
+  )
+  if deadLetterPath == "" {
+    return
+  }
+  d.Time = time.Now().UnixNano()
+  b, err := json.Marshal(d)
+  if err != nil {
+    log.Printf("error marshaling dead letter: %v", err)
+    return
+  }
+  deadLetterMtx.Lock()
+  defer deadLetterMtx.Unlock()
+  f, err := os.OpenFile(deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+  if err != nil {
+    log.Printf("error opening dead-letter file: %v", err)
+    return
+  }
+  defer f.Close()
+  if _, err := f.Write(append(b, '\n')); err != nil {
+    log.Printf("error writing dead letter: %v", err)
+  }
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+  "bufio"
+  "crypto/hmac"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "wschat/wschat-go/common"
+)
+
+// receivedDelivery is a request made to a test receiver.
+type receivedDelivery struct {
+  header http.Header
+  body []byte
+  at time.Time
+}
+
+// testReceiver records the requests it receives, responding with the status
+// status returns for each (by its 1-based count).
+type testReceiver struct {
+  *httptest.Server
+
+  mtx sync.Mutex
+  received []receivedDelivery
+  notify chan struct{}
+}
+
+func newTestReceiver(t *testing.T, status func(n int) int) *testReceiver {
+  rcv := &testReceiver{notify: make(chan struct{}, 100)}
+  rcv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(r.Body)
+    rcv.mtx.Lock()
+    rcv.received = append(rcv.received, receivedDelivery{r.Header.Clone(), body, time.Now()})
+    n := len(rcv.received)
+    rcv.mtx.Unlock()
+    w.WriteHeader(status(n))
+    rcv.notify <- struct{}{}
+  }))
+  t.Cleanup(rcv.Close)
+  return rcv
+}
+
+// wait waits for the receiver to have received n requests.
+func (rcv *testReceiver) wait(t *testing.T, n int) []receivedDelivery {
+  t.Helper()
+  timeout := time.After(5 * time.Second)
+  for {
+    rcv.mtx.Lock()
+    received := append([]receivedDelivery(nil), rcv.received...)
+    rcv.mtx.Unlock()
+    if len(received) >= n {
+      return received
+    }
+    select {
+    case <-rcv.notify:
+    case <-timeout:
+      t.Fatalf("received %d deliveries, want %d", len(received), n)
+    }
+  }
+}
+
+// startTestWebhooks loads the webhooks' config, with a dead-letter file and
+// short backoffs, and delivers in the background if run is set.
+func startTestWebhooks(t *testing.T, config string, run bool) string {
+  dir := t.TempDir()
+  path := filepath.Join(dir, "outgoing.json")
+  if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+    t.Fatal(err)
+  }
+  hooks, err := loadOutgoingWebhooks(path)
+  if err != nil {
+    t.Fatalf("loading webhooks: %v", err)
+  }
+  oldHooks, oldPath := outgoingWebhooks, deadLetterPath
+  oldBase, oldMax := outgoingBaseBackoff, outgoingMaxBackoff
+  outgoingWebhooks, deadLetterPath = hooks, filepath.Join(dir, "dead.jsonl")
+  outgoingBaseBackoff, outgoingMaxBackoff = 20*time.Millisecond, 50*time.Millisecond
+  var wg sync.WaitGroup
+  if run {
+    for _, hook := range hooks {
+      wg.Add(1)
+      go func(hook *OutgoingWebhook) {
+        defer wg.Done()
+        hook.run()
+      }(hook)
+    }
+  }
+  t.Cleanup(func() {
+    for _, hook := range hooks {
+      close(hook.queue)
+    }
+    wg.Wait()
+    outgoingWebhooks, deadLetterPath = oldHooks, oldPath
+    outgoingBaseBackoff, outgoingMaxBackoff = oldBase, oldMax
+  })
+  return deadLetterPath
+}
+
+func notifyTestChat(t *testing.T, contents string) []byte {
+  msg := common.Message{Sender: "a", Action: common.ActionChat, Contents: contents}
+  b, err := json.Marshal(msg)
+  if err != nil {
+    t.Fatal(err)
+  }
+  notifyOutgoingWebhooks(msg, b)
+  return b
+}
+
+// readDeadLetters waits for the dead-letter file to have n lines.
+func readDeadLetters(t *testing.T, path string, n int) []outgoingDelivery {
+  t.Helper()
+  deadline := time.Now().Add(5 * time.Second)
+  for {
+    var letters []outgoingDelivery
+    if f, err := os.Open(path); err == nil {
+      scanner := bufio.NewScanner(f)
+      for scanner.Scan() {
+        var d outgoingDelivery
+        if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+          t.Fatalf("invalid dead letter %q: %v", scanner.Text(), err)
+        }
+        letters = append(letters, d)
+      }
+      f.Close()
+    }
+    if len(letters) >= n {
+      return letters
+    }
+    if time.Now().After(deadline) {
+      t.Fatalf("dead-letter file has %d lines, want %d", len(letters), n)
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+}
+
+func TestOutgoingWebhookSignature(t *testing.T) {
+  rcv := newTestReceiver(t, func(int) int { return http.StatusOK })
+  startTestWebhooks(t, `[{"url": "`+rcv.URL+`", "secret": "s3cret"}]`, true)
+  before := time.Now().Unix()
+  body := notifyTestChat(t, "hi")
+
+  got := rcv.wait(t, 1)[0]
+  if string(got.body) != string(body) {
+    t.Errorf("body = %s, want %s", got.body, body)
+  }
+  timestamp := got.header.Get("X-Wschat-Timestamp")
+  if ts, err := strconv.ParseInt(timestamp, 10, 64); err != nil || ts < before || ts > time.Now().Unix() {
+    t.Errorf("timestamp = %q, want the time it was sent", timestamp)
+  }
+  mac := hmac.New(sha256.New, []byte("s3cret"))
+  mac.Write([]byte(timestamp + "."))
+  mac.Write(body)
+  want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+  if sig := got.header.Get("X-Wschat-Signature"); sig != want {
+    t.Errorf("signature = %q, want %q", sig, want)
+  }
+  if event := got.header.Get("X-Wschat-Event"); event != "chat" {
+    t.Errorf("event = %q, want chat", event)
+  }
+  if got.header.Get("X-Wschat-Delivery") == "" {
+    t.Error("no delivery ID")
+  }
+}
+
+func TestOutgoingWebhookEvents(t *testing.T) {
+  rcv := newTestReceiver(t, func(int) int { return http.StatusOK })
+  startTestWebhooks(t, `[{"url": "`+rcv.URL+`", "secret": "s", "events": ["connect"]}]`, true)
+  notifyTestChat(t, "not delivered")
+  connect := common.NewSystemMessage(common.ActionConnect, "a")
+  b, _ := json.Marshal(connect)
+  notifyOutgoingWebhooks(connect, b)
+
+  received := rcv.wait(t, 1)
+  if event := received[0].header.Get("X-Wschat-Event"); event != "connect" {
+    t.Errorf("event = %q, want connect", event)
+  }
+  time.Sleep(50 * time.Millisecond)
+  if n := len(rcv.wait(t, 1)); n != 1 {
+    t.Errorf("received %d deliveries, want 1", n)
+  }
+}
+
+func TestOutgoingWebhookRetry(t *testing.T) {
+  // Fails twice, then succeeds.
+  rcv := newTestReceiver(t, func(n int) int {
+    if n <= 2 {
+      return http.StatusServiceUnavailable
+    }
+    return http.StatusNoContent
+  })
+  dead := startTestWebhooks(t, `[{"url": "`+rcv.URL+`", "secret": "s", "maxAttempts": 3}]`, true)
+  notifyTestChat(t, "retried")
+
+  received := rcv.wait(t, 3)
+  id := received[0].header.Get("X-Wschat-Delivery")
+  for i, got := range received {
+    if gotID := got.header.Get("X-Wschat-Delivery"); gotID != id {
+      t.Errorf("attempt %d: delivery ID = %q, want %q", i+1, gotID, id)
+    }
+  }
+  // 20ms, then 40ms.
+  if gap := received[1].at.Sub(received[0].at); gap < 20*time.Millisecond {
+    t.Errorf("first backoff = %s, want at least 20ms", gap)
+  }
+  if gap := received[2].at.Sub(received[1].at); gap < 40*time.Millisecond {
+    t.Errorf("second backoff = %s, want at least 40ms", gap)
+  }
+  time.Sleep(50 * time.Millisecond)
+  if _, err := os.Stat(dead); !os.IsNotExist(err) {
+    t.Errorf("delivered, but dead-letter file exists (%v)", err)
+  }
+}
+
+func TestOutgoingWebhookDeadLetter(t *testing.T) {
+  rcv := newTestReceiver(t, func(int) int { return http.StatusInternalServerError })
+  dead := startTestWebhooks(t, `[{"url": "`+rcv.URL+`", "secret": "s", "maxAttempts": 2}]`, true)
+  body := notifyTestChat(t, "failed")
+
+  letters := readDeadLetters(t, dead, 1)
+  d := letters[0]
+  if d.Attempts != 2 {
+    t.Errorf("attempts = %d, want 2", d.Attempts)
+  }
+  if !strings.Contains(d.Error, "500") {
+    t.Errorf("error = %q, want the status", d.Error)
+  }
+  if d.URL != rcv.URL || d.Event != common.ActionChat || string(d.Payload) != string(body) {
+    t.Errorf("dead letter = %+v", d)
+  }
+  if n := len(rcv.wait(t, 2)); n != 2 {
+    t.Errorf("received %d attempts, want 2", n)
+  }
+}
+
+func TestOutgoingWebhookQueueFull(t *testing.T) {
+  // Not delivering, so the queue fills up.
+  dead := startTestWebhooks(t, `[{"url": "http://127.0.0.1:1/", "secret": "s", "queueSize": 1}]`, false)
+  notifyTestChat(t, "queued")
+  notifyTestChat(t, "dropped")
+
+  d := readDeadLetters(t, dead, 1)[0]
+  if d.Error != "queue full" || d.Attempts != 0 {
+    t.Errorf("dead letter = %+v, want queue full with no attempts", d)
+  }
+  var msg common.Message
+  if err := json.Unmarshal(d.Payload, &msg); err != nil || msg.Contents != "dropped" {
+    t.Errorf("dead letter payload = %s, want the dropped chat", d.Payload)
+  }
+}
+
+func TestLoadOutgoingWebhooks(t *testing.T) {
+  tests := []struct {
+    name, config string
+    wantErr bool
+  }{
+    {"defaults", `[{"url": "http://example.com/", "secret": "s"}]`, false},
+    {"no url", `[{"secret": "s"}]`, true},
+    {"no secret", `[{"url": "http://example.com/"}]`, true},
+    {"empty secret", `[{"url": "http://example.com/", "secret": ""}]`, true},
+    {"invalid json", `{`, true},
+  }
+  for _, tt := range tests {
+    t.Run(tt.name, func(t *testing.T) {
+      path := filepath.Join(t.TempDir(), "outgoing.json")
+      if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+        t.Fatal(err)
+      }
+      hooks, err := loadOutgoingWebhooks(path)
+      if (err != nil) != tt.wantErr {
+        t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+      }
+      if err != nil {
+        return
+      }
+      hook := hooks[0]
+      if hook.QueueSize != defaultOutgoingQueueSize || hook.MaxAttempts != defaultOutgoingMaxAttempts {
+        t.Errorf("queueSize, maxAttempts = %d, %d", hook.QueueSize, hook.MaxAttempts)
+      }
+      for _, action := range []common.Action{
+        common.ActionConnect, common.ActionChat, common.ActionDisconnect,
+      } {
+        if !hook.events[action] {
+          t.Errorf("not subscribed to %s by default", action)
+        }
+      }
+    })
+  }
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "wschat/wschat-go/common"
+  "wschat/wschat-go/middleware"
+)
+
+func TestLoadIncomingWebhooks(t *testing.T) {
+  tests := []struct {
+    name, config string
+    wantErr string
+  }{
+    {"valid", `{"ci": {"secret": "s", "bot": "CI-Bot", "room": "dev"}}`, ""},
+    {"default room", `{"ci": {"secret": "s", "bot": "ci"}}`, ""},
+    {"empty name", `{"": {"secret": "s", "bot": "ci"}}`, "invalid webhook name"},
+    {"slash in name", `{"a/b": {"secret": "s", "bot": "ci"}}`, "invalid webhook name"},
+    {"no secret", `{"ci": {"bot": "ci"}}`, "must have secret"},
+    {"no bot", `{"ci": {"secret": "s"}}`, "invalid bot name"},
+    {"system bot", `{"ci": {"secret": "s", "bot": "System"}}`, "invalid bot name"},
+    {"bot with a space", `{"ci": {"secret": "s", "bot": "ci bot"}}`, "invalid bot name"},
+    {
+      "bot like an ID",
+      `{"ci": {"secret": "s", "bot": "0b1f2d6d-98dd-4163-a921-502777e62163"}}`, "invalid bot name",
+    },
+    {"bot too long", `{"ci": {"secret": "s", "bot": "` + strings.Repeat("b", maxNameLen+1) + `"}}`, "invalid bot name"},
+    {"invalid room", `{"ci": {"secret": "s", "bot": "ci", "room": "a b"}}`, "invalid room name"},
+    {"invalid json", `[`, "unexpected EOF"},
+  }
+  for _, tt := range tests {
+    path := filepath.Join(t.TempDir(), "webhooks.json")
+    if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+      t.Fatal(err)
+    }
+    hooks, err := loadIncomingWebhooks(path)
+    if tt.wantErr == "" {
+      if err != nil {
+        t.Errorf("%s: %v", tt.name, err)
+      } else if len(hooks) != 1 || hooks["ci"].limiter == nil {
+        t.Errorf("%s: hooks = %+v", tt.name, hooks)
+      }
+    } else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+      t.Errorf("%s: err = %v, want %q", tt.name, err, tt.wantErr)
+    }
+  }
+}
+
+// vetoMiddleware rejects chats containing "veto".
+type vetoMiddleware struct {
+  middleware.Base
+}
+
+func (vetoMiddleware) OnMessage(conn middleware.Conn, msg *common.Message) error {
+  if strings.Contains(msg.Contents, "veto") {
+    return errors.New("vetoed")
+  }
+  return nil
+}
+
+func TestWebhookHandler(t *testing.T) {
+  oldHooks, oldPipeline := incomingWebhooks, pipeline
+  incomingWebhooks = map[string]*IncomingWebhook{
+    "ci": {Secret: "s3cret", Bot: "webhook-ci", Room: "webhook-test", limiter: NewRateLimiter(0, 0)},
+  }
+  pipeline = &middleware.Chain{}
+  pipeline.Use("veto", vetoMiddleware{})
+  t.Cleanup(func() {
+    incomingWebhooks, pipeline = oldHooks, oldPipeline
+  })
+
+  tests := []struct {
+    name, method, path, auth, body string
+    status int
+    room string
+  }{
+    {"posted", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": "build passed"}`, 200, "webhook-test"},
+    {"to a room", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": "hi", "room": "other"}`, 200, "other"},
+    {"to the default room", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": "hi", "room": ""}`, 200, ""},
+    {"unknown hook", "POST", "/webhooks/cd", "Bearer s3cret", `{"contents": "hi"}`, 404, ""},
+    {"GET", "GET", "/webhooks/ci", "Bearer s3cret", "", 405, ""},
+    {"no auth", "POST", "/webhooks/ci", "", `{"contents": "hi"}`, 401, ""},
+    {"not bearer", "POST", "/webhooks/ci", "s3cret", `{"contents": "hi"}`, 401, ""},
+    {"wrong secret", "POST", "/webhooks/ci", "Bearer s3cre", `{"contents": "hi"}`, 401, ""},
+    {"malformed", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": `, 400, ""},
+    {"no contents", "POST", "/webhooks/ci", "Bearer s3cret", `{"room": "dev"}`, 400, ""},
+    {"invalid room", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": "hi", "room": "a b"}`, 400, ""},
+    {"vetoed", "POST", "/webhooks/ci", "Bearer s3cret", `{"contents": "veto this"}`, 403, ""},
+  }
+  for _, tt := range tests {
+    r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+    if tt.auth != "" {
+      r.Header.Set("Authorization", tt.auth)
+    }
+    w := httptest.NewRecorder()
+    webhookHandler(w, r)
+    if w.Code != tt.status {
+      t.Errorf("%s: status = %d, want %d (%s)", tt.name, w.Code, tt.status, w.Body)
+      continue
+    }
+    if tt.status != http.StatusOK {
+      continue
+    }
+    var sent common.Message
+    if err := json.Unmarshal(w.Body.Bytes(), &sent); err != nil {
+      t.Errorf("%s: invalid response %s: %v", tt.name, w.Body, err)
+      continue
+    }
+    if sent.ID == 0 || sent.Sender != "webhook-ci" || sent.Room != tt.room || sent.Action != common.ActionChat {
+      t.Errorf("%s: sent %+v", tt.name, sent)
+    }
+  }
+}
+
+func TestWebhookHandlerRateLimit(t *testing.T) {
+  oldHooks := incomingWebhooks
+  incomingWebhooks = map[string]*IncomingWebhook{
+    "ci": {Secret: "s", Bot: "webhook-ci", Room: "webhook-test", limiter: NewRateLimiter(0.5, 2)},
+  }
+  t.Cleanup(func() {
+    incomingWebhooks = oldHooks
+  })
+  post := func(auth string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest("POST", "/webhooks/ci", strings.NewReader(`{"contents": "hi"}`))
+    r.Header.Set("Authorization", auth)
+    w := httptest.NewRecorder()
+    webhookHandler(w, r)
+    return w
+  }
+  // Unauthorized requests don't use up the limit.
+  for i := 0; i < 3; i++ {
+    post("Bearer wrong")
+  }
+  for i := 0; i < 2; i++ {
+    if w := post("Bearer s"); w.Code != http.StatusOK {
+      t.Fatalf("post %d: status = %d, want 200", i+1, w.Code)
+    }
+  }
+  w := post("Bearer s")
+  if w.Code != http.StatusTooManyRequests {
+    t.Fatalf("status = %d, want 429", w.Code)
+  }
+  if retry := w.Header().Get("Retry-After"); retry != "2" {
+    t.Errorf("Retry-After = %q, want 2", retry)
+  }
+}